@@ -15,13 +15,16 @@ import (
 	"time"
 
 	"github.com/beego/beego"
+	"github.com/djylb/nps/lib/audit"
 	"github.com/djylb/nps/lib/common"
 	"github.com/djylb/nps/lib/conn"
 	"github.com/djylb/nps/lib/crypt"
 	"github.com/djylb/nps/lib/file"
 	"github.com/djylb/nps/lib/logs"
+	"github.com/djylb/nps/lib/metrics"
 	"github.com/djylb/nps/lib/nps_mux"
 	"github.com/djylb/nps/lib/version"
+	"github.com/djylb/nps/lib/webhook"
 	"github.com/djylb/nps/server/connection"
 	"github.com/djylb/nps/server/tool"
 )
@@ -70,6 +73,14 @@ type Client struct {
 	retryTime int // it will add 1 when ping not ok until to 3 will close the client
 }
 
+// MuxStats 返回客户端数据通道的延迟（秒）和带宽（字节/秒），未连接时 ok 为 false
+func (s *Client) MuxStats() (latency, bandwidth float64, ok bool) {
+	if s.tunnel == nil {
+		return 0, 0, false
+	}
+	return s.tunnel.Latency(), s.tunnel.Bandwidth(), true
+}
+
 func NewClient(t, f *nps_mux.Mux, s *conn.Conn, vs string) *Client {
 	return &Client{
 		signal:  s,
@@ -202,6 +213,7 @@ func (s *Bridge) GetHealthFromClient(id int, c *conn.Conn) {
 				}
 				return true
 			})
+			webhook.Emit(file.EventHealthDown, map[string]interface{}{"client_id": id, "target": info})
 		} else { //the status is false,remove target from the targetArr
 			file.GetDb().JsonDb.Tasks.Range(func(key, value interface{}) bool {
 				v := value.(*file.Tunnel)
@@ -224,6 +236,7 @@ func (s *Bridge) GetHealthFromClient(id int, c *conn.Conn) {
 				}
 				return true
 			})
+			webhook.Emit(file.EventHealthUp, map[string]interface{}{"client_id": id, "target": info})
 		}
 	}
 	s.DelClient(id)
@@ -261,6 +274,7 @@ func (s *Bridge) cliProcess(c *conn.Conn) {
 	}
 	if err != nil || string(minVerBytes) != version.GetVersion(ver) {
 		logs.Info("The client %v version does not match or error occurred", c.Conn.RemoteAddr())
+		metrics.HandshakeFailed(metrics.ReasonVersion)
 		c.Close()
 		return
 	}
@@ -289,6 +303,7 @@ func (s *Bridge) cliProcess(c *conn.Conn) {
 		id, err := file.GetDb().GetIdByVerifyKey(string(keyBuf), c.Conn.RemoteAddr().String(), "", crypt.Md5)
 		if err != nil {
 			logs.Error("Client %v proto-ver %d vkey %s validation error", c.Conn.RemoteAddr(), ver, keyBuf)
+			metrics.HandshakeFailed(metrics.ReasonVkey)
 			s.verifyError(c)
 			return
 		}
@@ -309,6 +324,7 @@ func (s *Bridge) cliProcess(c *conn.Conn) {
 		ts := common.BytesToTimestamp(tsBuf)
 		now := time.Now().Unix()
 		if ServerSecureMode && (ts > now || ts < now-rep.ttl) {
+			metrics.HandshakeFailed(metrics.ReasonTimestamp)
 			c.Close()
 			return
 		}
@@ -321,6 +337,7 @@ func (s *Bridge) cliProcess(c *conn.Conn) {
 		id, err := file.GetDb().GetIdByVerifyKey(string(keyBuf), c.Conn.RemoteAddr().String(), "", crypt.Blake2b)
 		if err != nil {
 			logs.Error("Client %v proto-ver %d vkey %s validation error", c.Conn.RemoteAddr(), ver, keyBuf)
+			metrics.HandshakeFailed(metrics.ReasonVkey)
 			s.verifyError(c)
 			return
 		}
@@ -351,6 +368,7 @@ func (s *Bridge) cliProcess(c *conn.Conn) {
 			return
 		}
 		if ServerSecureMode && !bytes.Equal(hmacBuf, crypt.ComputeHMAC(client.VerifyKey, ts, minVerBytes, vs, ipBuf, randBuf)) {
+			metrics.HandshakeFailed(metrics.ReasonHmac)
 			c.Close()
 			return
 		}
@@ -388,6 +406,7 @@ func (s *Bridge) DelClient(id int) {
 			return
 		}
 		if c, err := file.GetDb().GetClient(id); err == nil {
+			webhook.Emit(file.EventClientDisconnect, map[string]interface{}{"client_id": c.Id, "remark": c.Remark})
 			select {
 			case s.CloseClient <- c.Id:
 			default:
@@ -406,7 +425,11 @@ func (s *Bridge) typeDeal(typeVal string, c *conn.Conn, id int, vs string) {
 			c.Close()
 			return
 		}
-		tcpConn, ok := c.Conn.(*net.TCPConn)
+		raw := c.Conn
+		if pc, ok := raw.(*conn.ProxyProtoConn); ok {
+			raw = pc.NetConn()
+		}
+		tcpConn, ok := raw.(*net.TCPConn)
 		if ok {
 			// add tcp keep alive option for signal connection
 			_ = tcpConn.SetKeepAlive(true)
@@ -425,6 +448,11 @@ func (s *Bridge) typeDeal(typeVal string, c *conn.Conn, id int, vs string) {
 
 		go s.GetHealthFromClient(id, c)
 		logs.Info("clientId %d connection succeeded, address:%v ", id, c.Conn.RemoteAddr())
+		if client, err := file.GetDb().GetClient(id); err == nil {
+			webhook.Emit(file.EventClientConnect, map[string]interface{}{
+				"client_id": id, "remark": client.Remark, "addr": c.Conn.RemoteAddr().String(), "version": vs,
+			})
+		}
 
 	case common.WORK_CHAN:
 		muxConn := nps_mux.NewMux(c.Conn, s.tunnelType, s.disconnectTime)
@@ -600,6 +628,11 @@ func (s *Bridge) ping() {
 	}
 }
 
+// npcActor 配置文件模式注册的 npc 客户端
+func npcActor(c *conn.Conn, client *file.Client) audit.Actor {
+	return audit.Actor{Name: "npc:" + strconv.Itoa(client.Id), Source: audit.SourceNpc, Ip: common.GetIpByAddr(c.Conn.RemoteAddr().String())}
+}
+
 // get config and add task from client config
 func (s *Bridge) getConfig(c *conn.Conn, isPub bool, client *file.Client) {
 	var fail bool
@@ -657,6 +690,7 @@ loop:
 				break loop
 			}
 
+			audit.Record(npcActor(c, client), audit.ActionCreate, "client", client.Id, nil, client)
 			c.WriteAddOk()
 			c.Write([]byte(client.VerifyKey))
 			s.Client.Store(client.Id, NewClient(nil, nil, nil, ""))
@@ -680,7 +714,9 @@ loop:
 					c.WriteAddFail()
 					break loop
 				}
-				file.GetDb().NewHost(h)
+				if file.GetDb().NewHost(h) == nil {
+					audit.Record(npcActor(c, client), audit.ActionCreate, "host", h.Id, nil, h)
+				}
 			}
 			c.WriteAddOk()
 
@@ -747,6 +783,7 @@ loop:
 						c.WriteAddFail()
 						break loop
 					}
+					audit.Record(npcActor(c, client), audit.ActionCreate, "tunnel", tl.Id, nil, tl)
 
 					if b := tool.TestServerPort(tl.Port, tl.Mode); !b && t.Mode != "secret" && t.Mode != "p2p" {
 						fail = true
@@ -3,22 +3,28 @@ package main
 import (
 	"flag"
 	"log"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/beego/beego"
 	"github.com/djylb/nps/bridge"
+	"github.com/djylb/nps/lib/audit"
 	"github.com/djylb/nps/lib/common"
 	"github.com/djylb/nps/lib/crypt"
 	"github.com/djylb/nps/lib/daemon"
 	"github.com/djylb/nps/lib/file"
+	"github.com/djylb/nps/lib/geoip"
 	"github.com/djylb/nps/lib/install"
 	"github.com/djylb/nps/lib/logs"
+	"github.com/djylb/nps/lib/metrics"
 	"github.com/djylb/nps/lib/version"
+	"github.com/djylb/nps/lib/webhook"
 	"github.com/djylb/nps/server"
 	"github.com/djylb/nps/server/connection"
 	"github.com/djylb/nps/server/tool"
@@ -40,6 +46,20 @@ func main() {
 		return
 	}
 
+	// nps hash_password <password> [bcrypt|argon2id]，生成用于 nps.conf 和 multi_account.conf 的密码哈希
+	if args := flag.Args(); len(args) >= 2 && args[0] == "hash_password" {
+		algorithm := crypt.HashBcrypt
+		if len(args) > 2 {
+			algorithm = args[2]
+		}
+		h, err := crypt.HashPassword(args[1], algorithm)
+		if err != nil {
+			log.Fatalln("hash password error", err.Error())
+		}
+		os.Stdout.WriteString(h + "\n")
+		return
+	}
+
 	// *confPath why get null value ?
 	for _, v := range os.Args[1:] {
 		switch v {
@@ -101,6 +121,29 @@ func main() {
 		logType = "file"
 	}
 	logs.Init(logType, logLevel, logPath, logMaxSize, logMaxFiles, logMaxDays, logCompress, logColor)
+	accessLogPath := beego.AppConfig.DefaultString("access_log_path", "conf/access")
+	if !filepath.IsAbs(accessLogPath) {
+		accessLogPath = filepath.Join(common.GetRunPath(), accessLogPath)
+	}
+	logs.InitAccess(beego.AppConfig.DefaultString("access_log", "off"), accessLogPath,
+		beego.AppConfig.DefaultInt("access_log_max_size", 5),
+		beego.AppConfig.DefaultInt("access_log_max_files", 10),
+		beego.AppConfig.DefaultInt("access_log_max_days", 7),
+		beego.AppConfig.DefaultBool("access_log_compress", false))
+	audit.Init(runPath(beego.AppConfig.DefaultString("audit_log_path", "conf/audit.log")),
+		beego.AppConfig.DefaultInt("audit_log_max_days", 90),
+		beego.AppConfig.DefaultInt("audit_log_max_entries", 10000))
+	webhook.Init(beego.AppConfig.DefaultInt("webhook_max_attempts", 5),
+		time.Duration(beego.AppConfig.DefaultInt("webhook_timeout", 10))*time.Second)
+	if beego.AppConfig.DefaultBool("metrics_enable", false) {
+		metrics.Enable()
+		if port := beego.AppConfig.String("metrics_port"); port != "" {
+			go metrics.ListenAndServe(net.JoinHostPort(beego.AppConfig.DefaultString("metrics_ip", "127.0.0.1"), port), beego.AppConfig.String("metrics_token"))
+		}
+	}
+	if err := geoip.Init(runPath(beego.AppConfig.String("geoip_db_path")), runPath(beego.AppConfig.String("geoip_asn_db_path"))); err != nil {
+		logs.Error("load geoip database error: %v", err)
+	}
 	if !common.IsWindows() {
 		svcConfig.Dependencies = []string{
 			"Requires=network.target",
@@ -258,3 +301,11 @@ func run() {
 	}
 	go server.StartNewServer(bridgePort, task, bridgeType, timeout)
 }
+
+// runPath 将相对路径转换为相对于运行目录的绝对路径
+func runPath(p string) string {
+	if p == "" || filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(common.GetRunPath(), p)
+}
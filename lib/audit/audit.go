@@ -0,0 +1,371 @@
+// Package audit 记录客户端、隧道、域名和全局参数的变更，保存为 JSON Lines 文件
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/djylb/nps/lib/logs"
+)
+
+// 操作类型
+const (
+	ActionCreate = "create"
+	ActionUpdate = "update"
+	ActionDelete = "delete"
+	ActionStart  = "start"
+	ActionStop   = "stop"
+)
+
+// 变更来源
+const (
+	SourceWeb = "web"
+	SourceApi = "api"
+	SourceNpc = "npc"
+)
+
+const masked = "******"
+
+// Actor 执行操作的账号
+type Actor struct {
+	Name   string //web username, api token name or client id
+	Source string //web, api or npc
+	Ip     string
+}
+
+// Change 一个字段修改前后的值
+type Change struct {
+	Field  string      `json:"field"`
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// Entry 一条审计日志
+type Entry struct {
+	Id       int64    `json:"id"`
+	Time     int64    `json:"time"`
+	Actor    string   `json:"actor"`
+	Source   string   `json:"source"`
+	Ip       string   `json:"ip"`
+	Action   string   `json:"action"`
+	Object   string   `json:"object"` //client, tunnel, host or global
+	ObjectId int      `json:"object_id"`
+	Name     string   `json:"name,omitempty"` //remark or domain of the object
+	Changes  []Change `json:"changes,omitempty"`
+}
+
+// Snapshot 对象在某一时刻的字段值，嵌套字段用 . 连接
+type Snapshot map[string]interface{}
+
+var (
+	lock       sync.Mutex
+	entries    []*Entry
+	lastId     int64
+	logPath    string
+	logFile    *os.File
+	maxDays    int
+	maxEntries int
+)
+
+// Init 加载已有的审计日志，days 和 max 为保留天数和最多条数，0 表示不限制
+func Init(path string, days, max int) {
+	lock.Lock()
+	defer lock.Unlock()
+	logPath, maxDays, maxEntries = path, days, max
+	entries, lastId = nil, 0
+	if logFile != nil {
+		logFile.Close()
+		logFile = nil
+	}
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+		for scanner.Scan() {
+			e := new(Entry)
+			if json.Unmarshal(scanner.Bytes(), e) == nil {
+				entries = append(entries, e)
+				if e.Id > lastId {
+					lastId = e.Id
+				}
+			}
+		}
+		f.Close()
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		logs.Error("audit log disabled, create directory error %v", err)
+		logPath = ""
+		return
+	}
+	prune(true)
+}
+
+// Take 生成对象的快照，v 为空时返回 nil
+func Take(v interface{}) Snapshot {
+	if v == nil || (reflect.ValueOf(v).Kind() == reflect.Ptr && reflect.ValueOf(v).IsNil()) {
+		return nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	var m map[string]interface{}
+	if json.Unmarshal(b, &m) != nil {
+		return nil
+	}
+	s := make(Snapshot)
+	flatten(s, "", m)
+	return s
+}
+
+func flatten(s Snapshot, prefix string, m map[string]interface{}) {
+	for k, v := range m {
+		key := prefix + k
+		if ignored(key) {
+			continue
+		}
+		if sub, ok := v.(map[string]interface{}); ok && !sensitive(key) {
+			flatten(s, key+".", sub)
+			continue
+		}
+		s[key] = v
+	}
+}
+
+// ignored 运行时状态和流量统计不属于配置
+func ignored(key string) bool {
+	k := strings.ToLower(key)
+	if strings.HasPrefix(k, "client.") {
+		return k != "client.id"
+	}
+	switch k {
+	case "flow.exportflow", "flow.inletflow", "isconnect", "addr", "localaddr", "nowconn", "version", "runstatus", "rate",
+		"lastonlinetime", "limitrejected", "healthnexttime", "healthmap", "healthremovearr", "target.targetarr":
+		return true
+	}
+	return strings.HasPrefix(k, "rate.")
+}
+
+// sensitive 密码、密钥等字段只记录是否修改
+func sensitive(key string) bool {
+	k := strings.ToLower(key)
+	for _, v := range []string{"password", "secret", "verifykey", "twofactor", "userauth", "multiaccount", "keyfilepath"} {
+		if strings.Contains(k, v) {
+			return true
+		}
+	}
+	return k == "cnf.p"
+}
+
+// Diff 比较两个快照，返回按字段名排序的修改
+func Diff(before, after Snapshot) []Change {
+	keys := make(map[string]bool)
+	for k := range before {
+		keys[k] = true
+	}
+	for k := range after {
+		keys[k] = true
+	}
+	changes := make([]Change, 0)
+	for k := range keys {
+		b, a := before[k], after[k]
+		if reflect.DeepEqual(b, a) || (empty(b) && empty(a)) {
+			continue
+		}
+		if sensitive(k) {
+			b, a = mask(b), mask(a)
+		}
+		changes = append(changes, Change{Field: k, Before: b, After: a})
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return changes
+}
+
+// empty 零值和不存在的字段视为相同，新建和删除时只记录有值的字段
+func empty(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	switch t := v.(type) {
+	case bool:
+		return !t
+	case float64:
+		return t == 0
+	case string:
+		return t == "" || t == "0001-01-01T00:00:00Z"
+	case []interface{}:
+		return len(t) == 0
+	case map[string]interface{}:
+		return len(t) == 0
+	}
+	return false
+}
+
+func mask(v interface{}) interface{} {
+	if empty(v) {
+		return ""
+	}
+	return masked
+}
+
+// Record 记录一次变更，before 为修改前的快照，after 为修改后的对象，删除时为 nil；
+// 修改前后没有差异的 update 不记录
+func Record(a Actor, action, object string, id int, before Snapshot, after interface{}) {
+	snap := Take(after)
+	changes := Diff(before, snap)
+	if action == ActionUpdate && len(changes) == 0 {
+		return
+	}
+	name := snap.name()
+	if name == "" {
+		name = before.name()
+	}
+	e := &Entry{
+		Time:     time.Now().Unix(),
+		Actor:    a.Name,
+		Source:   a.Source,
+		Ip:       a.Ip,
+		Action:   action,
+		Object:   object,
+		ObjectId: id,
+		Name:     name,
+		Changes:  changes,
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	lastId++
+	e.Id = lastId
+	entries = append(entries, e)
+	if !prune(false) {
+		write(e)
+	}
+}
+
+func (s Snapshot) name() string {
+	for _, k := range []string{"Host", "Remark"} {
+		if v, ok := s[k].(string); ok && v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func write(e *Entry) {
+	if logPath == "" {
+		return
+	}
+	if logFile == nil {
+		f, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			logs.Warn("open audit log error %v", err)
+			return
+		}
+		logFile = f
+	}
+	b, _ := json.Marshal(e)
+	if _, err := logFile.Write(append(b, '\n')); err != nil {
+		logs.Warn("write audit log error %v", err)
+	}
+}
+
+// prune 按保留天数和条数删除旧日志，超出 10% 或 force 时重写文件，返回是否重写
+func prune(force bool) bool {
+	n := 0
+	if maxDays > 0 {
+		deadline := time.Now().AddDate(0, 0, -maxDays).Unix()
+		for n < len(entries) && entries[n].Time < deadline {
+			n++
+		}
+	}
+	if maxEntries > 0 && len(entries)-n > maxEntries {
+		if !force && n == 0 && len(entries) <= maxEntries+maxEntries/10 {
+			return false
+		}
+		n = len(entries) - maxEntries
+	}
+	if n == 0 && !force {
+		return false
+	}
+	entries = append(entries[:0:0], entries[n:]...)
+	if logPath == "" {
+		return true
+	}
+	if logFile != nil {
+		logFile.Close()
+		logFile = nil
+	}
+	tmp := logPath + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		logs.Warn("write audit log error %v", err)
+		return true
+	}
+	w := bufio.NewWriter(f)
+	for _, e := range entries {
+		b, _ := json.Marshal(e)
+		w.Write(append(b, '\n'))
+	}
+	w.Flush()
+	f.Close()
+	if err := os.Rename(tmp, logPath); err != nil {
+		logs.Warn("write audit log error %v", err)
+	}
+	return true
+}
+
+// Query 查询条件，空值不限制
+type Query struct {
+	Search string //actor, ip, name, object id or changed field
+	Object string
+	Action string
+	Source string
+	Start  int64 //unix time
+	End    int64
+}
+
+func (q *Query) match(e *Entry) bool {
+	if (q.Object != "" && e.Object != q.Object) || (q.Action != "" && e.Action != q.Action) || (q.Source != "" && e.Source != q.Source) {
+		return false
+	}
+	if (q.Start > 0 && e.Time < q.Start) || (q.End > 0 && e.Time > q.End) {
+		return false
+	}
+	if q.Search == "" {
+		return true
+	}
+	s := strings.ToLower(q.Search)
+	if strings.Contains(strings.ToLower(e.Actor), s) || strings.Contains(e.Ip, s) || strings.Contains(strings.ToLower(e.Name), s) ||
+		strings.TrimPrefix(s, "#") == strconv.Itoa(e.ObjectId) {
+		return true
+	}
+	for _, c := range e.Changes {
+		if strings.Contains(strings.ToLower(c.Field), s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Search 按时间倒序返回符合条件的日志，limit 为 0 时返回全部
+func Search(q Query, offset, limit int) ([]*Entry, int) {
+	lock.Lock()
+	defer lock.Unlock()
+	list := make([]*Entry, 0)
+	cnt := 0
+	for i := len(entries) - 1; i >= 0; i-- {
+		if !q.match(entries[i]) {
+			continue
+		}
+		if cnt++; cnt > offset && (limit == 0 || len(list) < limit) {
+			list = append(list, entries[i])
+		}
+	}
+	return list, cnt
+}
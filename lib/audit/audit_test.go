@@ -0,0 +1,61 @@
+package audit
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+type testFlow struct {
+	ExportFlow int64
+	FlowLimit  int64
+}
+
+type testClient struct {
+	Id        int
+	Remark    string
+	VerifyKey string
+	IsConnect bool
+	Flow      *testFlow
+}
+
+func TestDiff(t *testing.T) {
+	before := Take(&testClient{Id: 1, Remark: "a", VerifyKey: "k1", Flow: &testFlow{ExportFlow: 10, FlowLimit: 1}})
+	after := &testClient{Id: 1, Remark: "b", VerifyKey: "k2", IsConnect: true, Flow: &testFlow{ExportFlow: 20, FlowLimit: 2}}
+	changes := Diff(before, Take(after))
+	if len(changes) != 3 {
+		t.Fatalf("changes %+v", changes)
+	}
+	if changes[0].Field != "Flow.FlowLimit" || changes[1].Field != "Remark" || changes[2].Field != "VerifyKey" {
+		t.Fatalf("changes %+v", changes)
+	}
+	if changes[2].Before != masked || changes[2].After != masked {
+		t.Fatalf("secret not masked %+v", changes[2])
+	}
+	if len(Diff(Take(after), Take(after))) != 0 {
+		t.Fatal("same object has changes")
+	}
+}
+
+func TestRecordAndSearch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	Init(path, 0, 3)
+	c := &testClient{Id: 1, Remark: "a"}
+	Record(Actor{Name: "admin", Source: SourceWeb}, ActionCreate, "client", 1, nil, c)
+	before := Take(c)
+	Record(Actor{Name: "admin", Source: SourceWeb}, ActionUpdate, "client", 1, before, c)
+	for i := 0; i < 5; i++ {
+		c.Remark += "x"
+		Record(Actor{Name: "token:ci", Source: SourceApi}, ActionUpdate, "client", 1, before, c)
+	}
+	list, cnt := Search(Query{}, 0, 0)
+	if cnt < 3 || cnt > 4 || list[0].Name != "axxxxx" {
+		t.Fatalf("cnt %d list %+v", cnt, list)
+	}
+	if _, cnt = Search(Query{Search: "admin"}, 0, 0); cnt != 0 {
+		t.Fatalf("old entries not pruned, cnt %d", cnt)
+	}
+	Init(path, 0, 3)
+	if list, cnt = Search(Query{Source: SourceApi}, 0, 1); cnt != 3 || len(list) != 1 {
+		t.Fatalf("reload cnt %d", cnt)
+	}
+}
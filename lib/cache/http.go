@@ -0,0 +1,231 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Entry 缓存的 HTTP 响应
+type Entry struct {
+	Key        string
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	VaryHeader http.Header //request header values selected by Vary
+	Stored     time.Time   //time the response was received, used for Age
+	Expires    time.Time   //fresh until, zero means revalidate before use
+}
+
+// Size 返回响应占用的大致字节数
+func (e *Entry) Size() int64 {
+	n := int64(len(e.Key) + len(e.Body))
+	for k, v := range e.Header {
+		n += int64(len(k))
+		for _, s := range v {
+			n += int64(len(s))
+		}
+	}
+	return n
+}
+
+// Fresh reports whether the entry can be served without revalidation.
+func (e *Entry) Fresh(now time.Time) bool {
+	return now.Before(e.Expires)
+}
+
+// Store 保存 HTTP 响应的缓存，超出条数或容量时淘汰最久未使用的响应
+type Store interface {
+	Get(key string) (*Entry, bool)
+	Set(e *Entry)
+	// Purge 删除 key 以 prefix 开头的响应，返回删除的条数
+	Purge(prefix string) int
+	Len() int
+	Size() int64
+}
+
+// MemoryStore 保存在内存中的缓存
+type MemoryStore struct {
+	lru      *Cache
+	maxBytes int64
+	size     int64
+}
+
+// NewMemoryStore 创建内存缓存，maxEntries 和 maxBytes 为 0 表示不限制
+func NewMemoryStore(maxEntries int, maxBytes int64) *MemoryStore {
+	s := &MemoryStore{lru: New(maxEntries), maxBytes: maxBytes}
+	s.lru.OnEvicted = func(key Key, value interface{}) {
+		atomic.AddInt64(&s.size, -value.(*Entry).Size())
+	}
+	return s
+}
+
+func (s *MemoryStore) Get(key string) (*Entry, bool) {
+	v, ok := s.lru.Get(key)
+	if !ok {
+		return nil, false
+	}
+	return v.(*Entry), true
+}
+
+func (s *MemoryStore) Set(e *Entry) {
+	if s.maxBytes > 0 && e.Size() > s.maxBytes {
+		return
+	}
+	s.lru.Remove(e.Key)
+	atomic.AddInt64(&s.size, e.Size())
+	s.lru.Add(e.Key, e)
+	for s.maxBytes > 0 && atomic.LoadInt64(&s.size) > s.maxBytes && s.lru.Len() > 0 {
+		s.lru.RemoveOldest()
+	}
+}
+
+func (s *MemoryStore) Purge(prefix string) int {
+	return purge(s.lru, prefix)
+}
+
+func (s *MemoryStore) Len() int {
+	return s.lru.Len()
+}
+
+func (s *MemoryStore) Size() int64 {
+	return atomic.LoadInt64(&s.size)
+}
+
+// DiskStore 保存在磁盘目录中的缓存，内存中只保留索引，重启后清空
+type DiskStore struct {
+	dir      string
+	lru      *Cache // key -> size
+	maxBytes int64
+	size     int64
+}
+
+// DiskStoreDir 磁盘缓存在配置目录下使用的子目录
+const DiskStoreDir = "nps-http-cache"
+
+// NewDiskStore 在 dir 的 nps-http-cache 子目录中创建磁盘缓存并删除上次留下的缓存文件，
+// 子目录中有其它文件时拒绝使用，maxEntries 和 maxBytes 为 0 表示不限制
+func NewDiskStore(dir string, maxEntries int, maxBytes int64) (*DiskStore, error) {
+	dir = filepath.Join(dir, DiskStoreDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := cleanDiskStore(dir); err != nil {
+		return nil, err
+	}
+	s := &DiskStore{dir: dir, lru: New(maxEntries), maxBytes: maxBytes}
+	s.lru.OnEvicted = func(key Key, value interface{}) {
+		atomic.AddInt64(&s.size, -value.(int64))
+		os.Remove(s.path(key.(string)))
+	}
+	return s, nil
+}
+
+// cleanDiskStore 只删除缓存写入的文件，发现其它文件时返回错误且不删除任何文件
+func cleanDiskStore(dir string) error {
+	list, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, v := range list {
+		if !isDiskStoreFile(v) {
+			return errors.New("the cache directory " + dir + " contains files not written by nps: " + v.Name())
+		}
+	}
+	for _, v := range list {
+		if err := os.Remove(filepath.Join(dir, v.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isDiskStoreFile(v os.DirEntry) bool {
+	if !v.Type().IsRegular() {
+		return false
+	}
+	name := strings.TrimSuffix(v.Name(), ".tmp")
+	if len(name) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
+
+func (s *DiskStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:]))
+}
+
+func (s *DiskStore) Get(key string) (*Entry, bool) {
+	if _, ok := s.lru.Get(key); !ok {
+		return nil, false
+	}
+	b, err := os.ReadFile(s.path(key))
+	if err != nil {
+		s.lru.Remove(key)
+		return nil, false
+	}
+	e := new(Entry)
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(e); err != nil || e.Key != key {
+		s.lru.Remove(key)
+		return nil, false
+	}
+	return e, true
+}
+
+func (s *DiskStore) Set(e *Entry) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(e); err != nil {
+		return
+	}
+	size := int64(buf.Len())
+	if s.maxBytes > 0 && size > s.maxBytes {
+		return
+	}
+	s.lru.Remove(e.Key)
+	tmp := s.path(e.Key) + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return
+	}
+	if err := os.Rename(tmp, s.path(e.Key)); err != nil {
+		os.Remove(tmp)
+		return
+	}
+	atomic.AddInt64(&s.size, size)
+	s.lru.Add(e.Key, size)
+	for s.maxBytes > 0 && atomic.LoadInt64(&s.size) > s.maxBytes && s.lru.Len() > 0 {
+		s.lru.RemoveOldest()
+	}
+}
+
+func (s *DiskStore) Purge(prefix string) int {
+	return purge(s.lru, prefix)
+}
+
+func (s *DiskStore) Len() int {
+	return s.lru.Len()
+}
+
+func (s *DiskStore) Size() int64 {
+	return atomic.LoadInt64(&s.size)
+}
+
+func purge(c *Cache, prefix string) int {
+	n := 0
+	for _, k := range c.Keys() {
+		if strings.HasPrefix(k.(string), prefix) {
+			c.Remove(k)
+			n++
+		}
+	}
+	return n
+}
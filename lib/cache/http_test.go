@@ -0,0 +1,90 @@
+package cache
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newEntry(key string, size int) *Entry {
+	return &Entry{Key: key, StatusCode: 200, Header: http.Header{}, Body: []byte(strings.Repeat("a", size)), Stored: time.Now()}
+}
+
+func TestMemoryStoreMaxBytes(t *testing.T) {
+	s := NewMemoryStore(0, 300)
+	s.Set(newEntry("1|a", 100))
+	s.Set(newEntry("1|b", 100))
+	s.Get("1|a")
+	s.Set(newEntry("1|c", 100))
+	if _, ok := s.Get("1|b"); ok {
+		t.Error("least recently used entry should be evicted")
+	}
+	if _, ok := s.Get("1|a"); !ok {
+		t.Error("recently used entry should be kept")
+	}
+	if s.Size() > 300 {
+		t.Errorf("size %d exceeds limit", s.Size())
+	}
+	s.Set(newEntry("1|c", 50))
+	if s.Len() != 2 {
+		t.Errorf("replacing an entry should not add a new one, len %d", s.Len())
+	}
+}
+
+func TestDiskStorePurge(t *testing.T) {
+	s, err := NewDiskStore(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := newEntry("1|GET|a.com/static/x.js", 10)
+	e.Header.Set("ETag", `"x"`)
+	s.Set(e)
+	s.Set(newEntry("2|GET|b.com/", 10))
+	got, ok := s.Get(e.Key)
+	if !ok || string(got.Body) != string(e.Body) || got.Header.Get("ETag") != `"x"` {
+		t.Fatalf("unexpected entry %+v", got)
+	}
+	if n := s.Purge("1|"); n != 1 {
+		t.Errorf("purged %d entries, want 1", n)
+	}
+	if _, ok := s.Get(e.Key); ok {
+		t.Error("purged entry is still cached")
+	}
+	if s.Len() != 1 {
+		t.Errorf("len %d, want 1", s.Len())
+	}
+}
+
+func TestDiskStoreDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "nps.conf"), []byte("keep"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewDiskStore(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Set(newEntry("1|GET|a.com/", 10))
+	if _, err := NewDiskStore(dir, 0, 0); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "nps.conf")); err != nil {
+		t.Errorf("files outside the cache directory were removed: %v", err)
+	}
+	if list, _ := os.ReadDir(filepath.Join(dir, DiskStoreDir)); len(list) != 0 {
+		t.Errorf("old cache files were kept: %d", len(list))
+	}
+	foreign := filepath.Join(dir, DiskStoreDir, "data.db")
+	if err := os.WriteFile(foreign, []byte("keep"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewDiskStore(dir, 0, 0); err == nil {
+		t.Error("a cache directory with foreign files should be refused")
+	}
+	if _, err := os.Stat(foreign); err != nil {
+		t.Errorf("foreign file was removed: %v", err)
+	}
+}
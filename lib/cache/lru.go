@@ -14,8 +14,9 @@ type Cache struct {
 	//Execute this callback function when an element is culled
 	OnEvicted func(key Key, value interface{})
 
+	mu    sync.Mutex
 	ll    *list.List //list
-	cache sync.Map
+	cache map[interface{}]*list.Element
 }
 
 // A Key may be any value that is comparable. See http://golang.org/ref/spec#Comparison_operators
@@ -33,42 +34,54 @@ func New(maxEntries int) *Cache {
 	return &Cache{
 		MaxEntries: maxEntries,
 		ll:         list.New(),
-		//cache:      make(map[interface{}]*list.Element),
+		cache:      make(map[interface{}]*list.Element),
 	}
 }
 
 // If the key value already exists, move the key to the front
 func (c *Cache) Add(key Key, value interface{}) {
-	if ee, ok := c.cache.Load(key); ok {
-		c.ll.MoveToFront(ee.(*list.Element)) // move to the front
-		ee.(*list.Element).Value.(*entry).value = value
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ee, ok := c.cache[key]; ok {
+		c.ll.MoveToFront(ee) // move to the front
+		ee.Value.(*entry).value = value
 		return
 	}
 	ele := c.ll.PushFront(&entry{key, value})
-	c.cache.Store(key, ele)
+	c.cache[key] = ele
 	if c.MaxEntries != 0 && c.ll.Len() > c.MaxEntries { // Remove the oldest element if the limit is exceeded
-		c.RemoveOldest()
+		c.removeOldest()
 	}
 }
 
 // Get looks up a key's value from the cache.
 func (c *Cache) Get(key Key) (value interface{}, ok bool) {
-	if ele, hit := c.cache.Load(key); hit {
-		c.ll.MoveToFront(ele.(*list.Element))
-		return ele.(*list.Element).Value.(*entry).value, true
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ele, hit := c.cache[key]; hit {
+		c.ll.MoveToFront(ele)
+		return ele.Value.(*entry).value, true
 	}
 	return
 }
 
 // Remove removes the provided key from the cache.
 func (c *Cache) Remove(key Key) {
-	if ele, hit := c.cache.Load(key); hit {
-		c.removeElement(ele.(*list.Element))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ele, hit := c.cache[key]; hit {
+		c.removeElement(ele)
 	}
 }
 
 // RemoveOldest removes the oldest item from the cache.
 func (c *Cache) RemoveOldest() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeOldest()
+}
+
+func (c *Cache) removeOldest() {
 	ele := c.ll.Back()
 	if ele != nil {
 		c.removeElement(ele)
@@ -78,7 +91,7 @@ func (c *Cache) RemoveOldest() {
 func (c *Cache) removeElement(e *list.Element) {
 	c.ll.Remove(e)
 	kv := e.Value.(*entry)
-	c.cache.Delete(kv.key)
+	delete(c.cache, kv.key)
 	if c.OnEvicted != nil {
 		c.OnEvicted(kv.key, kv.value)
 	}
@@ -86,17 +99,32 @@ func (c *Cache) removeElement(e *list.Element) {
 
 // Len returns the number of items in the cache.
 func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	return c.ll.Len()
 }
 
+// Keys returns the keys from the most to the least recently used.
+func (c *Cache) Keys() []Key {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([]Key, 0, c.ll.Len())
+	for e := c.ll.Front(); e != nil; e = e.Next() {
+		keys = append(keys, e.Value.(*entry).key)
+	}
+	return keys
+}
+
 // Clear purges all stored items from the cache.
 func (c *Cache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	if c.OnEvicted != nil {
-		c.cache.Range(func(key, value interface{}) bool {
-			kv := value.(*list.Element).Value.(*entry)
+		for _, e := range c.cache {
+			kv := e.Value.(*entry)
 			c.OnEvicted(kv.key, kv.value)
-			return true
-		})
+		}
 	}
-	c.ll = nil
+	c.ll = list.New()
+	c.cache = make(map[interface{}]*list.Element)
 }
@@ -17,7 +17,6 @@ import (
 	"net/url"
 	"os"
 	"regexp"
-	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -25,7 +24,7 @@ import (
 
 	"github.com/araddon/dateparse"
 	"github.com/beego/beego"
-	"github.com/djylb/nps/lib/logs"
+	"github.com/djylb/nps/lib/crypt"
 	"github.com/djylb/nps/lib/version"
 )
 
@@ -191,12 +190,13 @@ func GetPort(value int) int {
 // user global user
 // passwd global passwd
 // accountMap enable multi user auth
+// passwords may be stored as bcrypt or argon2id hashes
 func CheckAuthWithAccountMap(u, p, user, passwd string, accountMap, authMap map[string]string) bool {
 	// Single account check
 	noAccountMap := (accountMap == nil || len(accountMap) == 0)
 	noAuthMap := (authMap == nil || len(authMap) == 0)
 	if noAccountMap && noAuthMap {
-		return u == user && p == passwd
+		return u == user && crypt.CheckPassword(passwd, p)
 	}
 
 	// Multi-account authentication check
@@ -204,18 +204,18 @@ func CheckAuthWithAccountMap(u, p, user, passwd string, accountMap, authMap map[
 		return false
 	}
 
-	if u == user && p == passwd {
+	if u == user && crypt.CheckPassword(passwd, p) {
 		return true
 	}
 
 	if !noAccountMap {
-		if P, ok := accountMap[u]; ok && p == P {
+		if P, ok := accountMap[u]; ok && crypt.CheckPassword(P, p) {
 			return true
 		}
 	}
 
 	if !noAuthMap {
-		if P, ok := authMap[u]; ok && p == P {
+		if P, ok := authMap[u]; ok && crypt.CheckPassword(P, p) {
 			return true
 		}
 	}
@@ -230,25 +230,34 @@ func CheckAuth(r *http.Request, user, passwd string, accountMap, authMap map[str
 		return true
 	}
 
+	u, p, ok := GetAuthPair(r)
+	if !ok {
+		return false
+	}
+
+	return CheckAuthWithAccountMap(u, p, user, passwd, accountMap, authMap)
+}
+
+// GetAuthPair 按 CheckAuth 的规则从 Authorization 或 Proxy-Authorization 中取出用户名和密码
+func GetAuthPair(r *http.Request) (user, passwd string, ok bool) {
 	s := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
 	if len(s) != 2 {
 		s = strings.SplitN(r.Header.Get("Proxy-Authorization"), " ", 2)
 		if len(s) != 2 {
-			return false
+			return "", "", false
 		}
 	}
 
 	b, err := base64.StdEncoding.DecodeString(s[1])
 	if err != nil {
-		return false
+		return "", "", false
 	}
 
 	pair := strings.SplitN(string(b), ":", 2)
 	if len(pair) != 2 {
-		return false
+		return "", "", false
 	}
-
-	return CheckAuthWithAccountMap(pair[0], pair[1], user, passwd, accountMap, authMap)
+	return pair[0], pair[1], true
 }
 
 func DealMultiUser(s string) map[string]string {
@@ -560,24 +569,6 @@ func FormatAddress(s string) string {
 	return "127.0.0.1:" + s
 }
 
-func in(target string, str_array []string) bool {
-	sort.Strings(str_array)
-	index := sort.SearchStrings(str_array, target)
-	if index < len(str_array) && str_array[index] == target {
-		return true
-	}
-	return false
-}
-
-func IsBlackIp(ipPort, vkey string, blackIpList []string) bool {
-	ip := GetIpByAddr(ipPort)
-	if in(ip, blackIpList) {
-		logs.Warn("IP [%s] is in the blacklist for [%s]", ip, vkey)
-		return true
-	}
-	return false
-}
-
 func CopyBuffer(dst io.Writer, src io.Reader, label ...string) (written int64, err error) {
 	buf := CopyBuff.Get()
 	defer CopyBuff.Put(buf)
@@ -7,6 +7,7 @@ import (
 	"strings"
 
 	"github.com/djylb/nps/lib/common"
+	"github.com/djylb/nps/lib/crypt"
 	"github.com/djylb/nps/lib/file"
 )
 
@@ -87,7 +88,7 @@ func NewConfig(path string) (c *Config, err error) {
 			case "[common]":
 				c.CommonConfig = dealCommon(nowContent)
 			default:
-				if strings.Index(nowContent, "host") > -1 {
+				if isHostSection(nowContent) {
 					h := dealHost(nowContent)
 					h.Remark = getTitleContent(c.title[i])
 					c.Hosts = append(c.Hosts, h)
@@ -102,6 +103,16 @@ func NewConfig(path string) (c *Config, err error) {
 	return
 }
 
+// isHostSection 是否为域名配置，即含有 host 项，target_addr=localhost:80 之类的隧道不算
+func isHostSection(s string) bool {
+	for _, v := range splitStr(s) {
+		if strings.TrimSpace(strings.SplitN(v, "=", 2)[0]) == "host" {
+			return true
+		}
+	}
+	return false
+}
+
 func getTitleContent(s string) string {
 	re, _ := regexp.Compile(`[\[\]]`)
 	return re.ReplaceAllString(s, "")
@@ -278,13 +289,14 @@ func dealTunnel(s string) *file.Tunnel {
 func dealMultiUser(s string) map[string]string {
 	multiUserMap := make(map[string]string)
 	for _, v := range splitStr(s) {
-		item := strings.Split(v, "=")
+		item := strings.SplitN(v, "=", 2)
 		if len(item) == 0 {
 			continue
 		} else if len(item) == 1 {
 			item = append(item, "")
 		}
-		multiUserMap[strings.TrimSpace(item[0])] = item[1]
+		// 旧版本 nps hash_password 生成的哈希没有标记
+		multiUserMap[strings.TrimSpace(item[0])] = crypt.MarkLegacyHash(item[1])
 	}
 	return multiUserMap
 }
@@ -2,8 +2,13 @@ package config
 
 import (
 	"log"
+	"os"
+	"path/filepath"
 	"regexp"
+	"strings"
 	"testing"
+
+	"github.com/djylb/nps/lib/file"
 )
 
 func TestReg(t *testing.T) {
@@ -67,3 +72,60 @@ func TestGetTitleContent(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestRender(t *testing.T) {
+	c := &Config{
+		CommonConfig: &CommonConfig{Server: "1.2.3.4:8024", Tp: "tls", VKey: "abc", AutoReconnection: true,
+			Client: &file.Client{Remark: "office", Cnf: &file.Config{Compress: true}, Flow: &file.Flow{}}},
+		Tasks: []*file.Tunnel{
+			{Mode: "tcp", Port: 9000, Remark: "ssh", Target: &file.Target{TargetStr: "localhost:22\n127.0.0.1:22"}},
+			{Mode: "secret", Remark: "ssh", Password: "pw", Target: &file.Target{TargetStr: "127.0.0.1:22"}},
+			{Mode: "sni", Port: 443, Target: &file.Target{TargetStr: "127.0.0.1:443"}},
+		},
+		Hosts: []*file.Host{
+			{Host: "a.example.com", Remark: "health", Location: "/api", Scheme: "http", HeaderChange: "X-A:1\n", Target: &file.Target{TargetStr: "127.0.0.1:80"}},
+		},
+	}
+	path := filepath.Join(t.TempDir(), "npc.conf")
+	if err := os.WriteFile(path, []byte(c.Render()), 0600); err != nil {
+		t.Fatal(err)
+	}
+	n, err := NewConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.CommonConfig.Server != "1.2.3.4:8024" || n.CommonConfig.Tp != "tls" || n.CommonConfig.VKey != "abc" || !n.CommonConfig.Client.Cnf.Compress {
+		t.Fatalf("common %+v", n.CommonConfig)
+	}
+	if len(n.Tasks) != 2 || n.Tasks[0].Ports != "9000" || n.Tasks[0].Target.TargetStr != "localhost:22\n127.0.0.1:22" ||
+		n.Tasks[1].Mode != "secret" || n.Tasks[1].Password != "pw" || n.Tasks[1].Remark != "ssh_2" {
+		t.Fatalf("tasks %+v %+v", n.Tasks[0], n.Tasks[1])
+	}
+	if len(n.Hosts) != 1 || len(n.Healths) != 0 || n.Hosts[0].Location != "/api" || n.Hosts[0].Scheme != "http" || n.Hosts[0].HeaderChange != "X-A:1\n" {
+		t.Fatalf("hosts %+v", n.Hosts)
+	}
+}
+
+func TestRenderSingleLine(t *testing.T) {
+	c := &Config{
+		CommonConfig: &CommonConfig{Server: "1.2.3.4:8024", Tp: "tcp", VKey: "abc",
+			Client: &file.Client{Remark: "office\nvkey=evil", Cnf: &file.Config{U: "u\r\n[evil]"}, Flow: &file.Flow{}}},
+		Tasks: []*file.Tunnel{
+			{Mode: "tcp", Port: 9000, Remark: "ssh\n[common]", Password: "pw\nmode=udp", Target: &file.Target{TargetStr: "127.0.0.1:22\r\n"}},
+			{Mode: "sni", Port: 443, Remark: "x\nserver_addr=evil"},
+		},
+		Hosts: []*file.Host{
+			{Host: "a.example.com\nvkey=evil", HostChange: "b\rc", HeaderChange: "X-A\r:1\nvkey=evil", Target: &file.Target{TargetStr: "127.0.0.1:80"}},
+		},
+	}
+	out := c.Render()
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, "vkey=") && line != "vkey=abc" || strings.HasPrefix(line, "server_addr=evil") ||
+			strings.HasPrefix(line, "mode=udp") || line == "[evil]" || strings.Contains(line, "\r") {
+			t.Errorf("injected line %q in\n%s", line, out)
+		}
+	}
+	if strings.Count(out, "[common]") != 1 {
+		t.Errorf("injected section in\n%s", out)
+	}
+}
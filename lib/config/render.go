@@ -0,0 +1,147 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Render 生成与 NewConfig 对应的 npc 配置文件内容，CommonConfig 为 [common] 部分，
+// 只写入配置文件模式支持的字段，不支持的隧道以注释列出
+func (c *Config) Render() string {
+	var b strings.Builder
+	names := map[string]bool{"common": true}
+	var skipped []string
+	var sections strings.Builder
+	for _, t := range c.Tasks {
+		if !renderable(t.Mode) {
+			skipped = append(skipped, SingleLine(strings.TrimSpace(fmt.Sprintf("%s %s:%d", t.Remark, t.Mode, t.Port))))
+			continue
+		}
+		sections.WriteString("\n[" + sectionName(names, t.Remark, t.Mode+"_"+strconv.Itoa(t.Port)) + "]\n")
+		writeItem(&sections, "mode", t.Mode)
+		if t.Mode != "secret" && t.Mode != "p2p" {
+			writeItem(&sections, "server_port", strconv.Itoa(t.Port))
+			writeItem(&sections, "server_ip", t.ServerIp)
+		}
+		if t.Target != nil {
+			writeItem(&sections, "target_addr", joinLines(t.Target.TargetStr))
+		}
+		writeItem(&sections, "password", t.Password)
+		writeItem(&sections, "local_path", t.LocalPath)
+		writeItem(&sections, "strip_pre", t.StripPre)
+	}
+	for _, h := range c.Hosts {
+		sections.WriteString("\n[" + sectionName(names, h.Remark, h.Host) + "]\n")
+		writeItem(&sections, "host", h.Host)
+		if h.Target != nil {
+			writeItem(&sections, "target_addr", joinLines(h.Target.TargetStr))
+		}
+		writeItem(&sections, "host_change", h.HostChange)
+		if h.Scheme != "" && h.Scheme != "all" {
+			writeItem(&sections, "scheme", h.Scheme)
+		}
+		if h.Location != "" && h.Location != "/" {
+			writeItem(&sections, "location", h.Location)
+		}
+		for _, line := range strings.Split(h.HeaderChange, "\n") {
+			if kv := strings.SplitN(line, ":", 2); len(kv) == 2 && strings.TrimSpace(kv[0]) != "" {
+				writeItem(&sections, "header_"+SingleLine(strings.TrimSpace(kv[0])), strings.TrimSpace(kv[1]))
+			}
+		}
+	}
+	for _, v := range skipped {
+		b.WriteString("# not supported in config file mode: " + v + "\n")
+	}
+	if cc := c.CommonConfig; cc != nil {
+		b.WriteString("[common]\n")
+		writeItem(&b, "server_addr", cc.Server)
+		writeItem(&b, "conn_type", cc.Tp)
+		writeItem(&b, "vkey", cc.VKey)
+		b.WriteString("auto_reconnection=" + strconv.FormatBool(cc.AutoReconnection) + "\n")
+		writeItem(&b, "dns_server", cc.DnsServer)
+		if cl := cc.Client; cl != nil {
+			writeItem(&b, "remark", cl.Remark)
+			if cl.Cnf != nil {
+				writeItem(&b, "basic_username", cl.Cnf.U)
+				if cl.Cnf.Compress {
+					b.WriteString("compress=true\n")
+				}
+				if cl.Cnf.Crypt {
+					b.WriteString("crypt=true\n")
+				}
+			}
+			if cl.RateLimit > 0 {
+				writeItem(&b, "rate_limit", strconv.Itoa(cl.RateLimit))
+			}
+			if cl.MaxConn > 0 {
+				writeItem(&b, "max_conn", strconv.Itoa(cl.MaxConn))
+			}
+			if cl.Flow != nil && cl.Flow.FlowLimit > 0 {
+				writeItem(&b, "flow_limit", strconv.FormatInt(cl.Flow.FlowLimit, 10))
+			}
+		}
+		if cc.DisconnectTime > 0 {
+			writeItem(&b, "disconnect_timeout", strconv.Itoa(cc.DisconnectTime))
+		}
+	}
+	b.WriteString(sections.String())
+	return b.String()
+}
+
+// renderable 配置文件模式可以创建的隧道
+func renderable(mode string) bool {
+	switch mode {
+	case "tcp", "udp", "socks5", "httpProxy", "secret", "p2p", "file":
+		return true
+	}
+	return false
+}
+
+var sectionChars = regexp.MustCompile(`[^0-9A-Za-z_.\-]+`)
+
+// sectionName 生成不重复的节名，避开 common 以及会被当作本地服务和健康检查的前缀
+func sectionName(names map[string]bool, remark, fallback string) string {
+	name := strings.Trim(sectionChars.ReplaceAllString(remark, "_"), "_")
+	if name == "" {
+		name = strings.Trim(sectionChars.ReplaceAllString(fallback, "_"), "_")
+	}
+	if strings.HasPrefix(name, "health") || strings.HasPrefix(name, "secret") || strings.HasPrefix(name, "p2p") {
+		name = "npc_" + name
+	}
+	for i, base := 2, name; names[name]; i++ {
+		name = base + "_" + strconv.Itoa(i)
+	}
+	names[name] = true
+	return name
+}
+
+// writeItem 写入一行配置，值中的换行等控制字符会被去掉，避免写入额外的配置项
+func writeItem(b *strings.Builder, key, value string) {
+	value = SingleLine(value)
+	if key == "" || value == "" {
+		return
+	}
+	b.WriteString(key + "=" + value + "\n")
+}
+
+// SingleLine 去掉字符串中的换行和其它控制字符，用于写入按行解析的配置文件
+func SingleLine(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+func joinLines(s string) string {
+	var list []string
+	for _, v := range strings.Split(s, "\n") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return strings.Join(list, ",")
+}
@@ -0,0 +1,217 @@
+package conn
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/djylb/nps/lib/common"
+	"github.com/djylb/nps/lib/ipfilter"
+	"github.com/djylb/nps/lib/logs"
+)
+
+var (
+	proxyProtoV2Sig  = []byte("\r\n\r\n\x00\r\nQUIT\n")
+	proxyProtoV1Max  = 107
+	proxyProtoTrust  *ipfilter.Trie
+	proxyProtoFirst  = 300 * time.Millisecond
+	proxyProtoWait   = 5 * time.Second
+	errProxyProtoBad = errors.New("invalid proxy protocol header")
+)
+
+// SetProxyProtocolTrusted 设置允许发送 PROXY 协议头的来源（IP 或 CIDR），
+// 为空时不信任任何来源
+func SetProxyProtocolTrusted(list []string) {
+	t := ipfilter.NewTrie()
+	for _, v := range list {
+		if v = strings.TrimSpace(v); v != "" && !t.Add(v) {
+			logs.Warn("invalid proxy protocol trusted address %s", v)
+		}
+	}
+	proxyProtoTrust = t
+}
+
+// ProxyProtocolTrustedSet 是否配置了允许发送 PROXY 协议头的来源
+func ProxyProtocolTrustedSet() bool {
+	return proxyProtoTrust != nil && proxyProtoTrust.Len() > 0
+}
+
+func proxyProtoTrusted(addr net.Addr) bool {
+	if !ProxyProtocolTrustedSet() {
+		return false
+	}
+	return proxyProtoTrust.Contains(net.ParseIP(common.GetIpByAddr(addr.String())))
+}
+
+// ProxyProtoConn 解析入站 PROXY v1/v2 协议头，并用其中的源地址作为 RemoteAddr。
+// 协议头在第一次 Read 或 RemoteAddr 时解析，第一个字节只等待很短的时间，
+// 服务端先发送数据的协议不会被长时间阻塞，没有协议头时保持原地址
+type ProxyProtoConn struct {
+	net.Conn
+	r      *bufio.Reader
+	once   sync.Once
+	remote net.Addr
+	local  net.Addr
+}
+
+// AcceptProxyProtocol 对受信任来源的连接解析 PROXY 协议头，其它连接原样返回
+func AcceptProxyProtocol(c net.Conn) net.Conn {
+	if !proxyProtoTrusted(c.RemoteAddr()) {
+		return c
+	}
+	return &ProxyProtoConn{Conn: c, r: bufio.NewReader(c)}
+}
+
+func (c *ProxyProtoConn) parse() {
+	c.remote, c.local = c.Conn.RemoteAddr(), c.Conn.LocalAddr()
+	defer c.Conn.SetReadDeadline(time.Time{})
+	c.Conn.SetReadDeadline(time.Now().Add(proxyProtoFirst))
+	if _, err := c.r.Peek(1); err != nil {
+		// 超时说明对端在等待服务端先发送数据，其它错误留给之后的 Read 处理
+		return
+	}
+	c.Conn.SetReadDeadline(time.Now().Add(proxyProtoWait))
+	src, dst, err := readProxyProtoHeader(c.r)
+	if err != nil {
+		logs.Warn("read proxy protocol header from %v error %v", c.Conn.RemoteAddr(), err)
+		return
+	}
+	if src != nil {
+		c.remote, c.local = src, dst
+	}
+}
+
+func (c *ProxyProtoConn) Read(b []byte) (int, error) {
+	c.once.Do(c.parse)
+	return c.r.Read(b)
+}
+
+func (c *ProxyProtoConn) RemoteAddr() net.Addr {
+	c.once.Do(c.parse)
+	return c.remote
+}
+
+func (c *ProxyProtoConn) LocalAddr() net.Addr {
+	c.once.Do(c.parse)
+	return c.local
+}
+
+// NetConn returns the underlying connection.
+func (c *ProxyProtoConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// ProxyProtoListener 为受信任来源的连接解析 PROXY 协议头
+type ProxyProtoListener struct {
+	net.Listener
+}
+
+func NewProxyProtoListener(l net.Listener) net.Listener {
+	return &ProxyProtoListener{Listener: l}
+}
+
+func (l *ProxyProtoListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return AcceptProxyProtocol(c), nil
+}
+
+// readProxyProtoHeader 读取 PROXY 协议头，没有协议头或为 LOCAL/UNKNOWN 时返回 nil 地址
+func readProxyProtoHeader(r *bufio.Reader) (src, dst net.Addr, err error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			// 对端等待服务端先发送数据
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+	switch b[0] {
+	case 'P':
+		if b, _ = r.Peek(6); string(b) != "PROXY " {
+			return nil, nil, nil
+		}
+		return readProxyProtoV1(r)
+	case proxyProtoV2Sig[0]:
+		if b, _ = r.Peek(len(proxyProtoV2Sig)); !bytes.Equal(b, proxyProtoV2Sig) {
+			return nil, nil, nil
+		}
+		return readProxyProtoV2(r)
+	}
+	return nil, nil, nil
+}
+
+func readProxyProtoV1(r *bufio.Reader) (src, dst net.Addr, err error) {
+	var line []byte
+	for len(line) < proxyProtoV1Max {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+	s := strings.TrimSuffix(string(line), "\r\n")
+	if len(s) == len(line) {
+		return nil, nil, errProxyProtoBad
+	}
+	fields := strings.Split(s, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, errProxyProtoBad
+	}
+	srcIp, dstIp := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, err1 := strconv.Atoi(fields[4])
+	dstPort, err2 := strconv.Atoi(fields[5])
+	if srcIp == nil || dstIp == nil || err1 != nil || err2 != nil {
+		return nil, nil, errProxyProtoBad
+	}
+	return &net.TCPAddr{IP: srcIp, Port: srcPort}, &net.TCPAddr{IP: dstIp, Port: dstPort}, nil
+}
+
+func readProxyProtoV2(r *bufio.Reader) (src, dst net.Addr, err error) {
+	hdr := make([]byte, 16)
+	if _, err = io.ReadFull(r, hdr); err != nil {
+		return nil, nil, err
+	}
+	verCmd, fam := hdr[12], hdr[13]
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err = io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+	if verCmd>>4 != 2 {
+		return nil, nil, errProxyProtoBad
+	}
+	if verCmd&0x0f == 0 {
+		// LOCAL 命令，例如负载均衡的健康检查
+		return nil, nil, nil
+	}
+	switch fam >> 4 {
+	case 1:
+		if len(body) < 12 {
+			return nil, nil, errProxyProtoBad
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))},
+			&net.TCPAddr{IP: net.IP(body[4:8]), Port: int(binary.BigEndian.Uint16(body[10:12]))}, nil
+	case 2:
+		if len(body) < 36 {
+			return nil, nil, errProxyProtoBad
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))},
+			&net.TCPAddr{IP: net.IP(body[16:32]), Port: int(binary.BigEndian.Uint16(body[34:36]))}, nil
+	}
+	return nil, nil, nil
+}
@@ -0,0 +1,105 @@
+package conn
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReadProxyProtoHeader(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51234}
+	dst := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}
+	src6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 51234}
+	dst6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}
+	cases := []struct {
+		name     string
+		header   []byte
+		src, dst *net.TCPAddr
+	}{
+		{"v1", BuildProxyProtocolV1Header(src, dst), src, dst},
+		{"v2", BuildProxyProtocolV2Header(src, dst), src, dst},
+		{"v1 ipv6", BuildProxyProtocolV1Header(src6, dst6), src6, dst6},
+		{"v2 ipv6", BuildProxyProtocolV2Header(src6, dst6), src6, dst6},
+		{"none", nil, nil, nil},
+	}
+	for _, c := range cases {
+		r := bufio.NewReader(bytes.NewReader(append(c.header, []byte("GET / HTTP/1.1\r\n")...)))
+		gotSrc, gotDst, err := readProxyProtoHeader(r)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if c.src == nil {
+			if gotSrc != nil {
+				t.Errorf("%s: unexpected address %v", c.name, gotSrc)
+			}
+		} else if gotSrc.String() != c.src.String() || gotDst.String() != c.dst.String() {
+			t.Errorf("%s: got %v -> %v, want %v -> %v", c.name, gotSrc, gotDst, c.src, c.dst)
+		}
+		rest, _ := io.ReadAll(r)
+		if string(rest) != "GET / HTTP/1.1\r\n" {
+			t.Errorf("%s: payload %q", c.name, rest)
+		}
+	}
+}
+
+func TestAcceptProxyProtocolTrusted(t *testing.T) {
+	defer SetProxyProtocolTrusted(nil)
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	SetProxyProtocolTrusted(nil)
+	if _, ok := AcceptProxyProtocol(&addrConn{Conn: a, remote: "10.0.0.1:1234"}).(*ProxyProtoConn); ok {
+		t.Error("an empty trusted list should not accept proxy protocol")
+	}
+	SetProxyProtocolTrusted([]string{"10.0.0.0/8"})
+	if _, ok := AcceptProxyProtocol(&addrConn{Conn: a, remote: "192.168.0.1:1234"}).(*ProxyProtoConn); ok {
+		t.Error("an untrusted source should not accept proxy protocol")
+	}
+	if _, ok := AcceptProxyProtocol(&addrConn{Conn: a, remote: "10.0.0.1:1234"}).(*ProxyProtoConn); !ok {
+		t.Error("a trusted source should accept proxy protocol")
+	}
+}
+
+func TestProxyProtoConnServerFirst(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	peer, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	pc := &ProxyProtoConn{Conn: c, r: bufio.NewReader(c)}
+	start := time.Now()
+	if pc.RemoteAddr().String() != peer.LocalAddr().String() {
+		t.Errorf("remote address %v, want %v", pc.RemoteAddr(), peer.LocalAddr())
+	}
+	if d := time.Since(start); d > 2*proxyProtoFirst {
+		t.Errorf("waiting for the header took %v", d)
+	}
+	peer.Write([]byte("hello"))
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(pc, b); err != nil || string(b) != "hello" {
+		t.Errorf("read %q %v", b, err)
+	}
+}
+
+type addrConn struct {
+	net.Conn
+	remote string
+}
+
+func (c *addrConn) RemoteAddr() net.Addr {
+	addr, _ := net.ResolveTCPAddr("tcp", c.remote)
+	return addr
+}
@@ -0,0 +1,156 @@
+package crypt
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// 密码哈希算法
+const (
+	HashBcrypt   = "bcrypt"
+	HashArgon2id = "argon2id"
+)
+
+// argon2id 参数，参考 OWASP 推荐值
+const (
+	argon2Memory  = 19 * 1024
+	argon2Time    = 2
+	argon2Threads = 1
+	argon2KeyLen  = 32
+)
+
+// 校验通过的密码缓存，避免每个请求都重新计算 bcrypt/argon2id
+var (
+	verifiedPasswords sync.Map
+	verifiedNum       int32
+)
+
+const maxVerifiedPasswords = 4096
+
+// HashPrefix 保存的密码哈希前的标记，只有带标记且格式完整的值才按哈希校验，
+// 恰好以 $2a$ 等开头的明文密码仍按明文处理
+const HashPrefix = "{hash}"
+
+// IsPasswordHash 判断 s 是否为带标记的 bcrypt 或 argon2id 哈希
+func IsPasswordHash(s string) bool {
+	return strings.HasPrefix(s, HashPrefix) && wellFormedHash(s[len(HashPrefix):])
+}
+
+// MarkLegacyHash 为旧版本保存的、没有标记但格式完整的哈希加上标记，其它值原样返回；
+// 只用于旧数据和管理员编写的配置文件，不能用于访问者或表单输入的密码
+func MarkLegacyHash(s string) string {
+	if !IsPasswordHash(s) && wellFormedHash(s) {
+		return HashPrefix + s
+	}
+	return s
+}
+
+func wellFormedHash(s string) bool {
+	if strings.HasPrefix(s, "$argon2id$") {
+		_, ok := parseArgon2id(s)
+		return ok
+	}
+	if strings.HasPrefix(s, "$2a$") || strings.HasPrefix(s, "$2b$") || strings.HasPrefix(s, "$2y$") {
+		_, err := bcrypt.Cost([]byte(s))
+		return err == nil
+	}
+	return false
+}
+
+// HashPassword 使用 algorithm 计算带标记的密码哈希，algorithm 为空时使用 bcrypt；
+// 超过 bcrypt 72 字节限制的密码使用 argon2id
+func HashPassword(password, algorithm string) (string, error) {
+	if algorithm != HashArgon2id {
+		if b, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost); err == nil {
+			return HashPrefix + string(b), nil
+		} else if !errors.Is(err, bcrypt.ErrPasswordTooLong) {
+			return "", err
+		}
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+	return fmt.Sprintf(HashPrefix+"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2Memory, argon2Time, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// CheckPassword 以恒定时间校验密码，stored 可以是带标记的哈希或明文
+func CheckPassword(stored, password string) bool {
+	if !IsPasswordHash(stored) {
+		a, b := sha256.Sum256([]byte(stored)), sha256.Sum256([]byte(password))
+		return subtle.ConstantTimeCompare(a[:], b[:]) == 1
+	}
+	key := sha256.Sum256([]byte(stored + "\x00" + password))
+	if _, ok := verifiedPasswords.Load(key); ok {
+		return true
+	}
+	hash := stored[len(HashPrefix):]
+	var ok bool
+	if strings.HasPrefix(hash, "$argon2id$") {
+		ok = checkArgon2id(hash, password)
+	} else {
+		ok = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+	if ok {
+		if atomic.AddInt32(&verifiedNum, 1) > maxVerifiedPasswords {
+			verifiedPasswords.Range(func(k, v interface{}) bool {
+				verifiedPasswords.Delete(k)
+				return true
+			})
+			atomic.StoreInt32(&verifiedNum, 1)
+		}
+		verifiedPasswords.Store(key, struct{}{})
+	}
+	return ok
+}
+
+// checkArgon2id 校验 $argon2id$v=19$m=...,t=...,p=...$salt$hash 格式的哈希
+func checkArgon2id(stored, password string) bool {
+	h, ok := parseArgon2id(stored)
+	if !ok {
+		return false
+	}
+	key := argon2.IDKey([]byte(password), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+	return subtle.ConstantTimeCompare(key, h.key) == 1
+}
+
+type argon2Hash struct {
+	memory, time uint32
+	threads      uint8
+	salt, key    []byte
+}
+
+func parseArgon2id(stored string) (*argon2Hash, bool) {
+	parts := strings.Split(stored, "$")
+	if len(parts) != 6 {
+		return nil, false
+	}
+	var version int
+	h := new(argon2Hash)
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, false
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil || h.threads == 0 {
+		return nil, false
+	}
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, false
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(h.key) == 0 {
+		return nil, false
+	}
+	return h, true
+}
@@ -0,0 +1,54 @@
+package crypt
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPasswordHash(t *testing.T) {
+	for _, algorithm := range []string{HashBcrypt, HashArgon2id} {
+		h, err := HashPassword("secret", algorithm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !IsPasswordHash(h) || !strings.Contains(h, map[string]string{HashBcrypt: "$2a$", HashArgon2id: "$argon2id$"}[algorithm]) {
+			t.Fatalf("unexpected %s hash %s", algorithm, h)
+		}
+		if !CheckPassword(h, "secret") || !CheckPassword(h, "secret") {
+			t.Errorf("%s hash should match", algorithm)
+		}
+		if CheckPassword(h, "Secret") || CheckPassword(h, "") {
+			t.Errorf("%s hash should not match", algorithm)
+		}
+	}
+	if !CheckPassword("plain", "plain") || CheckPassword("plain", "plain2") || !CheckPassword("", "") {
+		t.Error("plaintext compare failed")
+	}
+	long := strings.Repeat("a", 100)
+	h, err := HashPassword(long, HashBcrypt)
+	if err != nil || !strings.HasPrefix(h, HashPrefix+"$argon2id$") || !CheckPassword(h, long) {
+		t.Errorf("long password: %v %s", err, h)
+	}
+	if CheckPassword(HashPrefix+"$argon2id$v=19$m=1,t=1,p=0$AAAA$AAAA", "x") {
+		t.Error("invalid argon2id parameters should fail")
+	}
+}
+
+func TestPasswordHashMark(t *testing.T) {
+	h, _ := HashPassword("secret", HashBcrypt)
+	legacy := strings.TrimPrefix(h, HashPrefix)
+	if IsPasswordHash(legacy) || CheckPassword(legacy, "secret") {
+		t.Error("a hash without the mark should be treated as plaintext")
+	}
+	if MarkLegacyHash(legacy) != h || MarkLegacyHash(h) != h {
+		t.Error("a well formed legacy hash should be marked once")
+	}
+	for _, v := range []string{"$2a$secret", "$argon2id$secret", HashPrefix + "secret", "plain"} {
+		if IsPasswordHash(v) || MarkLegacyHash(v) != v {
+			t.Errorf("%s should be treated as plaintext", v)
+		}
+		if !CheckPassword(v, v) {
+			t.Errorf("%s should match as plaintext", v)
+		}
+	}
+}
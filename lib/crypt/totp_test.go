@@ -0,0 +1,37 @@
+package crypt
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+)
+
+func TestTotpRfc6238(t *testing.T) {
+	// RFC 6238 附录 B 的 SHA1 测试向量，取后 6 位
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	for ts, want := range map[int64]string{59: "287082", 1111111109: "081804", 1234567890: "005924", 2000000000: "279037"} {
+		if code, err := TotpCode(secret, time.Unix(ts, 0)); err != nil || code != want {
+			t.Errorf("time %d: got %s %v, want %s", ts, code, err, want)
+		}
+	}
+}
+
+func TestValidateTotp(t *testing.T) {
+	secret := NewTotpSecret()
+	now := time.Now()
+	prev, _ := TotpCode(secret, now.Add(-30*time.Second))
+	if step, ok := ValidateTotp(secret, prev, now); !ok || step != now.Unix()/30-1 {
+		t.Error("previous step should be accepted")
+	}
+	old, _ := TotpCode(secret, now.Add(-90*time.Second))
+	if _, ok := ValidateTotp(secret, old, now); ok {
+		t.Error("old code should be rejected")
+	}
+	if _, ok := ValidateTotp(secret, "12345", now); ok {
+		t.Error("short code should be rejected")
+	}
+	codes := NewRecoveryCodes(2)
+	if len(codes[0]) != 11 || HashRecoveryCode(codes[0]) != HashRecoveryCode(" "+codes[0][:5]+codes[0][6:]+" ") {
+		t.Errorf("unexpected recovery code %s", codes[0])
+	}
+}
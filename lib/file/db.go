@@ -10,6 +10,7 @@ import (
 
 	"github.com/djylb/nps/lib/common"
 	"github.com/djylb/nps/lib/crypt"
+	"github.com/djylb/nps/lib/logs"
 	"github.com/djylb/nps/lib/rate"
 )
 
@@ -26,10 +27,14 @@ var (
 func GetDb() *DbUtils {
 	once.Do(func() {
 		jsonDb := NewJsonDb(common.GetRunPath())
+		jsonDb.LoadGroupFromJsonFile()
 		jsonDb.LoadClientFromJsonFile()
 		jsonDb.LoadTaskFromJsonFile()
 		jsonDb.LoadHostFromJsonFile()
 		jsonDb.LoadGlobalFromJsonFile()
+		jsonDb.LoadTokenFromJsonFile()
+		jsonDb.LoadUserFromJsonFile()
+		jsonDb.LoadWebhookFromJsonFile()
 		Db = &DbUtils{JsonDb: jsonDb}
 	})
 	return Db
@@ -47,7 +52,8 @@ func GetMapKeys(m sync.Map, isSort bool, sortKey, order string) (keys []int) {
 	return
 }
 
-func (s *DbUtils) GetClientList(start, length int, search, sort, order string, clientId int) ([]*Client, int) {
+// GetClientList 分页查询客户端，groupId 和 tag 不为空时只返回该分组或带有该标签的客户端
+func (s *DbUtils) GetClientList(start, length int, search, sort, order string, clientId, groupId int, tag string) ([]*Client, int) {
 	list := make([]*Client, 0)
 	var cnt int
 	originLength := length
@@ -61,6 +67,9 @@ func (s *DbUtils) GetClientList(start, length int, search, sort, order string, c
 			if clientId != 0 && clientId != v.Id {
 				continue
 			}
+			if (groupId != 0 && groupId != v.GroupId) || (tag != "" && !v.HasTag(tag)) {
+				continue
+			}
 			if search != "" && !(v.Id == common.GetIntNoErrByStr(search) || common.ContainsFold(v.VerifyKey, search) || common.ContainsFold(v.Remark, search)) {
 				continue
 			}
@@ -109,6 +118,7 @@ func (s *DbUtils) NewTask(t *Tunnel) (err error) {
 		return
 	}
 	t.Flow = new(Flow)
+	t.HashPasswords()
 	s.JsonDb.Tasks.Store(t.Id, t)
 	s.JsonDb.StoreTasksToJsonFile()
 	return
@@ -129,6 +139,7 @@ func (s *DbUtils) SaveGlobal(t *Glob) error {
 func (s *DbUtils) DelTask(id int) error {
 	s.JsonDb.Tasks.Delete(id)
 	s.JsonDb.StoreTasksToJsonFile()
+	logs.CloseAccess("tunnel", id)
 	return nil
 }
 
@@ -156,6 +167,7 @@ func (s *DbUtils) GetTask(id int) (t *Tunnel, err error) {
 func (s *DbUtils) DelHost(id int) error {
 	s.JsonDb.Hosts.Delete(id)
 	s.JsonDb.StoreHostToJsonFile()
+	logs.CloseAccess("host", id)
 	return nil
 }
 
@@ -209,6 +221,7 @@ func (s *DbUtils) NewHost(t *Host) error {
 		return errors.New("host has exist")
 	}
 	t.Flow = new(Flow)
+	t.HashPasswords()
 	s.JsonDb.Hosts.Store(t.Id, t)
 	s.JsonDb.StoreHostToJsonFile()
 	return nil
@@ -243,6 +256,7 @@ func (s *DbUtils) GetHost(start, length int, id int, search string) ([]*Host, in
 func (s *DbUtils) DelClient(id int) error {
 	s.JsonDb.Clients.Delete(id)
 	s.JsonDb.StoreClientsToJsonFile()
+	s.RemoveUserClient(id)
 	return nil
 }
 
@@ -256,12 +270,11 @@ reset:
 		isNotSet = true
 		c.VerifyKey = crypt.GetRandomString(16, c.Id)
 	}
-	if c.RateLimit == 0 {
-		c.Rate = rate.NewRate(int64(2 << 23))
-	} else if c.Rate == nil {
-		c.Rate = rate.NewRate(int64(c.RateLimit * 1024))
+	if c.Rate == nil || c.RateLimit == 0 {
+		c.ResetRate()
+	} else {
+		c.Rate.Start()
 	}
-	c.Rate.Start()
 	if !s.VerifyVkey(c.VerifyKey, c.Id) {
 		if isNotSet {
 			goto reset
@@ -274,6 +287,7 @@ reset:
 	if c.Flow == nil {
 		c.Flow = new(Flow)
 	}
+	c.HashPasswords()
 	s.JsonDb.Clients.Store(c.Id, c)
 	s.JsonDb.StoreClientsToJsonFile()
 	return nil
@@ -292,7 +306,15 @@ func (s *DbUtils) VerifyVkey(vkey string, id int) (res bool) {
 	return res
 }
 
-func (s *DbUtils) VerifyUserName(username string, id int) (res bool) {
+// VerifyUserName 检查客户端的 web 登录用户名是否与其他客户端或 web 管理账号重复
+func (s *DbUtils) VerifyUserName(username string, id int) bool {
+	if _, err := s.GetUserByName(username); err == nil {
+		return false
+	}
+	return s.verifyClientUserName(username, id)
+}
+
+func (s *DbUtils) verifyClientUserName(username string, id int) (res bool) {
 	res = true
 	s.JsonDb.Clients.Range(func(key, value interface{}) bool {
 		v := value.(*Client)
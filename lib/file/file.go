@@ -20,42 +20,66 @@ import (
 
 func NewJsonDb(runPath string) *JsonDb {
 	return &JsonDb{
-		RunPath:        runPath,
-		TaskFilePath:   filepath.Join(runPath, "conf", "tasks.json"),
-		HostFilePath:   filepath.Join(runPath, "conf", "hosts.json"),
-		ClientFilePath: filepath.Join(runPath, "conf", "clients.json"),
-		GlobalFilePath: filepath.Join(runPath, "conf", "global.json"),
+		RunPath:         runPath,
+		TaskFilePath:    filepath.Join(runPath, "conf", "tasks.json"),
+		HostFilePath:    filepath.Join(runPath, "conf", "hosts.json"),
+		ClientFilePath:  filepath.Join(runPath, "conf", "clients.json"),
+		GlobalFilePath:  filepath.Join(runPath, "conf", "global.json"),
+		TokenFilePath:   filepath.Join(runPath, "conf", "tokens.json"),
+		UserFilePath:    filepath.Join(runPath, "conf", "users.json"),
+		WebhookFilePath: filepath.Join(runPath, "conf", "webhooks.json"),
+		GroupFilePath:   filepath.Join(runPath, "conf", "groups.json"),
 	}
 }
 
 type JsonDb struct {
-	Tasks            sync.Map
-	Hosts            sync.Map
-	HostsTmp         sync.Map
-	Clients          sync.Map
-	Global           *Glob
-	RunPath          string
-	ClientIncreaseId int32  //client increased id
-	TaskIncreaseId   int32  //task increased id
-	HostIncreaseId   int32  //host increased id
-	TaskFilePath     string //task file path
-	HostFilePath     string //host file path
-	ClientFilePath   string //client file path
-	GlobalFilePath   string //global file path
+	Tasks             sync.Map
+	Hosts             sync.Map
+	HostsTmp          sync.Map
+	Clients           sync.Map
+	Tokens            sync.Map
+	Users             sync.Map
+	Webhooks          sync.Map
+	Groups            sync.Map
+	Global            *Glob
+	RunPath           string
+	ClientIncreaseId  int32  //client increased id
+	TaskIncreaseId    int32  //task increased id
+	HostIncreaseId    int32  //host increased id
+	TokenIncreaseId   int32  //api token increased id
+	UserIncreaseId    int32  //web user increased id
+	WebhookIncreaseId int32  //webhook increased id
+	GroupIncreaseId   int32  //client group increased id
+	TaskFilePath      string //task file path
+	HostFilePath      string //host file path
+	ClientFilePath    string //client file path
+	GlobalFilePath    string //global file path
+	TokenFilePath     string //api token file path
+	UserFilePath      string //web user file path
+	WebhookFilePath   string //webhook file path
+	GroupFilePath     string //client group file path
 }
 
 func (s *JsonDb) LoadTaskFromJsonFile() {
+	var migrated bool
 	loadSyncMapFromFile(s.TaskFilePath, Tunnel{}, func(v interface{}) {
 		var err error
 		post := v.(*Tunnel)
 		if post.Client, err = s.GetClient(post.Client.Id); err != nil {
 			return
 		}
+		if post.hashPasswords(migratePassword) {
+			migrated = true
+		}
 		s.Tasks.Store(post.Id, post)
 		if post.Id > int(s.TaskIncreaseId) {
 			s.TaskIncreaseId = int32(post.Id)
 		}
 	})
+	if migrated {
+		logs.Info("Plaintext tunnel passwords have been replaced with hashes")
+		s.StoreTasksToJsonFile()
+	}
 }
 
 func (s *JsonDb) LoadClientFromJsonFile() {
@@ -77,43 +101,105 @@ func (s *JsonDb) LoadClientFromJsonFile() {
 			logs.Info("Auto create local proxy client.")
 		}
 	}
+	var migrated bool
 	loadSyncMapFromFile(s.ClientFilePath, Client{}, func(v interface{}) {
 		post := v.(*Client)
-		if post.RateLimit > 0 {
-			post.Rate = rate.NewRate(int64(post.RateLimit * 1024))
-		} else {
-			post.Rate = rate.NewRate(int64(2 << 23))
+		if post.hashPasswords(migratePassword) {
+			migrated = true
 		}
-		post.Rate.Start()
+		var g *Group
+		if v, ok := s.Groups.Load(post.GroupId); ok {
+			g = v.(*Group)
+		}
+		post.resetRate(post.policy(g).RateLimit)
 		post.NowConn = 0
 		s.Clients.Store(post.Id, post)
 		if post.Id > int(s.ClientIncreaseId) {
 			s.ClientIncreaseId = int32(post.Id)
 		}
 	})
+	if migrated {
+		logs.Info("Plaintext client passwords have been replaced with hashes")
+		s.StoreClientsToJsonFile()
+	}
 }
 
 func (s *JsonDb) LoadHostFromJsonFile() {
+	var migrated bool
 	loadSyncMapFromFile(s.HostFilePath, Host{}, func(v interface{}) {
 		var err error
 		post := v.(*Host)
 		if post.Client, err = s.GetClient(post.Client.Id); err != nil {
 			return
 		}
+		if post.UserAuth.hashPasswords(migratePassword) {
+			migrated = true
+		}
 		s.Hosts.Store(post.Id, post)
 		if post.Id > int(s.HostIncreaseId) {
 			s.HostIncreaseId = int32(post.Id)
 		}
 	})
+	if migrated {
+		logs.Info("Plaintext host passwords have been replaced with hashes")
+		s.StoreHostToJsonFile()
+	}
 }
 
 func (s *JsonDb) LoadGlobalFromJsonFile() {
 	loadSyncMapFromFileWithSingleJson(s.GlobalFilePath, func(v string) {
-		post := new(Glob)
+		post := storedGlob{Glob: new(Glob)}
 		if json.Unmarshal([]byte(v), &post) != nil {
 			return
 		}
-		s.Global = post
+		s.Global = post.load()
+	})
+}
+
+func (s *JsonDb) LoadTokenFromJsonFile() {
+	loadSyncMapFromFile(s.TokenFilePath, ApiToken{}, func(v interface{}) {
+		post := v.(*ApiToken)
+		s.Tokens.Store(post.Id, post)
+		if post.Id > int(s.TokenIncreaseId) {
+			s.TokenIncreaseId = int32(post.Id)
+		}
+	})
+}
+
+func (s *JsonDb) LoadUserFromJsonFile() {
+	var migrated bool
+	loadSyncMapFromFile(s.UserFilePath, User{}, func(v interface{}) {
+		post := v.(*User)
+		if p := migratePassword(post.Password); p != post.Password {
+			post.Password, migrated = p, true
+		}
+		s.Users.Store(post.Id, post)
+		if post.Id > int(s.UserIncreaseId) {
+			s.UserIncreaseId = int32(post.Id)
+		}
+	})
+	if migrated {
+		s.StoreUsersToJsonFile()
+	}
+}
+
+func (s *JsonDb) LoadWebhookFromJsonFile() {
+	loadSyncMapFromFile(s.WebhookFilePath, Webhook{}, func(v interface{}) {
+		post := v.(*Webhook)
+		s.Webhooks.Store(post.Id, post)
+		if post.Id > int(s.WebhookIncreaseId) {
+			s.WebhookIncreaseId = int32(post.Id)
+		}
+	})
+}
+
+func (s *JsonDb) LoadGroupFromJsonFile() {
+	loadSyncMapFromFile(s.GroupFilePath, Group{}, func(v interface{}) {
+		post := v.(*Group)
+		s.Groups.Store(post.Id, post)
+		if post.Id > int(s.GroupIncreaseId) {
+			s.GroupIncreaseId = int32(post.Id)
+		}
 	})
 }
 
@@ -126,10 +212,26 @@ func (s *JsonDb) GetClient(id int) (c *Client, err error) {
 	return
 }
 
+// resetIpAcl 保存后清空编译好的黑白名单，下次访问时按新的名单重新编译
+func resetIpAcl(m *sync.Map) {
+	m.Range(func(key, value interface{}) bool {
+		switch v := value.(type) {
+		case *Client:
+			v.ipAcl.reset()
+		case *Tunnel:
+			v.ipAcl.reset()
+		case *Host:
+			v.ipAcl.reset()
+		}
+		return true
+	})
+}
+
 var hostLock sync.Mutex
 
 func (s *JsonDb) StoreHostToJsonFile() {
 	hostLock.Lock()
+	resetIpAcl(&s.Hosts)
 	storeSyncMapToFile(s.Hosts, s.HostFilePath)
 	hostLock.Unlock()
 }
@@ -138,6 +240,7 @@ var taskLock sync.Mutex
 
 func (s *JsonDb) StoreTasksToJsonFile() {
 	taskLock.Lock()
+	resetIpAcl(&s.Tasks)
 	storeSyncMapToFile(s.Tasks, s.TaskFilePath)
 	taskLock.Unlock()
 }
@@ -146,6 +249,7 @@ var clientLock sync.Mutex
 
 func (s *JsonDb) StoreClientsToJsonFile() {
 	clientLock.Lock()
+	resetIpAcl(&s.Clients)
 	storeSyncMapToFile(s.Clients, s.ClientFilePath)
 	clientLock.Unlock()
 }
@@ -154,10 +258,47 @@ var globalLock sync.Mutex
 
 func (s *JsonDb) StoreGlobalToJsonFile() {
 	globalLock.Lock()
+	if s.Global != nil {
+		s.Global.ipAcl.reset()
+	}
 	storeGlobalToFile(s.Global, s.GlobalFilePath)
 	globalLock.Unlock()
 }
 
+var tokenLock sync.Mutex
+
+func (s *JsonDb) StoreTokensToJsonFile() {
+	tokenLock.Lock()
+	storeSyncMapToFile(s.Tokens, s.TokenFilePath)
+	tokenLock.Unlock()
+}
+
+var userLock sync.Mutex
+
+func (s *JsonDb) StoreUsersToJsonFile() {
+	userLock.Lock()
+	storeSyncMapToFile(s.Users, s.UserFilePath)
+	userLock.Unlock()
+}
+
+var webhookLock sync.Mutex
+
+func (s *JsonDb) StoreWebhooksToJsonFile() {
+	webhookLock.Lock()
+	storeSyncMapToFile(s.Webhooks, s.WebhookFilePath)
+	webhookLock.Unlock()
+}
+
+var groupLock sync.Mutex
+
+func (s *JsonDb) StoreGroupsToJsonFile() {
+	groupLock.Lock()
+	// 分组的黑名单对成员客户端生效
+	resetIpAcl(&s.Clients)
+	storeSyncMapToFile(s.Groups, s.GroupFilePath)
+	groupLock.Unlock()
+}
+
 func (s *JsonDb) GetClientId() int32 {
 	return atomic.AddInt32(&s.ClientIncreaseId, 1)
 }
@@ -170,6 +311,22 @@ func (s *JsonDb) GetHostId() int32 {
 	return atomic.AddInt32(&s.HostIncreaseId, 1)
 }
 
+func (s *JsonDb) GetTokenId() int32 {
+	return atomic.AddInt32(&s.TokenIncreaseId, 1)
+}
+
+func (s *JsonDb) GetUserId() int32 {
+	return atomic.AddInt32(&s.UserIncreaseId, 1)
+}
+
+func (s *JsonDb) GetWebhookId() int32 {
+	return atomic.AddInt32(&s.WebhookIncreaseId, 1)
+}
+
+func (s *JsonDb) GetGroupId() int32 {
+	return atomic.AddInt32(&s.GroupIncreaseId, 1)
+}
+
 func loadSyncMapFromFile(filePath string, t interface{}, f func(value interface{})) {
 	// 如果文件不存在，则创建空文件
 	if !common.FileExists(filePath) {
@@ -206,20 +363,20 @@ func loadObsoleteJsonFile(b []byte, t interface{}, f func(value interface{})) {
 		}
 		switch t.(type) {
 		case Client:
-			var client Client
+			client := storedClient{Client: new(Client)}
 			if err = json.Unmarshal([]byte(v), &client); err != nil {
 				fmt.Println("Error:", err)
 				return
 			}
-			f(&client)
+			f(client.load())
 			break
 		case Host:
-			var host Host
+			host := storedHost{Host: new(Host)}
 			if err = json.Unmarshal([]byte(v), &host); err != nil {
 				fmt.Println("Error:", err)
 				return
 			}
-			f(&host)
+			f(host.load())
 			break
 		case Tunnel:
 			var tunnel Tunnel
@@ -238,7 +395,7 @@ func loadJsonFile(b []byte, t interface{}, f func(value interface{})) error {
 	var err error
 	switch t.(type) {
 	case Client:
-		var clients []Client
+		var clients []storedClient
 		if len(b) != 0 {
 			err = json.Unmarshal(b, &clients)
 			if err != nil {
@@ -246,11 +403,11 @@ func loadJsonFile(b []byte, t interface{}, f func(value interface{})) error {
 			}
 		}
 		for i := range clients {
-			f(&clients[i])
+			f(clients[i].load())
 		}
 		break
 	case Host:
-		var hosts []Host
+		var hosts []storedHost
 		if len(b) != 0 {
 			err = json.Unmarshal(b, &hosts)
 			if err != nil {
@@ -258,7 +415,7 @@ func loadJsonFile(b []byte, t interface{}, f func(value interface{})) error {
 			}
 		}
 		for i := range hosts {
-			f(&hosts[i])
+			f(hosts[i].load())
 		}
 		break
 	case Tunnel:
@@ -273,6 +430,54 @@ func loadJsonFile(b []byte, t interface{}, f func(value interface{})) error {
 			f(&tunnels[i])
 		}
 		break
+	case ApiToken:
+		var tokens []ApiToken
+		if len(b) != 0 {
+			err = json.Unmarshal(b, &tokens)
+			if err != nil {
+				return err
+			}
+		}
+		for i := range tokens {
+			f(&tokens[i])
+		}
+		break
+	case User:
+		var users []storedUser
+		if len(b) != 0 {
+			err = json.Unmarshal(b, &users)
+			if err != nil {
+				return err
+			}
+		}
+		for i := range users {
+			f(users[i].load())
+		}
+		break
+	case Webhook:
+		var webhooks []Webhook
+		if len(b) != 0 {
+			err = json.Unmarshal(b, &webhooks)
+			if err != nil {
+				return err
+			}
+		}
+		for i := range webhooks {
+			f(&webhooks[i])
+		}
+		break
+	case Group:
+		var groups []Group
+		if len(b) != 0 {
+			err = json.Unmarshal(b, &groups)
+			if err != nil {
+				return err
+			}
+		}
+		for i := range groups {
+			f(&groups[i])
+		}
+		break
 	}
 	return nil
 }
@@ -346,7 +551,7 @@ func storeSyncMapToFile(m sync.Map, filePath string) {
 			}
 		}
 
-		data, err := json.Marshal(value)
+		data, err := json.Marshal(storeValue(value))
 		if err != nil {
 			panic(err)
 		}
@@ -396,7 +601,7 @@ func storeGlobalToFile(m *Glob, filePath string) {
 	}
 
 	var b []byte
-	b, err = json.Marshal(m)
+	b, err = json.Marshal(storeValue(m))
 	_, err = file.Write(b)
 	if err != nil {
 		panic(err)
@@ -409,3 +614,91 @@ func storeGlobalToFile(m *Glob, filePath string) {
 		logs.Error("store to file err %v, data will lost", err)
 	}
 }
+
+// 两步验证的密钥和 oidc 的 client secret 不输出到 json，避免 web 列表返回，保存到文件时由下面的结构补上
+
+type storedTwoFactor struct {
+	Secret        string
+	RecoveryCodes []string
+}
+
+func newStoredTwoFactor(tf *TwoFactor) *storedTwoFactor {
+	if tf == nil {
+		return nil
+	}
+	return &storedTwoFactor{Secret: tf.Secret, RecoveryCodes: tf.RecoveryCodes}
+}
+
+func (s *storedTwoFactor) twoFactor() *TwoFactor {
+	if s == nil {
+		return nil
+	}
+	return &TwoFactor{Secret: s.Secret, RecoveryCodes: s.RecoveryCodes}
+}
+
+type storedClient struct {
+	*Client
+	TwoFactor *storedTwoFactor
+}
+
+func (s *storedClient) load() *Client {
+	if s.Client == nil {
+		s.Client = new(Client)
+	}
+	s.Client.TwoFactor = s.TwoFactor.twoFactor()
+	return s.Client
+}
+
+type storedUser struct {
+	*User
+	TwoFactor *storedTwoFactor
+}
+
+func (s *storedUser) load() *User {
+	if s.User == nil {
+		s.User = new(User)
+	}
+	s.User.TwoFactor = s.TwoFactor.twoFactor()
+	return s.User
+}
+
+type storedGlob struct {
+	*Glob
+	TwoFactor *storedTwoFactor
+}
+
+func (s *storedGlob) load() *Glob {
+	if s.Glob == nil {
+		s.Glob = new(Glob)
+	}
+	s.Glob.TwoFactor = s.TwoFactor.twoFactor()
+	return s.Glob
+}
+
+type storedHost struct {
+	*Host
+	OidcClientSecret string
+}
+
+func (s *storedHost) load() *Host {
+	if s.Host == nil {
+		s.Host = new(Host)
+	}
+	s.Host.OidcClientSecret = s.OidcClientSecret
+	return s.Host
+}
+
+// storeValue 返回保存到文件的值
+func storeValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case *Client:
+		return &storedClient{Client: v, TwoFactor: newStoredTwoFactor(v.TwoFactor)}
+	case *User:
+		return &storedUser{User: v, TwoFactor: newStoredTwoFactor(v.TwoFactor)}
+	case *Glob:
+		return &storedGlob{Glob: v, TwoFactor: newStoredTwoFactor(v.TwoFactor)}
+	case *Host:
+		return &storedHost{Host: v, OidcClientSecret: v.OidcClientSecret}
+	}
+	return v
+}
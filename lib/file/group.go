@@ -0,0 +1,321 @@
+package file
+
+import (
+	"errors"
+	"html"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/djylb/nps/lib/common"
+	"github.com/djylb/nps/lib/rate"
+)
+
+// Group 客户端分组，成员客户端未设置的限制使用分组的设置
+type Group struct {
+	Id           int
+	Name         string
+	Remark       string
+	RateLimit    int   //rate /kb
+	FlowLimit    int64 //flow limit /MB
+	MaxConn      int
+	MaxTunnelNum int
+	BlackIpList  []string
+	AllowPorts   string //port ranges of tunnels, such as 10000-20000,30001
+	CreateTime   string
+}
+
+// Policy 客户端实际生效的限制
+type Policy struct {
+	RateLimit    int
+	FlowLimit    int64
+	MaxConn      int
+	MaxTunnelNum int
+	BlackIpList  []string
+	AllowPorts   string
+}
+
+// 客户端可以不继承分组的限制项，列在 Client.GroupOverride 中的项即使为 0 或空也使用客户端自己的值
+const (
+	OverrideRateLimit    = "rate_limit"
+	OverrideFlowLimit    = "flow_limit"
+	OverrideMaxConn      = "max_conn"
+	OverrideMaxTunnelNum = "max_tunnel_num"
+	OverrideBlackIpList  = "black_ip_list"
+	OverrideAllowPorts   = "allow_ports"
+)
+
+var groupOverrides = []string{OverrideRateLimit, OverrideFlowLimit, OverrideMaxConn, OverrideMaxTunnelNum, OverrideBlackIpList, OverrideAllowPorts}
+
+// CheckGroupOverride 检查不继承分组的限制项，返回去重后的列表
+func CheckGroupOverride(list []string) ([]string, error) {
+	res := make([]string, 0, len(list))
+	for _, v := range list {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		if !common.InStrArr(groupOverrides, v) {
+			return nil, errors.New("invalid group override " + v)
+		}
+		if !common.InStrArr(res, v) {
+			res = append(res, v)
+		}
+	}
+	return res, nil
+}
+
+// Overrides 客户端的该项限制是否不继承分组
+func (s *Client) Overrides(item string) bool {
+	return common.InStrArr(s.GroupOverride, item)
+}
+
+// policy 合并客户端与分组的限制，客户端为 0 或空且没有设置不继承的项使用分组的值
+func (s *Client) policy(g *Group) Policy {
+	p := Policy{RateLimit: s.RateLimit, MaxConn: s.MaxConn, MaxTunnelNum: s.MaxTunnelNum, BlackIpList: s.BlackIpList, AllowPorts: s.AllowPorts}
+	if s.Flow != nil {
+		p.FlowLimit = s.Flow.FlowLimit
+	}
+	if g == nil {
+		return p
+	}
+	if p.RateLimit == 0 && !s.Overrides(OverrideRateLimit) {
+		p.RateLimit = g.RateLimit
+	}
+	if p.FlowLimit == 0 && !s.Overrides(OverrideFlowLimit) {
+		p.FlowLimit = g.FlowLimit
+	}
+	if p.MaxConn == 0 && !s.Overrides(OverrideMaxConn) {
+		p.MaxConn = g.MaxConn
+	}
+	if p.MaxTunnelNum == 0 && !s.Overrides(OverrideMaxTunnelNum) {
+		p.MaxTunnelNum = g.MaxTunnelNum
+	}
+	if len(p.BlackIpList) == 0 && !s.Overrides(OverrideBlackIpList) {
+		p.BlackIpList = g.BlackIpList
+	}
+	if p.AllowPorts == "" && !s.Overrides(OverrideAllowPorts) {
+		p.AllowPorts = g.AllowPorts
+	}
+	return p
+}
+
+// Policy 返回客户端实际生效的限制
+func (s *Client) Policy() Policy {
+	if s.GroupId == 0 {
+		return s.policy(nil)
+	}
+	g, _ := GetDb().GetGroup(s.GroupId)
+	return s.policy(g)
+}
+
+// FlowLimitExceeded 客户端流量是否超出生效的流量限制
+func (s *Client) FlowLimitExceeded() bool {
+	limit := s.Policy().FlowLimit
+	return limit > 0 && s.Flow != nil && (limit<<20) < (s.Flow.ExportFlow+s.Flow.InletFlow)
+}
+
+// AllowPort 隧道端口是否在客户端允许的端口范围内，secret 和 p2p 不占用端口
+func (s *Client) AllowPort(port int, mode string) bool {
+	if mode == "secret" || mode == "p2p" {
+		return true
+	}
+	return inPortRanges(s.Policy().AllowPorts, port)
+}
+
+// TunnelNumExceeded 再添加一个隧道或域名是否会超出数量限制
+func (s *Client) TunnelNumExceeded() bool {
+	max := s.Policy().MaxTunnelNum
+	return max != 0 && s.GetTunnelNum() >= max
+}
+
+// ResetRate 按生效的速度限制重建客户端的限速器
+func (s *Client) ResetRate() {
+	s.resetRate(s.Policy().RateLimit)
+}
+
+func (s *Client) resetRate(limit int) {
+	if s.Rate != nil {
+		s.Rate.Stop()
+	}
+	if limit > 0 {
+		s.Rate = rate.NewRate(int64(limit * 1024))
+	} else {
+		s.Rate = rate.NewRate(int64(2 << 23))
+	}
+	s.Rate.Start()
+}
+
+// HasTag 客户端是否有该标签，不区分大小写
+func (s *Client) HasTag(tag string) bool {
+	for _, v := range s.Tags {
+		if strings.EqualFold(v, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// CleanTags 去掉标签两端空白、空标签和重复的标签
+func CleanTags(tags []string) []string {
+	list := make([]string, 0, len(tags))
+	for _, v := range tags {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		var exist bool
+		for _, t := range list {
+			if strings.EqualFold(t, v) {
+				exist = true
+				break
+			}
+		}
+		if !exist {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// CheckPortRanges 检查端口范围的格式，例如 10000-20000,30001
+func CheckPortRanges(ranges string) error {
+	for _, v := range strings.Split(ranges, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		if _, _, ok := portRange(v); !ok {
+			return errors.New("invalid port range " + v)
+		}
+	}
+	return nil
+}
+
+// inPortRanges 端口是否在范围内，未设置范围时允许全部端口
+func inPortRanges(ranges string, port int) bool {
+	if strings.TrimSpace(ranges) == "" {
+		return true
+	}
+	for _, v := range strings.Split(ranges, ",") {
+		if start, end, ok := portRange(strings.TrimSpace(v)); ok && port >= start && port <= end {
+			return true
+		}
+	}
+	return false
+}
+
+func portRange(s string) (start, end int, ok bool) {
+	a, b := s, s
+	if i := strings.Index(s, "-"); i >= 0 {
+		a, b = strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:])
+	}
+	var err error
+	if start, err = strconv.Atoi(a); err != nil {
+		return
+	}
+	if end, err = strconv.Atoi(b); err != nil {
+		return
+	}
+	ok = start >= 1 && end <= 65535 && start <= end
+	return
+}
+
+func (s *DbUtils) checkGroup(g *Group) error {
+	g.Name = strings.TrimSpace(g.Name)
+	if g.Name == "" {
+		return errors.New("the group name can not be empty")
+	}
+	if g.RateLimit < 0 || g.FlowLimit < 0 || g.MaxConn < 0 || g.MaxTunnelNum < 0 {
+		return errors.New("the group limits can not be negative")
+	}
+	if err := CheckPortRanges(g.AllowPorts); err != nil {
+		return err
+	}
+	var err error
+	s.JsonDb.Groups.Range(func(key, value interface{}) bool {
+		if v := value.(*Group); v.Id != g.Id && strings.EqualFold(html.UnescapeString(v.Name), html.UnescapeString(g.Name)) {
+			err = errors.New("the group name is already exist")
+			return false
+		}
+		return true
+	})
+	return err
+}
+
+func (s *DbUtils) NewGroup(g *Group) error {
+	if err := s.checkGroup(g); err != nil {
+		return err
+	}
+	g.Id = int(s.JsonDb.GetGroupId())
+	g.CreateTime = time.Now().Format("2006-01-02 15:04:05")
+	s.JsonDb.Groups.Store(g.Id, g)
+	s.JsonDb.StoreGroupsToJsonFile()
+	return nil
+}
+
+// UpdateGroup 保存修改后的分组，速度限制变化时重建成员的限速器
+func (s *DbUtils) UpdateGroup(g *Group) error {
+	if err := s.checkGroup(g); err != nil {
+		return err
+	}
+	old, err := s.GetGroup(g.Id)
+	if err != nil {
+		return err
+	}
+	s.JsonDb.Groups.Store(g.Id, g)
+	s.JsonDb.StoreGroupsToJsonFile()
+	if old.RateLimit != g.RateLimit {
+		for _, c := range s.GetGroupClients(g.Id) {
+			if c.RateLimit == 0 && !c.Overrides(OverrideRateLimit) {
+				c.ResetRate()
+			}
+		}
+	}
+	return nil
+}
+
+// DelGroup 删除分组，成员客户端移出分组并恢复自身的限制
+func (s *DbUtils) DelGroup(id int) error {
+	if _, err := s.GetGroup(id); err != nil {
+		return err
+	}
+	members := s.GetGroupClients(id)
+	s.JsonDb.Groups.Delete(id)
+	s.JsonDb.StoreGroupsToJsonFile()
+	for _, c := range members {
+		c.GroupId = 0
+		c.ResetRate()
+	}
+	if len(members) > 0 {
+		s.JsonDb.StoreClientsToJsonFile()
+	}
+	return nil
+}
+
+func (s *DbUtils) GetGroup(id int) (*Group, error) {
+	if v, ok := s.JsonDb.Groups.Load(id); ok {
+		return v.(*Group), nil
+	}
+	return nil, errors.New("the group is not exist")
+}
+
+// GetGroupList 返回按 id 排序的全部分组
+func (s *DbUtils) GetGroupList() []*Group {
+	list := make([]*Group, 0)
+	for _, key := range GetMapKeys(s.JsonDb.Groups, false, "", "") {
+		if v, ok := s.JsonDb.Groups.Load(key); ok {
+			list = append(list, v.(*Group))
+		}
+	}
+	return list
+}
+
+// GetGroupClients 返回分组的全部成员客户端
+func (s *DbUtils) GetGroupClients(id int) []*Client {
+	list := make([]*Client, 0)
+	for _, key := range GetMapKeys(s.JsonDb.Clients, false, "", "") {
+		if v, ok := s.JsonDb.Clients.Load(key); ok && v.(*Client).GroupId == id && id != 0 {
+			list = append(list, v.(*Client))
+		}
+	}
+	return list
+}
@@ -1,11 +1,14 @@
 package file
 
 import (
+	"net"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/djylb/nps/lib/geoip"
+	"github.com/djylb/nps/lib/ipfilter"
 	"github.com/djylb/nps/lib/rate"
 	"github.com/pkg/errors"
 )
@@ -57,12 +60,21 @@ type Client struct {
 	NowConn         int32      //the connection num of now
 	WebUserName     string     //the username of web login
 	WebPassword     string     //the password of web login
+	TwoFactor       *TwoFactor //two-factor authentication of web login
 	ConfigConnAllow bool       //is allowed connected by config file
 	MaxTunnelNum    int
 	Version         string
 	BlackIpList     []string
+	WhiteIpList     []string
+	GeoWhiteList    []string
+	GeoBlackList    []string
+	GroupId         int      //the group of client, 0 means no group
+	Tags            []string //tags for filter
+	AllowPorts      string   //allowed port ranges of tunnels, empty means use the group setting
+	GroupOverride   []string //limits not inherited from the group even if 0 or empty, see Override*
 	CreateTime      string
 	LastOnlineTime  string
+	ipAcl           ipAcl
 	sync.RWMutex
 }
 
@@ -84,6 +96,13 @@ func NewClient(vKey string, noStore bool, noDisplay bool) *Client {
 	}
 }
 
+// AllowIp 按 IP 和地区黑白名单判断 ip 是否允许访问该客户端下的隧道和域名
+func (s *Client) AllowIp(ip net.IP) bool {
+	return s.ipAcl.get(func() ([]string, []string) {
+		return s.WhiteIpList, s.Policy().BlackIpList
+	}).Allow(ip) && geoip.Allow(ip, s.GeoWhiteList, s.GeoBlackList)
+}
+
 func (s *Client) AddConn() {
 	atomic.AddInt32(&s.NowConn, 1)
 }
@@ -96,7 +115,7 @@ func (s *Client) GetConn() bool {
 	if s.NowConn < 0 {
 		s.NowConn = 0
 	}
-	if s.MaxConn == 0 || int(s.NowConn) < s.MaxConn {
+	if max := s.Policy().MaxConn; max == 0 || int(s.NowConn) < max {
 		s.AddConn()
 		return true
 	}
@@ -148,29 +167,71 @@ func (s *Client) HasHost(h *Host) bool {
 }
 
 type Tunnel struct {
-	Id           int
-	Port         int
-	ServerIp     string
-	Mode         string
-	Status       bool
-	RunStatus    bool
-	Client       *Client
-	Ports        string
-	Flow         *Flow
-	Password     string
-	Remark       string
-	TargetAddr   string
-	NoStore      bool
-	IsHttp       bool
-	LocalPath    string
-	StripPre     string
-	Target       *Target
-	UserAuth     *MultiAccount
-	MultiAccount *MultiAccount
+	Id                  int
+	Port                int
+	ServerIp            string
+	Mode                string
+	Status              bool
+	RunStatus           bool
+	Client              *Client
+	Ports               string
+	Flow                *Flow
+	Password            string
+	Remark              string
+	TargetAddr          string
+	NoStore             bool
+	IsHttp              bool
+	LocalPath           string
+	StripPre            string
+	Target              *Target
+	UserAuth            *MultiAccount
+	MultiAccount        *MultiAccount
+	ConnLimit           int   //new connections per second of each visitor
+	ConnBurst           int   //burst of new connections
+	LimitRejected       int64 //connections rejected by ConnLimit
+	connLimiter         *rate.Limiter
+	WhiteIpList         []string //allowed ip or cidr, empty means all
+	BlackIpList         []string //denied ip or cidr
+	GeoWhiteList        []string //allowed country code or asn, such as CN or AS4134
+	GeoBlackList        []string //denied country code or asn
+	ipAcl               ipAcl
+	AcceptProxyProtocol bool   //parse inbound proxy protocol header from trusted sources
+	SniHost             string //server names routed by sni mode, such as a.com,*.b.com
+	TlsOffload          bool   //terminate tls on the public port of tcp mode
+	CertFilePath        string //certificate content or path
+	KeyFilePath         string //key content or path
+	AcmeDomain          string //domains issued by acme instead of the certificate
+	ClientCaFile        string //ca content or path to verify client certificates
+	AuthUrl             string //forward auth endpoint of tcp, socks5 and httpProxy mode
 	Health
 	sync.RWMutex
 }
 
+// AllowIp 按 IP 和地区黑白名单判断 ip 是否允许访问该隧道
+func (s *Tunnel) AllowIp(ip net.IP) bool {
+	return s.ipAcl.get(func() ([]string, []string) {
+		return s.WhiteIpList, s.BlackIpList
+	}).Allow(ip) && geoip.Allow(ip, s.GeoWhiteList, s.GeoBlackList)
+}
+
+// AllowConn 按访问者限制新建连接频率，超出时计入 LimitRejected
+func (s *Tunnel) AllowConn(key string) bool {
+	if s.ConnLimit <= 0 {
+		return true
+	}
+	s.Lock()
+	if s.connLimiter == nil || !s.connLimiter.Match(s.ConnLimit, s.ConnBurst) {
+		s.connLimiter = rate.NewLimiter(s.ConnLimit, s.ConnBurst)
+	}
+	l := s.connLimiter
+	s.Unlock()
+	if l.Allow(key) {
+		return true
+	}
+	atomic.AddInt64(&s.LimitRejected, 1)
+	return false
+}
+
 type Health struct {
 	HealthCheckTimeout  int
 	HealthMaxFail       int
@@ -185,29 +246,79 @@ type Health struct {
 }
 
 type Host struct {
-	Id             int
-	Host           string //host
-	HeaderChange   string //header change
-	HostChange     string //host change
-	Location       string //url router
-	Remark         string //remark
-	Scheme         string //http https all
-	HttpsJustProxy bool
-	CertFilePath   string
-	KeyFilePath    string
-	NoStore        bool
-	IsClose        bool
-	AutoHttps      bool
-	AutoCORS       bool
-	Flow           *Flow
-	Client         *Client
-	TargetIsHttps  bool
-	Target         *Target //目标
-	UserAuth       *MultiAccount
-	Health         `json:"-"`
+	Id                  int
+	Host                string //host
+	HeaderChange        string //header change
+	HostChange          string //host change
+	Location            string //url router
+	Remark              string //remark
+	Scheme              string //http https all
+	HttpsJustProxy      bool
+	CertFilePath        string
+	KeyFilePath         string
+	NoStore             bool
+	IsClose             bool
+	AutoHttps           bool
+	AutoCORS            bool
+	Flow                *Flow
+	Client              *Client
+	TargetIsHttps       bool
+	BackendProto        string //protocol to the target: http1, h2 or h2c, empty means http1
+	CacheEnable         bool   //cache responses when http_cache is on
+	CacheInclude        string //cached paths, prefix or *.ext, empty means all
+	CacheExclude        string //paths never cached
+	CompressEnable      bool   //compress responses with br or gzip
+	CompressTypes       string //compressed content types, empty means text and common types
+	CompressMinSize     int    //minimum body size to compress, 0 means 1024
+	OidcIssuer          string //openid connect issuer, empty means disabled
+	OidcClientId        string
+	OidcClientSecret    string  `json:"-"` //only stored to file
+	OidcScopes          string  //empty means openid email profile
+	OidcAllowDomains    string  //allowed email domains, separated by commas
+	OidcAllowGroups     string  //allowed groups claim values, separated by commas
+	AuthUrl             string  //forward auth endpoint, 2xx allows the request
+	AuthResponseHeaders string  //headers copied from the auth response to the upstream request
+	Target              *Target //目标
+	UserAuth            *MultiAccount
+	ReqLimit            int    //requests per second of each visitor
+	ReqBurst            int    //burst of requests
+	ReqLimitKey         string //visitor key: ip, header:<name> or user
+	LimitRejected       int64  //requests rejected by ReqLimit
+	reqLimiter          *rate.Limiter
+	WhiteIpList         []string //allowed ip or cidr, empty means all
+	BlackIpList         []string //denied ip or cidr
+	GeoWhiteList        []string //allowed country code or asn, such as CN or AS4134
+	GeoBlackList        []string //denied country code or asn
+	ipAcl               ipAcl
+	Health              `json:"-"`
 	sync.RWMutex
 }
 
+// AllowIp 按 IP 和地区黑白名单判断 ip 是否允许访问该域名
+func (s *Host) AllowIp(ip net.IP) bool {
+	return s.ipAcl.get(func() ([]string, []string) {
+		return s.WhiteIpList, s.BlackIpList
+	}).Allow(ip) && geoip.Allow(ip, s.GeoWhiteList, s.GeoBlackList)
+}
+
+// AllowRequest 按访问者限制请求频率，超出时计入 LimitRejected
+func (s *Host) AllowRequest(key string) bool {
+	if s.ReqLimit <= 0 {
+		return true
+	}
+	s.Lock()
+	if s.reqLimiter == nil || !s.reqLimiter.Match(s.ReqLimit, s.ReqBurst) {
+		s.reqLimiter = rate.NewLimiter(s.ReqLimit, s.ReqBurst)
+	}
+	l := s.reqLimiter
+	s.Unlock()
+	if l.Allow(key) {
+		return true
+	}
+	atomic.AddInt64(&s.LimitRejected, 1)
+	return false
+}
+
 type Target struct {
 	nowIndex      int
 	TargetStr     string
@@ -264,5 +375,40 @@ func (s *Target) GetRandomTarget() (string, error) {
 
 type Glob struct {
 	BlackIpList []string
+	TwoFactor   *TwoFactor //two-factor authentication of the web admin
+	ipAcl       ipAcl
 	sync.RWMutex
 }
+
+// AllowIp 判断 ip 是否不在全局黑名单内
+func (s *Glob) AllowIp(ip net.IP) bool {
+	return s.ipAcl.get(func() ([]string, []string) {
+		return nil, s.BlackIpList
+	}).Allow(ip)
+}
+
+// ipAcl 缓存由黑白名单编译出的前缀树，保存后由 reset 清空，下次访问时按 lists 返回的名单重新编译
+type ipAcl struct {
+	mu     sync.Mutex
+	filter atomic.Pointer[ipfilter.Filter]
+}
+
+func (a *ipAcl) get(lists func() (white, black []string)) *ipfilter.Filter {
+	if f := a.filter.Load(); f != nil {
+		return f
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if f := a.filter.Load(); f != nil {
+		return f
+	}
+	f, _ := ipfilter.NewFilter(lists())
+	a.filter.Store(f)
+	return f
+}
+
+func (a *ipAcl) reset() {
+	a.mu.Lock()
+	a.filter.Store(nil)
+	a.mu.Unlock()
+}
@@ -0,0 +1,94 @@
+package file
+
+import (
+	"strings"
+
+	"github.com/beego/beego"
+	"github.com/djylb/nps/lib/crypt"
+	"github.com/djylb/nps/lib/logs"
+)
+
+// HashPassword 把明文密码转换为 password_hash 配置的哈希，空密码和已经是哈希的值保持不变
+func HashPassword(p string) string {
+	if p == "" || crypt.IsPasswordHash(p) {
+		return p
+	}
+	h, err := crypt.HashPassword(p, beego.AppConfig.DefaultString("password_hash", crypt.HashBcrypt))
+	if err != nil {
+		logs.Error("hash password error %v", err)
+		return p
+	}
+	return h
+}
+
+// migratePassword 用于加载已保存的数据，旧版本保存的没有标记的哈希加上标记，明文密码转换为哈希
+func migratePassword(p string) string {
+	return HashPassword(crypt.MarkLegacyHash(p))
+}
+
+// HashPasswords 哈希 basic 认证密码和 web 登录密码，返回是否有修改
+func (s *Client) HashPasswords() bool {
+	return s.hashPasswords(HashPassword)
+}
+
+func (s *Client) hashPasswords(hash func(string) string) bool {
+	changed := false
+	if s.Cnf != nil {
+		if p := hash(s.Cnf.P); p != s.Cnf.P {
+			s.Cnf.P, changed = p, true
+		}
+	}
+	if p := hash(s.WebPassword); p != s.WebPassword {
+		s.WebPassword, changed = p, true
+	}
+	return changed
+}
+
+// HashPasswords 哈希隧道的多用户密码，返回是否有修改
+func (s *Tunnel) HashPasswords() bool {
+	return s.hashPasswords(HashPassword)
+}
+
+func (s *Tunnel) hashPasswords(hash func(string) string) bool {
+	a := s.MultiAccount.hashPasswords(hash)
+	b := s.UserAuth.hashPasswords(hash)
+	return a || b
+}
+
+// HashPasswords 哈希域名的认证用户密码，返回是否有修改
+func (s *Host) HashPasswords() bool {
+	return s.UserAuth.HashPasswords()
+}
+
+// HashPasswords 哈希账号密码，Content 中对应的行同时替换为哈希，返回是否有修改
+func (s *MultiAccount) HashPasswords() bool {
+	return s.hashPasswords(HashPassword)
+}
+
+func (s *MultiAccount) hashPasswords(hash func(string) string) bool {
+	if s == nil {
+		return false
+	}
+	changed := false
+	for u, p := range s.AccountMap {
+		if h := hash(p); h != p {
+			s.AccountMap[u], changed = h, true
+		}
+	}
+	if s.Content == "" {
+		return changed
+	}
+	lines := strings.Split(strings.ReplaceAll(s.Content, "\r\n", "\n"), "\n")
+	for i, v := range lines {
+		item := strings.SplitN(v, "=", 2)
+		if len(item) != 2 {
+			continue
+		}
+		p := strings.TrimSpace(item[1])
+		if h, ok := s.AccountMap[strings.TrimSpace(item[0])]; ok && p != h && crypt.IsPasswordHash(h) && !crypt.IsPasswordHash(p) {
+			lines[i], changed = strings.TrimSpace(item[0])+"="+h, true
+		}
+	}
+	s.Content = strings.Join(lines, "\n")
+	return changed
+}
@@ -0,0 +1,113 @@
+package file
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/djylb/nps/lib/crypt"
+)
+
+// api 令牌的权限范围
+const (
+	TokenScopeRead   = "read"   //read-only access to all resources
+	TokenScopeClient = "client" //full access to the resources of one client
+	TokenScopeAdmin  = "admin"  //full access including global settings and tokens
+)
+
+const tokenPrefix = "nps_"
+
+// ApiToken /api/v1 的 bearer 令牌，只保存令牌的摘要
+type ApiToken struct {
+	Id         int
+	Name       string
+	Prefix     string //leading characters shown in the token list
+	Hash       string //sha256 of the token
+	Scope      string //read, client or admin
+	ClientId   int    //client of the client scope
+	ExpireTime int64  //unix time, 0 means never
+	CreateTime string
+	LastUsed   int64 //unix time of the last request
+}
+
+// Expired 令牌是否已过期
+func (s *ApiToken) Expired() bool {
+	return s.ExpireTime > 0 && time.Now().Unix() >= s.ExpireTime
+}
+
+// ValidTokenScope 检查权限范围是否有效
+func ValidTokenScope(scope string) bool {
+	return scope == TokenScopeRead || scope == TokenScopeClient || scope == TokenScopeAdmin
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewApiToken 保存新令牌，返回只显示一次的令牌明文
+func (s *DbUtils) NewApiToken(t *ApiToken) (string, error) {
+	if !ValidTokenScope(t.Scope) {
+		return "", errors.New("invalid token scope")
+	}
+	if t.Scope == TokenScopeClient {
+		if _, err := s.GetClient(t.ClientId); err != nil {
+			return "", err
+		}
+	} else {
+		t.ClientId = 0
+	}
+	token := tokenPrefix + crypt.GetRandomString(40)
+	t.Id = int(s.JsonDb.GetTokenId())
+	t.Hash = hashToken(token)
+	t.Prefix = token[:len(tokenPrefix)+6]
+	t.CreateTime = time.Now().Format("2006-01-02 15:04:05")
+	s.JsonDb.Tokens.Store(t.Id, t)
+	s.JsonDb.StoreTokensToJsonFile()
+	return token, nil
+}
+
+// GetApiTokenList 返回按 id 排序的全部令牌
+func (s *DbUtils) GetApiTokenList() []*ApiToken {
+	list := make([]*ApiToken, 0)
+	for _, key := range GetMapKeys(s.JsonDb.Tokens, false, "", "") {
+		if v, ok := s.JsonDb.Tokens.Load(key); ok {
+			list = append(list, v.(*ApiToken))
+		}
+	}
+	return list
+}
+
+// DelApiToken 吊销令牌
+func (s *DbUtils) DelApiToken(id int) error {
+	if _, ok := s.JsonDb.Tokens.Load(id); !ok {
+		return errors.New("the token is not exist")
+	}
+	s.JsonDb.Tokens.Delete(id)
+	s.JsonDb.StoreTokensToJsonFile()
+	return nil
+}
+
+// GetApiToken 校验令牌明文，返回未过期的令牌并记录使用时间
+func (s *DbUtils) GetApiToken(token string) (t *ApiToken, err error) {
+	h := hashToken(token)
+	s.JsonDb.Tokens.Range(func(key, value interface{}) bool {
+		v := value.(*ApiToken)
+		if subtle.ConstantTimeCompare([]byte(v.Hash), []byte(h)) == 1 {
+			t = v
+			return false
+		}
+		return true
+	})
+	if t == nil {
+		return nil, errors.New("invalid token")
+	}
+	if t.Expired() {
+		return nil, errors.New("the token has expired")
+	}
+	atomic.StoreInt64(&t.LastUsed, time.Now().Unix())
+	return t, nil
+}
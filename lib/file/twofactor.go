@@ -0,0 +1,60 @@
+package file
+
+import (
+	"crypto/subtle"
+	"sync"
+	"time"
+
+	"github.com/djylb/nps/lib/crypt"
+)
+
+// TwoFactor web 登录的 TOTP 两步验证
+type TwoFactor struct {
+	Secret        string   `json:"-"` //base32 totp secret, only stored to file
+	RecoveryCodes []string `json:"-"` //sha256 of unused recovery codes
+	lastStep      int64
+	sync.Mutex
+}
+
+// Enabled 是否开启了两步验证
+func (s *TwoFactor) Enabled() bool {
+	return s != nil && s.Secret != ""
+}
+
+// Verify 校验验证码或恢复码，同一个验证码和恢复码只能使用一次；
+// 第二个返回值表示使用了恢复码，此时需要保存
+func (s *TwoFactor) Verify(code string) (ok bool, recovery bool) {
+	if !s.Enabled() || code == "" {
+		return false, false
+	}
+	s.Lock()
+	defer s.Unlock()
+	if step, ok := crypt.ValidateTotp(s.Secret, code, time.Now()); ok {
+		if step <= s.lastStep {
+			return false, false
+		}
+		s.lastStep = step
+		return true, false
+	}
+	h := crypt.HashRecoveryCode(code)
+	for i, v := range s.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(v), []byte(h)) == 1 {
+			s.RecoveryCodes = append(s.RecoveryCodes[:i:i], s.RecoveryCodes[i+1:]...)
+			return true, true
+		}
+	}
+	return false, false
+}
+
+// NewRecoveryCodes 重新生成恢复码，返回明文，只保存摘要
+func (s *TwoFactor) NewRecoveryCodes() []string {
+	codes := crypt.NewRecoveryCodes(10)
+	hashes := make([]string, len(codes))
+	for i, v := range codes {
+		hashes[i] = crypt.HashRecoveryCode(v)
+	}
+	s.Lock()
+	s.RecoveryCodes = hashes
+	s.Unlock()
+	return codes
+}
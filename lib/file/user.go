@@ -0,0 +1,155 @@
+package file
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/beego/beego"
+)
+
+// web 管理账号的角色
+const (
+	RoleSuperAdmin = "super-admin" //all permissions
+	RoleOperator   = "operator"    //manage clients, tunnels and hosts, no global settings
+	RoleAuditor    = "auditor"     //read-only
+	RoleTenant     = "tenant"      //manage tunnels and hosts of the clients in ClientIds
+)
+
+// User 保存在 users.json 中的 web 管理账号，nps.conf 中的 web_username 始终是超级管理员
+type User struct {
+	Id         int
+	Username   string
+	Password   string //bcrypt or argon2id hash
+	Role       string
+	ClientIds  []int //clients of the tenant role
+	Status     bool
+	Remark     string
+	TwoFactor  *TwoFactor
+	CreateTime string
+}
+
+// ValidRole 检查角色是否有效
+func ValidRole(role string) bool {
+	return role == RoleSuperAdmin || role == RoleOperator || role == RoleAuditor || role == RoleTenant
+}
+
+// checkUser 校验用户名、角色和客户端，非租户角色清空客户端列表
+func (s *DbUtils) checkUser(u *User) error {
+	u.Username = strings.TrimSpace(u.Username)
+	if u.Username == "" {
+		return errors.New("please check your input")
+	}
+	if !ValidRole(u.Role) {
+		return errors.New("invalid role")
+	}
+	if u.Username == beego.AppConfig.String("web_username") || !s.verifyClientUserName(u.Username, 0) {
+		return errors.New("web login username duplicate, please reset")
+	}
+	if v, err := s.GetUserByName(u.Username); err == nil && v.Id != u.Id {
+		return errors.New("web login username duplicate, please reset")
+	}
+	if u.Role != RoleTenant {
+		u.ClientIds = nil
+		return nil
+	}
+	if len(u.ClientIds) == 0 {
+		return errors.New("please select the clients of the tenant")
+	}
+	for _, id := range u.ClientIds {
+		if _, err := s.GetClient(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewUser 新建账号，密码保存为哈希
+func (s *DbUtils) NewUser(u *User) error {
+	if u.Password == "" {
+		return errors.New("please check your input")
+	}
+	if err := s.checkUser(u); err != nil {
+		return err
+	}
+	u.Id = int(s.JsonDb.GetUserId())
+	u.Password = HashPassword(u.Password)
+	u.CreateTime = time.Now().Format("2006-01-02 15:04:05")
+	s.JsonDb.Users.Store(u.Id, u)
+	s.JsonDb.StoreUsersToJsonFile()
+	return nil
+}
+
+// UpdateUser 保存修改后的账号，password 为空时保持原密码
+func (s *DbUtils) UpdateUser(u *User, password string) error {
+	if err := s.checkUser(u); err != nil {
+		return err
+	}
+	if password != "" {
+		u.Password = HashPassword(password)
+	}
+	s.JsonDb.Users.Store(u.Id, u)
+	s.JsonDb.StoreUsersToJsonFile()
+	return nil
+}
+
+func (s *DbUtils) DelUser(id int) error {
+	if _, ok := s.JsonDb.Users.Load(id); !ok {
+		return errors.New("the user is not exist")
+	}
+	s.JsonDb.Users.Delete(id)
+	s.JsonDb.StoreUsersToJsonFile()
+	return nil
+}
+
+func (s *DbUtils) GetUser(id int) (*User, error) {
+	if v, ok := s.JsonDb.Users.Load(id); ok {
+		return v.(*User), nil
+	}
+	return nil, errors.New("the user is not exist")
+}
+
+// GetUserByName 按用户名查找账号
+func (s *DbUtils) GetUserByName(username string) (u *User, err error) {
+	s.JsonDb.Users.Range(func(key, value interface{}) bool {
+		if v := value.(*User); v.Username == username {
+			u = v
+			return false
+		}
+		return true
+	})
+	if u == nil {
+		err = errors.New("the user is not exist")
+	}
+	return
+}
+
+// GetUserList 返回按 id 排序的全部账号
+func (s *DbUtils) GetUserList() []*User {
+	list := make([]*User, 0)
+	for _, key := range GetMapKeys(s.JsonDb.Users, false, "", "") {
+		if v, ok := s.JsonDb.Users.Load(key); ok {
+			list = append(list, v.(*User))
+		}
+	}
+	return list
+}
+
+// RemoveUserClient 删除客户端时把它从租户的客户端列表中移除
+func (s *DbUtils) RemoveUserClient(clientId int) {
+	changed := false
+	s.JsonDb.Users.Range(func(key, value interface{}) bool {
+		v := value.(*User)
+		for i, id := range v.ClientIds {
+			if id == clientId {
+				v.ClientIds = append(v.ClientIds[:i:i], v.ClientIds[i+1:]...)
+				changed = true
+				break
+			}
+		}
+		return true
+	})
+	if changed {
+		s.JsonDb.StoreUsersToJsonFile()
+	}
+}
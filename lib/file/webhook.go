@@ -0,0 +1,132 @@
+package file
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/djylb/nps/lib/crypt"
+)
+
+// webhook 可以订阅的事件
+const (
+	EventClientConnect    = "client.connect"
+	EventClientDisconnect = "client.disconnect"
+	EventTunnelStartFail  = "tunnel.start_failed"
+	EventFlowLimit        = "limit.flow"
+	EventTimeLimit        = "limit.time"
+	EventHealthDown       = "health.down"
+	EventHealthUp         = "health.up"
+	EventLoginFail        = "login.failed"
+	EventCertExpiring     = "cert.expiring"
+	EventPing             = "ping" //test delivery from the web management
+)
+
+// WebhookEvents 全部可以订阅的事件，ping 只在测试时发送
+var WebhookEvents = []string{
+	EventClientConnect, EventClientDisconnect, EventTunnelStartFail, EventFlowLimit, EventTimeLimit,
+	EventHealthDown, EventHealthUp, EventLoginFail, EventCertExpiring,
+}
+
+// Webhook 事件通知地址，请求体使用 Secret 做 HMAC-SHA256 签名
+type Webhook struct {
+	Id         int
+	Name       string
+	Url        string
+	Secret     string
+	Events     []string //empty means all events
+	Status     bool
+	CreateTime string
+}
+
+// Subscribed 是否订阅了事件
+func (s *Webhook) Subscribed(event string) bool {
+	if event == EventPing || len(s.Events) == 0 {
+		return true
+	}
+	for _, v := range s.Events {
+		if v == event {
+			return true
+		}
+	}
+	return false
+}
+
+func checkWebhook(h *Webhook) error {
+	h.Name = strings.TrimSpace(h.Name)
+	h.Url = strings.TrimSpace(h.Url)
+	if u, err := url.Parse(h.Url); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("invalid webhook url")
+	}
+	for _, e := range h.Events {
+		if !validEvent(e) {
+			return errors.New("invalid webhook event " + e)
+		}
+	}
+	return nil
+}
+
+func validEvent(event string) bool {
+	for _, v := range WebhookEvents {
+		if v == event {
+			return true
+		}
+	}
+	return false
+}
+
+// NewWebhook 保存新的通知地址，未填写密钥时随机生成
+func (s *DbUtils) NewWebhook(h *Webhook) error {
+	if err := checkWebhook(h); err != nil {
+		return err
+	}
+	if h.Secret == "" {
+		h.Secret = crypt.GetRandomString(32)
+	}
+	h.Id = int(s.JsonDb.GetWebhookId())
+	h.CreateTime = time.Now().Format("2006-01-02 15:04:05")
+	s.JsonDb.Webhooks.Store(h.Id, h)
+	s.JsonDb.StoreWebhooksToJsonFile()
+	return nil
+}
+
+// UpdateWebhook 保存修改后的通知地址
+func (s *DbUtils) UpdateWebhook(h *Webhook) error {
+	if err := checkWebhook(h); err != nil {
+		return err
+	}
+	if h.Secret == "" {
+		h.Secret = crypt.GetRandomString(32)
+	}
+	s.JsonDb.Webhooks.Store(h.Id, h)
+	s.JsonDb.StoreWebhooksToJsonFile()
+	return nil
+}
+
+func (s *DbUtils) DelWebhook(id int) error {
+	if _, ok := s.JsonDb.Webhooks.Load(id); !ok {
+		return errors.New("the webhook is not exist")
+	}
+	s.JsonDb.Webhooks.Delete(id)
+	s.JsonDb.StoreWebhooksToJsonFile()
+	return nil
+}
+
+func (s *DbUtils) GetWebhook(id int) (*Webhook, error) {
+	if v, ok := s.JsonDb.Webhooks.Load(id); ok {
+		return v.(*Webhook), nil
+	}
+	return nil, errors.New("the webhook is not exist")
+}
+
+// GetWebhookList 返回按 id 排序的全部通知地址
+func (s *DbUtils) GetWebhookList() []*Webhook {
+	list := make([]*Webhook, 0)
+	for _, key := range GetMapKeys(s.JsonDb.Webhooks, false, "", "") {
+		if v, ok := s.JsonDb.Webhooks.Load(key); ok {
+			list = append(list, v.(*Webhook))
+		}
+	}
+	return list
+}
@@ -0,0 +1,171 @@
+package geoip
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/djylb/nps/lib/logs"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+var (
+	countryDb *maxminddb.Reader
+	asnDb     *maxminddb.Reader
+	visits    sync.Map // country -> *int64
+	noDbWarn  sync.Once
+)
+
+type countryRecord struct {
+	Country struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+type asnRecord struct {
+	Number uint `maxminddb:"autonomous_system_number"`
+}
+
+// Init 加载 MaxMind 格式的国家库和 ASN 库，路径为空表示不加载
+func Init(countryPath, asnPath string) error {
+	if countryPath != "" {
+		db, err := maxminddb.Open(countryPath)
+		if err != nil {
+			return err
+		}
+		countryDb = db
+	}
+	if asnPath != "" {
+		db, err := maxminddb.Open(asnPath)
+		if err != nil {
+			return err
+		}
+		asnDb = db
+	}
+	return nil
+}
+
+// Enabled reports whether a country or ASN database is loaded.
+func Enabled() bool {
+	return countryDb != nil || asnDb != nil
+}
+
+// Country 返回 ip 所属国家的 ISO 代码，查询失败时返回空字符串
+func Country(ip net.IP) string {
+	if countryDb == nil || ip == nil {
+		return ""
+	}
+	var r countryRecord
+	if err := countryDb.Lookup(ip, &r); err != nil {
+		return ""
+	}
+	if r.Country.IsoCode != "" {
+		return r.Country.IsoCode
+	}
+	return r.RegisteredCountry.IsoCode
+}
+
+// Asn 返回 ip 所属的自治系统编号，查询失败时返回 0
+func Asn(ip net.IP) uint {
+	if asnDb == nil || ip == nil {
+		return 0
+	}
+	var r asnRecord
+	if err := asnDb.Lookup(ip, &r); err != nil {
+		return 0
+	}
+	return r.Number
+}
+
+// Allow 按国家代码（如 CN）或 ASN（如 AS4134）黑白名单判断 ip 是否允许访问，
+// 黑名单优先，白名单为空时不限制；未加载数据库时设置了白名单的拒绝全部访问，只有黑名单的不做限制
+func Allow(ip net.IP, white, black []string) bool {
+	if len(white) == 0 && len(black) == 0 {
+		return true
+	}
+	if !Enabled() {
+		noDbWarn.Do(func() {
+			logs.Warn("geoip database is not loaded, visitors of tunnels and hosts with a geo white list are denied and geo black lists are ignored")
+		})
+		return len(white) == 0
+	}
+	country, asn := Country(ip), Asn(ip)
+	if match(black, country, asn) {
+		return false
+	}
+	if len(white) > 0 && !match(white, country, asn) {
+		return false
+	}
+	return true
+}
+
+func match(list []string, country string, asn uint) bool {
+	for _, v := range list {
+		v = strings.ToUpper(strings.TrimSpace(v))
+		if strings.HasPrefix(v, "AS") && len(v) > 2 && v[2] >= '0' && v[2] <= '9' {
+			if n, err := strconv.ParseUint(v[2:], 10, 32); err == nil && asn != 0 && uint(n) == asn {
+				return true
+			}
+			continue
+		}
+		if country != "" && v == country {
+			return true
+		}
+	}
+	return false
+}
+
+// Valid reports whether s is a country code such as CN or an ASN such as AS4134.
+func Valid(s string) bool {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if strings.HasPrefix(s, "AS") && len(s) > 2 {
+		_, err := strconv.ParseUint(s[2:], 10, 32)
+		return err == nil
+	}
+	if len(s) != 2 {
+		return false
+	}
+	return s[0] >= 'A' && s[0] <= 'Z' && s[1] >= 'A' && s[1] <= 'Z'
+}
+
+// AddVisit 按国家统计访问次数，用于仪表盘展示
+func AddVisit(country string) {
+	if country == "" {
+		country = "-"
+	}
+	v, ok := visits.Load(country)
+	if !ok {
+		v, _ = visits.LoadOrStore(country, new(int64))
+	}
+	atomic.AddInt64(v.(*int64), 1)
+}
+
+type CountryCount struct {
+	Country string
+	Count   int64
+}
+
+// TopCountries 返回访问次数最多的 n 个国家
+func TopCountries(n int) []CountryCount {
+	list := make([]CountryCount, 0)
+	visits.Range(func(key, value interface{}) bool {
+		list = append(list, CountryCount{Country: key.(string), Count: atomic.LoadInt64(value.(*int64))})
+		return true
+	})
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Count == list[j].Count {
+			return list[i].Country < list[j].Country
+		}
+		return list[i].Count > list[j].Count
+	})
+	if len(list) > n {
+		list = list[:n]
+	}
+	return list
+}
@@ -0,0 +1,48 @@
+package geoip
+
+import (
+	"net"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	list := []string{"cn", "AS4134"}
+	if !match(list, "CN", 0) {
+		t.Error("country code should match case-insensitively")
+	}
+	if !match(list, "", 4134) {
+		t.Error("asn should match")
+	}
+	if match(list, "US", 13335) {
+		t.Error("unexpected match")
+	}
+	if match([]string{"AS0"}, "", 0) {
+		t.Error("unknown asn should not match AS0")
+	}
+}
+
+func TestValid(t *testing.T) {
+	for _, v := range []string{"CN", "us", "AS4134", "as13335"} {
+		if !Valid(v) {
+			t.Errorf("%s should be valid", v)
+		}
+	}
+	for _, v := range []string{"", "C", "CHN", "ASX", "1.2.3.4"} {
+		if Valid(v) {
+			t.Errorf("%s should be invalid", v)
+		}
+	}
+}
+
+func TestAllowWithoutDb(t *testing.T) {
+	ip := net.ParseIP("1.2.3.4")
+	if !Allow(ip, nil, nil) {
+		t.Error("empty lists should allow all")
+	}
+	if Allow(ip, []string{"CN"}, nil) {
+		t.Error("a white list without a database should deny")
+	}
+	if !Allow(ip, nil, []string{"CN"}) {
+		t.Error("a black list without a database should not deny")
+	}
+}
@@ -81,6 +81,10 @@ func CopyBuffer(dst io.Writer, src io.Reader, flows []*file.Flow, task *file.Tun
 							return written, errors.New("Time limit exceeded")
 						}
 					}
+					if task != nil && task.Client != nil && task.Client.GroupId != 0 && task.Client.FlowLimitExceeded() {
+						logs.Info("Flow limit exceeded")
+						return written, errors.New("Flow limit exceeded")
+					}
 				}
 			}
 			if ew != nil {
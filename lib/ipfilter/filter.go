@@ -0,0 +1,60 @@
+package ipfilter
+
+import (
+	"net"
+	"strings"
+)
+
+// Filter 由白名单和黑名单组成的访问控制，黑名单优先，
+// 白名单为空时不限制来源
+type Filter struct {
+	allow *Trie
+	deny  *Trie
+}
+
+// NewFilter 编译白名单和黑名单，返回无法解析的条目
+func NewFilter(allow, deny []string) (*Filter, []string) {
+	f := &Filter{allow: NewTrie(), deny: NewTrie()}
+	var invalid []string
+	for _, s := range allow {
+		if !f.allow.Add(s) && strings.TrimSpace(s) != "" {
+			invalid = append(invalid, s)
+		}
+	}
+	for _, s := range deny {
+		if !f.deny.Add(s) && strings.TrimSpace(s) != "" {
+			invalid = append(invalid, s)
+		}
+	}
+	return f, invalid
+}
+
+// Allow 判断 ip 是否允许访问，nil 的 Filter 允许所有来源
+func (f *Filter) Allow(ip net.IP) bool {
+	if f == nil {
+		return true
+	}
+	if f.deny.Contains(ip) {
+		return false
+	}
+	if f.allow.Len() > 0 && !f.allow.Contains(ip) {
+		return false
+	}
+	return true
+}
+
+// Empty reports whether the filter has no rules.
+func (f *Filter) Empty() bool {
+	return f == nil || (f.allow.Len() == 0 && f.deny.Len() == 0)
+}
+
+// Validate 返回列表中无法解析的条目
+func Validate(list []string) []string {
+	var invalid []string
+	for _, s := range list {
+		if _, _, ok := ParsePrefix(s); !ok && strings.TrimSpace(s) != "" {
+			invalid = append(invalid, s)
+		}
+	}
+	return invalid
+}
@@ -0,0 +1,75 @@
+package ipfilter
+
+import (
+	"net"
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	f, invalid := NewFilter(
+		[]string{"10.0.0.0/8", "2001:db8::/32", "192.168.1.10"},
+		[]string{"10.1.0.0/16", "2001:db8:1::1", "bad"},
+	)
+	if len(invalid) != 1 || invalid[0] != "bad" {
+		t.Fatalf("unexpected invalid entries %v", invalid)
+	}
+	cases := map[string]bool{
+		"10.2.3.4":         true,
+		"10.1.2.3":         false,
+		"192.168.1.10":     true,
+		"192.168.1.11":     false,
+		"::ffff:10.2.3.4":  true,
+		"2001:db8::5":      true,
+		"2001:db8:1::1":    false,
+		"2001:db9::1":      false,
+		"172.16.0.1":       false,
+		"not an ip at all": false,
+	}
+	for ip, want := range cases {
+		if got := f.Allow(net.ParseIP(ip)); got != want {
+			t.Errorf("Allow(%s) = %v, want %v", ip, got, want)
+		}
+	}
+}
+
+func TestFilterEmptyAllowList(t *testing.T) {
+	f, _ := NewFilter(nil, []string{"0.0.0.0/0"})
+	if f.Allow(net.ParseIP("1.2.3.4")) {
+		t.Error("ipv4 should be denied")
+	}
+	if !f.Allow(net.ParseIP("::1")) {
+		t.Error("ipv6 should be allowed")
+	}
+	var nilFilter *Filter
+	if !nilFilter.Allow(net.ParseIP("1.2.3.4")) {
+		t.Error("nil filter should allow all")
+	}
+}
+
+func TestTrieOverlap(t *testing.T) {
+	tr := NewTrie()
+	tr.Add("10.1.2.0/24")
+	tr.Add("10.0.0.0/8")
+	if !tr.Contains(net.ParseIP("10.9.9.9")) {
+		t.Error("shorter prefix added later should cover the range")
+	}
+}
+
+func TestTrieMappedPrefix(t *testing.T) {
+	tr := NewTrie()
+	if !tr.Add("::ffff:10.0.0.0/104") {
+		t.Fatal("mapped prefix should be accepted")
+	}
+	if !tr.Add("::ffff:0:0/96") {
+		t.Fatal("mapped prefix should be accepted")
+	}
+	if !tr.Contains(net.ParseIP("192.168.1.1")) || !tr.Contains(net.ParseIP("10.1.1.1")) {
+		t.Error("::ffff:0:0/96 should cover all ipv4 addresses")
+	}
+	if tr.Contains(net.ParseIP("2001:db8::1")) {
+		t.Error("ipv6 address should not match a mapped prefix")
+	}
+	if ip, bits, ok := ParsePrefix("::ffff:10.0.0.0/104"); !ok || len(ip) != net.IPv4len || bits != 8 {
+		t.Errorf("ParsePrefix = %v %d %v, want 10.0.0.0 8 true", ip, bits, ok)
+	}
+}
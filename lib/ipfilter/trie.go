@@ -0,0 +1,118 @@
+package ipfilter
+
+import (
+	"net"
+	"strings"
+)
+
+// Trie 按位存储的 IP 前缀树，IPv4 与 IPv6 分别存放
+type Trie struct {
+	v4  *node
+	v6  *node
+	num int
+}
+
+type node struct {
+	child [2]*node
+	end   bool
+}
+
+// NewTrie 创建空的前缀树
+func NewTrie() *Trie {
+	return &Trie{v4: new(node), v6: new(node)}
+}
+
+// ParsePrefix 解析单个 IP 或 CIDR，单个 IP 视为 /32 或 /128
+func ParsePrefix(s string) (net.IP, int, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, 0, false
+	}
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, 0, false
+		}
+		ones, size := n.Mask.Size()
+		if ip4 := n.IP.To4(); ip4 != nil {
+			// ::ffff:0:0/96 这类 IPv4 映射地址按 IPv4 存放，前缀长度去掉前 96 位
+			if size == 8*net.IPv6len {
+				ones -= 96
+			}
+			if ones < 0 {
+				return nil, 0, false
+			}
+			return ip4, ones, true
+		}
+		return n.IP, ones, true
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, 0, false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4, 32, true
+	}
+	return ip, 128, true
+}
+
+// Add 插入一条 IP 或 CIDR，格式不正确时返回 false
+func (t *Trie) Add(s string) bool {
+	ip, bits, ok := ParsePrefix(s)
+	if !ok {
+		return false
+	}
+	n := t.root(ip)
+	for i := 0; i < bits; i++ {
+		if n.end {
+			// 已有更短的前缀覆盖
+			return true
+		}
+		b := bit(ip, i)
+		if n.child[b] == nil {
+			n.child[b] = new(node)
+		}
+		n = n.child[b]
+	}
+	n.end = true
+	n.child = [2]*node{}
+	t.num++
+	return true
+}
+
+// Len returns the number of prefixes added.
+func (t *Trie) Len() int {
+	return t.num
+}
+
+// Contains 判断 ip 是否命中任一前缀
+func (t *Trie) Contains(ip net.IP) bool {
+	if t == nil || t.num == 0 || ip == nil {
+		return false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	n := t.root(ip)
+	for i := 0; i < len(ip)*8; i++ {
+		if n.end {
+			return true
+		}
+		n = n.child[bit(ip, i)]
+		if n == nil {
+			return false
+		}
+	}
+	return n.end
+}
+
+func (t *Trie) root(ip net.IP) *node {
+	if len(ip) == net.IPv4len {
+		return t.v4
+	}
+	return t.v6
+}
+
+func bit(ip net.IP, i int) int {
+	return int(ip[i/8]>>(7-uint(i%8))) & 1
+}
@@ -0,0 +1,242 @@
+package logs
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// AccessEntry is one line of a host or tunnel access log.
+// HTTP requests fill Method/Path/Status/Bytes, tcp and udp sessions
+// fill Event/BytesIn/BytesOut/Duration.
+type AccessEntry struct {
+	Time      time.Time
+	ClientIp  string
+	Method    string
+	Host      string
+	Path      string
+	Proto     string
+	Status    int
+	Bytes     int64
+	Referer   string
+	UserAgent string
+	Upstream  string
+	Latency   time.Duration
+	Mode      string
+	Event     string
+	BytesIn   int64
+	BytesOut  int64
+	Duration  time.Duration
+	Country   string
+}
+
+type accessJson struct {
+	Time       string  `json:"time"`
+	ClientIp   string  `json:"client_ip"`
+	Method     string  `json:"method,omitempty"`
+	Host       string  `json:"host,omitempty"`
+	Path       string  `json:"path,omitempty"`
+	Proto      string  `json:"proto,omitempty"`
+	Status     int     `json:"status,omitempty"`
+	Bytes      int64   `json:"bytes"`
+	Referer    string  `json:"referer,omitempty"`
+	UserAgent  string  `json:"user_agent,omitempty"`
+	Upstream   string  `json:"upstream,omitempty"`
+	LatencyMs  float64 `json:"latency_ms,omitempty"`
+	Mode       string  `json:"mode,omitempty"`
+	Event      string  `json:"event,omitempty"`
+	BytesIn    int64   `json:"bytes_in,omitempty"`
+	BytesOut   int64   `json:"bytes_out,omitempty"`
+	DurationMs float64 `json:"duration_ms,omitempty"`
+	Country    string  `json:"country,omitempty"`
+}
+
+var (
+	accessFormat     string
+	accessDir        string
+	accessMaxSize    int
+	accessMaxBackups int
+	accessMaxAge     int
+	accessCompress   bool
+	accessWriters    sync.Map // name -> *lumberjack.Logger
+)
+
+// InitAccess initializes per host/tunnel access logs.
+// format:     "combined"|"json"|"off"
+// dir:        directory holding host_<id>.log and tunnel_<id>.log
+// maxSize:    max size per file in MB
+// maxBackups: max number of backups
+// maxAge:     max age in days
+// compress:   whether to compress old logs
+func InitAccess(format, dir string, maxSize, maxBackups, maxAge int, compress bool) {
+	format = strings.ToLower(format)
+	if format != "combined" && format != "json" {
+		accessFormat = ""
+		return
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		Error("access log disabled, create directory %s error %v", dir, err)
+		accessFormat = ""
+		return
+	}
+	accessFormat = format
+	accessDir = dir
+	accessMaxSize = maxSize
+	accessMaxBackups = maxBackups
+	accessMaxAge = maxAge
+	accessCompress = compress
+}
+
+// AccessEnabled reports whether access logs are written.
+func AccessEnabled() bool {
+	return accessFormat != ""
+}
+
+func accessFileName(kind string, id int) string {
+	return filepath.Join(accessDir, kind+"_"+strconv.Itoa(id)+".log")
+}
+
+func getAccessWriter(kind string, id int) io.Writer {
+	name := accessFileName(kind, id)
+	if v, ok := accessWriters.Load(name); ok {
+		return v.(*lumberjack.Logger)
+	}
+	lj := &lumberjack.Logger{
+		Filename:   name,
+		MaxSize:    accessMaxSize,
+		MaxBackups: accessMaxBackups,
+		MaxAge:     accessMaxAge,
+		Compress:   accessCompress,
+		LocalTime:  true,
+	}
+	v, _ := accessWriters.LoadOrStore(name, lj)
+	return v.(*lumberjack.Logger)
+}
+
+// WriteAccess appends an entry to the access log of a host ("host") or tunnel ("tunnel").
+func WriteAccess(kind string, id int, e *AccessEntry) {
+	if !AccessEnabled() {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	var line []byte
+	if accessFormat == "json" {
+		line = formatAccessJson(e)
+	} else {
+		line = []byte(formatAccessCombined(e))
+	}
+	line = append(line, '\n')
+	if _, err := getAccessWriter(kind, id).Write(line); err != nil {
+		Warn("write access log %s_%d error %v", kind, id, err)
+	}
+}
+
+// CloseAccess releases the writer of a deleted host or tunnel.
+func CloseAccess(kind string, id int) {
+	name := accessFileName(kind, id)
+	if v, ok := accessWriters.LoadAndDelete(name); ok {
+		v.(*lumberjack.Logger).Close()
+	}
+}
+
+// ReadAccess returns at most the last n lines of an access log.
+func ReadAccess(kind string, id int, n int) ([]string, error) {
+	if !AccessEnabled() {
+		return nil, errors.New("access log is disabled")
+	}
+	f, err := os.Open(accessFileName(kind, id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	lines := make([]string, 0, n)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(lines) == n {
+			lines = append(lines[1:], scanner.Text())
+		} else {
+			lines = append(lines, scanner.Text())
+		}
+	}
+	return lines, scanner.Err()
+}
+
+func formatAccessJson(e *AccessEntry) []byte {
+	b, _ := json.Marshal(&accessJson{
+		Time:       e.Time.Format(time.RFC3339),
+		ClientIp:   e.ClientIp,
+		Method:     e.Method,
+		Host:       e.Host,
+		Path:       e.Path,
+		Proto:      e.Proto,
+		Status:     e.Status,
+		Bytes:      e.Bytes,
+		Referer:    e.Referer,
+		UserAgent:  e.UserAgent,
+		Upstream:   e.Upstream,
+		LatencyMs:  float64(e.Latency.Microseconds()) / 1000,
+		Mode:       e.Mode,
+		Event:      e.Event,
+		BytesIn:    e.BytesIn,
+		BytesOut:   e.BytesOut,
+		DurationMs: float64(e.Duration.Microseconds()) / 1000,
+		Country:    e.Country,
+	})
+	return b
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// formatAccessCombined 输出 Apache combined 格式，并在末尾追加上游地址和耗时
+func formatAccessCombined(e *AccessEntry) string {
+	var b strings.Builder
+	b.WriteString(orDash(e.ClientIp))
+	b.WriteString(" - - [")
+	b.WriteString(e.Time.Format("02/Jan/2006:15:04:05 -0700"))
+	b.WriteString("] \"")
+	if e.Event != "" {
+		// tcp/udp 会话: "CLOSE tcp :8080"
+		b.WriteString(strings.ToUpper(e.Event) + " " + e.Mode + " " + orDash(e.Host))
+		b.WriteString("\" - ")
+		b.WriteString(strconv.FormatInt(e.BytesIn+e.BytesOut, 10))
+		b.WriteString(" \"-\" \"-\" ")
+		b.WriteString(orDash(e.Upstream))
+		b.WriteString(" " + strconv.FormatFloat(float64(e.Duration.Microseconds())/1000, 'f', 3, 64) + "ms")
+		b.WriteString(" in=" + strconv.FormatInt(e.BytesIn, 10) + " out=" + strconv.FormatInt(e.BytesOut, 10))
+	} else {
+		b.WriteString(e.Method + " " + e.Path + " " + e.Proto)
+		b.WriteString("\" ")
+		b.WriteString(strconv.Itoa(e.Status))
+		b.WriteString(" ")
+		b.WriteString(strconv.FormatInt(e.Bytes, 10))
+		b.WriteString(" " + strconv.Quote(orDash(e.Referer)))
+		b.WriteString(" " + strconv.Quote(orDash(e.UserAgent)))
+		b.WriteString(" " + orDash(e.Upstream))
+		b.WriteString(" " + strconv.FormatFloat(float64(e.Latency.Microseconds())/1000, 'f', 3, 64) + "ms")
+		b.WriteString(" " + orDash(e.Host))
+	}
+	if e.Country != "" {
+		b.WriteString(" country=" + e.Country)
+	}
+	return b.String()
+}
@@ -0,0 +1,104 @@
+// Package metrics 以 Prometheus 文本格式导出服务端运行指标
+package metrics
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/djylb/nps/lib/logs"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// 握手失败原因
+const (
+	ReasonVersion   = "version"
+	ReasonVkey      = "vkey"
+	ReasonTimestamp = "timestamp"
+	ReasonHmac      = "hmac"
+)
+
+var (
+	// Registry 所有指标的注册表，包含 Go 运行时和进程指标
+	Registry = prometheus.NewRegistry()
+	enabled  bool
+
+	handshakeFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "nps_bridge_handshake_failures_total",
+		Help: "Client handshakes rejected by the bridge.",
+	}, []string{"reason"})
+	httpResponses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "nps_http_responses_total",
+		Help: "HTTP responses returned by host proxies, by status code.",
+	}, []string{"host_id", "host", "code"})
+)
+
+func init() {
+	Registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		handshakeFailures, httpResponses)
+	for _, r := range []string{ReasonVersion, ReasonVkey, ReasonTimestamp, ReasonHmac} {
+		handshakeFailures.WithLabelValues(r)
+	}
+}
+
+// Enable 开启指标采集，未开启时不统计 HTTP 状态码
+func Enable() {
+	enabled = true
+}
+
+// Enabled 是否开启了指标采集
+func Enabled() bool {
+	return enabled
+}
+
+// Register 注册自定义采集器
+func Register(c prometheus.Collector) {
+	if err := Registry.Register(c); err != nil {
+		logs.Error("register metrics collector error: %v", err)
+	}
+}
+
+// HandshakeFailed 记录一次客户端握手失败
+func HandshakeFailed(reason string) {
+	handshakeFailures.WithLabelValues(reason).Inc()
+}
+
+// HttpResponse 记录域名代理返回的状态码
+func HttpResponse(hostId int, host string, code int) {
+	if !enabled {
+		return
+	}
+	httpResponses.WithLabelValues(strconv.Itoa(hostId), host, strconv.Itoa(code)).Inc()
+}
+
+// Handler 返回 /metrics 处理器，token 不为空时要求 Authorization: Bearer <token> 或 ?token=<token>
+func Handler(token string) http.Handler {
+	h := promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" {
+			got := r.URL.Query().Get("token")
+			if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+				got = strings.TrimPrefix(auth, "Bearer ")
+			}
+			if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="nps metrics"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// ListenAndServe 在单独的地址上提供 /metrics
+func ListenAndServe(addr, token string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler(token))
+	logs.Info("metrics listen on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logs.Error("metrics listen error: %v", err)
+	}
+}
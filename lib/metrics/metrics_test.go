@@ -0,0 +1,34 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	HandshakeFailed(ReasonVkey)
+	h := Handler("secret")
+	for _, c := range []struct {
+		url, auth string
+		code      int
+	}{
+		{"/metrics", "", 401},
+		{"/metrics?token=bad", "", 401},
+		{"/metrics?token=secret", "", 200},
+		{"/metrics", "Bearer secret", 200},
+	} {
+		r := httptest.NewRequest("GET", c.url, nil)
+		if c.auth != "" {
+			r.Header.Set("Authorization", c.auth)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != c.code {
+			t.Fatalf("%s %s: got %d, want %d", c.url, c.auth, w.Code, c.code)
+		}
+		if c.code == 200 && !strings.Contains(w.Body.String(), `nps_bridge_handshake_failures_total{reason="vkey"} 1`) {
+			t.Fatalf("missing handshake counter:\n%s", w.Body.String())
+		}
+	}
+}
@@ -123,6 +123,19 @@ func (s *Mux) Addr() net.Addr {
 	return s.conn.LocalAddr()
 }
 
+// Latency returns the smoothed ping latency in seconds
+func (s *Mux) Latency() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&s.latency))
+}
+
+// Bandwidth returns the estimated read bandwidth in bytes per second
+func (s *Mux) Bandwidth() float64 {
+	if s.bw == nil {
+		return 0
+	}
+	return s.bw.Get()
+}
+
 func (s *Mux) sendInfo(flag uint8, id int32, data interface{}) {
 	if s.IsClose {
 		return
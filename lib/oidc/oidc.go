@@ -0,0 +1,361 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	providers   = make(map[string]*Provider)
+	providersMu sync.Mutex
+	// HttpClient 访问 OIDC 服务使用的客户端
+	HttpClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+// Provider OpenID Connect 服务的发现信息和签名公钥
+type Provider struct {
+	Issuer      string   `json:"issuer"`
+	AuthURL     string   `json:"authorization_endpoint"`
+	TokenURL    string   `json:"token_endpoint"`
+	JwksURL     string   `json:"jwks_uri"`
+	AuthMethods []string `json:"token_endpoint_auth_methods_supported"`
+
+	mu      sync.RWMutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+	expire  time.Time
+}
+
+// Claims ID Token 中使用的声明
+type Claims struct {
+	Issuer            string          `json:"iss"`
+	Subject           string          `json:"sub"`
+	Audience          audience        `json:"aud"`
+	Expiry            int64           `json:"exp"`
+	IssuedAt          int64           `json:"iat"`
+	Nonce             string          `json:"nonce"`
+	Email             string          `json:"email"`
+	EmailVerified     *bool           `json:"email_verified"`
+	Name              string          `json:"name"`
+	PreferredUsername string          `json:"preferred_username"`
+	Groups            stringOrStrings `json:"groups"`
+}
+
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	return (*stringOrStrings)(a).UnmarshalJSON(b)
+}
+
+type stringOrStrings []string
+
+func (s *stringOrStrings) UnmarshalJSON(b []byte) error {
+	var one string
+	if err := json.Unmarshal(b, &one); err == nil {
+		*s = []string{one}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	*s = list
+	return nil
+}
+
+// GetProvider 返回 issuer 的发现信息，结果缓存一小时
+func GetProvider(ctx context.Context, issuer string) (*Provider, error) {
+	issuer = strings.TrimSuffix(issuer, "/")
+	providersMu.Lock()
+	p, ok := providers[issuer]
+	providersMu.Unlock()
+	if ok && time.Now().Before(p.expire) {
+		return p, nil
+	}
+	p = new(Provider)
+	if err := getJson(ctx, issuer+"/.well-known/openid-configuration", p); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(p.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("oidc: issuer %q does not match %q", p.Issuer, issuer)
+	}
+	if p.AuthURL == "" || p.TokenURL == "" || p.JwksURL == "" {
+		return nil, errors.New("oidc: incomplete provider configuration")
+	}
+	p.expire = time.Now().Add(time.Hour)
+	providersMu.Lock()
+	providers[issuer] = p
+	providersMu.Unlock()
+	return p, nil
+}
+
+// AuthCodeURL 返回跳转到登录页的地址
+func (p *Provider) AuthCodeURL(clientId, redirectURI, scopes, state, nonce string) string {
+	if scopes == "" {
+		scopes = "openid email profile"
+	}
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", clientId)
+	v.Set("redirect_uri", redirectURI)
+	v.Set("scope", scopes)
+	v.Set("state", state)
+	v.Set("nonce", nonce)
+	sep := "?"
+	if strings.Contains(p.AuthURL, "?") {
+		sep = "&"
+	}
+	return p.AuthURL + sep + v.Encode()
+}
+
+// Exchange 用授权码换取 ID Token
+func (p *Provider) Exchange(ctx context.Context, clientId, clientSecret, code, redirectURI string) (string, error) {
+	v := url.Values{}
+	v.Set("grant_type", "authorization_code")
+	v.Set("code", code)
+	v.Set("redirect_uri", redirectURI)
+	post := len(p.AuthMethods) > 0 && !contains(p.AuthMethods, "client_secret_basic") && contains(p.AuthMethods, "client_secret_post")
+	if post {
+		v.Set("client_id", clientId)
+		v.Set("client_secret", clientSecret)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.TokenURL, strings.NewReader(v.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if !post {
+		req.SetBasicAuth(url.QueryEscape(clientId), url.QueryEscape(clientSecret))
+	}
+	resp, err := HttpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var token struct {
+		IdToken string `json:"id_token"`
+		Error   string `json:"error"`
+		Desc    string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("oidc: token response status %d: %v", resp.StatusCode, err)
+	}
+	if token.Error != "" {
+		return "", fmt.Errorf("oidc: %s %s", token.Error, token.Desc)
+	}
+	if token.IdToken == "" {
+		return "", errors.New("oidc: no id_token in token response")
+	}
+	return token.IdToken, nil
+}
+
+// Verify 校验 ID Token 的签名、签发者、受众、有效期和 nonce
+func (p *Provider) Verify(ctx context.Context, rawToken, clientId, nonce string) (*Claims, error) {
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("oidc: malformed id_token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("oidc: malformed signature")
+	}
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+	c := new(Claims)
+	if err := decodeSegment(parts[1], c); err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	switch {
+	case strings.TrimSuffix(c.Issuer, "/") != strings.TrimSuffix(p.Issuer, "/"):
+		return nil, errors.New("oidc: unexpected issuer")
+	case !contains(c.Audience, clientId):
+		return nil, errors.New("oidc: unexpected audience")
+	case c.Expiry < now-60:
+		return nil, errors.New("oidc: id_token expired")
+	case c.IssuedAt > now+60:
+		return nil, errors.New("oidc: id_token issued in the future")
+	case nonce != "" && c.Nonce != nonce:
+		return nil, errors.New("oidc: nonce mismatch")
+	}
+	return c, nil
+}
+
+// key 返回签名公钥，遇到未知的 kid 时重新获取 JWKS（最多每分钟一次）
+func (p *Provider) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	p.mu.RLock()
+	k, ok := p.lookup(kid)
+	stale := time.Since(p.fetched) > time.Minute
+	p.mu.RUnlock()
+	if ok {
+		return k, nil
+	}
+	if !stale {
+		return nil, errors.New("oidc: unknown signing key")
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := getJson(ctx, p.JwksURL, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, v := range set.Keys {
+		if v.Use != "" && v.Use != "sig" {
+			continue
+		}
+		if pub, err := v.publicKey(); err == nil {
+			keys[v.Kid] = pub
+		}
+	}
+	p.mu.Lock()
+	p.keys, p.fetched = keys, time.Now()
+	k, ok = p.lookup(kid)
+	p.mu.Unlock()
+	if !ok {
+		return nil, errors.New("oidc: unknown signing key")
+	}
+	return k, nil
+}
+
+func (p *Provider) lookup(kid string) (crypto.PublicKey, bool) {
+	if k, ok := p.keys[kid]; ok {
+		return k, true
+	}
+	// 没有 kid 且只有一个公钥时直接使用
+	if kid == "" && len(p.keys) == 1 {
+		for _, k := range p.keys {
+			return k, true
+		}
+	}
+	return nil, false
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+		e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+		if err1 != nil || err2 != nil || len(e) > 4 {
+			return nil, errors.New("oidc: invalid rsa key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, errors.New("oidc: unsupported curve")
+		}
+		x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+		y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+		if err1 != nil || err2 != nil {
+			return nil, errors.New("oidc: invalid ec key")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, errors.New("oidc: unsupported key type")
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signed string, sig []byte) error {
+	var h crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		h = crypto.SHA256
+	case "RS384", "ES384":
+		h = crypto.SHA384
+	case "RS512":
+		h = crypto.SHA512
+	default:
+		return errors.New("oidc: unsupported algorithm " + alg)
+	}
+	hasher := h.New()
+	hasher.Write([]byte(signed))
+	digest := hasher.Sum(nil)
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if alg[0] == 'R' && rsa.VerifyPKCS1v15(k, h, digest, sig) == nil {
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if alg[0] == 'E' && len(sig) == 2*size &&
+			ecdsa.Verify(k, digest, new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])) {
+			return nil
+		}
+	}
+	return errors.New("oidc: invalid signature")
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return errors.New("oidc: malformed id_token")
+	}
+	return json.Unmarshal(b, v)
+}
+
+func getJson(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := HttpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: get %s status %d", u, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
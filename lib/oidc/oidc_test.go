@@ -0,0 +1,146 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mockIssuer 本地模拟的 OIDC 服务，授权码即为要签发的 nonce
+type mockIssuer struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	claims map[string]interface{}
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockIssuer{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.URL,
+			"authorization_endpoint": m.URL + "/auth",
+			"token_endpoint":         m.URL + "/token",
+			"jwks_uri":               m.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "k1", "use": "sig",
+			"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if u, p, ok := r.BasicAuth(); !ok || u != "client" || p != "secret" {
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": m.sign(r.FormValue("code"))})
+	})
+	m.Server = httptest.NewServer(mux)
+	return m
+}
+
+func (m *mockIssuer) sign(nonce string) string {
+	claims := map[string]interface{}{
+		"iss": m.URL, "sub": "u1", "aud": "client", "nonce": nonce,
+		"iat": time.Now().Unix(), "exp": time.Now().Add(time.Hour).Unix(),
+		"email": "alice@example.com", "email_verified": true, "groups": []string{"dev"},
+	}
+	for k, v := range m.claims {
+		claims[k] = v
+	}
+	h, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "k1"})
+	c, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	digest := sha256.Sum256([]byte(signed))
+	sig, _ := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, digest[:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestLoginFlow(t *testing.T) {
+	m := newMockIssuer(t)
+	defer m.Close()
+	ctx := context.Background()
+	p, err := GetProvider(ctx, m.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := p.AuthCodeURL("client", "https://a.com/cb", "", "st", "n1"); !strings.HasPrefix(u, m.URL+"/auth?") || !strings.Contains(u, "nonce=n1") {
+		t.Fatalf("unexpected auth url %s", u)
+	}
+	raw, err := p.Exchange(ctx, "client", "secret", "n1", "https://a.com/cb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := p.Verify(ctx, raw, "client", "n1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Subject != "u1" || c.Email != "alice@example.com" || len(c.Groups) != 1 {
+		t.Fatalf("unexpected claims %+v", c)
+	}
+	if _, err := p.Verify(ctx, raw, "client", "other"); err == nil {
+		t.Error("nonce mismatch should fail")
+	}
+	if _, err := p.Verify(ctx, raw, "other-client", "n1"); err == nil {
+		t.Error("wrong audience should fail")
+	}
+	if _, err := p.Verify(ctx, raw[:len(raw)-4]+"AAAA", "client", "n1"); err == nil {
+		t.Error("tampered signature should fail")
+	}
+	if _, err := p.Exchange(ctx, "client", "bad", "n1", "https://a.com/cb"); err == nil {
+		t.Error("bad client secret should fail")
+	}
+	m.claims = map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()}
+	if _, err := p.Verify(ctx, m.sign("n1"), "client", "n1"); err == nil {
+		t.Error("expired token should fail")
+	}
+}
+
+func TestClaimsAllowed(t *testing.T) {
+	verified, unverified := true, false
+	c := &Claims{Email: "bob@Example.com", EmailVerified: &verified, Groups: []string{"ops"}}
+	if !c.Allowed([]string{"example.com"}, nil) || c.Allowed([]string{"other.com"}, nil) {
+		t.Error("email domain check failed")
+	}
+	if !c.Allowed(nil, []string{"dev", "ops"}) || c.Allowed(nil, []string{"dev"}) {
+		t.Error("group check failed")
+	}
+	c.EmailVerified = &unverified
+	if c.Allowed([]string{"example.com"}, nil) {
+		t.Error("unverified email should not be allowed")
+	}
+}
+
+func TestSession(t *testing.T) {
+	secret := []byte("secret")
+	s := &Session{HostId: 1, Subject: "u1", Expiry: time.Now().Add(time.Minute).Unix()}
+	v := s.Sign(secret)
+	got, err := ParseSession(secret, v)
+	if err != nil || got.Subject != "u1" || got.HostId != 1 {
+		t.Fatalf("parse session: %v %+v", err, got)
+	}
+	if _, err := ParseSession([]byte("other"), v); err == nil {
+		t.Error("wrong secret should fail")
+	}
+	s.Expiry = time.Now().Add(-time.Minute).Unix()
+	if _, err := ParseSession(secret, s.Sign(secret)); err == nil {
+		t.Error("expired session should fail")
+	}
+}
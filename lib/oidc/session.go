@@ -0,0 +1,90 @@
+package oidc
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Session 登录成功后保存在 Cookie 中的身份信息
+type Session struct {
+	HostId   int      `json:"h"`
+	Subject  string   `json:"s"`
+	Email    string   `json:"e,omitempty"`
+	Name     string   `json:"n,omitempty"`
+	Groups   []string `json:"g,omitempty"`
+	Expiry   int64    `json:"x"`
+	State    string   `json:"st,omitempty"` //login state, only in the state cookie
+	Nonce    string   `json:"no,omitempty"`
+	Redirect string   `json:"r,omitempty"`
+}
+
+// Sign 返回以 HMAC-SHA256 签名的 Cookie 值
+func (s *Session) Sign(secret []byte) string {
+	b, _ := json.Marshal(s)
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac(secret, payload))
+}
+
+// ParseSession 校验签名和有效期并解析 Cookie 值
+func ParseSession(secret []byte, v string) (*Session, error) {
+	payload, sig, ok := strings.Cut(v, ".")
+	if !ok {
+		return nil, errors.New("oidc: malformed session")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(b, mac(secret, payload)) {
+		return nil, errors.New("oidc: invalid session signature")
+	}
+	if b, err = base64.RawURLEncoding.DecodeString(payload); err != nil {
+		return nil, errors.New("oidc: malformed session")
+	}
+	s := new(Session)
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, err
+	}
+	if time.Now().Unix() > s.Expiry {
+		return nil, errors.New("oidc: session expired")
+	}
+	return s, nil
+}
+
+// Allowed 按邮箱域名和用户组判断是否允许访问，列表为空时不限制
+func (c *Claims) Allowed(domains, groups []string) bool {
+	if len(domains) > 0 {
+		if c.Email == "" || (c.EmailVerified != nil && !*c.EmailVerified) {
+			return false
+		}
+		domain := strings.ToLower(c.Email[strings.LastIndex(c.Email, "@")+1:])
+		if !contains(domains, domain) {
+			return false
+		}
+	}
+	if len(groups) > 0 {
+		for _, g := range c.Groups {
+			if contains(groups, g) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// RandomString 返回 URL 安全的随机字符串
+func RandomString(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func mac(secret []byte, payload string) []byte {
+	m := hmac.New(sha256.New, secret)
+	m.Write([]byte(payload))
+	return m.Sum(nil)
+}
@@ -0,0 +1,96 @@
+package rate
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter 按 key（访问者 IP、请求头或用户名）分别计数的令牌桶，
+// 用于限制每个访问者的请求数或新建连接数（次/秒）
+type Limiter struct {
+	rate    float64
+	burst   float64
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	lastGc  time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+const limiterGcInterval = time.Minute
+
+// NewLimiter 创建限速器，r 为每秒补充的令牌数，burst 为桶容量（<=0 时与 r 相同）
+func NewLimiter(r, burst int) *Limiter {
+	if burst <= 0 {
+		burst = r
+	}
+	return &Limiter{
+		rate:    float64(r),
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+		lastGc:  time.Now(),
+	}
+}
+
+// Match reports whether the limiter was created with the given settings.
+func (l *Limiter) Match(r, burst int) bool {
+	if burst <= 0 {
+		burst = r
+	}
+	return l.rate == float64(r) && l.burst == float64(burst)
+}
+
+// Allow 消耗 key 对应桶中的一个令牌，桶空时返回 false
+func (l *Limiter) Allow(key string) bool {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastGc) > limiterGcInterval {
+		l.gc(now)
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * l.rate
+		if b.tokens > l.burst {
+			b.tokens = l.burst
+		}
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Denied 判断 key 对应的桶是否已空，不消耗令牌
+func (l *Limiter) Denied(key string) bool {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[key]
+	return ok && b.tokens+now.Sub(b.last).Seconds()*l.rate < 1
+}
+
+// Len returns the number of tracked keys.
+func (l *Limiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buckets)
+}
+
+// 清理已经回满的桶，避免访问者过多时占用内存
+func (l *Limiter) gc(now time.Time) {
+	for k, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, k)
+		}
+	}
+	l.lastGc = now
+}
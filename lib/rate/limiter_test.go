@@ -0,0 +1,84 @@
+package rate
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiterBurst(t *testing.T) {
+	l := NewLimiter(1, 3)
+	for i := 0; i < 3; i++ {
+		if !l.Allow("a") {
+			t.Fatalf("request %d within the burst was denied", i)
+		}
+	}
+	if l.Allow("a") {
+		t.Error("request over the burst was allowed")
+	}
+	if !l.Allow("b") {
+		t.Error("another key should have its own bucket")
+	}
+	if l.Len() != 2 {
+		t.Errorf("len %d, want 2", l.Len())
+	}
+}
+
+func TestLimiterRefill(t *testing.T) {
+	l := NewLimiter(10, 1)
+	if !l.Allow("a") || l.Allow("a") {
+		t.Fatal("a burst of one should allow exactly one request")
+	}
+	l.buckets["a"].last = time.Now().Add(-150 * time.Millisecond)
+	if !l.Allow("a") {
+		t.Error("the bucket should refill over time")
+	}
+	l.buckets["a"].last = time.Now().Add(-time.Hour)
+	l.Allow("a")
+	if l.buckets["a"].tokens > l.burst {
+		t.Errorf("tokens %v exceed the burst %v", l.buckets["a"].tokens, l.burst)
+	}
+}
+
+func TestLimiterDefaultBurst(t *testing.T) {
+	l := NewLimiter(2, 0)
+	if !l.Match(2, 0) || !l.Match(2, 2) || l.Match(2, 3) || l.Match(3, 0) {
+		t.Error("unexpected Match result")
+	}
+	if !l.Allow("a") || !l.Allow("a") || l.Allow("a") {
+		t.Error("burst should default to the rate")
+	}
+}
+
+func TestLimiterGc(t *testing.T) {
+	l := NewLimiter(1, 1)
+	l.Allow("a")
+	l.Allow("b")
+	l.buckets["a"].last = time.Now().Add(-2 * time.Second)
+	l.lastGc = time.Now().Add(-2 * limiterGcInterval)
+	l.Allow("c")
+	if _, ok := l.buckets["a"]; ok {
+		t.Error("a refilled bucket should be removed")
+	}
+	if _, ok := l.buckets["b"]; !ok {
+		t.Error("a bucket that is still limited should be kept")
+	}
+}
+
+func TestLimiterDenied(t *testing.T) {
+	l := NewLimiter(1, 2)
+	if l.Denied("a") {
+		t.Error("an unknown key should not be denied")
+	}
+	l.Allow("a")
+	if l.Denied("a") {
+		t.Error("a bucket with tokens left should not be denied")
+	}
+	l.Allow("a")
+	if !l.Denied("a") || !l.Denied("a") {
+		t.Error("an empty bucket should be denied without taking tokens")
+	}
+	l.buckets["a"].last = time.Now().Add(-time.Second)
+	if l.Denied("a") {
+		t.Error("a refilled bucket should not be denied")
+	}
+}
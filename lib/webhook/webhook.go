@@ -0,0 +1,188 @@
+// Package webhook 把服务端事件以签名的 JSON 发送到配置的通知地址，失败时按指数退避重试
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/djylb/nps/lib/crypt"
+	"github.com/djylb/nps/lib/file"
+	"github.com/djylb/nps/lib/logs"
+	"github.com/djylb/nps/lib/version"
+)
+
+// 请求头
+const (
+	HeaderEvent     = "X-Nps-Event"
+	HeaderDelivery  = "X-Nps-Delivery"
+	HeaderSignature = "X-Nps-Signature" //sha256=<hex hmac of the body>
+)
+
+const (
+	logSize     = 200  //deliveries kept in the delivery log
+	maxInFlight = 1000 //deliveries waiting or retrying at the same time
+)
+
+var (
+	maxAttempts = 5
+	retryDelay  = time.Second //doubled after each failed attempt
+	client      = &http.Client{Timeout: 10 * time.Second}
+	inFlight    int32
+	lastId      int64
+	logLock     sync.Mutex
+	deliveries  []*Delivery
+)
+
+// Payload 请求体
+type Payload struct {
+	Id    string                 `json:"id"`
+	Event string                 `json:"event"`
+	Time  int64                  `json:"time"`
+	Data  map[string]interface{} `json:"data"`
+}
+
+// Delivery 一次发送记录，重试时原地更新
+type Delivery struct {
+	Id         int64  `json:"id"`
+	WebhookId  int    `json:"webhook_id"`
+	Url        string `json:"url"`
+	Event      string `json:"event"`
+	PayloadId  string `json:"payload_id"`
+	Time       int64  `json:"time"`
+	Attempts   int    `json:"attempts"`
+	StatusCode int    `json:"status_code"`
+	Error      string `json:"error,omitempty"`
+	Success    bool   `json:"success"`
+	Done       bool   `json:"done"` //false while waiting for a retry
+	Body       string `json:"body"`
+}
+
+// Init 设置每次通知的最多尝试次数和单次请求的超时时间
+func Init(attempts int, timeout time.Duration) {
+	if attempts > 0 {
+		maxAttempts = attempts
+	}
+	if timeout > 0 {
+		client.Timeout = timeout
+	}
+}
+
+// Sign 计算请求体的签名，接收方用同一个密钥计算后与 X-Nps-Signature 比较
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Emit 异步通知所有订阅了 event 的已启用地址
+func Emit(event string, data map[string]interface{}) {
+	p := newPayload(event, data)
+	for _, h := range file.GetDb().GetWebhookList() {
+		if !h.Status || !h.Subscribed(event) {
+			continue
+		}
+		if atomic.AddInt32(&inFlight, 1) > maxInFlight {
+			atomic.AddInt32(&inFlight, -1)
+			logs.Warn("too many pending webhook deliveries, drop event %s to %s", event, h.Url)
+			continue
+		}
+		go func(h *file.Webhook) {
+			defer atomic.AddInt32(&inFlight, -1)
+			deliver(h, p, maxAttempts)
+		}(h)
+	}
+}
+
+// Test 立即向 h 发送一次 ping 事件，不重试
+func Test(h *file.Webhook) *Delivery {
+	return deliver(h, newPayload(file.EventPing, map[string]interface{}{"webhook": h.Name}), 1)
+}
+
+func newPayload(event string, data map[string]interface{}) *Payload {
+	if data == nil {
+		data = make(map[string]interface{})
+	}
+	return &Payload{Id: crypt.GetRandomString(16), Event: event, Time: time.Now().Unix(), Data: data}
+}
+
+// deliver 发送 p 并记录到发送日志，网络错误、429 和 5xx 按指数退避重试
+func deliver(h *file.Webhook, p *Payload, attempts int) *Delivery {
+	body, _ := json.Marshal(p)
+	d := &Delivery{WebhookId: h.Id, Url: h.Url, Event: p.Event, PayloadId: p.Id, Time: p.Time, Body: string(body)}
+	record(d)
+	delay := retryDelay
+	for i := 1; i <= attempts; i++ {
+		code, err := post(h, p, body)
+		logLock.Lock()
+		d.Attempts, d.StatusCode, d.Error = i, code, ""
+		d.Success = err == nil && code >= 200 && code < 300
+		if err != nil {
+			d.Error = err.Error()
+		} else if !d.Success {
+			d.Error = "unexpected status " + http.StatusText(code)
+		}
+		retry := !d.Success && (err != nil || code == http.StatusTooManyRequests || code >= 500) && i < attempts
+		d.Done = !retry
+		logLock.Unlock()
+		if !retry {
+			break
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+	if !d.Success {
+		logs.Warn("webhook %s event %s delivery failed after %d attempts, status %d %s", h.Url, p.Event, d.Attempts, d.StatusCode, d.Error)
+	}
+	return d
+}
+
+func post(h *file.Webhook, p *Payload, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, h.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "nps-webhook/"+version.VERSION)
+	req.Header.Set(HeaderEvent, p.Event)
+	req.Header.Set(HeaderDelivery, p.Id)
+	req.Header.Set(HeaderSignature, Sign(h.Secret, body))
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+func record(d *Delivery) {
+	logLock.Lock()
+	defer logLock.Unlock()
+	lastId++
+	d.Id = lastId
+	deliveries = append(deliveries, d)
+	if len(deliveries) > logSize {
+		deliveries = append(deliveries[:0:0], deliveries[len(deliveries)-logSize:]...)
+	}
+}
+
+// Deliveries 返回最近的发送记录，新的在前；webhookId 不为 0 时只返回该地址的记录
+func Deliveries(webhookId int) []Delivery {
+	logLock.Lock()
+	defer logLock.Unlock()
+	list := make([]Delivery, 0)
+	for i := len(deliveries) - 1; i >= 0; i-- {
+		if webhookId == 0 || deliveries[i].WebhookId == webhookId {
+			list = append(list, *deliveries[i])
+		}
+	}
+	return list
+}
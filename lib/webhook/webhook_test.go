@@ -0,0 +1,51 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/djylb/nps/lib/file"
+)
+
+func TestDeliver(t *testing.T) {
+	retryDelay = 10 * time.Millisecond
+	var calls int32
+	var got Payload
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get(HeaderSignature) != Sign("key", body) {
+			t.Errorf("bad signature %s", r.Header.Get(HeaderSignature))
+		}
+		json.Unmarshal(body, &got)
+		if r.URL.Path == "/bad" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	h := &file.Webhook{Id: 1, Url: srv.URL, Secret: "key"}
+	d := deliver(h, newPayload(file.EventClientConnect, map[string]interface{}{"client_id": 1}), 5)
+	if !d.Success || d.Attempts != 3 || !d.Done {
+		t.Fatalf("delivery %+v", d)
+	}
+	if got.Event != file.EventClientConnect || got.Data["client_id"] != float64(1) {
+		t.Fatalf("payload %+v", got)
+	}
+
+	h = &file.Webhook{Id: 2, Url: srv.URL + "/bad", Secret: "key"}
+	if d = deliver(h, newPayload(file.EventPing, nil), 5); d.Success || d.Attempts != 1 || d.StatusCode != http.StatusBadRequest {
+		t.Fatalf("client error should not be retried %+v", d)
+	}
+	if list := Deliveries(2); len(list) != 1 || list[0].Id != d.Id {
+		t.Fatalf("deliveries %+v", list)
+	}
+}
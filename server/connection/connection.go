@@ -4,8 +4,10 @@ import (
 	"net"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/beego/beego"
+	"github.com/djylb/nps/lib/conn"
 	"github.com/djylb/nps/lib/logs"
 	"github.com/djylb/nps/lib/pmux"
 )
@@ -23,6 +25,10 @@ func InitConnectionService() {
 	httpsPort = beego.AppConfig.String("https_proxy_port")
 	httpPort = beego.AppConfig.String("http_proxy_port")
 	webPort = beego.AppConfig.String("web_port")
+	conn.SetProxyProtocolTrusted(strings.Split(beego.AppConfig.String("proxy_protocol_trusted_ips"), ","))
+	if (beego.AppConfig.DefaultBool("http_proxy_protocol", false) || beego.AppConfig.DefaultBool("bridge_proxy_protocol", false)) && !conn.ProxyProtocolTrustedSet() {
+		logs.Warn("proxy protocol is disabled because proxy_protocol_trusted_ips is empty")
+	}
 
 	if httpPort == bridgePort || httpsPort == bridgePort || webPort == bridgePort || bridgeTlsPort == bridgePort {
 		port, err := strconv.Atoi(bridgePort)
@@ -31,6 +37,9 @@ func InitConnectionService() {
 			os.Exit(0)
 		}
 		pMux = pmux.NewPortMux(port, beego.AppConfig.String("web_host"), beego.AppConfig.String("tls_bridge_host"))
+		if beego.AppConfig.DefaultBool("http_proxy_protocol", false) || beego.AppConfig.DefaultBool("bridge_proxy_protocol", false) {
+			logs.Warn("proxy protocol is not supported on ports shared with the bridge")
+		}
 	}
 }
 
@@ -44,7 +53,7 @@ func GetBridgeTcpListener() (net.Listener, error) {
 	if pMux != nil {
 		return pMux.GetClientListener(), nil
 	}
-	return net.ListenTCP("tcp", &net.TCPAddr{net.ParseIP(beego.AppConfig.String("bridge_ip")), p, ""})
+	return bridgeListener(net.ListenTCP("tcp", &net.TCPAddr{net.ParseIP(beego.AppConfig.String("bridge_ip")), p, ""}))
 }
 
 func GetBridgeTlsListener() (net.Listener, error) {
@@ -57,7 +66,7 @@ func GetBridgeTlsListener() (net.Listener, error) {
 	if pMux != nil && bridgeTlsPort == bridgePort {
 		return pMux.GetClientTlsListener(), nil
 	}
-	return net.ListenTCP("tcp", &net.TCPAddr{net.ParseIP(beego.AppConfig.String("bridge_ip")), p, ""})
+	return bridgeListener(net.ListenTCP("tcp", &net.TCPAddr{net.ParseIP(beego.AppConfig.String("bridge_ip")), p, ""}))
 }
 
 func GetHttpListener() (net.Listener, error) {
@@ -66,7 +75,7 @@ func GetHttpListener() (net.Listener, error) {
 		return pMux.GetHttpListener(), nil
 	}
 	logs.Info("start http listener, port is %s", httpPort)
-	return getTcpListener(beego.AppConfig.String("http_proxy_ip"), httpPort)
+	return proxyListener(getTcpListener(beego.AppConfig.String("http_proxy_ip"), httpPort))
 }
 
 func GetHttpsListener() (net.Listener, error) {
@@ -75,7 +84,7 @@ func GetHttpsListener() (net.Listener, error) {
 		return pMux.GetHttpsListener(), nil
 	}
 	logs.Info("start https listener, port is %s", httpsPort)
-	return getTcpListener(beego.AppConfig.String("http_proxy_ip"), httpsPort)
+	return proxyListener(getTcpListener(beego.AppConfig.String("http_proxy_ip"), httpsPort))
 }
 
 func GetWebManagerListener() (net.Listener, error) {
@@ -98,3 +107,22 @@ func getTcpListener(ip, p string) (net.Listener, error) {
 	}
 	return net.ListenTCP("tcp", &net.TCPAddr{net.ParseIP(ip), port, ""})
 }
+
+// proxyListener 开启 http_proxy_protocol 时解析域名代理端口上的入站 PROXY 协议头
+func proxyListener(l net.Listener, err error) (net.Listener, error) {
+	if err != nil || !beego.AppConfig.DefaultBool("http_proxy_protocol", false) || !conn.ProxyProtocolTrustedSet() {
+		return l, err
+	}
+	return conn.NewProxyProtoListener(l), nil
+}
+
+// bridgeListener 开启 bridge_proxy_protocol 时解析客户端连接端口上的入站 PROXY 协议头
+func bridgeListener(l *net.TCPListener, err error) (net.Listener, error) {
+	if err != nil {
+		return nil, err
+	}
+	if !beego.AppConfig.DefaultBool("bridge_proxy_protocol", false) || !conn.ProxyProtocolTrustedSet() {
+		return l, nil
+	}
+	return conn.NewProxyProtoListener(l), nil
+}
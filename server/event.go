@@ -0,0 +1,146 @@
+package server
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/beego/beego"
+	"github.com/djylb/nps/lib/common"
+	"github.com/djylb/nps/lib/file"
+	"github.com/djylb/nps/lib/webhook"
+)
+
+// notified 已经通知过的流量、时间限制和证书，状态恢复后删除，避免重复通知
+var notified sync.Map
+
+// taskStartFailed 通知隧道启动失败
+func taskStartFailed(t *file.Tunnel, err error) {
+	data := map[string]interface{}{"tunnel_id": t.Id, "remark": t.Remark, "mode": t.Mode, "port": t.Port, "error": err.Error()}
+	if t.Client != nil {
+		data["client_id"] = t.Client.Id
+	}
+	webhook.Emit(file.EventTunnelStartFail, data)
+}
+
+// checkLimits 检查客户端、隧道和域名是否超出流量或时间限制，每次超出只通知一次
+func checkLimits() {
+	now := time.Now()
+	file.GetDb().JsonDb.Clients.Range(func(key, value interface{}) bool {
+		v := value.(*file.Client)
+		if v.Flow != nil && v.Flow.FlowLimit == 0 {
+			//check the limit inherited from the group
+			checkFlowLimit("client", v.Id, v.Remark, v.Id, &file.Flow{FlowLimit: v.Policy().FlowLimit, ExportFlow: v.Flow.ExportFlow, InletFlow: v.Flow.InletFlow, TimeLimit: v.Flow.TimeLimit}, now)
+		} else {
+			checkFlowLimit("client", v.Id, v.Remark, v.Id, v.Flow, now)
+		}
+		return true
+	})
+	file.GetDb().JsonDb.Tasks.Range(func(key, value interface{}) bool {
+		v := value.(*file.Tunnel)
+		if v.Client != nil {
+			checkFlowLimit("tunnel", v.Id, v.Remark, v.Client.Id, v.Flow, now)
+		}
+		return true
+	})
+	file.GetDb().JsonDb.Hosts.Range(func(key, value interface{}) bool {
+		v := value.(*file.Host)
+		if v.Client != nil {
+			checkFlowLimit("host", v.Id, v.Host, v.Client.Id, v.Flow, now)
+		}
+		return true
+	})
+}
+
+func checkFlowLimit(object string, id int, name string, clientId int, f *file.Flow, now time.Time) {
+	if f == nil {
+		return
+	}
+	data := map[string]interface{}{"object": object, "id": id, "name": name, "client_id": clientId}
+	key := fmt.Sprintf("flow:%s:%d", object, id)
+	if f.FlowLimit > 0 && (f.FlowLimit<<20) < (f.ExportFlow+f.InletFlow) {
+		if _, ok := notified.LoadOrStore(key, true); !ok {
+			data["flow_limit"], data["flow"] = f.FlowLimit<<20, f.ExportFlow+f.InletFlow
+			webhook.Emit(file.EventFlowLimit, data)
+		}
+	} else {
+		notified.Delete(key)
+	}
+	key = fmt.Sprintf("time:%s:%d", object, id)
+	if !f.TimeLimit.IsZero() && f.TimeLimit.Before(now) {
+		if _, ok := notified.LoadOrStore(key, true); !ok {
+			data["time_limit"] = f.TimeLimit.Format("2006-01-02 15:04:05")
+			webhook.Emit(file.EventTimeLimit, data)
+		}
+	} else {
+		notified.Delete(key)
+	}
+}
+
+// dealCertExpiry 每 12 小时检查一次域名证书、隧道 tls 卸载证书和默认证书的有效期
+func dealCertExpiry() {
+	days := beego.AppConfig.DefaultInt("webhook_cert_expire_days", 14)
+	if days <= 0 {
+		return
+	}
+	ticker := time.NewTicker(12 * time.Hour)
+	defer ticker.Stop()
+	for {
+		checkCertExpiry(time.Duration(days) * 24 * time.Hour)
+		<-ticker.C
+	}
+}
+
+// checkCertExpiry 通知在 within 内到期的证书，每个证书只通知一次
+func checkCertExpiry(within time.Duration) {
+	check := func(certFile, object string, id int, data map[string]interface{}) {
+		notAfter, ok := certNotAfter(certFile)
+		if !ok || time.Until(notAfter) > within {
+			return
+		}
+		key := fmt.Sprintf("cert:%s:%d:%d", object, id, notAfter.Unix())
+		if _, ok := notified.LoadOrStore(key, true); ok {
+			return
+		}
+		data["object"] = object
+		data["not_after"] = notAfter.Format(time.RFC3339)
+		data["days_left"] = int(time.Until(notAfter).Hours() / 24)
+		webhook.Emit(file.EventCertExpiring, data)
+	}
+	file.GetDb().JsonDb.Hosts.Range(func(key, value interface{}) bool {
+		v := value.(*file.Host)
+		if v.CertFilePath != "" && !v.HttpsJustProxy {
+			check(v.CertFilePath, "host", v.Id, map[string]interface{}{"host_id": v.Id, "host": v.Host})
+		}
+		return true
+	})
+	file.GetDb().JsonDb.Tasks.Range(func(key, value interface{}) bool {
+		v := value.(*file.Tunnel)
+		if v.TlsOffload && v.CertFilePath != "" {
+			check(v.CertFilePath, "tunnel", v.Id, map[string]interface{}{"tunnel_id": v.Id, "port": v.Port, "remark": v.Remark})
+		}
+		return true
+	})
+	if certFile := beego.AppConfig.String("https_default_cert_file"); certFile != "" {
+		check(certFile, "default", 0, map[string]interface{}{"host_id": 0, "host": "default"})
+	}
+}
+
+// certNotAfter 读取证书文件或证书内容中第一个证书的到期时间
+func certNotAfter(certFile string) (time.Time, bool) {
+	content, err := common.GetCertContent(certFile, "CERTIFICATE")
+	if err != nil || content == "" {
+		return time.Time{}, false
+	}
+	block, _ := pem.Decode([]byte(content))
+	if block == nil {
+		return time.Time{}, false
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return cert.NotAfter, true
+}
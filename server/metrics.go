@@ -0,0 +1,106 @@
+package server
+
+import (
+	"strconv"
+
+	"github.com/djylb/nps/bridge"
+	"github.com/djylb/nps/lib/file"
+	"github.com/djylb/nps/lib/metrics"
+	"github.com/djylb/nps/server/proxy"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	clientLabels = []string{"client_id", "remark"}
+	tunnelLabels = []string{"tunnel_id", "client_id", "mode", "port", "remark"}
+	hostLabels   = []string{"host_id", "client_id", "host", "location"}
+
+	clientIn        = prometheus.NewDesc("nps_client_inlet_bytes_total", "Bytes received from the client.", clientLabels, nil)
+	clientOut       = prometheus.NewDesc("nps_client_export_bytes_total", "Bytes sent to the client.", clientLabels, nil)
+	clientConns     = prometheus.NewDesc("nps_client_connections", "Active connections of the client.", clientLabels, nil)
+	clientOnline    = prometheus.NewDesc("nps_client_online", "Whether the client is connected to the bridge.", clientLabels, nil)
+	clientLatency   = prometheus.NewDesc("nps_client_mux_latency_seconds", "Ping latency of the client mux.", clientLabels, nil)
+	clientBandwidth = prometheus.NewDesc("nps_client_mux_bandwidth_bytes", "Estimated read bandwidth of the client mux in bytes per second.", clientLabels, nil)
+	tunnelIn        = prometheus.NewDesc("nps_tunnel_inlet_bytes_total", "Bytes received by the tunnel.", tunnelLabels, nil)
+	tunnelOut       = prometheus.NewDesc("nps_tunnel_export_bytes_total", "Bytes sent by the tunnel.", tunnelLabels, nil)
+	tunnelRunning   = prometheus.NewDesc("nps_tunnel_running", "Whether the tunnel is running.", tunnelLabels, nil)
+	tunnelConns     = prometheus.NewDesc("nps_tunnel_connections", "Active visitor connections of the tunnel.", tunnelLabels, nil)
+	hostIn          = prometheus.NewDesc("nps_host_inlet_bytes_total", "Bytes received by the host.", hostLabels, nil)
+	hostOut         = prometheus.NewDesc("nps_host_export_bytes_total", "Bytes sent by the host.", hostLabels, nil)
+	hostConns       = prometheus.NewDesc("nps_host_connections", "Active visitor connections of the host, http requests are counted while they are being served.", hostLabels, nil)
+)
+
+// collector 采集时从数据库和运行列表读取客户端、隧道和域名的当前状态
+type collector struct{}
+
+func init() {
+	metrics.Register(collector{})
+}
+
+func (collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{clientIn, clientOut, clientConns, clientOnline, clientLatency, clientBandwidth,
+		tunnelIn, tunnelOut, tunnelRunning, tunnelConns, hostIn, hostOut, hostConns} {
+		ch <- d
+	}
+}
+
+func (collector) Collect(ch chan<- prometheus.Metric) {
+	db := file.GetDb()
+	if db == nil || db.JsonDb == nil {
+		return
+	}
+	tunnelNum, hostNum := proxy.ConnCounts()
+	db.JsonDb.Clients.Range(func(key, value interface{}) bool {
+		v := value.(*file.Client)
+		if v.NoDisplay {
+			return true
+		}
+		l := []string{strconv.Itoa(v.Id), v.Remark}
+		if v.Flow != nil {
+			ch <- prometheus.MustNewConstMetric(clientIn, prometheus.CounterValue, float64(v.Flow.InletFlow), l...)
+			ch <- prometheus.MustNewConstMetric(clientOut, prometheus.CounterValue, float64(v.Flow.ExportFlow), l...)
+		}
+		ch <- prometheus.MustNewConstMetric(clientConns, prometheus.GaugeValue, float64(v.NowConn), l...)
+		online := 0.0
+		if Bridge != nil {
+			if c, ok := Bridge.Client.Load(v.Id); ok {
+				online = 1
+				if latency, bw, ok := c.(*bridge.Client).MuxStats(); ok {
+					ch <- prometheus.MustNewConstMetric(clientLatency, prometheus.GaugeValue, latency, l...)
+					ch <- prometheus.MustNewConstMetric(clientBandwidth, prometheus.GaugeValue, bw, l...)
+				}
+			}
+		}
+		ch <- prometheus.MustNewConstMetric(clientOnline, prometheus.GaugeValue, online, l...)
+		return true
+	})
+	db.JsonDb.Tasks.Range(func(key, value interface{}) bool {
+		v := value.(*file.Tunnel)
+		if v.Client == nil {
+			return true
+		}
+		l := []string{strconv.Itoa(v.Id), strconv.Itoa(v.Client.Id), v.Mode, strconv.Itoa(v.Port), v.Remark}
+		if v.Flow != nil {
+			ch <- prometheus.MustNewConstMetric(tunnelIn, prometheus.CounterValue, float64(v.Flow.InletFlow), l...)
+			ch <- prometheus.MustNewConstMetric(tunnelOut, prometheus.CounterValue, float64(v.Flow.ExportFlow), l...)
+		}
+		running := 0.0
+		if _, ok := RunList.Load(v.Id); ok {
+			running = 1
+		}
+		ch <- prometheus.MustNewConstMetric(tunnelRunning, prometheus.GaugeValue, running, l...)
+		ch <- prometheus.MustNewConstMetric(tunnelConns, prometheus.GaugeValue, float64(tunnelNum[v.Id]), l...)
+		return true
+	})
+	db.JsonDb.Hosts.Range(func(key, value interface{}) bool {
+		v := value.(*file.Host)
+		if v.Client == nil || v.Flow == nil {
+			return true
+		}
+		l := []string{strconv.Itoa(v.Id), strconv.Itoa(v.Client.Id), v.Host, v.Location}
+		ch <- prometheus.MustNewConstMetric(hostIn, prometheus.CounterValue, float64(v.Flow.InletFlow), l...)
+		ch <- prometheus.MustNewConstMetric(hostOut, prometheus.CounterValue, float64(v.Flow.ExportFlow), l...)
+		ch <- prometheus.MustNewConstMetric(hostConns, prometheus.GaugeValue, float64(hostNum[v.Id]), l...)
+		return true
+	})
+}
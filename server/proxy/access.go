@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/djylb/nps/lib/common"
+	"github.com/djylb/nps/lib/file"
+	"github.com/djylb/nps/lib/geoip"
+	"github.com/djylb/nps/lib/logs"
+)
+
+// countConn 统计访问者连接的收发字节数
+type countConn struct {
+	net.Conn
+	in  int64
+	out int64
+}
+
+func newCountConn(c net.Conn) *countConn {
+	return &countConn{Conn: c}
+}
+
+func (c *countConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.in, int64(n))
+	return n, err
+}
+
+func (c *countConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.out, int64(n))
+	return n, err
+}
+
+func (c *countConn) Bytes() (in, out int64) {
+	return atomic.LoadInt64(&c.in), atomic.LoadInt64(&c.out)
+}
+
+// accessRecorder 记录 http 响应状态码和字节数
+type accessRecorder struct {
+	http.ResponseWriter
+	status   int
+	bytes    int64
+	host     string
+	upstream string
+	hijacked atomic.Pointer[countConn]
+}
+
+func (w *accessRecorder) WriteHeader(code int) {
+	if w.status == 0 && code >= http.StatusOK {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	atomic.AddInt64(&w.bytes, int64(n))
+	return n, err
+}
+
+func (w *accessRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *accessRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijack not supported")
+	}
+	c, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	cc := newCountConn(c)
+	w.hijacked.Store(cc)
+	return cc, rw, nil
+}
+
+func (w *accessRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *accessRecorder) result(r *http.Request) (status int, bytes int64) {
+	status = w.status
+	_, bytes = w.counts()
+	if status == 0 {
+		if w.hijacked.Load() != nil && r.Header.Get("Upgrade") != "" {
+			status = http.StatusSwitchingProtocols
+		} else {
+			// 未返回任何响应直接断开
+			status = 444
+		}
+	}
+	return
+}
+
+// counts 返回升级后连接读取的字节数和已发送的字节数，可在转发过程中调用
+func (w *accessRecorder) counts() (in, out int64) {
+	out = atomic.LoadInt64(&w.bytes)
+	if cc := w.hijacked.Load(); cc != nil {
+		var o int64
+		in, o = cc.Bytes()
+		out += o
+	}
+	return
+}
+
+func writeHostAccess(host *file.Host, r *http.Request, w *accessRecorder, start time.Time) {
+	status, bytes := w.result(r)
+	logs.WriteAccess("host", host.Id, &logs.AccessEntry{
+		Time:      start,
+		ClientIp:  common.GetIpByAddr(r.RemoteAddr),
+		Method:    r.Method,
+		Host:      w.host,
+		Path:      r.RequestURI,
+		Proto:     r.Proto,
+		Status:    status,
+		Bytes:     bytes,
+		Referer:   r.Referer(),
+		UserAgent: r.UserAgent(),
+		Upstream:  w.upstream,
+		Latency:   time.Since(start),
+		Country:   visitorCountry(r.RemoteAddr),
+	})
+}
+
+// writeConnAccess 记录 tcp/udp 会话的建立与关闭
+func writeConnAccess(kind string, id int, mode, event, remote, listen, upstream string, in, out int64, start time.Time) {
+	e := &logs.AccessEntry{
+		ClientIp: common.GetIpByAddr(remote),
+		Host:     listen,
+		Mode:     mode,
+		Event:    event,
+		Upstream: upstream,
+		Country:  visitorCountry(remote),
+	}
+	if event == "close" {
+		e.BytesIn = in
+		e.BytesOut = out
+		e.Duration = time.Since(start)
+	}
+	logs.WriteAccess(kind, id, e)
+}
+
+// visitorCountry 查询访问者所属国家，未加载 GeoIP 数据库时返回空
+func visitorCountry(addr string) string {
+	if !geoip.Enabled() {
+		return ""
+	}
+	return geoip.Country(net.ParseIP(common.GetIpByAddr(addr)))
+}
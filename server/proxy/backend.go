@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/djylb/nps/lib/file"
+	"golang.org/x/net/http2"
+)
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// backendScheme 返回访问目标时使用的协议，h2 总是经过 TLS
+func backendScheme(host *file.Host) string {
+	if host.BackendProto == "h2" || (host.TargetIsHttps && host.BackendProto != "h2c") {
+		return "https"
+	}
+	return "http"
+}
+
+// newBackendTransport 按域名配置的后端协议创建 Transport：
+// http1 为默认的 HTTP/1.1，h2 经 TLS 协商 HTTP/2，h2c 为明文 HTTP/2（如 gRPC）
+func newBackendTransport(host *file.Host, serverName string, dial dialFunc) http.RoundTripper {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         serverName,
+	}
+	switch host.BackendProto {
+	case "h2c":
+		return &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dial(ctx, network, addr)
+			},
+			ReadIdleTimeout: 30 * time.Second,
+			IdleConnTimeout: httpPoolTimeout,
+		}
+	case "h2":
+		tlsConfig.NextProtos = []string{http2.NextProtoTLS}
+		return &http2.Transport{
+			DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+				c, err := dial(ctx, network, addr)
+				if err != nil {
+					return nil, err
+				}
+				tc := tls.Client(c, cfg)
+				if err := tc.HandshakeContext(ctx); err != nil {
+					c.Close()
+					return nil, err
+				}
+				return tc, nil
+			},
+			TLSClientConfig: tlsConfig,
+			ReadIdleTimeout: 30 * time.Second,
+			IdleConnTimeout: httpPoolTimeout,
+		}
+	}
+	return &http.Transport{
+		ResponseHeaderTimeout: 60 * time.Second,
+		TLSClientConfig:       tlsConfig,
+		DialContext:           dial,
+		MaxIdleConnsPerHost:   httpPoolMaxIdle,
+		IdleConnTimeout:       httpPoolTimeout,
+	}
+}
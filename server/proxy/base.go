@@ -4,7 +4,7 @@ import (
 	"errors"
 	"net"
 	"net/http"
-	"sort"
+	"strconv"
 	"sync"
 	"time"
 
@@ -12,7 +12,9 @@ import (
 	"github.com/djylb/nps/lib/common"
 	"github.com/djylb/nps/lib/conn"
 	"github.com/djylb/nps/lib/file"
+	"github.com/djylb/nps/lib/geoip"
 	"github.com/djylb/nps/lib/logs"
+	"github.com/djylb/nps/lib/rate"
 )
 
 type Service interface {
@@ -69,7 +71,10 @@ func (s *BaseServer) writeConnFail(c net.Conn) {
 
 // auth check
 func (s *BaseServer) auth(r *http.Request, c *conn.Conn, u, p string, multiAccount, userAuth *file.MultiAccount) error {
-	if !common.CheckAuth(r, u, p, file.GetAccountMap(multiAccount), file.GetAccountMap(userAuth)) {
+	required := u != "" || p != "" || len(file.GetAccountMap(multiAccount)) > 0 || len(file.GetAccountMap(userAuth)) > 0
+	if required && !checkAuthLimited(r.RemoteAddr, func() bool {
+		return common.CheckAuth(r, u, p, file.GetAccountMap(multiAccount), file.GetAccountMap(userAuth))
+	}) {
 		if c != nil {
 			c.Write([]byte(common.UnauthorizedBytes))
 			c.Close()
@@ -79,12 +84,28 @@ func (s *BaseServer) auth(r *http.Request, c *conn.Conn, u, p string, multiAccou
 	return nil
 }
 
+// authFailures 按访问者 IP 统计认证失败次数，每秒恢复一次，最多连续失败 10 次
+var authFailures = rate.NewLimiter(1, 10)
+
+// checkAuthLimited 校验访问者的账号密码，同一 IP 失败过多时直接拒绝，避免访问者利用 bcrypt/argon2id 消耗 CPU
+func checkAuthLimited(remoteAddr string, check func() bool) bool {
+	ip := common.GetIpByAddr(remoteAddr)
+	if authFailures.Denied(ip) {
+		return false
+	}
+	if check() {
+		return true
+	}
+	authFailures.Allow(ip)
+	return false
+}
+
 // check flow limit of the client ,and decrease the allow num of client
 func (s *BaseServer) CheckFlowAndConnNum(client *file.Client) error {
 	if !client.Flow.TimeLimit.IsZero() && client.Flow.TimeLimit.Before(time.Now()) {
 		return errors.New("Service access expired.")
 	}
-	if client.Flow.FlowLimit > 0 && (client.Flow.FlowLimit<<20) < (client.Flow.ExportFlow+client.Flow.InletFlow) {
+	if client.FlowLimitExceeded() {
 		return errors.New("Traffic limit exceeded.")
 	}
 	if !client.GetConn() {
@@ -93,30 +114,16 @@ func (s *BaseServer) CheckFlowAndConnNum(client *file.Client) error {
 	return nil
 }
 
-func in(target string, str_array []string) bool {
-	sort.Strings(str_array)
-	index := sort.SearchStrings(str_array, target)
-	if index < len(str_array) && str_array[index] == target {
-		return true
-	}
-	return false
-}
-
 // 处理客户端连接
 func (s *BaseServer) DealClient(c *conn.Conn, client *file.Client, addr string,
 	rb []byte, tp string, f func(), flows []*file.Flow, proxyProtocol int, localProxy bool, task *file.Tunnel) error {
 
-	// 判断访问地址是否在全局黑名单内
-	if IsGlobalBlackIp(c.RemoteAddr().String()) {
-		c.Close()
-		return nil
-	}
-
-	// 判断访问地址是否在黑名单内
-	if common.IsBlackIp(c.RemoteAddr().String(), client.VerifyKey, client.BlackIpList) {
+	// 判断访问地址是否在黑白名单允许范围内
+	if !IsIpAllowed(c.RemoteAddr().String(), client, task, nil) {
 		c.Close()
 		return nil
 	}
+	countVisit(c.RemoteAddr().String())
 
 	// 创建连接链接
 	link := conn.NewLink(tp, addr, client.Cnf.Crypt, client.Cnf.Compress, c.Conn.RemoteAddr().String(), s.allowLocalProxy && localProxy)
@@ -134,18 +141,34 @@ func (s *BaseServer) DealClient(c *conn.Conn, client *file.Client, addr string,
 		f()
 	}
 
+	// 连接列表和访问日志
+	visitor := c.Conn
+	if task != nil {
+		cc := newCountConn(c.Conn)
+		visitor = cc
+		defer trackTunnelConn(task, c.Conn.RemoteAddr().String(), addr, connBytes(cc, len(rb)), closeAll(c, target))()
+		if logs.AccessEnabled() {
+			start := time.Now()
+			listen := ":" + strconv.Itoa(task.Port)
+			writeConnAccess("tunnel", task.Id, task.Mode, "connect", c.Conn.RemoteAddr().String(), listen, addr, 0, 0, start)
+			defer func() {
+				in, out := cc.Bytes()
+				writeConnAccess("tunnel", task.Id, task.Mode, "close", c.Conn.RemoteAddr().String(), listen, addr, in+int64(len(rb)), out, start)
+			}()
+		}
+	}
+
 	// 开始数据转发
-	conn.CopyWaitGroup(target, c.Conn, link.Crypt, link.Compress, client.Rate, flows, true, proxyProtocol, rb, task)
+	conn.CopyWaitGroup(target, visitor, link.Crypt, link.Compress, client.Rate, flows, true, proxyProtocol, rb, task)
 	return nil
 }
 
 // 判断访问地址是否在全局黑名单内
 func IsGlobalBlackIp(ipPort string) bool {
-	// 判断访问地址是否在全局黑名单内
 	global := file.GetDb().GetGlobal()
 	if global != nil {
 		ip := common.GetIpByAddr(ipPort)
-		if in(ip, global.BlackIpList) {
+		if !global.AllowIp(net.ParseIP(ip)) {
 			logs.Error("IP address [%s] is in the global blacklist", ip)
 			return true
 		}
@@ -153,3 +176,33 @@ func IsGlobalBlackIp(ipPort string) bool {
 
 	return false
 }
+
+// IsIpAllowed 依次检查全局黑名单以及客户端、隧道、域名的 IP 与地区黑白名单，
+// task 和 host 可以为 nil
+func IsIpAllowed(ipPort string, client *file.Client, task *file.Tunnel, host *file.Host) bool {
+	if IsGlobalBlackIp(ipPort) {
+		return false
+	}
+	ipStr := common.GetIpByAddr(ipPort)
+	ip := net.ParseIP(ipStr)
+	if client != nil && !client.AllowIp(ip) {
+		logs.Warn("IP [%s] is not allowed by client [%s]", ipStr, client.VerifyKey)
+		return false
+	}
+	if task != nil && !task.AllowIp(ip) {
+		logs.Warn("IP [%s] is not allowed by task %d", ipStr, task.Id)
+		return false
+	}
+	if host != nil && !host.AllowIp(ip) {
+		logs.Warn("IP [%s] is not allowed by host %s", ipStr, host.Host)
+		return false
+	}
+	return true
+}
+
+// countVisit 按国家统计访问次数，显示在仪表盘中
+func countVisit(ipPort string) {
+	if geoip.Enabled() {
+		geoip.AddVisit(visitorCountry(ipPort))
+	}
+}
@@ -0,0 +1,366 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/beego/beego"
+	"github.com/djylb/nps/lib/cache"
+	"github.com/djylb/nps/lib/common"
+	"github.com/djylb/nps/lib/file"
+	"github.com/djylb/nps/lib/logs"
+)
+
+var (
+	httpCacheOnce      sync.Once
+	httpCache          cache.Store
+	httpCacheType      string
+	httpCacheMaxObject int64
+	httpCacheHits      int64
+	httpCacheMisses    int64
+	httpCacheRevalid   int64
+)
+
+// CacheStats 域名代理响应缓存统计
+type CacheStats struct {
+	Enabled     bool
+	Type        string
+	Entries     int
+	Size        int64
+	Hits        int64
+	Misses      int64
+	Revalidated int64
+}
+
+func initHttpCache() {
+	httpCacheOnce.Do(func() {
+		if !beego.AppConfig.DefaultBool("http_cache", false) {
+			return
+		}
+		length := beego.AppConfig.DefaultInt("http_cache_length", 100)
+		maxSize := int64(beego.AppConfig.DefaultInt("http_cache_max_size", 64)) << 20
+		httpCacheMaxObject = int64(beego.AppConfig.DefaultInt("http_cache_max_object", 1024)) << 10
+		httpCacheType = beego.AppConfig.DefaultString("http_cache_type", "memory")
+		if httpCacheType == "disk" {
+			dir := beego.AppConfig.DefaultString("http_cache_dir", "conf/cache")
+			if !filepath.IsAbs(dir) {
+				dir = filepath.Join(common.GetRunPath(), dir)
+			}
+			s, err := cache.NewDiskStore(dir, length, maxSize)
+			if err == nil {
+				httpCache = s
+				return
+			}
+			logs.Error("open http cache dir %s error %v, use memory cache instead", dir, err)
+			httpCacheType = "memory"
+		}
+		httpCache = cache.NewMemoryStore(length, maxSize)
+	})
+}
+
+// GetHttpCacheStats 返回响应缓存的统计
+func GetHttpCacheStats() CacheStats {
+	initHttpCache()
+	if httpCache == nil {
+		return CacheStats{}
+	}
+	return CacheStats{
+		Enabled:     true,
+		Type:        httpCacheType,
+		Entries:     httpCache.Len(),
+		Size:        httpCache.Size(),
+		Hits:        atomic.LoadInt64(&httpCacheHits),
+		Misses:      atomic.LoadInt64(&httpCacheMisses),
+		Revalidated: atomic.LoadInt64(&httpCacheRevalid),
+	}
+}
+
+// PurgeHttpCache 删除域名的缓存，path 不为空时只删除以其开头的路径，返回删除的条数
+func PurgeHttpCache(hostId int, path string) int {
+	initHttpCache()
+	if httpCache == nil {
+		return 0
+	}
+	return httpCache.Purge(strconv.Itoa(hostId) + "|" + path)
+}
+
+// cacheKey 以域名编号和路径开头，便于按域名或路径前缀清除
+func cacheKey(host *file.Host, r *http.Request) string {
+	return strconv.Itoa(host.Id) + "|" + r.URL.RequestURI() + "|" + r.Host
+}
+
+// hostCacheable 判断请求是否使用缓存：全局开启、域名开启，且路径符合包含和排除规则；
+// oidc 登录和转发认证按 Cookie 或注入的请求头区分用户，响应可能因人而异，这类域名不缓存
+func hostCacheable(host *file.Host, r *http.Request) bool {
+	initHttpCache()
+	if httpCache == nil || !host.CacheEnable || r.Method != http.MethodGet {
+		return false
+	}
+	if host.OidcIssuer != "" || host.AuthUrl != "" {
+		return false
+	}
+	if host.CacheInclude != "" && !matchCachePath(host.CacheInclude, r.URL.Path) {
+		return false
+	}
+	return host.CacheExclude == "" || !matchCachePath(host.CacheExclude, r.URL.Path)
+}
+
+// matchCachePath 规则按行或逗号分隔，*.ext 匹配扩展名，含 * 的规则按通配符匹配，其余按前缀匹配
+func matchCachePath(rules, p string) bool {
+	for _, rule := range strings.FieldsFunc(rules, func(r rune) bool {
+		return r == ',' || r == '\n' || r == '\r' || r == ' '
+	}) {
+		switch {
+		case strings.HasPrefix(rule, "*.") && !strings.Contains(rule[1:], "*"):
+			if strings.HasSuffix(p, rule[1:]) {
+				return true
+			}
+		case strings.Contains(rule, "*"):
+			if ok, _ := path.Match(rule, p); ok {
+				return true
+			}
+		case strings.HasPrefix(p, rule):
+			return true
+		}
+	}
+	return false
+}
+
+// cacheTransport 为单个请求查询和保存缓存，过期的响应带上 ETag 或 Last-Modified 向目标验证
+type cacheTransport struct {
+	next http.RoundTripper
+	key  string
+}
+
+func newCacheTransport(next http.RoundTripper, host *file.Host, r *http.Request) http.RoundTripper {
+	return &cacheTransport{next: next, key: cacheKey(host, r)}
+}
+
+func (t *cacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	now := time.Now()
+	reqCc := parseCacheControl(req.Header.Get("Cache-Control"))
+	_, noCache := reqCc["no-cache"]
+	noCache = noCache || req.Header.Get("Pragma") == "no-cache"
+	orig := req
+	var stale *cache.Entry
+	if e, ok := httpCache.Get(t.key); ok && !noCache && varyMatch(e, req) {
+		if e.Fresh(now) {
+			atomic.AddInt64(&httpCacheHits, 1)
+			return cachedResponse(e, req, "HIT"), nil
+		}
+		if req.Header.Get("If-None-Match") == "" && req.Header.Get("If-Modified-Since") == "" {
+			etag, lm := e.Header.Get("ETag"), e.Header.Get("Last-Modified")
+			if etag != "" || lm != "" {
+				stale = e
+				req = req.Clone(req.Context())
+				if etag != "" {
+					req.Header.Set("If-None-Match", etag)
+				}
+				if lm != "" {
+					req.Header.Set("If-Modified-Since", lm)
+				}
+			}
+		}
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if stale != nil && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		e := &cache.Entry{Key: stale.Key, StatusCode: stale.StatusCode, Header: stale.Header.Clone(), Body: stale.Body, VaryHeader: stale.VaryHeader, Stored: now}
+		for _, k := range []string{"Cache-Control", "Expires", "Date", "ETag", "Last-Modified"} {
+			if v := resp.Header.Get(k); v != "" {
+				e.Header.Set(k, v)
+			}
+		}
+		e.Expires, _ = cacheExpires(e.Header, now)
+		httpCache.Set(e)
+		atomic.AddInt64(&httpCacheRevalid, 1)
+		return cachedResponse(e, orig, "REVALIDATED"), nil
+	}
+	atomic.AddInt64(&httpCacheMisses, 1)
+	resp.Header.Set("X-Cache", "MISS")
+	if _, noStore := reqCc["no-store"]; noStore || !storableResponse(req, resp) {
+		return resp, nil
+	}
+	expires, ok := cacheExpires(resp.Header, now)
+	if !ok {
+		return resp, nil
+	}
+	e := &cache.Entry{Key: t.key, StatusCode: resp.StatusCode, Header: resp.Header.Clone(), Stored: now, Expires: expires}
+	e.Header.Del("X-Cache")
+	if vary := resp.Header.Get("Vary"); vary != "" {
+		e.VaryHeader = http.Header{}
+		for _, k := range strings.Split(vary, ",") {
+			k = strings.TrimSpace(k)
+			e.VaryHeader[http.CanonicalHeaderKey(k)] = req.Header.Values(k)
+		}
+	}
+	resp.Body = &cacheBody{ReadCloser: resp.Body, entry: e}
+	return resp, nil
+}
+
+// storableResponse 只缓存不带 Cookie 的 200 响应，携带认证信息的请求需要响应声明 public
+func storableResponse(req *http.Request, resp *http.Response) bool {
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Set-Cookie") != "" || strings.TrimSpace(resp.Header.Get("Vary")) == "*" {
+		return false
+	}
+	if resp.ContentLength > httpCacheMaxObject {
+		return false
+	}
+	cc := parseCacheControl(resp.Header.Get("Cache-Control"))
+	if _, ok := cc["no-store"]; ok {
+		return false
+	}
+	if _, ok := cc["private"]; ok {
+		return false
+	}
+	if req.Header.Get("Authorization") != "" {
+		_, public := cc["public"]
+		_, sMaxAge := cc["s-maxage"]
+		return public || sMaxAge
+	}
+	return true
+}
+
+// cacheExpires 按 s-maxage、max-age、Expires 计算过期时间，都没有时按 Last-Modified 估算；
+// 无法确定新鲜度且没有验证信息的响应不缓存
+func cacheExpires(h http.Header, now time.Time) (time.Time, bool) {
+	cc := parseCacheControl(h.Get("Cache-Control"))
+	validator := h.Get("ETag") != "" || h.Get("Last-Modified") != ""
+	if _, ok := cc["no-cache"]; ok {
+		return now, validator
+	}
+	for _, k := range []string{"s-maxage", "max-age"} {
+		if v, ok := cc[k]; ok {
+			sec, err := strconv.Atoi(v)
+			if err != nil || sec <= 0 {
+				return now, validator
+			}
+			return now.Add(time.Duration(sec) * time.Second), true
+		}
+	}
+	if v := h.Get("Expires"); v != "" {
+		t, err := http.ParseTime(v)
+		if err != nil || !t.After(now) {
+			return now, validator
+		}
+		return t, true
+	}
+	if v := h.Get("Last-Modified"); v != "" {
+		if t, err := http.ParseTime(v); err == nil && t.Before(now) {
+			age := now.Sub(t) / 10
+			if age > 24*time.Hour {
+				age = 24 * time.Hour
+			}
+			return now.Add(age), true
+		}
+	}
+	return now, validator
+}
+
+func parseCacheControl(v string) map[string]string {
+	cc := make(map[string]string)
+	for _, d := range strings.Split(v, ",") {
+		d = strings.TrimSpace(d)
+		if d == "" {
+			continue
+		}
+		k, val, _ := strings.Cut(d, "=")
+		cc[strings.ToLower(strings.TrimSpace(k))] = strings.Trim(strings.TrimSpace(val), `"`)
+	}
+	return cc
+}
+
+func varyMatch(e *cache.Entry, req *http.Request) bool {
+	for k, v := range e.VaryHeader {
+		if strings.Join(req.Header.Values(k), ",") != strings.Join(v, ",") {
+			return false
+		}
+	}
+	return true
+}
+
+// cachedResponse 由缓存生成响应，访问者的条件请求命中时返回 304
+func cachedResponse(e *cache.Entry, req *http.Request, status string) *http.Response {
+	h := e.Header.Clone()
+	age := int(time.Since(e.Stored).Seconds())
+	if age < 0 {
+		age = 0
+	}
+	h.Set("Age", strconv.Itoa(age))
+	h.Set("X-Cache", status)
+	resp := &http.Response{
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     h,
+		Request:    req,
+	}
+	if notModified(e, req) {
+		h.Del("Content-Length")
+		resp.StatusCode = http.StatusNotModified
+		resp.Body = http.NoBody
+	} else {
+		resp.StatusCode = e.StatusCode
+		resp.Body = io.NopCloser(bytes.NewReader(e.Body))
+		resp.ContentLength = int64(len(e.Body))
+	}
+	resp.Status = strconv.Itoa(resp.StatusCode) + " " + http.StatusText(resp.StatusCode)
+	return resp
+}
+
+func notModified(e *cache.Entry, req *http.Request) bool {
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(e.Header.Get("ETag"), "W/")
+		for _, v := range strings.Split(inm, ",") {
+			v = strings.TrimPrefix(strings.TrimSpace(v), "W/")
+			if v == "*" || (etag != "" && v == etag) {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := req.Header.Get("If-Modified-Since"); ims != "" {
+		t, err1 := http.ParseTime(ims)
+		lm, err2 := http.ParseTime(e.Header.Get("Last-Modified"))
+		return err1 == nil && err2 == nil && !lm.After(t)
+	}
+	return false
+}
+
+// cacheBody 转发响应的同时保存内容，完整读取且未超出大小限制时写入缓存
+type cacheBody struct {
+	io.ReadCloser
+	entry *cache.Entry
+	buf   bytes.Buffer
+	over  bool
+	done  bool
+}
+
+func (b *cacheBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && !b.over {
+		if int64(b.buf.Len()+n) > httpCacheMaxObject {
+			b.over = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !b.over && !b.done {
+		b.done = true
+		b.entry.Body = b.buf.Bytes()
+		httpCache.Set(b.entry)
+	}
+	return n, err
+}
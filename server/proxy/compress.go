@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/djylb/nps/lib/file"
+)
+
+const defaultCompressMinSize = 1024
+
+// 默认压缩的内容类型，以 / 结尾的按前缀匹配
+var defaultCompressTypes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/x-javascript",
+	"application/xml",
+	"application/xhtml+xml",
+	"application/rss+xml",
+	"application/wasm",
+	"image/svg+xml",
+}
+
+// compressResponse 按访问者的 Accept-Encoding 对响应进行 br 或 gzip 压缩；
+// 已编码、分段和过小的响应保持不变，长度未知的响应可能是长轮询或流式响应，也保持不变
+func compressResponse(host *file.Host, resp *http.Response) {
+	if !host.CompressEnable || resp.Request == nil || resp.Request.Method == http.MethodHead {
+		return
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Encoding") != "" || resp.Header.Get("Content-Range") != "" {
+		return
+	}
+	if strings.Contains(strings.ToLower(resp.Header.Get("Cache-Control")), "no-transform") {
+		return
+	}
+	if !compressibleType(host.CompressTypes, resp.Header.Get("Content-Type")) {
+		return
+	}
+	encoding := ""
+	accept := resp.Request.Header.Get("Accept-Encoding")
+	if acceptsEncoding(accept, "br") {
+		encoding = "br"
+	} else if acceptsEncoding(accept, "gzip") {
+		encoding = "gzip"
+	} else {
+		return
+	}
+	minSize := host.CompressMinSize
+	if minSize <= 0 {
+		minSize = defaultCompressMinSize
+	}
+	if resp.ContentLength < int64(minSize) {
+		return
+	}
+	resp.Header.Set("Content-Encoding", encoding)
+	resp.Header.Del("Content-Length")
+	resp.Header.Add("Vary", "Accept-Encoding")
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+	resp.ContentLength = -1
+	resp.Body = newCompressBody(resp.Body, encoding)
+}
+
+// newCompressBody 在后台压缩 src，返回压缩后的内容
+func newCompressBody(src io.ReadCloser, encoding string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		defer src.Close()
+		var w io.WriteCloser
+		if encoding == "br" {
+			w = brotli.NewWriterLevel(pw, 4)
+		} else {
+			w, _ = gzip.NewWriterLevel(pw, gzip.DefaultCompression)
+		}
+		_, err := io.Copy(w, src)
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+func compressibleType(types, contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mt == "text/event-stream" {
+		return false
+	}
+	list := defaultCompressTypes
+	if types != "" {
+		list = strings.FieldsFunc(types, func(r rune) bool {
+			return r == ',' || r == '\n' || r == '\r' || r == ' '
+		})
+	}
+	for _, t := range list {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == mt || (strings.HasSuffix(t, "/") && strings.HasPrefix(mt, t)) {
+			return true
+		}
+	}
+	if types == "" && (strings.HasSuffix(mt, "+json") || strings.HasSuffix(mt, "+xml")) {
+		return true
+	}
+	return false
+}
+
+// acceptsEncoding 判断 Accept-Encoding 是否接受 encoding，q=0 表示拒绝，明确列出的编码优先于 *
+func acceptsEncoding(header, encoding string) bool {
+	wildcard := false
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		accepted := true
+		if k, v, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(k) == "q" {
+			if q, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil && q == 0 {
+				accepted = false
+			}
+		}
+		switch name {
+		case encoding:
+			return accepted
+		case "*":
+			wildcard = accepted
+		}
+	}
+	return wildcard
+}
@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/djylb/nps/lib/common"
+	"github.com/djylb/nps/lib/file"
+)
+
+// ActiveConn 一个正在转发的访问者连接，http 域名按请求记录
+type ActiveConn struct {
+	Id       int64
+	ClientId int
+	TunnelId int    //0 for hosts
+	HostId   int    //0 for tunnels
+	Mode     string //tunnel mode, or http/https for hosts
+	Name     string //remark of the tunnel or the host name
+	Visitor  string //ip:port of the visitor
+	Listen   string //port of the tunnel or the request host
+	Target   string
+	Start    time.Time
+	In       int64 //bytes received from the visitor
+	Out      int64 //bytes sent to the visitor
+	bytes    func() (in, out int64)
+	kill     func()
+}
+
+// ConnQuery 连接列表的过滤条件，为零值的条件不过滤
+type ConnQuery struct {
+	ClientId int
+	TunnelId int
+	HostId   int
+	Ip       string //visitor ip
+	Search   string //keyword of visitor, target, name and listen
+}
+
+var (
+	conns      sync.Map //map[int64]*ActiveConn
+	lastConnId int64
+)
+
+// trackConn 登记一个连接，bytes 返回当前字节数，kill 断开连接；返回的函数在连接结束时调用
+func trackConn(c *ActiveConn, bytes func() (in, out int64), kill func()) func() {
+	c.Id = atomic.AddInt64(&lastConnId, 1)
+	c.Start = time.Now()
+	c.bytes, c.kill = bytes, kill
+	conns.Store(c.Id, c)
+	return func() {
+		conns.Delete(c.Id)
+	}
+}
+
+// trackTunnelConn 登记隧道下的连接
+func trackTunnelConn(task *file.Tunnel, visitor, target string, bytes func() (in, out int64), kill func()) func() {
+	c := &ActiveConn{TunnelId: task.Id, Mode: task.Mode, Name: task.Remark, Visitor: visitor, Target: target, Listen: ":" + strconv.Itoa(task.Port)}
+	if task.Client != nil {
+		c.ClientId = task.Client.Id
+	}
+	return trackConn(c, bytes, kill)
+}
+
+// trackHostConn 登记域名下的连接或请求
+func trackHostConn(host *file.Host, mode, visitor, listen, target string, bytes func() (in, out int64), kill func()) func() {
+	c := &ActiveConn{HostId: host.Id, Mode: mode, Name: host.Host, Visitor: visitor, Listen: listen, Target: target}
+	if host.Client != nil {
+		c.ClientId = host.Client.Id
+	}
+	return trackConn(c, bytes, kill)
+}
+
+func (c *ActiveConn) match(q ConnQuery) bool {
+	switch {
+	case q.ClientId != 0 && c.ClientId != q.ClientId,
+		q.TunnelId != 0 && c.TunnelId != q.TunnelId,
+		q.HostId != 0 && c.HostId != q.HostId,
+		q.Ip != "" && common.GetIpByAddr(c.Visitor) != q.Ip:
+		return false
+	}
+	return q.Search == "" || common.ContainsFold(c.Visitor, q.Search) || common.ContainsFold(c.Target, q.Search) ||
+		common.ContainsFold(c.Name, q.Search) || common.ContainsFold(c.Listen, q.Search)
+}
+
+// ActiveConns 返回符合条件的连接及当前字节数，新的在前
+func ActiveConns(q ConnQuery) []ActiveConn {
+	list := make([]ActiveConn, 0)
+	conns.Range(func(key, value interface{}) bool {
+		c := value.(*ActiveConn)
+		if c.match(q) {
+			v := *c
+			v.In, v.Out = c.bytes()
+			list = append(list, v)
+		}
+		return true
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].Id > list[j].Id })
+	return list
+}
+
+// ConnCounts 按隧道和域名统计当前连接数，http 域名按正在处理的请求计算
+func ConnCounts() (tunnels, hosts map[int]int) {
+	tunnels, hosts = make(map[int]int), make(map[int]int)
+	conns.Range(func(key, value interface{}) bool {
+		c := value.(*ActiveConn)
+		if c.HostId != 0 {
+			hosts[c.HostId]++
+		} else {
+			tunnels[c.TunnelId]++
+		}
+		return true
+	})
+	return
+}
+
+// GetActiveConn 按 id 查找连接
+func GetActiveConn(id int64) (*ActiveConn, bool) {
+	if v, ok := conns.Load(id); ok {
+		return v.(*ActiveConn), true
+	}
+	return nil, false
+}
+
+// KillConn 断开连接 id
+func KillConn(id int64) bool {
+	c, ok := GetActiveConn(id)
+	if ok {
+		conns.Delete(id)
+		c.kill()
+	}
+	return ok
+}
+
+// KillConns 断开符合条件的全部连接，返回断开的数量；q.Ip 为空时不做任何操作，避免误断开所有连接
+func KillConns(q ConnQuery) int {
+	if q.Ip == "" {
+		return 0
+	}
+	n := 0
+	conns.Range(func(key, value interface{}) bool {
+		if c := value.(*ActiveConn); c.match(q) {
+			conns.Delete(key)
+			c.kill()
+			n++
+		}
+		return true
+	})
+	return n
+}
+
+// visitorConnKey http 请求上下文中访问者的连接
+type visitorConnKey struct{}
+
+// countBody 统计读取的请求体字节数
+type countBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(&b.n, int64(n))
+	return n, err
+}
+
+// closeAll 依次关闭连接，用作 kill
+func closeAll(list ...interface{ Close() error }) func() {
+	return func() {
+		for _, c := range list {
+			if c != nil {
+				c.Close()
+			}
+		}
+	}
+}
+
+// connBytes 返回 countConn 的字节数，extra 为已经读取的首包
+func connBytes(cc *countConn, extra int) func() (in, out int64) {
+	return func() (in, out int64) {
+		in, out = cc.Bytes()
+		return in + int64(extra), out
+	}
+}
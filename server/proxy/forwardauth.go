@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beego/beego"
+	"github.com/djylb/nps/lib/common"
+	"github.com/djylb/nps/lib/file"
+	"github.com/djylb/nps/lib/logs"
+)
+
+// 转发认证时不复制给认证服务的请求头
+var forwardAuthSkipHeaders = []string{"Connection", "Keep-Alive", "Proxy-Connection", "Te", "Trailer",
+	"Transfer-Encoding", "Upgrade", "Content-Length", "Content-Type", "Proxy-Authorization"}
+
+var (
+	forwardAuthOnce   sync.Once
+	forwardAuthClient *http.Client
+)
+
+// getForwardAuthClient 返回请求认证服务的客户端，不跟随跳转以便把跳转转发给访问者
+func getForwardAuthClient() *http.Client {
+	forwardAuthOnce.Do(func() {
+		timeout := beego.AppConfig.DefaultInt("forward_auth_timeout", 5)
+		forwardAuthClient = &http.Client{
+			Timeout: time.Duration(timeout) * time.Second,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+	})
+	return forwardAuthClient
+}
+
+// callForwardAuth 以 GET 请求认证地址，2xx 表示允许；返回的响应需要调用方关闭
+func callForwardAuth(authUrl string, header http.Header) (*http.Response, bool, error) {
+	req, err := http.NewRequest(http.MethodGet, authUrl, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header = header
+	resp, err := getForwardAuthClient().Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	return resp, resp.StatusCode >= 200 && resp.StatusCode < 300, nil
+}
+
+// hostForwardAuth 把访问者请求的元数据发送给域名的认证地址，允许时按 AuthResponseHeaders
+// 把认证服务返回的请求头加入转发请求，拒绝时把认证服务的响应返回给访问者；返回 false 表示不再转发
+func hostForwardAuth(w http.ResponseWriter, r *http.Request, host *file.Host, scheme string) bool {
+	header := make(http.Header)
+	for k, v := range r.Header {
+		header[k] = append([]string(nil), v...)
+	}
+	for _, k := range forwardAuthSkipHeaders {
+		header.Del(k)
+	}
+	ip := common.GetIpByAddr(r.RemoteAddr)
+	header.Set("X-Forwarded-For", ip)
+	header.Set("X-Real-IP", ip)
+	header.Set("X-Forwarded-Method", r.Method)
+	header.Set("X-Forwarded-Proto", scheme)
+	header.Set("X-Forwarded-Host", r.Host)
+	header.Set("X-Forwarded-Uri", r.URL.RequestURI())
+	header.Set("X-NPS-Host-Id", strconv.Itoa(host.Id))
+	header.Set("X-NPS-Client-Id", strconv.Itoa(host.Client.Id))
+
+	resp, ok, err := callForwardAuth(host.AuthUrl, header)
+	if err != nil {
+		logs.Warn("forward auth of host %s error %v", host.Host, err)
+		http.Error(w, "502 Bad Gateway", http.StatusBadGateway)
+		return false
+	}
+	defer resp.Body.Close()
+	if !ok {
+		logs.Debug("forward auth of host %s denied %s with status %d", host.Host, r.RemoteAddr, resp.StatusCode)
+		relayDenial(w, resp)
+		return false
+	}
+	for _, name := range splitList(host.AuthResponseHeaders) {
+		name = textproto.CanonicalMIMEHeaderKey(name)
+		r.Header.Del(name)
+		if v, ok := resp.Header[name]; ok {
+			r.Header[name] = v
+		}
+	}
+	return true
+}
+
+// relayDenial 把认证服务的拒绝响应返回给访问者
+func relayDenial(w http.ResponseWriter, resp *http.Response) {
+	copyDenialHeader(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, io.LimitReader(resp.Body, 64<<10))
+}
+
+// writeDenial 把认证服务的拒绝响应写给 http 代理的访问者
+func writeDenial(c net.Conn, resp *http.Response) {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	header := make(http.Header)
+	copyDenialHeader(header, resp.Header)
+	(&http.Response{
+		StatusCode:    resp.StatusCode,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Close:         true,
+	}).Write(c)
+}
+
+func copyDenialHeader(dst, src http.Header) {
+	for k, v := range src {
+		switch k {
+		case "Connection", "Keep-Alive", "Transfer-Encoding", "Content-Length", "Trailer", "Upgrade":
+			continue
+		}
+		dst[k] = v
+	}
+}
+
+// tunnelForwardAuth 对 tcp、socks5、http 代理隧道的连接调用认证地址；
+// target 为访问目标，r 为 http 代理的请求，没有时为 nil
+func tunnelForwardAuth(task *file.Tunnel, remoteAddr net.Addr, target, user, pass string, r *http.Request) (*http.Response, error) {
+	header := make(http.Header)
+	if r != nil {
+		for k, v := range r.Header {
+			header[k] = append([]string(nil), v...)
+		}
+		for _, k := range forwardAuthSkipHeaders {
+			header.Del(k)
+		}
+		header.Set("X-Forwarded-Method", r.Method)
+		if r.Method != http.MethodConnect {
+			header.Set("X-Forwarded-Uri", r.URL.RequestURI())
+		}
+	}
+	ip := common.GetIpByAddr(remoteAddr.String())
+	header.Set("X-Forwarded-For", ip)
+	header.Set("X-Real-IP", ip)
+	header.Set("X-NPS-Mode", task.Mode)
+	header.Set("X-NPS-Task-Id", strconv.Itoa(task.Id))
+	header.Set("X-NPS-Client-Id", strconv.Itoa(task.Client.Id))
+	header.Set("X-NPS-Port", strconv.Itoa(task.Port))
+	if target != "" {
+		header.Set("X-Forwarded-Host", target)
+	}
+	if user != "" || pass != "" {
+		header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user+":"+pass)))
+	}
+	resp, ok, err := callForwardAuth(task.AuthUrl, header)
+	if err != nil {
+		logs.Warn("forward auth of task %d error %v", task.Id, err)
+		return nil, err
+	}
+	if !ok {
+		logs.Debug("forward auth of task %d denied %v with status %d", task.Id, remoteAddr, resp.StatusCode)
+		return resp, errors.New("forward auth denied")
+	}
+	resp.Body.Close()
+	return nil, nil
+}
+
+// proxyAuthCredentials 解析 http 代理请求的 Proxy-Authorization
+func proxyAuthCredentials(r *http.Request) (user, pass string) {
+	auth := r.Header.Get("Proxy-Authorization")
+	if !strings.HasPrefix(auth, "Basic ") {
+		return "", ""
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(auth, "Basic "))
+	if err != nil {
+		return "", ""
+	}
+	user, pass, _ = strings.Cut(string(b), ":")
+	return user, pass
+}
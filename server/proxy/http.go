@@ -14,6 +14,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/beego/beego"
@@ -22,7 +23,10 @@ import (
 	"github.com/djylb/nps/lib/file"
 	"github.com/djylb/nps/lib/goroutine"
 	"github.com/djylb/nps/lib/logs"
+	"github.com/djylb/nps/lib/metrics"
 	"github.com/djylb/nps/server/connection"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 var localTCPAddr = &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}
@@ -53,6 +57,17 @@ func checkFlowLimits(f *file.Flow, label string, now time.Time) error {
 	return nil
 }
 
+// checkClientLimits 检查客户端的时间限制和生效的流量限制（包括分组的流量限制）
+func checkClientLimits(c *file.Client, now time.Time) error {
+	if c.FlowLimitExceeded() {
+		return fmt.Errorf("Client: flow limit exceeded")
+	}
+	if !c.Flow.TimeLimit.IsZero() && c.Flow.TimeLimit.Before(now) {
+		return fmt.Errorf("Client: time limit exceeded")
+	}
+	return nil
+}
+
 func (c *flowConn) Read(p []byte) (int, error) {
 	n, err := c.basicConn.Read(p)
 	n64 := int64(n)
@@ -62,7 +77,7 @@ func (c *flowConn) Read(p []byte) (int, error) {
 	if err := checkFlowLimits(c.host.Flow, "Host", now); err != nil {
 		return n, err
 	}
-	if err := checkFlowLimits(c.host.Client.Flow, "Client", now); err != nil {
+	if err := checkClientLimits(c.host.Client, now); err != nil {
 		return n, err
 	}
 	return n, err
@@ -77,7 +92,7 @@ func (c *flowConn) Write(p []byte) (int, error) {
 	if err := checkFlowLimits(c.host.Flow, "Host", now); err != nil {
 		return n, err
 	}
-	if err := checkFlowLimits(c.host.Client.Flow, "Client", now); err != nil {
+	if err := checkClientLimits(c.host.Client, now); err != nil {
 		return n, err
 	}
 	return n, err
@@ -184,9 +199,22 @@ func (s *httpServer) handleProxy(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// IP 黑名单检查
+	// 访问日志、状态码指标和连接列表的字节数
+	rec := &accessRecorder{ResponseWriter: w, host: r.Host}
+	w = rec
+	if logs.AccessEnabled() || metrics.Enabled() {
+		defer func(start time.Time) {
+			status, _ := rec.result(r)
+			metrics.HttpResponse(host.Id, host.Host, status)
+			if logs.AccessEnabled() {
+				writeHostAccess(host, r, rec, start)
+			}
+		}(time.Now())
+	}
+
+	// IP 黑白名单检查
 	clientIP := common.GetIpByAddr(r.RemoteAddr)
-	if IsGlobalBlackIp(clientIP) || common.IsBlackIp(clientIP, host.Client.VerifyKey, host.Client.BlackIpList) {
+	if !IsIpAllowed(r.RemoteAddr, host.Client, nil, host) {
 		//http.Error(w, "403 Forbidden", http.StatusForbidden)
 		logs.Warn("Blocked IP: %s", clientIP)
 		if hj, ok := w.(http.Hijacker); ok {
@@ -195,6 +223,7 @@ func (s *httpServer) handleProxy(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+	countVisit(r.RemoteAddr)
 
 	// HTTP-Only 请求处理
 	isHttpOnlyRequest := (s.httpOnlyPass != "" && r.Header.Get("X-NPS-Http-Only") == s.httpOnlyPass)
@@ -220,7 +249,8 @@ func (s *httpServer) handleProxy(w http.ResponseWriter, r *http.Request) {
 	}
 	defer host.Client.CutConn()
 
-	// HTTP 认证
+	// HTTP 认证，authUser 为通过认证的用户名，未开启认证时为空
+	var authUser string
 	if r.Header.Get("Upgrade") == "" {
 		if err := s.auth(r, nil, host.Client.Cnf.U, host.Client.Cnf.P, s.task.MultiAccount, host.UserAuth); err != nil {
 			logs.Warn("Unauthorized request from %s", r.RemoteAddr)
@@ -228,6 +258,32 @@ func (s *httpServer) handleProxy(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
 			return
 		}
+		if host.Client.Cnf.U != "" || host.Client.Cnf.P != "" || len(file.GetAccountMap(s.task.MultiAccount)) > 0 || len(file.GetAccountMap(host.UserAuth)) > 0 {
+			authUser, _, _ = common.GetAuthPair(r)
+		}
+	}
+
+	// 访问频率限制
+	if !host.AllowRequest(reqLimitKey(host, r, isHttpOnlyRequest, authUser)) {
+		logs.Debug("Request rate limit exceeded, host id %d, remote address %s", host.Id, r.RemoteAddr)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "429 Too Many Requests", http.StatusTooManyRequests)
+		return
+	}
+
+	scheme := r.URL.Scheme
+	if proto := r.Header.Get("X-Forwarded-Proto"); isHttpOnlyRequest && proto != "" {
+		scheme = proto
+	}
+
+	// OIDC 登录
+	if host.OidcIssuer != "" && !oidcAuth(w, r, host, scheme) {
+		return
+	}
+
+	// 外部转发认证
+	if host.AuthUrl != "" && !hostForwardAuth(w, r, host, scheme) {
+		return
 	}
 
 	// 获取目标地址
@@ -240,6 +296,26 @@ func (s *httpServer) handleProxy(w http.ResponseWriter, r *http.Request) {
 		w.Write(s.errorContent)
 		return
 	}
+	rec.upstream = targetAddr
+
+	// 连接列表，断开时取消请求并关闭访问者的连接
+	visitorConn, _ := r.Context().Value(visitorConnKey{}).(net.Conn)
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	r = r.WithContext(ctx)
+	body := &countBody{ReadCloser: r.Body}
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = body
+	}
+	defer trackHostConn(host, r.URL.Scheme, r.RemoteAddr, r.Host, targetAddr, func() (int64, int64) {
+		in, out := rec.counts()
+		return in + atomic.LoadInt64(&body.n), out
+	}, func() {
+		cancel()
+		if visitorConn != nil {
+			visitorConn.Close()
+		}
+	})()
 
 	logs.Debug("%s request, method %s, host %s, url %s, remote address %s, target %s", r.URL.Scheme, r.Method, r.Host, r.URL.Path, r.RemoteAddr, targetAddr)
 
@@ -249,15 +325,32 @@ func (s *httpServer) handleProxy(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	serverName := ""
+	if backendScheme(host) == "https" {
+		serverName = host.HostChange
+		if serverName == "" {
+			serverName = common.RemovePortFromHost(r.Host)
+		}
+	}
+	dial := s.hostDialer(host, targetAddr)
+	var transport http.RoundTripper
+	// 复用的连接带有第一个访问者的地址，向后端发送 PROXY 协议头时不能复用
+	if httpPoolEnabled() && host.Target.ProxyProtocol == 0 {
+		transport = getHttpPool(host, targetAddr, serverName, dial)
+	} else {
+		transport = newBackendTransport(host, serverName, dial)
+		defer transport.(interface{ CloseIdleConnections() }).CloseIdleConnections()
+	}
+	if hostCacheable(host, r) {
+		transport = newCacheTransport(transport, host, r)
+	}
+	r = r.WithContext(context.WithValue(r.Context(), remoteAddrKey{}, r.RemoteAddr))
+
 	// 创建 HTTP 反向代理
 	proxy := &httputil.ReverseProxy{
 		Director: func(req *http.Request) {
 			//req = req.WithContext(context.WithValue(req.Context(), "origReq", r))
-			if host.TargetIsHttps {
-				req.URL.Scheme = "https"
-			} else {
-				req.URL.Scheme = "http"
-			}
+			req.URL.Scheme = backendScheme(host)
 			req.URL.Host = r.Host
 			//logs.Debug("Director: set req.URL.Scheme=%s, req.URL.Host=%s", req.URL.Scheme, req.URL.Host)
 			common.ChangeHostAndHeader(req, host.HostChange, host.HeaderChange, isHttpOnlyRequest)
@@ -273,40 +366,15 @@ func (s *httpServer) handleProxy(w http.ResponseWriter, r *http.Request) {
 				}
 			}
 		},
-		Transport: &http.Transport{
-			ResponseHeaderTimeout: 60 * time.Second,
-			//DisableKeepAlives:     true,
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-				ServerName: func() string {
-					if host.TargetIsHttps {
-						if host.HostChange != "" {
-							return host.HostChange
-						}
-						return common.RemovePortFromHost(r.Host)
-					}
-					return ""
-				}(),
-			},
-			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-				//logs.Debug("DialContext: start dialing; network=%s, addr=%s, using targetAddr=%s", network, addr, targetAddr)
-				link := conn.NewLink("tcp", targetAddr, host.Client.Cnf.Crypt, host.Client.Cnf.Compress, r.RemoteAddr, s.allowLocalProxy && host.Target.LocalProxy)
-				target, err := s.bridge.SendLinkInfo(host.Client.Id, link, nil)
-				if err != nil {
-					logs.Info("DialContext: connection to host %s (target %s) failed: %v", r.Host, targetAddr, err)
-					return nil, err
-				}
-				rawConn := conn.GetConn(target, link.Crypt, link.Compress, host.Client.Rate, true)
-				return &flowConn{
-					basicConn: &basicConn{
-						ReadWriteCloser: rawConn,
-						fakeAddr:        localTCPAddr,
-					},
-					host: host,
-				}, nil
-			},
-		},
+		Transport: transport,
 		ModifyResponse: func(resp *http.Response) error {
+			// 压缩响应
+			compressResponse(host, resp)
+			// 带 Trailer 的响应需要分块传输，否则 HTTP/1.1 访问者收不到 Trailer
+			if len(resp.Trailer) > 0 {
+				resp.ContentLength = -1
+				resp.Header.Del("Content-Length")
+			}
 			// 处理 CORS
 			if host.AutoCORS {
 				origin := resp.Request.Header.Get("Origin")
@@ -341,9 +409,33 @@ func (s *httpServer) handleProxy(w http.ResponseWriter, r *http.Request) {
 			}
 		},
 	}
+	if host.BackendProto == "h2" || host.BackendProto == "h2c" {
+		// gRPC 等流式响应需要立即转发
+		proxy.FlushInterval = -1
+	}
 	proxy.ServeHTTP(w, r)
 }
 
+// hostDialer 经 bridge 向客户端建立到目标的连接，连接池中的连接可被后续请求复用
+func (s *httpServer) hostDialer(host *file.Host, targetAddr string) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		link := conn.NewLink("tcp", targetAddr, host.Client.Cnf.Crypt, host.Client.Cnf.Compress, requestRemoteAddr(ctx), s.allowLocalProxy && host.Target.LocalProxy)
+		target, err := s.bridge.SendLinkInfo(host.Client.Id, link, nil)
+		if err != nil {
+			logs.Info("DialContext: connection to host %s (target %s) failed: %v", host.Host, targetAddr, err)
+			return nil, err
+		}
+		rawConn := conn.GetConn(target, link.Crypt, link.Compress, host.Client.Rate, true)
+		return &flowConn{
+			basicConn: &basicConn{
+				ReadWriteCloser: rawConn,
+				fakeAddr:        localTCPAddr,
+			},
+			host: host,
+		}, nil
+	}
+}
+
 func (s *httpServer) handleWebsocket(w http.ResponseWriter, r *http.Request, host *file.Host, targetAddr string, isHttpOnlyRequest bool) {
 	logs.Info("%s websocket request, method %s, host %s, url %s, remote address %s, target %s", r.URL.Scheme, r.Method, r.Host, r.URL.Path, r.RemoteAddr, targetAddr)
 
@@ -461,13 +553,41 @@ func join(c1, c2 net.Conn, flows []*file.Flow, task *file.Tunnel, remote string)
 }
 
 func (s *httpServer) NewServer(port int, scheme string) *http.Server {
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.URL.Scheme = scheme
+		s.handleProxy(w, r)
+	})
+	if scheme == "http" {
+		handler = AcmeHTTPHandler(handler)
+		if beego.AppConfig.DefaultBool("http_proxy_h2c", false) {
+			// 接收明文 HTTP/2（h2c）请求，例如 gRPC 客户端直接访问 http 代理端口
+			handler = h2c.NewHandler(handler, &http2.Server{})
+		}
+	}
 	return &http.Server{
-		Addr: ":" + strconv.Itoa(port),
-		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			r.URL.Scheme = scheme
-			s.handleProxy(w, r)
-		}),
+		Addr:    ":" + strconv.Itoa(port),
+		Handler: handler,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, visitorConnKey{}, c)
+		},
 		// Disable HTTP/2.
 		//TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
 	}
 }
+
+// reqLimitKey 返回频率限制使用的访问者标识，取不到时退回访问者 IP。
+// 访问者可以随意修改请求头和未验证的用户名，因此请求头只在请求来自通过 X-NPS-Http-Only 验证的前置代理时使用，
+// 用户名只在通过 Basic 认证后使用
+func reqLimitKey(host *file.Host, r *http.Request, trusted bool, authUser string) string {
+	switch {
+	case strings.HasPrefix(host.ReqLimitKey, "header:"):
+		if v := r.Header.Get(strings.TrimPrefix(host.ReqLimitKey, "header:")); v != "" && trusted {
+			return "h:" + v
+		}
+	case host.ReqLimitKey == "user":
+		if authUser != "" {
+			return "u:" + authUser
+		}
+	}
+	return common.GetIpByAddr(r.RemoteAddr)
+}
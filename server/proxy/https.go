@@ -249,7 +249,17 @@ func (https *HttpsServer) NewHttps(l net.Listener, certText string, keyText stri
 		}
 		tlsConfig := &tls.Config{
 			Certificates: []tls.Certificate{cert},
-			NextProtos:   []string{"h2", "http/1.1"},
+			NextProtos:   []string{"http/1.1"},
+		}
+		h2Config := tlsConfig.Clone()
+		h2Config.NextProtos = []string{"h2", "http/1.1"}
+		// 按 SNI 对应域名当前的后端协议协商，只有后端为 h2 或 h2c 的域名对访问者使用 HTTP/2，
+		// 其余域名断开单个请求时不会影响同一连接上的其他请求
+		tlsConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			if host, err := file.GetDb().FindCertByHost(hello.ServerName); err == nil && (host.BackendProto == "h2" || host.BackendProto == "h2c") {
+				return h2Config, nil
+			}
+			return nil, nil
 		}
 		tlsListener := tls.NewListener(l, tlsConfig)
 		err = https.NewServer(0, "https").Serve(tlsListener)
@@ -260,6 +270,16 @@ func (https *HttpsServer) NewHttps(l net.Listener, certText string, keyText stri
 }
 
 func (https *HttpsServer) handleHttpsProxy(host *file.Host, c net.Conn, rb []byte, sni string) {
+	if !host.AllowIp(net.ParseIP(common.GetIpByAddr(c.RemoteAddr().String()))) {
+		logs.Warn("IP [%v] is not allowed by host %s", c.RemoteAddr(), host.Host)
+		c.Close()
+		return
+	}
+	if !host.AllowRequest(common.GetIpByAddr(c.RemoteAddr().String())) {
+		logs.Debug("connection rate limit exceeded, host id %d, remote address %v", host.Id, c.RemoteAddr())
+		c.Close()
+		return
+	}
 	if err := https.CheckFlowAndConnNum(host.Client); err != nil {
 		logs.Debug("Client id %d, host id %d, error %v during https connection", host.Client.Id, host.Id, err)
 		c.Close()
@@ -274,6 +294,17 @@ func (https *HttpsServer) handleHttpsProxy(host *file.Host, c net.Conn, rb []byt
 		return
 	}
 	logs.Info("New HTTPS connection, clientId %d, host %s, remote address %v", host.Client.Id, sni, c.RemoteAddr())
+	cc := newCountConn(c)
+	c = cc
+	defer trackHostConn(host, "https", c.RemoteAddr().String(), sni, targetAddr, connBytes(cc, len(rb)), closeAll(cc))()
+	if logs.AccessEnabled() {
+		start := time.Now()
+		writeConnAccess("host", host.Id, "https", "connect", c.RemoteAddr().String(), sni, targetAddr, 0, 0, start)
+		defer func() {
+			in, out := cc.Bytes()
+			writeConnAccess("host", host.Id, "https", "close", c.RemoteAddr().String(), sni, targetAddr, in+int64(len(rb)), out, start)
+		}()
+	}
 	https.DealClient(conn.NewConn(c), host.Client, targetAddr, rb, common.CONN_TCP, nil, []*file.Flow{host.Flow, host.Client.Flow}, host.Target.ProxyProtocol, host.Target.LocalProxy, nil)
 }
 
@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beego/beego"
+	"github.com/djylb/nps/lib/file"
+	"github.com/djylb/nps/lib/logs"
+	"github.com/djylb/nps/lib/oidc"
+)
+
+const (
+	oidcCallbackPath = "/.nps/oidc/callback"
+	oidcLogoutPath   = "/.nps/oidc/logout"
+)
+
+// 转发给目标的身份请求头，访问者自带的同名请求头会被删除
+var oidcIdentityHeaders = []string{"X-Auth-Request-User", "X-Auth-Request-Email", "X-Auth-Request-Preferred-Username", "X-Auth-Request-Groups"}
+
+var (
+	oidcSecretOnce sync.Once
+	oidcSecret     []byte
+)
+
+// oidcCookieSecret 返回签名 Cookie 的密钥，未配置 oidc_cookie_secret 时随机生成，重启后需要重新登录
+func oidcCookieSecret() []byte {
+	oidcSecretOnce.Do(func() {
+		if s := beego.AppConfig.String("oidc_cookie_secret"); s != "" {
+			oidcSecret = []byte(s)
+		} else {
+			oidcSecret = []byte(oidc.RandomString(32))
+		}
+	})
+	return oidcSecret
+}
+
+func oidcCookieName(host *file.Host) string {
+	return "nps_oidc_" + strconv.Itoa(host.Id)
+}
+
+// oidcAuth 对开启 OIDC 登录的域名校验会话，未登录时跳转到登录页；
+// 返回 false 表示已经写入响应，不再转发
+func oidcAuth(w http.ResponseWriter, r *http.Request, host *file.Host, scheme string) bool {
+	for _, h := range oidcIdentityHeaders {
+		r.Header.Del(h)
+	}
+	secret := oidcCookieSecret()
+	name := oidcCookieName(host)
+	switch r.URL.Path {
+	case oidcCallbackPath:
+		oidcCallback(w, r, host, scheme)
+		return false
+	case oidcLogoutPath:
+		http.SetCookie(w, &http.Cookie{Name: name, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+		http.Redirect(w, r, "/", http.StatusFound)
+		return false
+	}
+	if c, err := r.Cookie(name); err == nil {
+		if s, err := oidc.ParseSession(secret, c.Value); err == nil && s.HostId == host.Id && s.State == "" {
+			user := s.Email
+			if user == "" {
+				user = s.Subject
+			}
+			r.Header.Set("X-Auth-Request-User", user)
+			if s.Email != "" {
+				r.Header.Set("X-Auth-Request-Email", s.Email)
+			}
+			if s.Name != "" {
+				r.Header.Set("X-Auth-Request-Preferred-Username", s.Name)
+			}
+			if len(s.Groups) > 0 {
+				r.Header.Set("X-Auth-Request-Groups", strings.Join(s.Groups, ","))
+			}
+			removeCookie(r, name, name+"_state")
+			return true
+		}
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	p, err := oidc.GetProvider(r.Context(), host.OidcIssuer)
+	if err != nil {
+		logs.Warn("oidc provider %s of host %s error %v", host.OidcIssuer, host.Host, err)
+		http.Error(w, "502 Bad Gateway", http.StatusBadGateway)
+		return false
+	}
+	state := &oidc.Session{
+		HostId:   host.Id,
+		State:    oidc.RandomString(16),
+		Nonce:    oidc.RandomString(16),
+		Redirect: r.URL.RequestURI(),
+		Expiry:   time.Now().Add(10 * time.Minute).Unix(),
+	}
+	http.SetCookie(w, &http.Cookie{Name: name + "_state", Value: state.Sign(secret), Path: oidcCallbackPath, MaxAge: 600, HttpOnly: true, Secure: scheme == "https", SameSite: http.SameSiteLaxMode})
+	http.Redirect(w, r, p.AuthCodeURL(host.OidcClientId, oidcRedirectURI(r, scheme), host.OidcScopes, state.State, state.Nonce), http.StatusFound)
+	return false
+}
+
+func oidcCallback(w http.ResponseWriter, r *http.Request, host *file.Host, scheme string) {
+	secret := oidcCookieSecret()
+	name := oidcCookieName(host)
+	c, err := r.Cookie(name + "_state")
+	if err != nil {
+		http.Error(w, "400 Login state not found", http.StatusBadRequest)
+		return
+	}
+	state, err := oidc.ParseSession(secret, c.Value)
+	if err != nil || state.HostId != host.Id || state.State == "" || state.State != r.URL.Query().Get("state") {
+		http.Error(w, "400 Invalid login state", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: name + "_state", Value: "", Path: oidcCallbackPath, MaxAge: -1, HttpOnly: true})
+	if e := r.URL.Query().Get("error"); e != "" {
+		http.Error(w, "403 "+e, http.StatusForbidden)
+		return
+	}
+	p, err := oidc.GetProvider(r.Context(), host.OidcIssuer)
+	if err != nil {
+		http.Error(w, "502 Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	raw, err := p.Exchange(r.Context(), host.OidcClientId, host.OidcClientSecret, r.URL.Query().Get("code"), oidcRedirectURI(r, scheme))
+	if err != nil {
+		logs.Warn("oidc code exchange of host %s error %v", host.Host, err)
+		http.Error(w, "403 Login failed", http.StatusForbidden)
+		return
+	}
+	claims, err := p.Verify(r.Context(), raw, host.OidcClientId, state.Nonce)
+	if err != nil {
+		logs.Warn("oidc id_token of host %s error %v", host.Host, err)
+		http.Error(w, "403 Login failed", http.StatusForbidden)
+		return
+	}
+	if !claims.Allowed(splitList(strings.ToLower(host.OidcAllowDomains)), splitList(host.OidcAllowGroups)) {
+		logs.Info("oidc user %s %s is not allowed by host %s", claims.Subject, claims.Email, host.Host)
+		http.Error(w, "403 Forbidden", http.StatusForbidden)
+		return
+	}
+	displayName := claims.Name
+	if displayName == "" {
+		displayName = claims.PreferredUsername
+	}
+	hours := beego.AppConfig.DefaultInt("oidc_session_timeout", 24)
+	s := &oidc.Session{
+		HostId:  host.Id,
+		Subject: claims.Subject,
+		Email:   claims.Email,
+		Name:    displayName,
+		Groups:  claims.Groups,
+		Expiry:  time.Now().Add(time.Duration(hours) * time.Hour).Unix(),
+	}
+	http.SetCookie(w, &http.Cookie{Name: name, Value: s.Sign(secret), Path: "/", MaxAge: hours * 3600, HttpOnly: true, Secure: scheme == "https", SameSite: http.SameSiteLaxMode})
+	redirect := state.Redirect
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") {
+		redirect = "/"
+	}
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+func oidcRedirectURI(r *http.Request, scheme string) string {
+	return scheme + "://" + r.Host + oidcCallbackPath
+}
+
+// removeCookie 删除转发给目标的请求中 nps 使用的 Cookie
+func removeCookie(r *http.Request, names ...string) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, c := range cookies {
+		keep := true
+		for _, n := range names {
+			if c.Name == n {
+				keep = false
+			}
+		}
+		if keep {
+			r.AddCookie(c)
+		}
+	}
+}
+
+func splitList(s string) []string {
+	list := make([]string, 0)
+	for _, v := range strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == '\n' || r == '\r' || r == ' '
+	}) {
+		list = append(list, v)
+	}
+	return list
+}
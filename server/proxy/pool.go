@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/beego/beego"
+	"github.com/djylb/nps/lib/file"
+	"github.com/djylb/nps/lib/logs"
+)
+
+type remoteAddrKey struct{}
+
+var (
+	httpPools       sync.Map // key -> *httpPool
+	httpPoolOnce    sync.Once
+	httpPoolMaxIdle int
+	httpPoolTimeout time.Duration
+	httpPoolTotals  poolCounter
+)
+
+// httpPool 每个域名和目标共用一个长期存在的 Transport，复用经过 bridge 建立的空闲连接
+type httpPool struct {
+	transport http.RoundTripper
+	lastUsed  int64
+}
+
+type poolCounter struct {
+	requests   int64
+	reused     int64
+	newConns   int64
+	newTtfb    int64
+	reusedTtfb int64
+}
+
+// PoolStats 上游连接池统计，Ttfb 为从发出请求到收到首字节的平均耗时（毫秒）
+type PoolStats struct {
+	Pools        int
+	MaxIdle      int
+	Requests     int64
+	Reused       int64
+	NewConns     int64
+	NewTtfbMs    float64
+	ReusedTtfbMs float64
+}
+
+func initHttpPool() {
+	httpPoolOnce.Do(func() {
+		httpPoolMaxIdle = beego.AppConfig.DefaultInt("http_pool_max_idle", 32)
+		httpPoolTimeout = time.Duration(beego.AppConfig.DefaultInt("http_pool_idle_timeout", 90)) * time.Second
+		if httpPoolMaxIdle > 0 {
+			go httpPoolGc()
+		}
+	})
+}
+
+// httpPoolEnabled reports whether upstream connections are kept for reuse.
+func httpPoolEnabled() bool {
+	initHttpPool()
+	return httpPoolMaxIdle > 0
+}
+
+// getHttpPool 返回域名和目标对应的 Transport，域名配置或所属客户端变化后使用新的连接池
+func getHttpPool(host *file.Host, targetAddr, serverName string, dial dialFunc) http.RoundTripper {
+	key := fmt.Sprintf("%d|%d|%s|%s|%s|%t|%t|%t", host.Id, host.Client.Id, targetAddr, serverName, host.BackendProto,
+		host.TargetIsHttps, host.Client.Cnf.Crypt, host.Client.Cnf.Compress)
+	if v, ok := httpPools.Load(key); ok {
+		p := v.(*httpPool)
+		atomic.StoreInt64(&p.lastUsed, time.Now().Unix())
+		return p.transport
+	}
+	p := &httpPool{transport: &tracedTransport{newBackendTransport(host, serverName, dial)}, lastUsed: time.Now().Unix()}
+	if v, loaded := httpPools.LoadOrStore(key, p); loaded {
+		return v.(*httpPool).transport
+	}
+	return p.transport
+}
+
+// httpPoolGc 关闭长时间未使用的连接池
+func httpPoolGc() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		expire := time.Now().Add(-2 * httpPoolTimeout).Unix()
+		httpPools.Range(func(key, value interface{}) bool {
+			p := value.(*httpPool)
+			if atomic.LoadInt64(&p.lastUsed) < expire {
+				httpPools.Delete(key)
+				p.transport.(*tracedTransport).CloseIdleConnections()
+				logs.Debug("http upstream pool %s released", key)
+			}
+			return true
+		})
+	}
+}
+
+// GetHttpPoolStats 返回上游连接池的汇总统计
+func GetHttpPoolStats() PoolStats {
+	initHttpPool()
+	s := PoolStats{
+		MaxIdle:  httpPoolMaxIdle,
+		Requests: atomic.LoadInt64(&httpPoolTotals.requests),
+		Reused:   atomic.LoadInt64(&httpPoolTotals.reused),
+		NewConns: atomic.LoadInt64(&httpPoolTotals.newConns),
+	}
+	httpPools.Range(func(key, value interface{}) bool {
+		s.Pools++
+		return true
+	})
+	if s.NewConns > 0 {
+		s.NewTtfbMs = float64(atomic.LoadInt64(&httpPoolTotals.newTtfb)) / float64(s.NewConns) / 1e6
+	}
+	if s.Reused > 0 {
+		s.ReusedTtfbMs = float64(atomic.LoadInt64(&httpPoolTotals.reusedTtfb)) / float64(s.Reused) / 1e6
+	}
+	return s
+}
+
+// tracedTransport 统计连接复用情况和首字节耗时
+type tracedTransport struct {
+	http.RoundTripper
+}
+
+func (t *tracedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	var reused, got int32
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			atomic.StoreInt32(&got, 1)
+			if info.Reused {
+				atomic.StoreInt32(&reused, 1)
+			}
+		},
+		GotFirstResponseByte: func() {
+			if atomic.LoadInt32(&got) == 0 {
+				return
+			}
+			d := int64(time.Since(start))
+			if atomic.LoadInt32(&reused) == 1 {
+				atomic.AddInt64(&httpPoolTotals.reused, 1)
+				atomic.AddInt64(&httpPoolTotals.reusedTtfb, d)
+			} else {
+				atomic.AddInt64(&httpPoolTotals.newConns, 1)
+				atomic.AddInt64(&httpPoolTotals.newTtfb, d)
+			}
+		},
+	}
+	atomic.AddInt64(&httpPoolTotals.requests, 1)
+	return t.RoundTripper.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+}
+
+func (t *tracedTransport) CloseIdleConnections() {
+	if c, ok := t.RoundTripper.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// requestRemoteAddr 返回触发拨号的访问者地址，连接复用时为第一次建立连接的访问者
+func requestRemoteAddr(ctx context.Context) string {
+	if v, ok := ctx.Value(remoteAddrKey{}).(string); ok {
+		return v
+	}
+	return ""
+}
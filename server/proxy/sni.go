@@ -0,0 +1,213 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beego/beego"
+	"github.com/djylb/nps/lib/common"
+	"github.com/djylb/nps/lib/conn"
+	"github.com/djylb/nps/lib/crypt"
+	"github.com/djylb/nps/lib/file"
+	"github.com/djylb/nps/lib/logs"
+)
+
+// 同一个监听地址上的 sni 隧道共用一个路由
+var (
+	sniRouters   = make(map[string]*sniRouter)
+	sniRoutersMu sync.Mutex
+)
+
+type sniRouter struct {
+	addr     string
+	listener net.Listener
+	mu       sync.RWMutex
+	servers  map[int]*SniModeServer
+}
+
+// SniModeServer 按 TLS ClientHello 中的 SNI 将连接转发到对应客户端，不解密 TLS
+type SniModeServer struct {
+	BaseServer
+	router *sniRouter
+}
+
+func NewSniModeServer(bridge NetBridge, task *file.Tunnel) *SniModeServer {
+	allowLocalProxy, _ := beego.AppConfig.Bool("allow_local_proxy")
+	s := new(SniModeServer)
+	s.bridge = bridge
+	s.task = task
+	s.allowLocalProxy = allowLocalProxy
+	return s
+}
+
+func sniListenAddr(ip string, port int) string {
+	if ip == "" {
+		ip = "0.0.0.0"
+	}
+	return common.BuildAddress(ip, strconv.Itoa(port))
+}
+
+// IsSniPort reports whether the address is already served by sni tunnels,
+// so another sni tunnel can share it.
+func IsSniPort(ip string, port int) bool {
+	sniRoutersMu.Lock()
+	defer sniRoutersMu.Unlock()
+	_, ok := sniRouters[sniListenAddr(ip, port)]
+	return ok
+}
+
+func (s *SniModeServer) Start() error {
+	addr := sniListenAddr(s.task.ServerIp, s.task.Port)
+	sniRoutersMu.Lock()
+	r, ok := sniRouters[addr]
+	if ok {
+		if err := r.add(s); err != nil {
+			sniRoutersMu.Unlock()
+			return err
+		}
+		s.router = r
+		sniRoutersMu.Unlock()
+		return nil
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		sniRoutersMu.Unlock()
+		return err
+	}
+	r = &sniRouter{addr: addr, listener: l, servers: make(map[int]*SniModeServer)}
+	r.add(s)
+	s.router = r
+	sniRouters[addr] = r
+	sniRoutersMu.Unlock()
+	conn.Accept(l, r.handle)
+	return nil
+}
+
+func (s *SniModeServer) Close() error {
+	if s.router == nil {
+		return nil
+	}
+	sniRoutersMu.Lock()
+	defer sniRoutersMu.Unlock()
+	if s.router.remove(s.task.Id) == 0 {
+		delete(sniRouters, s.router.addr)
+		return s.router.listener.Close()
+	}
+	return nil
+}
+
+func (r *sniRouter) add(s *SniModeServer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, v := range r.servers {
+		if name := SniHostConflict(s.task.SniHost, v.task.SniHost); name != "" {
+			return errors.New("the sni host " + name + " is already used by task " + strconv.Itoa(v.task.Id))
+		}
+	}
+	r.servers[s.task.Id] = s
+	return nil
+}
+
+func (r *sniRouter) remove(id int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.servers, id)
+	return len(r.servers)
+}
+
+// match 精确匹配优先，其次为 *.example.com 形式的通配符（后缀最长的优先），最后为 *
+func (r *sniRouter) match(serverName string) *SniModeServer {
+	serverName = strings.ToLower(serverName)
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var wildcard, fallback *SniModeServer
+	var wildcardLen int
+	for _, s := range r.servers {
+		if !s.task.Status {
+			continue
+		}
+		for _, name := range sniNames(s.task.SniHost) {
+			switch {
+			case name == serverName:
+				return s
+			case name == "*":
+				fallback = s
+			case strings.HasPrefix(name, "*.") && strings.HasSuffix(serverName, name[1:]) && len(name) > wildcardLen:
+				wildcard, wildcardLen = s, len(name)
+			}
+		}
+	}
+	if wildcard != nil {
+		return wildcard
+	}
+	return fallback
+}
+
+func (r *sniRouter) handle(c net.Conn) {
+	c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	helloInfo, rb, err := crypt.ReadClientHello(c, nil)
+	c.SetReadDeadline(time.Time{})
+	if err != nil || helloInfo == nil {
+		logs.Debug("Failed to read clientHello from %v, err=%v", c.RemoteAddr(), err)
+		c.Close()
+		return
+	}
+	s := r.match(helloInfo.ServerName)
+	if s == nil {
+		logs.Debug("no sni tunnel for %s on %s, remote address %v", helloInfo.ServerName, r.addr, c.RemoteAddr())
+		c.Close()
+		return
+	}
+	s.handle(c, rb, helloInfo.ServerName)
+}
+
+func (s *SniModeServer) handle(c net.Conn, rb []byte, serverName string) {
+	defer c.Close()
+	if !s.task.AllowConn(common.GetIpByAddr(c.RemoteAddr().String())) {
+		logs.Debug("connection rate limit exceeded, task id %d, remote address %v", s.task.Id, c.RemoteAddr())
+		return
+	}
+	if err := s.CheckFlowAndConnNum(s.task.Client); err != nil {
+		logs.Warn("client id %d, task id %d, error %v, when sni connection", s.task.Client.Id, s.task.Id, err)
+		return
+	}
+	defer s.task.Client.CutConn()
+	targetAddr, err := s.task.Target.GetRandomTarget()
+	if err != nil {
+		logs.Warn("%v", err)
+		return
+	}
+	logs.Trace("new sni connection, sni %s, client %d, remote address %v", serverName, s.task.Client.Id, c.RemoteAddr())
+	s.DealClient(conn.NewConn(c), s.task.Client, targetAddr, rb, common.CONN_TCP, nil, []*file.Flow{s.task.Flow, s.task.Client.Flow}, s.task.Target.ProxyProtocol, s.task.Target.LocalProxy, s.task)
+}
+
+// SniHostConflict 返回两个 sni 域名列表中重复的域名，没有重复时返回空字符串
+func SniHostConflict(a, b string) string {
+	list := sniNames(b)
+	for _, name := range sniNames(a) {
+		if common.InStrArr(list, name) {
+			return name
+		}
+	}
+	return ""
+}
+
+// SniListenAddrEqual reports whether two sni tunnels listen on the same address.
+func SniListenAddrEqual(ip1 string, port1 int, ip2 string, port2 int) bool {
+	return sniListenAddr(ip1, port1) == sniListenAddr(ip2, port2)
+}
+
+// sniNames 解析逗号或换行分隔的域名列表
+func sniNames(s string) []string {
+	names := make([]string, 0)
+	for _, v := range strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return r == ',' || r == '\n' || r == '\r' || r == ' '
+	}) {
+		names = append(names, v)
+	}
+	return names
+}
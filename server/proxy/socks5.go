@@ -6,6 +6,7 @@ import (
 	"io"
 	"net"
 	"strconv"
+	"sync/atomic"
 
 	"github.com/beego/beego"
 	"github.com/djylb/nps/lib/common"
@@ -228,6 +229,10 @@ func (s *Sock5ModeServer) handleUDP(c net.Conn) {
 	}
 
 	var clientAddr net.Addr
+	var in, out int64
+	defer trackTunnelConn(s.task, c.RemoteAddr().String(), net.JoinHostPort(host, strconv.Itoa(int(port))), func() (int64, int64) {
+		return atomic.LoadInt64(&in), atomic.LoadInt64(&out)
+	}, closeAll(c, target, reply))()
 	// copy buffer
 	go func() {
 		b := common.BufPoolUdp.Get().([]byte)
@@ -247,6 +252,7 @@ func (s *Sock5ModeServer) handleUDP(c net.Conn) {
 				logs.Debug("write data to client error %v", err)
 				return
 			}
+			atomic.AddInt64(&in, int64(n))
 		}
 	}()
 
@@ -269,6 +275,7 @@ func (s *Sock5ModeServer) handleUDP(c net.Conn) {
 				logs.Warn("write data to user %v", err)
 				return
 			}
+			atomic.AddInt64(&out, int64(l))
 		}
 	}()
 
@@ -306,7 +313,7 @@ func (s *Sock5ModeServer) handleConn(c net.Conn) {
 		c.Close()
 		return
 	}
-	if (s.task.Client.Cnf.U != "" && s.task.Client.Cnf.P != "") || (s.task.MultiAccount != nil && len(s.task.MultiAccount.AccountMap) > 0) || (s.task.UserAuth != nil && len(s.task.UserAuth.AccountMap) > 0) {
+	if s.hasAccounts() || s.task.AuthUrl != "" {
 		buf[1] = UserPassAuth
 		c.Write(buf)
 		if err := s.Auth(c); err != nil {
@@ -344,7 +351,19 @@ func (s *Sock5ModeServer) Auth(c net.Conn) error {
 		return err
 	}
 
-	if common.CheckAuthWithAccountMap(string(user), string(pass), s.task.Client.Cnf.U, s.task.Client.Cnf.P, file.GetAccountMap(s.task.MultiAccount), file.GetAccountMap(s.task.UserAuth)) {
+	ok := !s.hasAccounts() || checkAuthLimited(c.RemoteAddr().String(), func() bool {
+		return common.CheckAuthWithAccountMap(string(user), string(pass), s.task.Client.Cnf.U, s.task.Client.Cnf.P, file.GetAccountMap(s.task.MultiAccount), file.GetAccountMap(s.task.UserAuth))
+	})
+	// 本地账号通过后再由外部认证地址校验
+	if ok && s.task.AuthUrl != "" {
+		if resp, err := tunnelForwardAuth(s.task, c.RemoteAddr(), "", string(user), string(pass), nil); err != nil {
+			if resp != nil {
+				resp.Body.Close()
+			}
+			ok = false
+		}
+	}
+	if ok {
 		if _, err := c.Write([]byte{userAuthVersion, authSuccess}); err != nil {
 			return err
 		}
@@ -357,9 +376,27 @@ func (s *Sock5ModeServer) Auth(c net.Conn) error {
 	}
 }
 
+// hasAccounts 是否配置了本地认证账号
+func (s *Sock5ModeServer) hasAccounts() bool {
+	return (s.task.Client.Cnf.U != "" && s.task.Client.Cnf.P != "") || (s.task.MultiAccount != nil && len(s.task.MultiAccount.AccountMap) > 0) || (s.task.UserAuth != nil && len(s.task.UserAuth.AccountMap) > 0)
+}
+
 // start
 func (s *Sock5ModeServer) Start() error {
 	return conn.NewTcpListenerAndProcess(common.BuildAddress(s.task.ServerIp, strconv.Itoa(s.task.Port)), func(c net.Conn) {
+		if s.task.AcceptProxyProtocol {
+			c = conn.AcceptProxyProtocol(c)
+		}
+		// 认证前先检查黑白名单及地区限制
+		if !IsIpAllowed(c.RemoteAddr().String(), s.task.Client, s.task, nil) {
+			c.Close()
+			return
+		}
+		if !s.task.AllowConn(common.GetIpByAddr(c.RemoteAddr().String())) {
+			logs.Debug("connection rate limit exceeded, task id %d, remote address %v", s.task.Id, c.RemoteAddr())
+			c.Close()
+			return
+		}
 		if err := s.CheckFlowAndConnNum(s.task.Client); err != nil {
 			logs.Warn("client id %d, task id %d, error %v, when socks5 connection", s.task.Client.Id, s.task.Id, err)
 			c.Close()
@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"crypto/tls"
 	"errors"
 	"net"
 	"net/http"
@@ -44,7 +45,18 @@ func NewTunnelModeServer(process process, bridge NetBridge, task *file.Tunnel) *
 
 // 开始
 func (s *TunnelModeServer) Start() error {
+	var tlsConfig *tls.Config
+	if s.task.Mode == "tcp" && s.task.TlsOffload {
+		var err error
+		if tlsConfig, err = newTlsOffloadConfig(s.task); err != nil {
+			return err
+		}
+	}
 	return conn.NewTcpListenerAndProcess(common.BuildAddress(s.task.ServerIp, strconv.Itoa(s.task.Port)), func(c net.Conn) {
+		if s.task.AcceptProxyProtocol {
+			c = conn.AcceptProxyProtocol(c)
+		}
+
 		// 将新连接加入到连接池中
 		s.activeConnections.Store(c, struct{}{})
 
@@ -57,6 +69,30 @@ func (s *TunnelModeServer) Start() error {
 			}
 		}()
 
+		if !s.task.AllowConn(common.GetIpByAddr(c.RemoteAddr().String())) {
+			logs.Debug("connection rate limit exceeded, task id %d, remote address %v", s.task.Id, c.RemoteAddr())
+			c.Close()
+			return
+		}
+
+		pc := c
+		if tlsConfig != nil {
+			var err error
+			if pc, err = tlsOffload(c, tlsConfig); err != nil {
+				logs.Debug("tls handshake failed, task id %d, remote address %v, error %v", s.task.Id, c.RemoteAddr(), err)
+				return
+			}
+		}
+
+		if s.task.Mode == "tcp" && s.task.AuthUrl != "" {
+			if resp, err := tunnelForwardAuth(s.task, c.RemoteAddr(), "", "", "", nil); err != nil {
+				if resp != nil {
+					resp.Body.Close()
+				}
+				return
+			}
+		}
+
 		if err := s.CheckFlowAndConnNum(s.task.Client); err != nil {
 			logs.Warn("client id %d, task id %d, error %v, when tcp connection", s.task.Client.Id, s.task.Id, err)
 			c.Close()
@@ -65,7 +101,7 @@ func (s *TunnelModeServer) Start() error {
 
 		logs.Trace("new tcp connection,local port %d,client %d,remote address %v", s.task.Port, s.task.Client.Id, c.RemoteAddr())
 
-		s.process(conn.NewConn(c), s)
+		s.process(conn.NewConn(pc), s)
 		s.task.Client.CutConn()
 	}, &s.listener)
 }
@@ -153,12 +189,27 @@ func ProcessHttp(c *conn.Conn, s *TunnelModeServer) error {
 		return err
 	}
 
+	r.RemoteAddr = c.RemoteAddr().String()
 	if err := s.auth(r, nil, s.task.Client.Cnf.U, s.task.Client.Cnf.P, s.task.MultiAccount, s.task.UserAuth); err != nil {
 		c.Write([]byte(common.ProxyAuthRequiredBytes))
 		c.Close()
 		return err
 	}
 
+	if s.task.AuthUrl != "" {
+		user, pass := proxyAuthCredentials(r)
+		if resp, err := tunnelForwardAuth(s.task, c.RemoteAddr(), addr, user, pass, r); err != nil {
+			if resp != nil {
+				writeDenial(c, resp)
+				resp.Body.Close()
+			} else {
+				c.Write([]byte("HTTP/1.1 502 Bad Gateway\r\nConnection: close\r\nContent-Length: 0\r\n\r\n"))
+			}
+			c.Close()
+			return err
+		}
+	}
+
 	if r.Method == "CONNECT" {
 		c.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
 		rb = nil
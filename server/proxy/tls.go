@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beego/beego"
+	"github.com/djylb/nps/lib/common"
+	"github.com/djylb/nps/lib/file"
+	"github.com/djylb/nps/lib/logs"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+var (
+	acmeOnce sync.Once
+	acmeMgr  *autocert.Manager
+)
+
+// acmeManager 返回全局共用的 ACME 证书管理器，证书缓存在 acme_cache_dir
+func acmeManager() *autocert.Manager {
+	acmeOnce.Do(func() {
+		dir := beego.AppConfig.DefaultString("acme_cache_dir", "conf/acme")
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(common.GetRunPath(), dir)
+		}
+		acmeMgr = &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(dir),
+			Email:      beego.AppConfig.String("acme_email"),
+			HostPolicy: acmeHostPolicy,
+		}
+		if u := beego.AppConfig.String("acme_directory_url"); u != "" {
+			acmeMgr.Client = &acme.Client{DirectoryURL: u}
+		}
+	})
+	return acmeMgr
+}
+
+// acmeHostPolicy 只为开启了 TLS 卸载的隧道中配置的域名申请证书
+func acmeHostPolicy(_ context.Context, host string) error {
+	if acmeTask(host) == nil {
+		return errors.New("acme: host " + host + " is not configured")
+	}
+	return nil
+}
+
+func acmeTask(host string) *file.Tunnel {
+	host = strings.ToLower(host)
+	var task *file.Tunnel
+	file.GetDb().JsonDb.Tasks.Range(func(key, value interface{}) bool {
+		v := value.(*file.Tunnel)
+		if v.TlsOffload && common.InStrArr(sniNames(v.AcmeDomain), host) {
+			task = v
+			return false
+		}
+		return true
+	})
+	return task
+}
+
+// AcmeHTTPHandler 在 http 代理端口上响应 ACME HTTP-01 验证请求，其它请求交给 fallback
+func AcmeHTTPHandler(fallback http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/.well-known/acme-challenge/") && acmeTask(common.GetIpByAddr(r.Host)) != nil {
+			acmeManager().HTTPHandler(fallback).ServeHTTP(w, r)
+			return
+		}
+		fallback.ServeHTTP(w, r)
+	})
+}
+
+// newTlsOffloadConfig 根据隧道配置生成 TLS 卸载使用的配置，
+// 配置了 AcmeDomain 时通过 ACME 签发证书，否则使用证书文件
+func newTlsOffloadConfig(task *file.Tunnel) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if task.AcmeDomain != "" {
+		cfg.GetCertificate = acmeManager().GetCertificate
+	} else {
+		cert, ok := common.LoadCert(task.CertFilePath, task.KeyFilePath)
+		if !ok {
+			return nil, errors.New("load tls certificate failed")
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if task.ClientCaFile != "" {
+		ca, err := common.GetCertContent(task.ClientCaFile, "CERTIFICATE")
+		if err != nil || ca == "" {
+			return nil, errors.New("load client ca failed")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(ca)) {
+			return nil, errors.New("no valid client ca certificate")
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if task.AcmeDomain == "" {
+		return cfg, nil
+	}
+	// 只对 ACME TLS-ALPN-01 验证连接协商 ALPN，且不要求客户端证书；
+	// 普通连接不协商 ALPN，由后端决定应用层协议
+	challenge := cfg.Clone()
+	challenge.NextProtos = []string{acme.ALPNProto}
+	challenge.ClientAuth = tls.NoClientCert
+	cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto {
+			return challenge, nil
+		}
+		return nil, nil
+	}
+	return cfg, nil
+}
+
+// tlsOffload 完成 TLS 握手，失败时返回错误，由调用方关闭连接
+func tlsOffload(c net.Conn, cfg *tls.Config) (net.Conn, error) {
+	tc := tls.Server(c, cfg)
+	tc.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := tc.Handshake(); err != nil {
+		return nil, err
+	}
+	tc.SetDeadline(time.Time{})
+	if tc.ConnectionState().NegotiatedProtocol == acme.ALPNProto {
+		logs.Debug("acme tls-alpn-01 challenge from %v", c.RemoteAddr())
+		return nil, errors.New("acme challenge connection")
+	}
+	return tc, nil
+}
@@ -3,8 +3,10 @@ package proxy
 import (
 	"io"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/beego/beego"
@@ -14,6 +16,25 @@ import (
 	"github.com/djylb/nps/lib/logs"
 )
 
+// udpSession 统计 udp 会话的收发字节数
+type udpSession struct {
+	io.ReadWriteCloser
+	in  int64
+	out int64
+}
+
+func (s *udpSession) Write(p []byte) (int, error) {
+	n, err := s.ReadWriteCloser.Write(p)
+	atomic.AddInt64(&s.in, int64(n))
+	return n, err
+}
+
+func (s *udpSession) Read(p []byte) (int, error) {
+	n, err := s.ReadWriteCloser.Read(p)
+	atomic.AddInt64(&s.out, int64(n))
+	return n, err
+}
+
 type UdpModeServer struct {
 	BaseServer
 	addrMap  sync.Map
@@ -49,14 +70,10 @@ func (s *UdpModeServer) Start() error {
 			continue
 		}
 
-		// 判断访问地址是否在全局黑名单内
-		if IsGlobalBlackIp(addr.String()) {
-			break
-		}
-
-		// 判断访问地址是否在黑名单内
-		if common.IsBlackIp(addr.String(), s.task.Client.VerifyKey, s.task.Client.BlackIpList) {
-			break
+		// 判断访问地址是否在黑白名单允许范围内
+		if !IsIpAllowed(addr.String(), s.task.Client, s.task, nil) {
+			common.BufPoolUdp.Put(buf)
+			continue
 		}
 
 		logs.Trace("New udp connection,client %d,remote address %v", s.task.Client.Id, addr)
@@ -80,19 +97,39 @@ func (s *UdpModeServer) process(addr *net.UDPAddr, data []byte) {
 			s.task.Client.Flow.Add(dataLength, dataLength)
 		}
 	} else {
+		if !s.task.AllowConn(addr.IP.String()) {
+			logs.Debug("udp session rate limit exceeded, task id %d, remote address %v", s.task.Id, addr)
+			return
+		}
 		if err := s.CheckFlowAndConnNum(s.task.Client); err != nil {
 			logs.Warn("client id %d, task id %d,error %v, when udp connection", s.task.Client.Id, s.task.Id, err)
 			return
 		}
+		countVisit(addr.String())
 		defer s.task.Client.CutConn()
 		link := conn.NewLink(common.CONN_UDP, s.task.Target.TargetStr, s.task.Client.Cnf.Crypt, s.task.Client.Cnf.Compress, addr.String(), s.allowLocalProxy && s.task.Target.LocalProxy)
 		clientConn, err := s.bridge.SendLinkInfo(s.task.Client.Id, link, s.task)
 		if err != nil {
 			return
 		}
-		target := conn.GetConn(clientConn, s.task.Client.Cnf.Crypt, s.task.Client.Cnf.Compress, nil, true)
+		target := &udpSession{ReadWriteCloser: conn.GetConn(clientConn, s.task.Client.Cnf.Crypt, s.task.Client.Cnf.Compress, nil, true)}
 		s.addrMap.Store(addr.String(), target)
 		defer target.Close()
+		defer trackTunnelConn(s.task, addr.String(), link.Host, func() (int64, int64) {
+			return atomic.LoadInt64(&target.in), atomic.LoadInt64(&target.out)
+		}, func() {
+			s.addrMap.Delete(addr.String())
+			target.Close()
+		})()
+
+		if logs.AccessEnabled() {
+			start := time.Now()
+			listen := ":" + strconv.Itoa(s.task.Port)
+			writeConnAccess("tunnel", s.task.Id, "udp", "connect", addr.String(), listen, link.Host, 0, 0, start)
+			defer func() {
+				writeConnAccess("tunnel", s.task.Id, "udp", "close", addr.String(), listen, link.Host, atomic.LoadInt64(&target.in), atomic.LoadInt64(&target.out), start)
+			}()
+		}
 
 		_, err = target.Write(data)
 		if err != nil {
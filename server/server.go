@@ -13,6 +13,7 @@ import (
 	"github.com/djylb/nps/bridge"
 	"github.com/djylb/nps/lib/common"
 	"github.com/djylb/nps/lib/file"
+	"github.com/djylb/nps/lib/geoip"
 	"github.com/djylb/nps/lib/logs"
 	"github.com/djylb/nps/lib/version"
 	"github.com/djylb/nps/server/proxy"
@@ -107,6 +108,7 @@ func StartNewServer(bridgePort int, cnf *file.Tunnel, bridgeType string, bridgeD
 	}
 	go DealBridgeTask()
 	go dealClientFlow()
+	go dealCertExpiry()
 	if svr := NewMode(Bridge, cnf); svr != nil {
 		if err := svr.Start(); err != nil {
 			logs.Error("%v", err)
@@ -125,6 +127,7 @@ func dealClientFlow() {
 		select {
 		case <-ticker.C:
 			dealClientData()
+			checkLimits()
 		}
 	}
 }
@@ -143,6 +146,8 @@ func NewMode(Bridge *bridge.Bridge, c *file.Tunnel) proxy.Service {
 		service = proxy.NewTunnelModeServer(proxy.HandleTrans, Bridge, c)
 	case "udp":
 		service = proxy.NewUdpModeServer(Bridge, c)
+	case "sni":
+		service = proxy.NewSniModeServer(Bridge, c)
 	case "webServer":
 		InitFromCsv()
 		t := &file.Tunnel{
@@ -198,8 +203,9 @@ func AddTask(t *file.Tunnel) error {
 		RunList.Store(t.Id, nil)
 		return nil
 	}
-	if b := tool.TestServerPort(t.Port, t.Mode); !b && t.Mode != "httpHostServer" {
+	if b := TestTaskPort(t.Port, t.ServerIp, t.Mode); !b && t.Mode != "httpHostServer" {
 		logs.Error("taskId %d start error port %d open failed", t.Id, t.Port)
+		taskStartFailed(t, errors.New("the port open error"))
 		return errors.New("the port open error")
 	}
 	if minute, err := beego.AppConfig.Int("flow_store_interval"); err == nil && minute > 0 {
@@ -212,6 +218,7 @@ func AddTask(t *file.Tunnel) error {
 		go func() {
 			if err := svr.Start(); err != nil {
 				logs.Error("clientId %d taskId %d start error %v", t.Client.Id, t.Id, err)
+				taskStartFailed(t, err)
 				//delete(RunList, t.Id)
 				RunList.Delete(t.Id)
 				return
@@ -223,12 +230,41 @@ func AddTask(t *file.Tunnel) error {
 	return nil
 }
 
+// CheckSniHost 检查 sni 隧道的域名是否与同一监听地址上已保存的其它 sni 隧道重复
+func CheckSniHost(t *file.Tunnel) error {
+	if t.Mode != "sni" {
+		return nil
+	}
+	var err error
+	file.GetDb().JsonDb.Tasks.Range(func(key, value interface{}) bool {
+		v := value.(*file.Tunnel)
+		if v.Id == t.Id || v.Mode != "sni" || !proxy.SniListenAddrEqual(v.ServerIp, v.Port, t.ServerIp, t.Port) {
+			return true
+		}
+		if name := proxy.SniHostConflict(t.SniHost, v.SniHost); name != "" {
+			err = errors.New("the sni host " + name + " is already used by task " + strconv.Itoa(v.Id))
+			return false
+		}
+		return true
+	})
+	return err
+}
+
+// TestTaskPort 检查隧道端口是否可用，sni 隧道可以共用已有 sni 隧道的端口
+func TestTaskPort(port int, serverIp, mode string) bool {
+	if mode == "sni" && proxy.IsSniPort(serverIp, port) {
+		return true
+	}
+	return tool.TestServerPort(port, mode)
+}
+
 // start task
 func StartTask(id int) error {
 	if t, err := file.GetDb().GetTask(id); err != nil {
 		return err
 	} else {
-		if !tool.TestServerPort(t.Port, t.Mode) {
+		if !TestTaskPort(t.Port, t.ServerIp, t.Mode) {
+			taskStartFailed(t, errors.New("the port open error"))
 			return errors.New("the port open error")
 		}
 		AddTask(t)
@@ -444,8 +480,8 @@ func GetHostList(start, length, clientId int, search, sortField, order string) (
 }
 
 // get client list
-func GetClientList(start, length int, search, sortField, order string, clientId int) (list []*file.Client, cnt int) {
-	list, cnt = file.GetDb().GetClientList(start, length, search, sortField, order, clientId)
+func GetClientList(start, length int, search, sortField, order string, clientId, groupId int, tag string) (list []*file.Client, cnt int) {
+	list, cnt = file.GetDb().GetClientList(start, length, search, sortField, order, clientId, groupId, tag)
 	//sort by Id, Remark, Port..., asc or desc
 	if sortField == "Id" {
 		if order == "asc" {
@@ -601,6 +637,11 @@ func DelClientConnect(clientId int) {
 	Bridge.DelClient(clientId)
 }
 
+// PurgeHttpCache 清除域名的响应缓存，返回清除的条数
+func PurgeHttpCache(hostId int, path string) int {
+	return proxy.PurgeHttpCache(hostId, path)
+}
+
 func GetDashboardData() map[string]interface{} {
 	data := make(map[string]interface{})
 	data["version"] = version.VERSION
@@ -662,6 +703,10 @@ func GetDashboardData() map[string]interface{} {
 	data["serverIp"] = common.GetServerIp()
 	data["p2pPort"] = beego.AppConfig.String("p2p_port")
 	data["logLevel"] = beego.AppConfig.String("log_level")
+	data["geoipEnabled"] = geoip.Enabled()
+	data["geoCountries"] = geoip.TopCountries(10)
+	data["httpPool"] = proxy.GetHttpPoolStats()
+	data["httpCache"] = proxy.GetHttpCacheStats()
 	tcpCount := 0
 
 	file.GetDb().JsonDb.Clients.Range(func(key, value interface{}) bool {
@@ -0,0 +1,746 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"html"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/beego/beego"
+	"github.com/djylb/nps/lib/audit"
+	"github.com/djylb/nps/lib/common"
+	"github.com/djylb/nps/lib/file"
+	"github.com/djylb/nps/server"
+	"github.com/djylb/nps/server/proxy"
+	"github.com/djylb/nps/server/tool"
+)
+
+// ApiController /api/v1 的 JSON 接口，使用 bearer 令牌认证，不使用 web 登录的会话
+type ApiController struct {
+	beego.Controller
+	token *file.ApiToken
+}
+
+// Prepare 校验令牌，只读令牌只能发起 GET 请求，其余权限见 ApiRoutes 的 Scope
+func (s *ApiController) Prepare() {
+	auth := s.Ctx.Input.Header("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		s.Ctx.Output.Header("WWW-Authenticate", `Bearer realm="nps"`)
+		s.apiErr(http.StatusUnauthorized, "missing bearer token")
+	}
+	token, err := file.GetDb().GetApiToken(strings.TrimSpace(auth[7:]))
+	if err != nil {
+		s.Ctx.Output.Header("WWW-Authenticate", `Bearer realm="nps", error="invalid_token"`)
+		s.apiErr(http.StatusUnauthorized, err.Error())
+	}
+	s.token = token
+	if token.Scope == file.TokenScopeRead && s.Ctx.Request.Method != http.MethodGet && s.Ctx.Request.Method != http.MethodHead {
+		s.apiErr(http.StatusForbidden, "the token is read-only")
+	}
+	if !s.allowed() {
+		s.apiErr(http.StatusForbidden, "permission denied")
+	}
+}
+
+// Status 服务端概况
+func (s *ApiController) Status() {
+	s.apiJSON(http.StatusOK, server.GetDashboardData())
+}
+
+func (s *ApiController) ListClients() {
+	start, length := s.page()
+	list, cnt := server.GetClientList(start, length, s.GetString("search"), "", "", s.token.ClientId, s.GetIntNoErr("group_id"), s.GetString("tag"))
+	items := make([]*apiClient, len(list))
+	for i, v := range list {
+		items[i] = newApiClient(v)
+	}
+	s.apiJSON(http.StatusOK, map[string]interface{}{"total": cnt, "items": items})
+}
+
+func (s *ApiController) GetClient() {
+	s.apiJSON(http.StatusOK, newApiClient(s.client()))
+}
+
+func (s *ApiController) AddClient() {
+	v := &apiClient{Status: true, ConfigConnAllow: true}
+	s.decode(v)
+	c := &file.Client{CreateTime: time.Now().Format("2006-01-02 15:04:05")}
+	s.saveClient(v, c, true)
+}
+
+func (s *ApiController) PutClient() {
+	c := s.client()
+	v := &apiClient{VerifyKey: c.VerifyKey, Status: true, ConfigConnAllow: true, WebUsername: c.WebUserName}
+	s.decode(v)
+	s.saveClient(v, c, false)
+}
+
+func (s *ApiController) PatchClient() {
+	c := s.client()
+	v := newApiClient(c)
+	s.decode(v)
+	s.saveClient(v, c, false)
+}
+
+func (s *ApiController) saveClient(v *apiClient, c *file.Client, isNew bool) {
+	admin := s.token.ClientId == 0
+	changeUsername := beego.AppConfig.DefaultBool("allow_user_change_username", false)
+	fields := make(map[string]string)
+	v.validate(fields)
+	if (admin || changeUsername) && v.WebUsername != "" {
+		if v.WebUsername == beego.AppConfig.String("web_username") || !file.GetDb().VerifyUserName(v.WebUsername, c.Id) {
+			fields["web_username"] = "web login username duplicate"
+		}
+	}
+	if admin && !isNew && !file.GetDb().VerifyVkey(v.VerifyKey, c.Id) {
+		fields["verify_key"] = "verify key duplicate"
+	}
+	s.checkFields(fields)
+	htmlStrings(v, html.EscapeString)
+	before := audit.Take(c)
+	v.apply(c, admin, changeUsername)
+	if isNew {
+		if err := file.GetDb().NewClient(c); err != nil {
+			s.apiErr(http.StatusConflict, err.Error())
+		}
+		s.audit(audit.ActionCreate, "client", c.Id, nil, c)
+		s.apiJSON(http.StatusCreated, newApiClient(c))
+	}
+	c.HashPasswords()
+	c.ResetRate()
+	if !c.Status {
+		server.DelClientConnect(c.Id)
+	}
+	file.GetDb().JsonDb.StoreClientsToJsonFile()
+	s.audit(audit.ActionUpdate, "client", c.Id, before, c)
+	s.apiJSON(http.StatusOK, newApiClient(c))
+}
+
+// ClientConfig 生成客户端的 npc.conf、systemd 或 docker-compose 配置
+func (s *ApiController) ClientConfig() {
+	c := s.client()
+	fields := make(map[string]string)
+	o := readNpcConfOptions(&s.Controller, fields)
+	s.checkFields(fields)
+	s.apiJSON(http.StatusOK, &apiNpcConf{Kind: o.Kind, Filename: npcConfKinds[o.Kind], Content: renderNpcConf(c, o)})
+}
+
+// AddConfigLink 创建配置的一次性下载链接
+func (s *ApiController) AddConfigLink() {
+	c := s.client()
+	fields := make(map[string]string)
+	o := readNpcConfOptions(&s.Controller, fields)
+	expire := npcConfExpire(s.GetIntNoErr("expire"), fields)
+	s.checkFields(fields)
+	path, t := newNpcConfLink(c.Id, o, expire)
+	s.apiJSON(http.StatusCreated, &apiNpcConfLink{Path: path, ExpireTime: t.Unix()})
+}
+
+func (s *ApiController) DelClient() {
+	c := s.client()
+	if err := file.GetDb().DelClient(c.Id); err != nil {
+		s.apiErr(http.StatusInternalServerError, err.Error())
+	}
+	server.DelTunnelAndHostByClientId(c.Id, false)
+	server.DelClientConnect(c.Id)
+	s.audit(audit.ActionDelete, "client", c.Id, audit.Take(c), nil)
+	s.apiNoContent()
+}
+
+func (s *ApiController) ListTunnels() {
+	start, length := s.page()
+	mode, search := s.GetString("mode"), s.GetString("search")
+	clientId := s.apiClientId()
+	items := make([]*apiTunnel, 0)
+	var cnt int
+	for _, key := range file.GetMapKeys(file.GetDb().JsonDb.Tasks, false, "", "") {
+		value, ok := file.GetDb().JsonDb.Tasks.Load(key)
+		if !ok {
+			continue
+		}
+		v := value.(*file.Tunnel)
+		if v.Client == nil || v.Mode == "httpHostServer" || (mode != "" && v.Mode != mode) || (clientId != 0 && v.Client.Id != clientId) {
+			continue
+		}
+		if search != "" && !(v.Id == common.GetIntNoErrByStr(search) || v.Port == common.GetIntNoErrByStr(search) || common.ContainsFold(v.Remark, search) ||
+			(v.Target != nil && common.ContainsFold(v.Target.TargetStr, search))) {
+			continue
+		}
+		if cnt++; cnt > start && (length == 0 || len(items) < length) {
+			items = append(items, newApiTunnel(v))
+		}
+	}
+	s.apiJSON(http.StatusOK, map[string]interface{}{"total": cnt, "items": items})
+}
+
+func (s *ApiController) GetTunnel() {
+	s.apiJSON(http.StatusOK, newApiTunnel(s.tunnel()))
+}
+
+func (s *ApiController) AddTunnel() {
+	v := &apiTunnel{Status: true, ClientId: s.token.ClientId}
+	s.decode(v)
+	s.saveTunnel(v, nil)
+}
+
+func (s *ApiController) PutTunnel() {
+	t := s.tunnel()
+	v := &apiTunnel{Status: true, ClientId: t.Client.Id, Mode: t.Mode}
+	s.decode(v)
+	s.saveTunnel(v, t)
+}
+
+func (s *ApiController) PatchTunnel() {
+	t := s.tunnel()
+	v := newApiTunnel(t)
+	s.decode(v)
+	s.saveTunnel(v, t)
+}
+
+// saveTunnel 新建或修改隧道，t 为空时新建
+func (s *ApiController) saveTunnel(v *apiTunnel, t *file.Tunnel) {
+	fields := make(map[string]string)
+	v.validate(fields)
+	client := s.ownClient(v.ClientId, fields)
+	if t != nil && v.Mode != t.Mode && (v.Mode == "secret" || v.Mode == "p2p" || t.Mode == "secret" || t.Mode == "p2p") {
+		fields["mode"] = "can not change between " + t.Mode + " and " + v.Mode
+	}
+	s.checkFields(fields)
+	htmlStrings(v, html.EscapeString)
+	old := new(file.Tunnel)
+	if t != nil {
+		old = t
+	}
+	s.adminOnly(fields, "auth_url", v.AuthUrl, old.AuthUrl, "")
+	s.adminOnly(fields, "cert_file_path", v.CertFilePath, old.CertFilePath, "CERTIFICATE")
+	s.adminOnly(fields, "key_file_path", v.KeyFilePath, old.KeyFilePath, "PRIVATE")
+	s.adminOnly(fields, "client_ca_file", v.ClientCaFile, old.ClientCaFile, "CERTIFICATE")
+	tmp := &file.Tunnel{Client: client}
+	v.apply(tmp)
+	if err := checkTlsOffload(tmp); err != nil {
+		fields["tls_offload"] = err.Error()
+	}
+	if err := checkProxyProtocol(tmp); err != nil {
+		fields["accept_proxy_protocol"] = err.Error()
+	}
+	if t != nil {
+		tmp.Id = t.Id
+	}
+	if err := server.CheckSniHost(tmp); err != nil {
+		fields["sni_host"] = err.Error()
+	}
+	if err := checkAuthUrl(tmp.AuthUrl); err != nil {
+		fields["auth_url"] = err.Error()
+	}
+	s.checkFields(fields)
+	if t == nil {
+		s.addTunnel(v, client)
+	}
+	if v.Port <= 0 {
+		v.Port = tool.GenerateServerPort(v.Mode)
+	}
+	if v.Port != t.Port && !server.TestTaskPort(v.Port, v.ServerIp, v.Mode) {
+		s.apiErr(http.StatusConflict, "The port cannot be opened because it may has been occupied or is no longer allowed.")
+	}
+	if !client.AllowPort(v.Port, v.Mode) {
+		s.apiErr(http.StatusConflict, "The port is not in the allowed port range of the client")
+	}
+	before := audit.Take(t)
+	server.StopServer(t.Id)
+	t.Client = client
+	v.apply(t)
+	t.UserAuth.HashPasswords()
+	file.GetDb().UpdateTask(t)
+	s.audit(audit.ActionUpdate, "tunnel", t.Id, before, t)
+	if v.Status {
+		if err := server.StartTask(t.Id); err != nil {
+			s.apiErr(http.StatusConflict, err.Error())
+		}
+	}
+	s.apiJSON(http.StatusOK, newApiTunnel(t))
+}
+
+func (s *ApiController) addTunnel(v *apiTunnel, client *file.Client) {
+	if client.TunnelNumExceeded() {
+		s.apiErr(http.StatusConflict, "The number of tunnels exceeds the limit")
+	}
+	if v.Port <= 0 {
+		v.Port = tool.GenerateServerPort(v.Mode)
+	}
+	if !server.TestTaskPort(v.Port, v.ServerIp, v.Mode) {
+		s.apiErr(http.StatusConflict, "The port cannot be opened because it may has been occupied or is no longer allowed.")
+	}
+	if !client.AllowPort(v.Port, v.Mode) {
+		s.apiErr(http.StatusConflict, "The port is not in the allowed port range of the client")
+	}
+	t := &file.Tunnel{Id: int(file.GetDb().JsonDb.GetTaskId()), Client: client}
+	v.apply(t)
+	flow := t.Flow
+	if err := file.GetDb().NewTask(t); err != nil {
+		s.apiErr(http.StatusConflict, err.Error())
+	}
+	t.Flow.FlowLimit, t.Flow.TimeLimit = flow.FlowLimit, flow.TimeLimit
+	s.audit(audit.ActionCreate, "tunnel", t.Id, nil, t)
+	if v.Status {
+		t.Status = true
+		if err := server.AddTask(t); err != nil {
+			t.Status = false
+			file.GetDb().UpdateTask(t)
+			s.apiErr(http.StatusConflict, err.Error())
+		}
+	}
+	file.GetDb().UpdateTask(t)
+	s.apiJSON(http.StatusCreated, newApiTunnel(t))
+}
+
+func (s *ApiController) DelTunnel() {
+	t := s.tunnel()
+	before := audit.Take(t)
+	if err := server.DelTask(t.Id); err != nil {
+		s.apiErr(http.StatusInternalServerError, err.Error())
+	}
+	s.audit(audit.ActionDelete, "tunnel", t.Id, before, nil)
+	s.apiNoContent()
+}
+
+func (s *ApiController) ListHosts() {
+	start, length := s.page()
+	list, cnt := server.GetHostList(start, length, s.apiClientId(), s.GetString("search"), "", "")
+	items := make([]*apiHost, len(list))
+	for i, v := range list {
+		items[i] = newApiHost(v)
+	}
+	s.apiJSON(http.StatusOK, map[string]interface{}{"total": cnt, "items": items})
+}
+
+func (s *ApiController) GetHost() {
+	s.apiJSON(http.StatusOK, newApiHost(s.host()))
+}
+
+func (s *ApiController) AddHost() {
+	v := &apiHost{Status: true, Scheme: "all", Location: "/", ClientId: s.token.ClientId}
+	s.decode(v)
+	s.saveHost(v, nil)
+}
+
+func (s *ApiController) PutHost() {
+	h := s.host()
+	v := &apiHost{Status: true, Scheme: "all", Location: "/", ClientId: h.Client.Id}
+	s.decode(v)
+	s.saveHost(v, h)
+}
+
+func (s *ApiController) PatchHost() {
+	h := s.host()
+	v := newApiHost(h)
+	s.decode(v)
+	s.saveHost(v, h)
+}
+
+// saveHost 新建或修改域名，h 为空时新建
+func (s *ApiController) saveHost(v *apiHost, h *file.Host) {
+	fields := make(map[string]string)
+	v.validate(fields)
+	client := s.ownClient(v.ClientId, fields)
+	s.checkFields(fields)
+	htmlStrings(v, html.EscapeString)
+	old := new(file.Host)
+	if h != nil {
+		old = h
+	}
+	s.adminOnly(fields, "auth_url", v.AuthUrl, old.AuthUrl, "")
+	s.adminOnly(fields, "oidc_issuer", v.OidcIssuer, old.OidcIssuer, "")
+	s.adminOnly(fields, "cert_file_path", v.CertFilePath, old.CertFilePath, "CERTIFICATE")
+	s.adminOnly(fields, "key_file_path", v.KeyFilePath, old.KeyFilePath, "PRIVATE")
+	tmp := &file.Host{Client: client}
+	if h != nil {
+		tmp.Id, tmp.OidcClientSecret = h.Id, h.OidcClientSecret
+	}
+	v.apply(tmp)
+	if err := checkOidc(tmp); err != nil {
+		fields["oidc_issuer"] = err.Error()
+	}
+	if err := checkAuthUrl(tmp.AuthUrl); err != nil {
+		fields["auth_url"] = err.Error()
+	}
+	s.checkFields(fields)
+	if file.GetDb().IsHostExist(tmp) {
+		s.apiErr(http.StatusConflict, "host has exist")
+	}
+	if h == nil {
+		if client.TunnelNumExceeded() {
+			s.apiErr(http.StatusConflict, "The number of tunnels exceeds the limit")
+		}
+		tmp.Id = int(file.GetDb().JsonDb.GetHostId())
+		flow := tmp.Flow
+		if err := file.GetDb().NewHost(tmp); err != nil {
+			s.apiErr(http.StatusConflict, err.Error())
+		}
+		tmp.Flow.FlowLimit, tmp.Flow.TimeLimit = flow.FlowLimit, flow.TimeLimit
+		file.GetDb().JsonDb.StoreHostToJsonFile()
+		s.audit(audit.ActionCreate, "host", tmp.Id, nil, tmp)
+		s.apiJSON(http.StatusCreated, newApiHost(tmp))
+	}
+	before := audit.Take(h)
+	h.Client = client
+	v.apply(h)
+	h.UserAuth.HashPasswords()
+	file.GetDb().JsonDb.StoreHostToJsonFile()
+	s.audit(audit.ActionUpdate, "host", h.Id, before, h)
+	server.PurgeHttpCache(h.Id, "")
+	s.apiJSON(http.StatusOK, newApiHost(h))
+}
+
+func (s *ApiController) DelHost() {
+	h := s.host()
+	if err := file.GetDb().DelHost(h.Id); err != nil {
+		s.apiErr(http.StatusInternalServerError, err.Error())
+	}
+	server.PurgeHttpCache(h.Id, "")
+	s.audit(audit.ActionDelete, "host", h.Id, audit.Take(h), nil)
+	s.apiNoContent()
+}
+
+func (s *ApiController) ListConns() {
+	start, length := s.page()
+	q := connQuery(&s.Controller)
+	q.ClientId = s.apiClientId()
+	list := proxy.ActiveConns(q)
+	items := make([]*apiConn, 0)
+	for i := start; i < len(list) && (length == 0 || len(items) < length); i++ {
+		items = append(items, newApiConn(&list[i]))
+	}
+	s.apiJSON(http.StatusOK, map[string]interface{}{"total": len(list), "items": items})
+}
+
+func (s *ApiController) KillConn() {
+	id := int64(apiId(s.Ctx.Input.Param(":id")))
+	c, ok := proxy.GetActiveConn(id)
+	if !ok || (s.token.ClientId != 0 && c.ClientId != s.token.ClientId) {
+		s.apiErr(http.StatusNotFound, "the connection is not exist")
+	}
+	proxy.KillConn(id)
+	s.apiNoContent()
+}
+
+func (s *ApiController) KillConns() {
+	q := proxy.ConnQuery{Ip: s.GetString("ip"), ClientId: s.apiClientId()}
+	if net.ParseIP(q.Ip) == nil {
+		s.apiJSON(http.StatusUnprocessableEntity, map[string]interface{}{"error": "validation failed", "fields": map[string]string{"ip": "invalid ip"}})
+	}
+	s.apiJSON(http.StatusOK, map[string]interface{}{"killed": proxy.KillConns(q)})
+}
+
+// Export 导出客户端及其隧道和域名，format=yaml 时返回 yaml
+func (s *ApiController) Export() {
+	doc := exportClients(transferIds(s.GetStrings("client_ids")))
+	if s.GetString("format") != "yaml" {
+		s.apiJSON(http.StatusOK, doc)
+	}
+	b, err := encodeTransfer(doc, "yaml")
+	if err != nil {
+		s.apiErr(http.StatusInternalServerError, err.Error())
+	}
+	s.Ctx.Output.Header("Content-Type", "application/yaml; charset=utf-8")
+	s.Ctx.Output.Body(b)
+	s.StopRun()
+}
+
+// Import 导入 json 或 yaml 格式的导出文档
+func (s *ApiController) Import() {
+	body := s.Ctx.Input.RequestBody
+	if len(body) == 0 {
+		body, _ = io.ReadAll(io.LimitReader(s.Ctx.Request.Body, 16<<20))
+	}
+	doc, err := decodeTransfer(body)
+	if err != nil {
+		s.apiErr(http.StatusBadRequest, "invalid document: "+err.Error())
+	}
+	dryRun, _ := s.GetBool("dry_run")
+	im, err := newImporter(s.GetString("mode"), dryRun, s.actor())
+	if err != nil {
+		s.apiJSON(http.StatusUnprocessableEntity, map[string]interface{}{"error": "validation failed", "fields": map[string]string{"mode": err.Error()}})
+	}
+	runImport(im, doc)
+	s.apiJSON(http.StatusOK, &transferReport{DryRun: dryRun, Count: im.Count(), Results: im.Results})
+}
+
+func (s *ApiController) ListGroups() {
+	list := file.GetDb().GetGroupList()
+	items := make([]*apiGroup, len(list))
+	for i, v := range list {
+		items[i] = newApiGroup(v)
+	}
+	s.apiJSON(http.StatusOK, map[string]interface{}{"total": len(items), "items": items})
+}
+
+func (s *ApiController) GetGroup() {
+	s.apiJSON(http.StatusOK, newApiGroup(s.group()))
+}
+
+func (s *ApiController) AddGroup() {
+	v := new(apiGroup)
+	s.decode(v)
+	s.saveGroup(v, new(file.Group), true)
+}
+
+func (s *ApiController) PutGroup() {
+	v := new(apiGroup)
+	s.decode(v)
+	s.saveGroup(v, s.group(), false)
+}
+
+func (s *ApiController) PatchGroup() {
+	g := s.group()
+	v := newApiGroup(g)
+	s.decode(v)
+	s.saveGroup(v, g, false)
+}
+
+func (s *ApiController) saveGroup(v *apiGroup, g *file.Group, isNew bool) {
+	fields := make(map[string]string)
+	v.validate(fields)
+	s.checkFields(fields)
+	htmlStrings(v, html.EscapeString)
+	before := audit.Take(g)
+	t := *g
+	v.apply(&t)
+	if isNew {
+		if err := file.GetDb().NewGroup(&t); err != nil {
+			s.apiErr(http.StatusConflict, err.Error())
+		}
+		s.audit(audit.ActionCreate, "group", t.Id, nil, &t)
+		s.apiJSON(http.StatusCreated, newApiGroup(&t))
+	}
+	if err := file.GetDb().UpdateGroup(&t); err != nil {
+		s.apiErr(http.StatusConflict, err.Error())
+	}
+	s.audit(audit.ActionUpdate, "group", t.Id, before, &t)
+	s.apiJSON(http.StatusOK, newApiGroup(&t))
+}
+
+func (s *ApiController) DelGroup() {
+	g := s.group()
+	before := audit.Take(g)
+	if err := file.GetDb().DelGroup(g.Id); err != nil {
+		s.apiErr(http.StatusNotFound, err.Error())
+	}
+	s.audit(audit.ActionDelete, "group", g.Id, before, nil)
+	s.apiNoContent()
+}
+
+// GroupStatus 启用或停用分组的全部客户端
+func (s *ApiController) GroupStatus() {
+	g := s.group()
+	v := new(apiGroupStatus)
+	s.decode(v)
+	n := setGroupStatus(g.Id, v.Status, s.actor())
+	s.apiJSON(http.StatusOK, map[string]interface{}{"count": n})
+}
+
+func (s *ApiController) GetGlobal() {
+	v := &apiGlobal{BlackIpList: make([]string, 0)}
+	if global := file.GetDb().GetGlobal(); global != nil {
+		v.BlackIpList = global.BlackIpList
+	}
+	s.apiJSON(http.StatusOK, v)
+}
+
+func (s *ApiController) PutGlobal() {
+	v := new(apiGlobal)
+	s.decode(v)
+	fields := make(map[string]string)
+	validateLists(fields, nil, v.BlackIpList, nil, nil)
+	s.checkFields(fields)
+	htmlStrings(v, html.EscapeString)
+	t := &file.Glob{BlackIpList: apiList(v.BlackIpList, false)}
+	global := file.GetDb().GetGlobal()
+	if global != nil {
+		t.TwoFactor = global.TwoFactor
+	}
+	file.GetDb().SaveGlobal(t)
+	s.audit(audit.ActionUpdate, "global", 0, audit.Take(global), t)
+	s.apiJSON(http.StatusOK, &apiGlobal{BlackIpList: t.BlackIpList})
+}
+
+func (s *ApiController) ListTokens() {
+	list := file.GetDb().GetApiTokenList()
+	items := make([]*apiToken, len(list))
+	for i, v := range list {
+		items[i] = newApiToken(v)
+	}
+	s.apiJSON(http.StatusOK, map[string]interface{}{"total": len(items), "items": items})
+}
+
+func (s *ApiController) AddToken() {
+	v := new(apiTokenRequest)
+	s.decode(v)
+	if v.ExpiresIn > 0 {
+		v.ExpireTime = time.Now().Unix() + v.ExpiresIn
+	}
+	t := &file.ApiToken{Name: html.EscapeString(v.Name), Scope: v.Scope, ClientId: v.ClientId, ExpireTime: v.ExpireTime}
+	fields := make(map[string]string)
+	if validateEnum(fields, "scope", t.Scope); t.Scope == file.TokenScopeClient {
+		if _, err := file.GetDb().GetClient(t.ClientId); err != nil {
+			fields["client_id"] = "the client is not exist"
+		}
+	}
+	if t.Expired() {
+		fields["expire_time"] = "must be in the future"
+	}
+	s.checkFields(fields)
+	token, err := file.GetDb().NewApiToken(t)
+	if err != nil {
+		s.apiErr(http.StatusBadRequest, err.Error())
+	}
+	res := newApiToken(t)
+	res.Token = token
+	s.apiJSON(http.StatusCreated, res)
+}
+
+func (s *ApiController) DelToken() {
+	if err := file.GetDb().DelApiToken(apiId(s.Ctx.Input.Param(":id"))); err != nil {
+		s.apiErr(http.StatusNotFound, err.Error())
+	}
+	s.apiNoContent()
+}
+
+func (s *ApiController) group() *file.Group {
+	g, err := file.GetDb().GetGroup(apiId(s.Ctx.Input.Param(":id")))
+	if err != nil {
+		s.apiErr(http.StatusNotFound, err.Error())
+	}
+	return g
+}
+
+// client 读取路径中的客户端，客户端令牌只能访问自己的客户端
+func (s *ApiController) client() *file.Client {
+	id := apiId(s.Ctx.Input.Param(":id"))
+	c, err := file.GetDb().GetClient(id)
+	if err != nil || c.NoDisplay || (s.token.ClientId != 0 && c.Id != s.token.ClientId) {
+		s.apiErr(http.StatusNotFound, "the client is not exist")
+	}
+	return c
+}
+
+func (s *ApiController) tunnel() *file.Tunnel {
+	t, err := file.GetDb().GetTask(apiId(s.Ctx.Input.Param(":id")))
+	if err != nil || t.Client == nil || (s.token.ClientId != 0 && t.Client.Id != s.token.ClientId) {
+		s.apiErr(http.StatusNotFound, "the tunnel is not exist")
+	}
+	return t
+}
+
+func (s *ApiController) host() *file.Host {
+	h, err := file.GetDb().GetHostById(apiId(s.Ctx.Input.Param(":id")))
+	if err != nil || h.Client == nil || (s.token.ClientId != 0 && h.Client.Id != s.token.ClientId) {
+		s.apiErr(http.StatusNotFound, "the host is not exist")
+	}
+	return h
+}
+
+// ownClient 查找隧道和域名所属的客户端，客户端令牌不能转移到其他客户端
+func (s *ApiController) ownClient(id int, fields map[string]string) *file.Client {
+	if s.token.ClientId != 0 && id != s.token.ClientId {
+		fields["client_id"] = "permission denied"
+		return nil
+	}
+	c, err := file.GetDb().GetClient(id)
+	if err != nil {
+		fields["client_id"] = "the client is not exist"
+	}
+	return c
+}
+
+// apiClientId 列表的客户端过滤条件，客户端令牌总是只看到自己的资源
+func (s *ApiController) apiClientId() int {
+	if s.token.ClientId != 0 {
+		return s.token.ClientId
+	}
+	return s.GetIntNoErr("client_id")
+}
+
+// allowed 按路由表中的权限范围检查令牌，不在表中的路由拒绝访问
+func (s *ApiController) allowed() bool {
+	_, action := s.GetControllerAndAction()
+	switch apiScopes[s.Ctx.Request.Method+" "+action] {
+	case "any":
+		return true
+	case "read":
+		return s.token.ClientId == 0
+	case "client":
+		return s.token.Scope != file.TokenScopeRead
+	case "admin":
+		return s.token.Scope == file.TokenScopeAdmin
+	}
+	return false
+}
+
+// adminOnly 认证地址、oidc 签发者和证书文件路径会让服务端请求任意地址或读取本机文件，
+// 只有管理员令牌可以修改；header 不为空时允许直接填写包含该标记的证书内容
+func (s *ApiController) adminOnly(fields map[string]string, key, value, old, header string) {
+	if s.token.Scope == file.TokenScopeAdmin || value == old {
+		return
+	}
+	if header != "" && (value == "" || strings.Contains(value, header)) {
+		return
+	}
+	fields[key] = "requires an admin token"
+}
+
+func (s *ApiController) page() (start, limit int) {
+	return s.GetIntNoErr("offset"), s.GetIntNoErr("limit")
+}
+
+func (s *ApiController) GetIntNoErr(key string) int {
+	v, _ := s.GetInt(key)
+	return v
+}
+
+// decode 读取 JSON 请求体到 v，未知字段视为错误
+func (s *ApiController) decode(v interface{}) {
+	body := s.Ctx.Input.RequestBody
+	if len(body) == 0 {
+		body, _ = io.ReadAll(io.LimitReader(s.Ctx.Request.Body, 1<<20))
+	}
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.DisallowUnknownFields()
+	if err := d.Decode(v); err != nil {
+		s.apiErr(http.StatusBadRequest, "invalid json body: "+err.Error())
+	}
+}
+
+func (s *ApiController) checkFields(fields map[string]string) {
+	if len(fields) > 0 {
+		s.apiJSON(http.StatusUnprocessableEntity, map[string]interface{}{"error": "validation failed", "fields": fields})
+	}
+}
+
+// audit 记录令牌对配置的修改
+func (s *ApiController) audit(action, object string, id int, before audit.Snapshot, after interface{}) {
+	audit.Record(s.actor(), action, object, id, before, after)
+}
+
+func (s *ApiController) actor() audit.Actor {
+	return audit.Actor{Name: "token:" + s.token.Name, Source: audit.SourceApi, Ip: s.Ctx.Input.IP()}
+}
+
+func (s *ApiController) apiJSON(status int, v interface{}) {
+	s.Ctx.Output.SetStatus(status)
+	s.Data["json"] = v
+	s.ServeJSON()
+	s.StopRun()
+}
+
+func (s *ApiController) apiErr(status int, msg string) {
+	s.apiJSON(status, map[string]interface{}{"error": msg})
+}
+
+func (s *ApiController) apiNoContent() {
+	s.Ctx.ResponseWriter.WriteHeader(http.StatusNoContent)
+	s.StopRun()
+}
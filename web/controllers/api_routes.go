@@ -0,0 +1,173 @@
+package controllers
+
+import (
+	"net/http"
+	"strings"
+)
+
+// ApiRoute /api/v1 的一条路由，路由注册和 OpenAPI 文档共用这份定义
+type ApiRoute struct {
+	Path       string //beego route such as /clients/:id([0-9]+)
+	Operations []apiOperation
+}
+
+type apiOperation struct {
+	Method  string
+	Handler string //method of ApiController
+	Summary string
+	Scope   string      //any: any token, read: read and admin tokens, client: client and admin tokens, admin: admin tokens
+	Query   []apiParam  //query parameters
+	Body    interface{} //request body
+	Result  interface{} //response body, nil means no content
+	Status  int         //status code of success
+}
+
+type apiParam struct {
+	Name string
+	Type string
+	Desc string
+}
+
+// apiPage 列表接口的返回值
+type apiPage struct {
+	item interface{}
+}
+
+var apiPageParams = []apiParam{
+	{"offset", "integer", "number of items to skip"},
+	{"limit", "integer", "max number of items, 0 means all"},
+	{"search", "string", "keyword of id, remark and so on"},
+}
+
+var ApiRoutes = []ApiRoute{
+	{"/status", []apiOperation{
+		{Method: http.MethodGet, Handler: "Status", Summary: "Server overview", Scope: "read", Result: map[string]interface{}{}},
+	}},
+	{"/clients", []apiOperation{
+		{Method: http.MethodGet, Handler: "ListClients", Summary: "List clients", Scope: "any", Query: append([]apiParam{
+			{"group_id", "integer", "group id"},
+			{"tag", "string", "tag of clients"},
+		}, apiPageParams...), Result: apiPage{&apiClient{}}},
+		{Method: http.MethodPost, Handler: "AddClient", Summary: "Create a client", Scope: "admin", Body: &apiClient{}, Result: &apiClient{}, Status: http.StatusCreated},
+	}},
+	{"/clients/:id([0-9]+)", []apiOperation{
+		{Method: http.MethodGet, Handler: "GetClient", Summary: "Get a client", Scope: "any", Result: &apiClient{}},
+		{Method: http.MethodPut, Handler: "PutClient", Summary: "Replace a client", Scope: "client", Body: &apiClient{}, Result: &apiClient{}},
+		{Method: http.MethodPatch, Handler: "PatchClient", Summary: "Update fields of a client", Scope: "client", Body: &apiClient{}, Result: &apiClient{}},
+		{Method: http.MethodDelete, Handler: "DelClient", Summary: "Delete a client with its tunnels and hosts", Scope: "admin"},
+	}},
+	{"/clients/:id([0-9]+)/config", []apiOperation{
+		{Method: http.MethodGet, Handler: "ClientConfig", Summary: "Render npc.conf, systemd unit or docker-compose file of a client", Scope: "any", Query: npcConfParams, Result: &apiNpcConf{}},
+	}},
+	{"/clients/:id([0-9]+)/config/link", []apiOperation{
+		{Method: http.MethodPost, Handler: "AddConfigLink", Summary: "Create a one-time download link of the config", Scope: "client",
+			Query:  append([]apiParam{{"expire", "integer", "minutes before the link expires, default 30, at most 1440"}}, npcConfParams...),
+			Result: &apiNpcConfLink{}, Status: http.StatusCreated},
+	}},
+	{"/groups", []apiOperation{
+		{Method: http.MethodGet, Handler: "ListGroups", Summary: "List client groups", Scope: "read", Result: apiPage{&apiGroup{}}},
+		{Method: http.MethodPost, Handler: "AddGroup", Summary: "Create a client group", Scope: "admin", Body: &apiGroup{}, Result: &apiGroup{}, Status: http.StatusCreated},
+	}},
+	{"/groups/:id([0-9]+)", []apiOperation{
+		{Method: http.MethodGet, Handler: "GetGroup", Summary: "Get a client group", Scope: "read", Result: &apiGroup{}},
+		{Method: http.MethodPut, Handler: "PutGroup", Summary: "Replace a client group", Scope: "admin", Body: &apiGroup{}, Result: &apiGroup{}},
+		{Method: http.MethodPatch, Handler: "PatchGroup", Summary: "Update fields of a client group", Scope: "admin", Body: &apiGroup{}, Result: &apiGroup{}},
+		{Method: http.MethodDelete, Handler: "DelGroup", Summary: "Delete a client group, members are kept without group", Scope: "admin"},
+	}},
+	{"/groups/:id([0-9]+)/status", []apiOperation{
+		{Method: http.MethodPut, Handler: "GroupStatus", Summary: "Enable or disable all clients of a group", Scope: "admin", Body: &apiGroupStatus{}, Result: map[string]interface{}{}},
+	}},
+	{"/tunnels", []apiOperation{
+		{Method: http.MethodGet, Handler: "ListTunnels", Summary: "List tunnels", Scope: "any", Query: append([]apiParam{
+			{"mode", "string", "tunnel mode"},
+			{"client_id", "integer", "client id"},
+		}, apiPageParams...), Result: apiPage{&apiTunnel{}}},
+		{Method: http.MethodPost, Handler: "AddTunnel", Summary: "Create a tunnel", Scope: "client", Body: &apiTunnel{}, Result: &apiTunnel{}, Status: http.StatusCreated},
+	}},
+	{"/tunnels/:id([0-9]+)", []apiOperation{
+		{Method: http.MethodGet, Handler: "GetTunnel", Summary: "Get a tunnel", Scope: "any", Result: &apiTunnel{}},
+		{Method: http.MethodPut, Handler: "PutTunnel", Summary: "Replace a tunnel", Scope: "client", Body: &apiTunnel{}, Result: &apiTunnel{}},
+		{Method: http.MethodPatch, Handler: "PatchTunnel", Summary: "Update fields of a tunnel", Scope: "client", Body: &apiTunnel{}, Result: &apiTunnel{}},
+		{Method: http.MethodDelete, Handler: "DelTunnel", Summary: "Delete a tunnel", Scope: "client"},
+	}},
+	{"/hosts", []apiOperation{
+		{Method: http.MethodGet, Handler: "ListHosts", Summary: "List hosts", Scope: "any", Query: append([]apiParam{
+			{"client_id", "integer", "client id"},
+		}, apiPageParams...), Result: apiPage{&apiHost{}}},
+		{Method: http.MethodPost, Handler: "AddHost", Summary: "Create a host", Scope: "client", Body: &apiHost{}, Result: &apiHost{}, Status: http.StatusCreated},
+	}},
+	{"/hosts/:id([0-9]+)", []apiOperation{
+		{Method: http.MethodGet, Handler: "GetHost", Summary: "Get a host", Scope: "any", Result: &apiHost{}},
+		{Method: http.MethodPut, Handler: "PutHost", Summary: "Replace a host", Scope: "client", Body: &apiHost{}, Result: &apiHost{}},
+		{Method: http.MethodPatch, Handler: "PatchHost", Summary: "Update fields of a host", Scope: "client", Body: &apiHost{}, Result: &apiHost{}},
+		{Method: http.MethodDelete, Handler: "DelHost", Summary: "Delete a host", Scope: "client"},
+	}},
+	{"/connections", []apiOperation{
+		{Method: http.MethodGet, Handler: "ListConns", Summary: "List active visitor connections, http hosts are listed per request", Scope: "any", Query: []apiParam{
+			{"offset", "integer", "number of items to skip"},
+			{"limit", "integer", "max number of items, 0 means all"},
+			{"client_id", "integer", "client id"},
+			{"tunnel_id", "integer", "tunnel id"},
+			{"host_id", "integer", "host id"},
+			{"ip", "string", "visitor ip"},
+			{"search", "string", "keyword of visitor, target, name and listen address"},
+		}, Result: apiPage{&apiConn{}}},
+		{Method: http.MethodDelete, Handler: "KillConns", Summary: "Disconnect all connections of a visitor ip", Scope: "client", Query: []apiParam{
+			{"ip", "string", "visitor ip, required"},
+			{"client_id", "integer", "only disconnect connections of this client"},
+		}, Result: map[string]interface{}{}},
+	}},
+	{"/connections/:id([0-9]+)", []apiOperation{
+		{Method: http.MethodDelete, Handler: "KillConn", Summary: "Disconnect a connection", Scope: "client"},
+	}},
+	{"/export", []apiOperation{
+		{Method: http.MethodGet, Handler: "Export", Summary: "Export clients with their tunnels and hosts", Scope: "admin", Query: []apiParam{
+			{"client_ids", "string", "comma separated client ids, empty exports all"},
+			{"format", "string", "json or yaml"},
+		}, Result: &transferDoc{}},
+	}},
+	{"/import", []apiOperation{
+		{Method: http.MethodPost, Handler: "Import", Summary: "Import an exported json or yaml document", Scope: "admin", Query: []apiParam{
+			{"mode", "string", "create skips existing objects, upsert updates them"},
+			{"dry_run", "boolean", "only validate, nothing is saved"},
+		}, Body: &transferDoc{}, Result: &transferReport{}},
+	}},
+	{"/global", []apiOperation{
+		{Method: http.MethodGet, Handler: "GetGlobal", Summary: "Get global settings", Scope: "read", Result: &apiGlobal{}},
+		{Method: http.MethodPut, Handler: "PutGlobal", Summary: "Replace global settings", Scope: "admin", Body: &apiGlobal{}, Result: &apiGlobal{}},
+		{Method: http.MethodPatch, Handler: "PutGlobal", Summary: "Replace global settings", Scope: "admin", Body: &apiGlobal{}, Result: &apiGlobal{}},
+	}},
+	{"/tokens", []apiOperation{
+		{Method: http.MethodGet, Handler: "ListTokens", Summary: "List api tokens", Scope: "admin", Result: apiPage{&apiToken{}}},
+		{Method: http.MethodPost, Handler: "AddToken", Summary: "Create an api token, the token is only returned once", Scope: "admin", Body: &apiTokenRequest{}, Result: &apiToken{}, Status: http.StatusCreated},
+	}},
+	{"/tokens/:id([0-9]+)", []apiOperation{
+		{Method: http.MethodDelete, Handler: "DelToken", Summary: "Revoke an api token", Scope: "admin"},
+	}},
+}
+
+var npcConfParams = []apiParam{
+	{"kind", "string", "npc, systemd or compose, default npc"},
+	{"type", "string", "connection type tcp, kcp or tls, default bridge_type"},
+	{"server", "string", "server address written to npc.conf, default the host of the request"},
+}
+
+// apiScopes 方法和处理函数到权限范围的映射，如 "GET Status": "read"
+var apiScopes = func() map[string]string {
+	m := make(map[string]string)
+	for _, r := range ApiRoutes {
+		for _, op := range r.Operations {
+			m[op.Method+" "+op.Handler] = op.Scope
+		}
+	}
+	return m
+}()
+
+// Mapping 返回 beego 的方法映射，如 get:ListClients;post:AddClient
+func (r ApiRoute) Mapping() string {
+	list := make([]string, len(r.Operations))
+	for i, op := range r.Operations {
+		list[i] = strings.ToLower(op.Method) + ":" + op.Handler
+	}
+	return strings.Join(list, ";")
+}
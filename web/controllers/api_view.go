@@ -0,0 +1,695 @@
+package controllers
+
+import (
+	"html"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/djylb/nps/lib/common"
+	"github.com/djylb/nps/lib/file"
+	"github.com/djylb/nps/lib/geoip"
+	"github.com/djylb/nps/lib/ipfilter"
+	"github.com/djylb/nps/server/proxy"
+)
+
+// /api/v1 的资源表示，字段名与 web 表单一致；只读字段在写入时忽略，
+// 密码字段只写不读，为空时保持原值
+
+type apiClient struct {
+	Id              int      `json:"id" api:"readonly"`
+	VerifyKey       string   `json:"verify_key"`
+	Remark          string   `json:"remark"`
+	GroupId         int      `json:"group_id" desc:"client group, 0 means no group"`
+	Tags            []string `json:"tags"`
+	Status          bool     `json:"status"`
+	IsConnect       bool     `json:"is_connect" api:"readonly"`
+	Addr            string   `json:"addr" api:"readonly"`
+	Version         string   `json:"version" api:"readonly"`
+	BasicUsername   string   `json:"basic_username"`
+	BasicPassword   string   `json:"basic_password,omitempty" api:"writeonly"`
+	Compress        bool     `json:"compress"`
+	Crypt           bool     `json:"crypt"`
+	ConfigConnAllow bool     `json:"config_conn_allow"`
+	RateLimit       int      `json:"rate_limit" desc:"bandwidth limit in KB/s, 0 means unlimited"`
+	MaxConn         int      `json:"max_conn"`
+	MaxTunnelNum    int      `json:"max_tunnel_num"`
+	FlowLimit       int64    `json:"flow_limit" desc:"traffic limit in MB, 0 means unlimited"`
+	TimeLimit       string   `json:"time_limit" desc:"expire time such as 2025-01-01 00:00:00 or unix timestamp, empty means never"`
+	AllowPorts      string   `json:"allow_ports" desc:"allowed tunnel ports such as 10000-20000,30001, empty means all"`
+	GroupOverride   []string `json:"group_override" desc:"limits not inherited from the group even if 0 or empty: rate_limit, flow_limit, max_conn, max_tunnel_num, black_ip_list, allow_ports"`
+	InletFlow       int64    `json:"inlet_flow" api:"readonly"`
+	ExportFlow      int64    `json:"export_flow" api:"readonly"`
+	WebUsername     string   `json:"web_username"`
+	WebPassword     string   `json:"web_password,omitempty" api:"writeonly"`
+	TwoFactor       bool     `json:"two_factor" api:"readonly"`
+	BlackIpList     []string `json:"black_ip_list"`
+	WhiteIpList     []string `json:"white_ip_list"`
+	GeoWhiteList    []string `json:"geo_white_list"`
+	GeoBlackList    []string `json:"geo_black_list"`
+	CreateTime      string   `json:"create_time" api:"readonly"`
+	LastOnlineTime  string   `json:"last_online_time" api:"readonly"`
+}
+
+func newApiClient(c *file.Client) *apiClient {
+	v := &apiClient{
+		Id:              c.Id,
+		VerifyKey:       c.VerifyKey,
+		Remark:          c.Remark,
+		GroupId:         c.GroupId,
+		Tags:            c.Tags,
+		Status:          c.Status,
+		IsConnect:       c.IsConnect,
+		Addr:            c.Addr,
+		Version:         c.Version,
+		ConfigConnAllow: c.ConfigConnAllow,
+		RateLimit:       c.RateLimit,
+		MaxConn:         c.MaxConn,
+		MaxTunnelNum:    c.MaxTunnelNum,
+		AllowPorts:      c.AllowPorts,
+		GroupOverride:   c.GroupOverride,
+		WebUsername:     c.WebUserName,
+		TwoFactor:       c.TwoFactor.Enabled(),
+		BlackIpList:     c.BlackIpList,
+		WhiteIpList:     c.WhiteIpList,
+		GeoWhiteList:    c.GeoWhiteList,
+		GeoBlackList:    c.GeoBlackList,
+		CreateTime:      c.CreateTime,
+		LastOnlineTime:  c.LastOnlineTime,
+	}
+	if c.Cnf != nil {
+		v.BasicUsername, v.Compress, v.Crypt = c.Cnf.U, c.Cnf.Compress, c.Cnf.Crypt
+	}
+	if c.Flow != nil {
+		v.FlowLimit, v.TimeLimit = c.Flow.FlowLimit, apiTime(c.Flow.TimeLimit)
+		v.InletFlow, v.ExportFlow = c.Flow.InletFlow, c.Flow.ExportFlow
+	}
+	htmlStrings(v, html.UnescapeString)
+	return v
+}
+
+func (v *apiClient) validate(fields map[string]string) {
+	if v.RateLimit < 0 {
+		fields["rate_limit"] = "must not be negative"
+	}
+	if v.MaxConn < 0 {
+		fields["max_conn"] = "must not be negative"
+	}
+	if v.MaxTunnelNum < 0 {
+		fields["max_tunnel_num"] = "must not be negative"
+	}
+	if _, err := file.GetDb().GetGroup(v.GroupId); v.GroupId != 0 && err != nil {
+		fields["group_id"] = err.Error()
+	}
+	if err := file.CheckPortRanges(v.AllowPorts); err != nil {
+		fields["allow_ports"] = err.Error()
+	}
+	if _, err := file.CheckGroupOverride(v.GroupOverride); err != nil {
+		fields["group_override"] = err.Error()
+	}
+	validateTimeLimit(fields, v.TimeLimit)
+	validateLists(fields, v.WhiteIpList, v.BlackIpList, v.GeoWhiteList, v.GeoBlackList)
+}
+
+// apply 把资源写入客户端，admin 为 false 时和 web 一样不能修改密钥和各项限制
+func (v *apiClient) apply(c *file.Client, admin bool, changeUsername bool) {
+	if c.Cnf == nil {
+		c.Cnf = new(file.Config)
+	}
+	if c.Flow == nil {
+		c.Flow = new(file.Flow)
+	}
+	if admin {
+		c.VerifyKey = v.VerifyKey
+		c.Status = v.Status
+		c.RateLimit = v.RateLimit
+		c.MaxConn = v.MaxConn
+		c.MaxTunnelNum = v.MaxTunnelNum
+		c.Flow.FlowLimit = v.FlowLimit
+		c.Flow.TimeLimit = common.GetTimeNoErrByStr(v.TimeLimit)
+		c.GroupId = v.GroupId
+		c.AllowPorts = strings.TrimSpace(v.AllowPorts)
+		c.GroupOverride, _ = file.CheckGroupOverride(v.GroupOverride)
+	}
+	if admin || changeUsername {
+		c.WebUserName = v.WebUsername
+	}
+	if v.WebPassword != "" {
+		c.WebPassword = v.WebPassword
+	}
+	if v.BasicPassword != "" {
+		c.Cnf.P = v.BasicPassword
+	}
+	c.Remark = v.Remark
+	c.Tags = file.CleanTags(v.Tags)
+	c.Cnf.U = v.BasicUsername
+	c.Cnf.Compress = v.Compress
+	c.Cnf.Crypt = v.Crypt
+	c.ConfigConnAllow = v.ConfigConnAllow
+	c.BlackIpList = apiList(v.BlackIpList, false)
+	c.WhiteIpList = apiList(v.WhiteIpList, false)
+	c.GeoWhiteList = apiList(v.GeoWhiteList, true)
+	c.GeoBlackList = apiList(v.GeoBlackList, true)
+}
+
+type apiTunnel struct {
+	Id                  int      `json:"id" api:"readonly"`
+	ClientId            int      `json:"client_id"`
+	Mode                string   `json:"mode"`
+	Port                int      `json:"port" desc:"public port, 0 allocates one automatically"`
+	ServerIp            string   `json:"server_ip"`
+	Status              bool     `json:"status" desc:"false stops the tunnel, true starts it"`
+	RunStatus           bool     `json:"run_status" api:"readonly"`
+	Remark              string   `json:"remark"`
+	Target              string   `json:"target" desc:"targets separated by new lines, such as 127.0.0.1:22"`
+	ProxyProtocol       int      `json:"proxy_protocol" desc:"0 off, 1 v1, 2 v2"`
+	LocalProxy          bool     `json:"local_proxy"`
+	Auth                string   `json:"auth" desc:"user=password lines of basic or socks5 auth"`
+	Password            string   `json:"password" desc:"key of secret and p2p mode"`
+	LocalPath           string   `json:"local_path"`
+	StripPre            string   `json:"strip_pre"`
+	ConnLimit           int      `json:"conn_limit"`
+	ConnBurst           int      `json:"conn_burst"`
+	AcceptProxyProtocol bool     `json:"accept_proxy_protocol"`
+	SniHost             string   `json:"sni_host"`
+	TlsOffload          bool     `json:"tls_offload"`
+	CertFilePath        string   `json:"cert_file_path"`
+	KeyFilePath         string   `json:"key_file_path"`
+	AcmeDomain          string   `json:"acme_domain"`
+	ClientCaFile        string   `json:"client_ca_file"`
+	AuthUrl             string   `json:"auth_url"`
+	BlackIpList         []string `json:"black_ip_list"`
+	WhiteIpList         []string `json:"white_ip_list"`
+	GeoWhiteList        []string `json:"geo_white_list"`
+	GeoBlackList        []string `json:"geo_black_list"`
+	FlowLimit           int64    `json:"flow_limit" desc:"traffic limit in MB, 0 means unlimited"`
+	TimeLimit           string   `json:"time_limit" desc:"expire time such as 2025-01-01 00:00:00 or unix timestamp, empty means never"`
+	InletFlow           int64    `json:"inlet_flow" api:"readonly"`
+	ExportFlow          int64    `json:"export_flow" api:"readonly"`
+}
+
+// apiEnums 各枚举字段的可选值，校验和 OpenAPI 文档共用
+var apiEnums = map[string][]string{
+	"mode":          {"tcp", "udp", "socks5", "httpProxy", "secret", "p2p", "file", "sni"},
+	"scheme":        {"all", "http", "https"},
+	"backend_proto": {"", "http1", "h2", "h2c"},
+	"scope":         {file.TokenScopeRead, file.TokenScopeClient, file.TokenScopeAdmin},
+}
+
+// validateEnum 检查字段是否为可选值之一
+func validateEnum(fields map[string]string, key, value string) {
+	if !common.InStrArr(apiEnums[key], value) {
+		fields[key] = "must be one of " + strings.Join(apiEnums[key], ", ")
+	}
+}
+
+func newApiTunnel(t *file.Tunnel) *apiTunnel {
+	v := &apiTunnel{
+		Id:                  t.Id,
+		Mode:                t.Mode,
+		Port:                t.Port,
+		ServerIp:            t.ServerIp,
+		Status:              t.Status,
+		RunStatus:           t.RunStatus,
+		Remark:              t.Remark,
+		Password:            t.Password,
+		LocalPath:           t.LocalPath,
+		StripPre:            t.StripPre,
+		ConnLimit:           t.ConnLimit,
+		ConnBurst:           t.ConnBurst,
+		AcceptProxyProtocol: t.AcceptProxyProtocol,
+		SniHost:             t.SniHost,
+		TlsOffload:          t.TlsOffload,
+		CertFilePath:        t.CertFilePath,
+		KeyFilePath:         t.KeyFilePath,
+		AcmeDomain:          t.AcmeDomain,
+		ClientCaFile:        t.ClientCaFile,
+		AuthUrl:             t.AuthUrl,
+		BlackIpList:         t.BlackIpList,
+		WhiteIpList:         t.WhiteIpList,
+		GeoWhiteList:        t.GeoWhiteList,
+		GeoBlackList:        t.GeoBlackList,
+	}
+	if t.Client != nil {
+		v.ClientId = t.Client.Id
+	}
+	if t.Target != nil {
+		v.Target, v.ProxyProtocol, v.LocalProxy = t.Target.TargetStr, t.Target.ProxyProtocol, t.Target.LocalProxy
+	}
+	if t.UserAuth != nil {
+		v.Auth = t.UserAuth.Content
+	}
+	if t.Flow != nil {
+		v.FlowLimit, v.TimeLimit = t.Flow.FlowLimit, apiTime(t.Flow.TimeLimit)
+		v.InletFlow, v.ExportFlow = t.Flow.InletFlow, t.Flow.ExportFlow
+	}
+	htmlStrings(v, html.UnescapeString)
+	return v
+}
+
+func (v *apiTunnel) validate(fields map[string]string) {
+	validateEnum(fields, "mode", v.Mode)
+	if v.Port < 0 || v.Port > 65535 {
+		fields["port"] = "must be between 0 and 65535"
+	}
+	if v.ProxyProtocol < 0 || v.ProxyProtocol > 2 {
+		fields["proxy_protocol"] = "must be 0, 1 or 2"
+	}
+	if v.ConnLimit < 0 || v.ConnBurst < 0 {
+		fields["conn_limit"] = "must not be negative"
+	}
+	if (v.Mode == "secret" || v.Mode == "p2p") && v.Password == "" {
+		fields["password"] = "is required in " + v.Mode + " mode"
+	}
+	validateTimeLimit(fields, v.TimeLimit)
+	validateLists(fields, v.WhiteIpList, v.BlackIpList, v.GeoWhiteList, v.GeoBlackList)
+}
+
+func (v *apiTunnel) apply(t *file.Tunnel) {
+	t.Mode = v.Mode
+	t.Port = v.Port
+	t.ServerIp = v.ServerIp
+	t.Remark = v.Remark
+	t.Target = &file.Target{
+		TargetStr:     strings.ReplaceAll(v.Target, "\r\n", "\n"),
+		ProxyProtocol: v.ProxyProtocol,
+		LocalProxy:    (v.ClientId > 0 && v.LocalProxy) || v.ClientId <= 0,
+	}
+	t.UserAuth = &file.MultiAccount{Content: v.Auth, AccountMap: common.DealMultiUser(v.Auth)}
+	t.Password = v.Password
+	t.LocalPath = v.LocalPath
+	t.StripPre = v.StripPre
+	t.ConnLimit = v.ConnLimit
+	t.ConnBurst = v.ConnBurst
+	t.AcceptProxyProtocol = v.AcceptProxyProtocol
+	t.SniHost = v.SniHost
+	t.TlsOffload = v.TlsOffload
+	t.CertFilePath = v.CertFilePath
+	t.KeyFilePath = v.KeyFilePath
+	t.AcmeDomain = strings.TrimSpace(v.AcmeDomain)
+	t.ClientCaFile = v.ClientCaFile
+	t.AuthUrl = strings.TrimSpace(v.AuthUrl)
+	t.BlackIpList = apiList(v.BlackIpList, false)
+	t.WhiteIpList = apiList(v.WhiteIpList, false)
+	t.GeoWhiteList = apiList(v.GeoWhiteList, true)
+	t.GeoBlackList = apiList(v.GeoBlackList, true)
+	if t.Flow == nil {
+		t.Flow = new(file.Flow)
+	}
+	t.Flow.FlowLimit = v.FlowLimit
+	t.Flow.TimeLimit = common.GetTimeNoErrByStr(v.TimeLimit)
+}
+
+type apiHost struct {
+	Id                  int      `json:"id" api:"readonly"`
+	ClientId            int      `json:"client_id"`
+	Host                string   `json:"host"`
+	Location            string   `json:"location"`
+	Scheme              string   `json:"scheme"`
+	Status              bool     `json:"status" desc:"false closes the host"`
+	Remark              string   `json:"remark"`
+	Target              string   `json:"target" desc:"targets separated by new lines, such as 127.0.0.1:80"`
+	ProxyProtocol       int      `json:"proxy_protocol" desc:"0 off, 1 v1, 2 v2"`
+	LocalProxy          bool     `json:"local_proxy"`
+	Auth                string   `json:"auth" desc:"user=password lines of basic auth"`
+	Header              string   `json:"header"`
+	HostChange          string   `json:"hostchange"`
+	HttpsJustProxy      bool     `json:"https_just_proxy"`
+	CertFilePath        string   `json:"cert_file_path"`
+	KeyFilePath         string   `json:"key_file_path"`
+	AutoHttps           bool     `json:"auto_https"`
+	AutoCORS            bool     `json:"auto_cors"`
+	TargetIsHttps       bool     `json:"target_is_https"`
+	BackendProto        string   `json:"backend_proto"`
+	CacheEnable         bool     `json:"cache_enable"`
+	CacheInclude        string   `json:"cache_include"`
+	CacheExclude        string   `json:"cache_exclude"`
+	CompressEnable      bool     `json:"compress_enable"`
+	CompressTypes       string   `json:"compress_types"`
+	CompressMinSize     int      `json:"compress_min_size"`
+	OidcIssuer          string   `json:"oidc_issuer"`
+	OidcClientId        string   `json:"oidc_client_id"`
+	OidcClientSecret    string   `json:"oidc_client_secret,omitempty" api:"writeonly"`
+	OidcScopes          string   `json:"oidc_scopes"`
+	OidcAllowDomains    string   `json:"oidc_allow_domains"`
+	OidcAllowGroups     string   `json:"oidc_allow_groups"`
+	AuthUrl             string   `json:"auth_url"`
+	AuthResponseHeaders string   `json:"auth_response_headers"`
+	ReqLimit            int      `json:"req_limit"`
+	ReqBurst            int      `json:"req_burst"`
+	ReqLimitKey         string   `json:"req_limit_key" desc:"visitor key: ip, header:<name> or user"`
+	BlackIpList         []string `json:"black_ip_list"`
+	WhiteIpList         []string `json:"white_ip_list"`
+	GeoWhiteList        []string `json:"geo_white_list"`
+	GeoBlackList        []string `json:"geo_black_list"`
+	FlowLimit           int64    `json:"flow_limit" desc:"traffic limit in MB, 0 means unlimited"`
+	TimeLimit           string   `json:"time_limit" desc:"expire time such as 2025-01-01 00:00:00 or unix timestamp, empty means never"`
+	InletFlow           int64    `json:"inlet_flow" api:"readonly"`
+	ExportFlow          int64    `json:"export_flow" api:"readonly"`
+}
+
+func newApiHost(h *file.Host) *apiHost {
+	v := &apiHost{
+		Id:                  h.Id,
+		Host:                h.Host,
+		Location:            h.Location,
+		Scheme:              h.Scheme,
+		Status:              !h.IsClose,
+		Remark:              h.Remark,
+		Header:              h.HeaderChange,
+		HostChange:          h.HostChange,
+		HttpsJustProxy:      h.HttpsJustProxy,
+		CertFilePath:        h.CertFilePath,
+		KeyFilePath:         h.KeyFilePath,
+		AutoHttps:           h.AutoHttps,
+		AutoCORS:            h.AutoCORS,
+		TargetIsHttps:       h.TargetIsHttps,
+		BackendProto:        h.BackendProto,
+		CacheEnable:         h.CacheEnable,
+		CacheInclude:        h.CacheInclude,
+		CacheExclude:        h.CacheExclude,
+		CompressEnable:      h.CompressEnable,
+		CompressTypes:       h.CompressTypes,
+		CompressMinSize:     h.CompressMinSize,
+		OidcIssuer:          h.OidcIssuer,
+		OidcClientId:        h.OidcClientId,
+		OidcScopes:          h.OidcScopes,
+		OidcAllowDomains:    h.OidcAllowDomains,
+		OidcAllowGroups:     h.OidcAllowGroups,
+		AuthUrl:             h.AuthUrl,
+		AuthResponseHeaders: h.AuthResponseHeaders,
+		ReqLimit:            h.ReqLimit,
+		ReqBurst:            h.ReqBurst,
+		ReqLimitKey:         h.ReqLimitKey,
+		BlackIpList:         h.BlackIpList,
+		WhiteIpList:         h.WhiteIpList,
+		GeoWhiteList:        h.GeoWhiteList,
+		GeoBlackList:        h.GeoBlackList,
+	}
+	if h.Client != nil {
+		v.ClientId = h.Client.Id
+	}
+	if h.Target != nil {
+		v.Target, v.ProxyProtocol, v.LocalProxy = h.Target.TargetStr, h.Target.ProxyProtocol, h.Target.LocalProxy
+	}
+	if h.UserAuth != nil {
+		v.Auth = h.UserAuth.Content
+	}
+	if h.Flow != nil {
+		v.FlowLimit, v.TimeLimit = h.Flow.FlowLimit, apiTime(h.Flow.TimeLimit)
+		v.InletFlow, v.ExportFlow = h.Flow.InletFlow, h.Flow.ExportFlow
+	}
+	htmlStrings(v, html.UnescapeString)
+	return v
+}
+
+func (v *apiHost) validate(fields map[string]string) {
+	if strings.TrimSpace(v.Host) == "" {
+		fields["host"] = "is required"
+	}
+	validateEnum(fields, "scheme", v.Scheme)
+	validateEnum(fields, "backend_proto", v.BackendProto)
+	if v.ProxyProtocol < 0 || v.ProxyProtocol > 2 {
+		fields["proxy_protocol"] = "must be 0, 1 or 2"
+	}
+	if v.ReqLimit < 0 || v.ReqBurst < 0 {
+		fields["req_limit"] = "must not be negative"
+	}
+	validateTimeLimit(fields, v.TimeLimit)
+	validateLists(fields, v.WhiteIpList, v.BlackIpList, v.GeoWhiteList, v.GeoBlackList)
+}
+
+func (v *apiHost) apply(h *file.Host) {
+	h.Host = v.Host
+	h.Location = v.Location
+	h.Scheme = v.Scheme
+	h.IsClose = !v.Status
+	h.Remark = v.Remark
+	h.Target = &file.Target{
+		TargetStr:     strings.ReplaceAll(v.Target, "\r\n", "\n"),
+		ProxyProtocol: v.ProxyProtocol,
+		LocalProxy:    (v.ClientId > 0 && v.LocalProxy) || v.ClientId <= 0,
+	}
+	h.UserAuth = &file.MultiAccount{Content: v.Auth, AccountMap: common.DealMultiUser(v.Auth)}
+	h.HeaderChange = v.Header
+	h.HostChange = v.HostChange
+	h.HttpsJustProxy = v.HttpsJustProxy
+	h.CertFilePath = v.CertFilePath
+	h.KeyFilePath = v.KeyFilePath
+	h.AutoHttps = v.AutoHttps
+	h.AutoCORS = v.AutoCORS
+	h.TargetIsHttps = v.TargetIsHttps
+	h.BackendProto = v.BackendProto
+	h.CacheEnable = v.CacheEnable
+	h.CacheInclude = v.CacheInclude
+	h.CacheExclude = v.CacheExclude
+	h.CompressEnable = v.CompressEnable
+	h.CompressTypes = v.CompressTypes
+	h.CompressMinSize = v.CompressMinSize
+	h.OidcIssuer = strings.TrimSpace(v.OidcIssuer)
+	h.OidcClientId = v.OidcClientId
+	if v.OidcClientSecret != "" {
+		h.OidcClientSecret = v.OidcClientSecret
+	}
+	h.OidcScopes = v.OidcScopes
+	h.OidcAllowDomains = v.OidcAllowDomains
+	h.OidcAllowGroups = v.OidcAllowGroups
+	h.AuthUrl = strings.TrimSpace(v.AuthUrl)
+	h.AuthResponseHeaders = v.AuthResponseHeaders
+	h.ReqLimit = v.ReqLimit
+	h.ReqBurst = v.ReqBurst
+	h.ReqLimitKey = v.ReqLimitKey
+	h.BlackIpList = apiList(v.BlackIpList, false)
+	h.WhiteIpList = apiList(v.WhiteIpList, false)
+	h.GeoWhiteList = apiList(v.GeoWhiteList, true)
+	h.GeoBlackList = apiList(v.GeoBlackList, true)
+	if h.Flow == nil {
+		h.Flow = new(file.Flow)
+	}
+	h.Flow.FlowLimit = v.FlowLimit
+	h.Flow.TimeLimit = common.GetTimeNoErrByStr(v.TimeLimit)
+}
+
+type apiGroup struct {
+	Id           int      `json:"id" api:"readonly"`
+	Name         string   `json:"name"`
+	Remark       string   `json:"remark"`
+	RateLimit    int      `json:"rate_limit" desc:"bandwidth limit in KB/s of each member, 0 means unlimited"`
+	FlowLimit    int64    `json:"flow_limit" desc:"traffic limit in MB of each member, 0 means unlimited"`
+	MaxConn      int      `json:"max_conn"`
+	MaxTunnelNum int      `json:"max_tunnel_num"`
+	BlackIpList  []string `json:"black_ip_list"`
+	AllowPorts   string   `json:"allow_ports" desc:"allowed tunnel ports such as 10000-20000,30001, empty means all"`
+	ClientNum    int      `json:"client_num" api:"readonly"`
+	CreateTime   string   `json:"create_time" api:"readonly"`
+}
+
+func newApiGroup(g *file.Group) *apiGroup {
+	v := &apiGroup{
+		Id:           g.Id,
+		Name:         g.Name,
+		Remark:       g.Remark,
+		RateLimit:    g.RateLimit,
+		FlowLimit:    g.FlowLimit,
+		MaxConn:      g.MaxConn,
+		MaxTunnelNum: g.MaxTunnelNum,
+		BlackIpList:  g.BlackIpList,
+		AllowPorts:   g.AllowPorts,
+		ClientNum:    len(file.GetDb().GetGroupClients(g.Id)),
+		CreateTime:   g.CreateTime,
+	}
+	htmlStrings(v, html.UnescapeString)
+	return v
+}
+
+func (v *apiGroup) validate(fields map[string]string) {
+	if strings.TrimSpace(v.Name) == "" {
+		fields["name"] = "must not be empty"
+	}
+	if v.RateLimit < 0 {
+		fields["rate_limit"] = "must not be negative"
+	}
+	if v.FlowLimit < 0 {
+		fields["flow_limit"] = "must not be negative"
+	}
+	if v.MaxConn < 0 {
+		fields["max_conn"] = "must not be negative"
+	}
+	if v.MaxTunnelNum < 0 {
+		fields["max_tunnel_num"] = "must not be negative"
+	}
+	if err := file.CheckPortRanges(v.AllowPorts); err != nil {
+		fields["allow_ports"] = err.Error()
+	}
+	validateLists(fields, nil, v.BlackIpList, nil, nil)
+}
+
+func (v *apiGroup) apply(g *file.Group) {
+	g.Name = v.Name
+	g.Remark = v.Remark
+	g.RateLimit = v.RateLimit
+	g.FlowLimit = v.FlowLimit
+	g.MaxConn = v.MaxConn
+	g.MaxTunnelNum = v.MaxTunnelNum
+	g.BlackIpList = apiList(v.BlackIpList, false)
+	g.AllowPorts = strings.TrimSpace(v.AllowPorts)
+}
+
+type apiGroupStatus struct {
+	Status bool `json:"status" desc:"enable or disable all members"`
+}
+
+type apiGlobal struct {
+	BlackIpList []string `json:"black_ip_list"`
+}
+
+type apiToken struct {
+	Id         int    `json:"id" api:"readonly"`
+	Name       string `json:"name"`
+	Prefix     string `json:"prefix" api:"readonly"`
+	Scope      string `json:"scope"`
+	ClientId   int    `json:"client_id"`
+	ExpireTime int64  `json:"expire_time" desc:"unix time, 0 means never"`
+	CreateTime string `json:"create_time" api:"readonly"`
+	LastUsed   int64  `json:"last_used" api:"readonly"`
+	Token      string `json:"token,omitempty" api:"readonly"`
+}
+
+type apiTokenRequest struct {
+	Name       string `json:"name"`
+	Scope      string `json:"scope"`
+	ClientId   int    `json:"client_id" desc:"client of the client scope"`
+	ExpireTime int64  `json:"expire_time" desc:"unix time, 0 means never"`
+	ExpiresIn  int64  `json:"expires_in" desc:"seconds until the token expires, overrides expire_time"`
+}
+
+func newApiToken(t *file.ApiToken) *apiToken {
+	return &apiToken{
+		Id:         t.Id,
+		Name:       t.Name,
+		Prefix:     t.Prefix,
+		Scope:      t.Scope,
+		ClientId:   t.ClientId,
+		ExpireTime: t.ExpireTime,
+		CreateTime: t.CreateTime,
+		LastUsed:   t.LastUsed,
+	}
+}
+
+type apiNpcConf struct {
+	Kind     string `json:"kind"`
+	Filename string `json:"filename"`
+	Content  string `json:"content"`
+}
+
+type apiNpcConfLink struct {
+	Path       string `json:"path" desc:"download path on the web port, valid for one download"`
+	ExpireTime int64  `json:"expire_time" desc:"unix time"`
+}
+
+type apiConn struct {
+	Id        int64  `json:"id"`
+	ClientId  int    `json:"client_id"`
+	TunnelId  int    `json:"tunnel_id" desc:"0 for hosts"`
+	HostId    int    `json:"host_id" desc:"0 for tunnels"`
+	Mode      string `json:"mode"`
+	Name      string `json:"name" desc:"remark of the tunnel or the host name"`
+	Visitor   string `json:"visitor"`
+	Listen    string `json:"listen"`
+	Target    string `json:"target"`
+	StartTime int64  `json:"start_time" desc:"unix time"`
+	InBytes   int64  `json:"in_bytes" desc:"bytes received from the visitor"`
+	OutBytes  int64  `json:"out_bytes" desc:"bytes sent to the visitor"`
+}
+
+func newApiConn(c *proxy.ActiveConn) *apiConn {
+	return &apiConn{
+		Id:        c.Id,
+		ClientId:  c.ClientId,
+		TunnelId:  c.TunnelId,
+		HostId:    c.HostId,
+		Mode:      c.Mode,
+		Name:      c.Name,
+		Visitor:   c.Visitor,
+		Listen:    c.Listen,
+		Target:    c.Target,
+		StartTime: c.Start.Unix(),
+		InBytes:   c.In,
+		OutBytes:  c.Out,
+	}
+}
+
+func apiTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format("2006-01-02 15:04:05")
+}
+
+func validateTimeLimit(fields map[string]string, s string) {
+	if s = strings.TrimSpace(s); s != "" && common.GetTimeNoErrByStr(s).IsZero() {
+		fields["time_limit"] = "invalid time"
+	}
+}
+
+func validateLists(fields map[string]string, white, black, geoWhite, geoBlack []string) {
+	if invalid := ipfilter.Validate(apiList(white, false)); len(invalid) > 0 {
+		fields["white_ip_list"] = "invalid ip or cidr: " + strings.Join(invalid, ", ")
+	}
+	if invalid := ipfilter.Validate(apiList(black, false)); len(invalid) > 0 {
+		fields["black_ip_list"] = "invalid ip or cidr: " + strings.Join(invalid, ", ")
+	}
+	for key, list := range map[string][]string{"geo_white_list": geoWhite, "geo_black_list": geoBlack} {
+		for _, v := range apiList(list, true) {
+			if !geoip.Valid(v) {
+				fields[key] = "invalid country code or asn: " + v
+				break
+			}
+		}
+		if _, ok := fields[key]; !ok && len(apiList(list, true)) > 0 && !geoip.Enabled() {
+			fields[key] = "the geoip database is not loaded"
+		}
+	}
+}
+
+// apiList 去掉空项和重复项，地区代码转为大写
+func apiList(list []string, upper bool) []string {
+	res := make([]string, 0, len(list))
+	for _, v := range list {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		if upper {
+			v = strings.ToUpper(v)
+		}
+		res = append(res, v)
+	}
+	return RemoveRepeatedElement(res)
+}
+
+// htmlStrings 对资源中的字符串调用 f，web 表单保存的值经过 html 转义，
+// 读取时还原，写入时重新转义，保持与 web 一致
+func htmlStrings(v interface{}, f func(string) string) {
+	e := reflect.ValueOf(v).Elem()
+	for i := 0; i < e.NumField(); i++ {
+		switch field := e.Field(i); field.Kind() {
+		case reflect.String:
+			field.SetString(f(field.String()))
+		case reflect.Slice:
+			if field.Type().Elem().Kind() != reflect.String {
+				continue
+			}
+			list := make([]string, field.Len())
+			for j := range list {
+				list[j] = f(field.Index(j).String())
+			}
+			field.Set(reflect.ValueOf(list))
+		}
+	}
+}
+
+func apiId(s string) int {
+	id, _ := strconv.Atoi(s)
+	return id
+}
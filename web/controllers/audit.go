@@ -0,0 +1,72 @@
+package controllers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/djylb/nps/lib/audit"
+)
+
+// AuditController 审计日志，租户不能访问
+type AuditController struct {
+	BaseController
+}
+
+// Index 审计日志列表，支持按关键字、对象、操作和来源查询
+func (s *AuditController) Index() {
+	if s.Ctx.Request.Method == "GET" {
+		s.Data["menu"] = "audit"
+		s.SetInfo("audit log")
+		s.display("audit/index")
+		return
+	}
+	start, length := s.GetAjaxParams()
+	list, cnt := audit.Search(s.query(), start, length)
+	s.AjaxTable(list, cnt, cnt, nil)
+}
+
+// Export 按当前查询条件导出全部审计日志，format 为 csv 或 json
+func (s *AuditController) Export() {
+	list, _ := audit.Search(s.query(), 0, 0)
+	name := "audit-" + time.Now().Format("20060102150405")
+	if s.GetString("format") == "csv" {
+		s.Ctx.Output.Header("Content-Type", "text/csv; charset=utf-8")
+		s.Ctx.Output.Header("Content-Disposition", "attachment; filename="+name+".csv")
+		w := csv.NewWriter(s.Ctx.ResponseWriter)
+		w.Write([]string{"id", "time", "actor", "source", "ip", "action", "object", "object_id", "name", "changes"})
+		for _, e := range list {
+			changes := make([]string, len(e.Changes))
+			for i, c := range e.Changes {
+				changes[i] = fmt.Sprintf("%s: %v -> %v", c.Field, c.Before, c.After)
+			}
+			w.Write([]string{fmt.Sprint(e.Id), time.Unix(e.Time, 0).Format("2006-01-02 15:04:05"), e.Actor, e.Source, e.Ip,
+				e.Action, e.Object, fmt.Sprint(e.ObjectId), e.Name, strings.Join(changes, "\n")})
+		}
+		w.Flush()
+		s.StopRun()
+	}
+	s.Ctx.Output.Header("Content-Type", "application/json; charset=utf-8")
+	s.Ctx.Output.Header("Content-Disposition", "attachment; filename="+name+".json")
+	json.NewEncoder(s.Ctx.ResponseWriter).Encode(list)
+	s.StopRun()
+}
+
+// query 读取查询条件，start 和 end 为 2006-01-02 格式的日期
+func (s *AuditController) query() audit.Query {
+	q := audit.Query{
+		Search: s.GetString("search"),
+		Object: s.GetString("object"),
+		Action: s.GetString("action"),
+		Source: s.GetString("source"),
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s.GetString("start"), time.Local); err == nil {
+		q.Start = t.Unix()
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s.GetString("end"), time.Local); err == nil {
+		q.End = t.AddDate(0, 0, 1).Unix() - 1
+	}
+	return q
+}
@@ -1,6 +1,7 @@
 package controllers
 
 import (
+	"errors"
 	"html"
 	"math"
 	"strconv"
@@ -9,9 +10,12 @@ import (
 
 	"github.com/beego/beego"
 	"github.com/djylb/nps/bridge"
+	"github.com/djylb/nps/lib/audit"
 	"github.com/djylb/nps/lib/common"
 	"github.com/djylb/nps/lib/crypt"
 	"github.com/djylb/nps/lib/file"
+	"github.com/djylb/nps/lib/geoip"
+	"github.com/djylb/nps/lib/ipfilter"
 	"github.com/djylb/nps/server"
 )
 
@@ -19,6 +23,8 @@ type BaseController struct {
 	beego.Controller
 	controllerName string
 	actionName     string
+	role           string //role of the logged in account
+	clientIds      []int  //clients of the tenant role
 }
 
 // 初始化参数
@@ -41,20 +47,30 @@ func (s *BaseController) Prepare() {
 	if !(md5Key != "" && (math.Abs(float64(timeNowUnix-int64(timestamp))) <= 20) && (crypt.Md5(configKey+strconv.Itoa(timestamp)) == md5Key)) {
 		if s.GetSession("auth") != true {
 			s.Redirect(beego.AppConfig.String("web_base_url")+"/login/index", 302)
+			return
+		}
+		s.role, _ = s.GetSession("role").(string)
+		s.clientIds, _ = s.GetSession("clientIds").([]int)
+		// web 管理账号每次请求都重新读取，修改角色、停用或删除后立即生效
+		if userId, _ := s.GetSession("userId").(int); userId != 0 {
+			u, err := file.GetDb().GetUser(userId)
+			if err != nil || !u.Status {
+				s.SetSession("auth", false)
+				s.Redirect(beego.AppConfig.String("web_base_url")+"/login/index", 302)
+				return
+			}
+			s.role, s.clientIds = u.Role, u.ClientIds
 		}
 	} else {
-		s.SetSession("isAdmin", true)
-		s.Data["isAdmin"] = true
-	}
-	if s.GetSession("isAdmin") != nil && !s.GetSession("isAdmin").(bool) {
-		s.Ctx.Input.SetData("client_id", s.GetSession("clientId").(int))
-		s.Ctx.Input.SetParam("client_id", strconv.Itoa(s.GetSession("clientId").(int)))
-		s.Data["isAdmin"] = false
-		s.Data["username"] = s.GetSession("username")
-		s.CheckUserAuth()
-	} else {
-		s.Data["isAdmin"] = true
+		s.role = file.RoleSuperAdmin
 	}
+	s.authorize()
+	s.Data["role"] = s.role
+	s.Data["isAdmin"] = !s.isTenant()
+	s.Data["canWrite"] = s.can(permWrite)
+	s.Data["canManage"] = s.can(permManage)
+	s.Data["isSuper"] = s.can(permAdmin)
+	s.Data["username"] = s.GetSession("username")
 
 	//s.Data["https_just_proxy"], _ = beego.AppConfig.Bool("https_just_proxy")
 	s.Data["allow_user_login"], _ = beego.AppConfig.Bool("allow_user_login")
@@ -69,6 +85,22 @@ func (s *BaseController) Prepare() {
 	s.Data["allow_user_change_username"], _ = beego.AppConfig.Bool("allow_user_change_username")
 }
 
+// audit 记录当前账号对配置的修改，before 为修改前的快照，after 为修改后的对象
+func (s *BaseController) audit(action, object string, id int, before audit.Snapshot, after interface{}) {
+	audit.Record(s.actor(), action, object, id, before, after)
+}
+
+// actor 当前请求的操作者
+func (s *BaseController) actor() audit.Actor {
+	name, _ := s.GetSession("username").(string)
+	if name == "" && s.GetSession("auth") == true {
+		name = beego.AppConfig.String("web_username")
+	} else if name == "" {
+		name = "auth_key"
+	}
+	return audit.Actor{Name: name, Source: audit.SourceWeb, Ip: s.Ctx.Input.IP()}
+}
+
 // 加载模板
 func (s *BaseController) display(tpl ...string) {
 	s.Data["web_base_url"] = beego.AppConfig.String("web_base_url")
@@ -123,6 +155,39 @@ func (s *BaseController) getEscapeString(key string) string {
 	return html.EscapeString(s.GetString(key))
 }
 
+// getIpList 读取按行填写的 IP/CIDR 名单，去掉空行和重复项
+func (s *BaseController) getIpList(key string) ([]string, error) {
+	list := make([]string, 0)
+	for _, v := range strings.Split(s.GetString(key), "\n") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	list = RemoveRepeatedElement(list)
+	if invalid := ipfilter.Validate(list); len(invalid) > 0 {
+		return nil, errors.New("invalid ip or cidr: " + strings.Join(invalid, ", "))
+	}
+	return list, nil
+}
+
+// getGeoList 读取国家代码或 ASN 名单，支持换行或逗号分隔
+func (s *BaseController) getGeoList(key string) ([]string, error) {
+	list := make([]string, 0)
+	for _, v := range strings.FieldsFunc(s.GetString(key), func(r rune) bool {
+		return r == '\n' || r == '\r' || r == ',' || r == ' '
+	}) {
+		v = strings.ToUpper(v)
+		if !geoip.Valid(v) {
+			return nil, errors.New("invalid country code or asn: " + v)
+		}
+		list = append(list, v)
+	}
+	if len(list) > 0 && !geoip.Enabled() {
+		return nil, errors.New("the geoip database is not loaded, set geoip_db_path or geoip_asn_db_path first")
+	}
+	return RemoveRepeatedElement(list), nil
+}
+
 // 去掉没有err返回值的int
 func (s *BaseController) GetIntNoErr(key string, def ...int) int {
 	strv := s.Ctx.Input.Query(key)
@@ -210,39 +275,3 @@ func (s *BaseController) SetInfo(name string) {
 func (s *BaseController) SetType(name string) {
 	s.Data["type"] = name
 }
-
-func (s *BaseController) CheckUserAuth() {
-	if s.controllerName == "client" {
-		if s.actionName == "add" {
-			s.StopRun()
-			return
-		}
-		if id := s.GetIntNoErr("id"); id != 0 {
-			if id != s.GetSession("clientId").(int) {
-				s.StopRun()
-				return
-			}
-		}
-	}
-	if s.controllerName == "index" {
-		if id := s.GetIntNoErr("id"); id != 0 {
-			belong := false
-			if strings.Contains(s.actionName, "h") {
-				if v, ok := file.GetDb().JsonDb.Hosts.Load(id); ok {
-					if v.(*file.Host).Client.Id == s.GetSession("clientId").(int) {
-						belong = true
-					}
-				}
-			} else {
-				if v, ok := file.GetDb().JsonDb.Tasks.Load(id); ok {
-					if v.(*file.Tunnel).Client.Id == s.GetSession("clientId").(int) {
-						belong = true
-					}
-				}
-			}
-			if !belong {
-				s.StopRun()
-			}
-		}
-	}
-}
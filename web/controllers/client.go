@@ -5,9 +5,10 @@ import (
 	"time"
 
 	"github.com/beego/beego"
+	"github.com/djylb/nps/bridge"
+	"github.com/djylb/nps/lib/audit"
 	"github.com/djylb/nps/lib/common"
 	"github.com/djylb/nps/lib/file"
-	"github.com/djylb/nps/lib/rate"
 	"github.com/djylb/nps/server"
 )
 
@@ -18,19 +19,25 @@ type ClientController struct {
 func (s *ClientController) List() {
 	if s.Ctx.Request.Method == "GET" {
 		s.Data["menu"] = "client"
+		if s.can(permManage) {
+			s.Data["groups"] = file.GetDb().GetGroupList()
+		}
+		s.Data["group_id"] = s.GetIntNoErr("group_id")
 		s.SetInfo("client")
 		s.display("client/list")
 		return
 	}
 	start, length := s.GetAjaxParams()
-	clientIdSession := s.GetSession("clientId")
-	var clientId int
-	if clientIdSession == nil {
-		clientId = s.GetIntNoErr("clientId")
+	clientId := s.GetIntNoErr("clientId")
+	groupId, tag := s.GetIntNoErr("group_id"), strings.TrimSpace(s.getEscapeString("tag"))
+	var list []*file.Client
+	var cnt int
+	if s.isTenant() {
+		list, _ = server.GetClientList(0, 0, s.getEscapeString("search"), s.getEscapeString("sort"), s.getEscapeString("order"), 0, groupId, tag)
+		list, cnt = pageOwned(&s.BaseController, list, func(c *file.Client) int { return c.Id }, start, length)
 	} else {
-		clientId = clientIdSession.(int)
+		list, cnt = server.GetClientList(start, length, s.getEscapeString("search"), s.getEscapeString("sort"), s.getEscapeString("order"), clientId, groupId, tag)
 	}
-	list, cnt := server.GetClientList(start, length, s.getEscapeString("search"), s.getEscapeString("sort"), s.getEscapeString("order"), clientId)
 	cmd := make(map[string]interface{})
 	ip := s.Ctx.Request.Host
 	cmd["ip"] = common.GetIpByAddr(ip)
@@ -47,15 +54,43 @@ func (s *ClientController) List() {
 func (s *ClientController) Add() {
 	if s.Ctx.Request.Method == "GET" {
 		s.Data["menu"] = "client"
+		s.Data["groups"] = file.GetDb().GetGroupList()
 		s.SetInfo("add client")
 		s.display()
 	} else {
+		blackIpList, err := s.getIpList("blackiplist")
+		if err != nil {
+			s.AjaxErr(err.Error())
+			return
+		}
+		whiteIpList, err := s.getIpList("whiteiplist")
+		if err != nil {
+			s.AjaxErr(err.Error())
+			return
+		}
+		geoWhiteList, err := s.getGeoList("geo_white_list")
+		if err != nil {
+			s.AjaxErr(err.Error())
+			return
+		}
+		geoBlackList, err := s.getGeoList("geo_black_list")
+		if err != nil {
+			s.AjaxErr(err.Error())
+			return
+		}
+		groupId, allowPorts, override, err := s.getGroupPolicy()
+		if err != nil {
+			s.AjaxErr(err.Error())
+			return
+		}
 		id := int(file.GetDb().JsonDb.GetClientId())
 		t := &file.Client{
 			VerifyKey: s.getEscapeString("vkey"),
 			Id:        id,
 			Status:    true,
 			Remark:    s.getEscapeString("remark"),
+			GroupId:   groupId,
+			Tags:      s.getTags(),
 			Cnf: &file.Config{
 				U:        s.getEscapeString("u"),
 				P:        s.getEscapeString("p"),
@@ -68,18 +103,24 @@ func (s *ClientController) Add() {
 			WebUserName:     s.getEscapeString("web_username"),
 			WebPassword:     s.getEscapeString("web_password"),
 			MaxTunnelNum:    s.GetIntNoErr("max_tunnel"),
+			AllowPorts:      allowPorts,
+			GroupOverride:   override,
 			Flow: &file.Flow{
 				ExportFlow: 0,
 				InletFlow:  0,
 				FlowLimit:  int64(s.GetIntNoErr("flow_limit")),
 				TimeLimit:  common.GetTimeNoErrByStr(s.getEscapeString("time_limit")),
 			},
-			BlackIpList: RemoveRepeatedElement(strings.Split(s.getEscapeString("blackiplist"), "\r\n")),
-			CreateTime:  time.Now().Format("2006-01-02 15:04:05"),
+			BlackIpList:  blackIpList,
+			WhiteIpList:  whiteIpList,
+			GeoWhiteList: geoWhiteList,
+			GeoBlackList: geoBlackList,
+			CreateTime:   time.Now().Format("2006-01-02 15:04:05"),
 		}
 		if err := file.GetDb().NewClient(t); err != nil {
 			s.AjaxErr(err.Error())
 		}
+		s.audit(audit.ActionCreate, "client", id, nil, t)
 		s.AjaxOkWithId("add success", id)
 	}
 }
@@ -107,23 +148,54 @@ func (s *ClientController) Edit() {
 			s.error()
 		} else {
 			s.Data["c"] = c
+			s.Data["groups"] = file.GetDb().GetGroupList()
+			s.Data["Tags"] = strings.Join(c.Tags, ", ")
 			s.Data["BlackIpList"] = strings.Join(c.BlackIpList, "\r\n")
+			s.Data["WhiteIpList"] = strings.Join(c.WhiteIpList, "\r\n")
+			s.Data["GeoWhiteList"] = strings.Join(c.GeoWhiteList, "\r\n")
+			s.Data["GeoBlackList"] = strings.Join(c.GeoBlackList, "\r\n")
 		}
 		s.SetInfo("edit client")
 		s.display()
 	} else {
+		blackIpList, err := s.getIpList("blackiplist")
+		if err != nil {
+			s.AjaxErr(err.Error())
+			return
+		}
+		whiteIpList, err := s.getIpList("whiteiplist")
+		if err != nil {
+			s.AjaxErr(err.Error())
+			return
+		}
+		geoWhiteList, err := s.getGeoList("geo_white_list")
+		if err != nil {
+			s.AjaxErr(err.Error())
+			return
+		}
+		geoBlackList, err := s.getGeoList("geo_black_list")
+		if err != nil {
+			s.AjaxErr(err.Error())
+			return
+		}
+		groupId, allowPorts, override, err := s.getGroupPolicy()
+		if err != nil {
+			s.AjaxErr(err.Error())
+			return
+		}
 		if c, err := file.GetDb().GetClient(id); err != nil {
 			s.error()
 			s.AjaxErr("client ID not found")
 			return
 		} else {
+			before := audit.Take(c)
 			if s.getEscapeString("web_username") != "" {
 				if s.getEscapeString("web_username") == beego.AppConfig.String("web_username") || !file.GetDb().VerifyUserName(s.getEscapeString("web_username"), c.Id) {
 					s.AjaxErr("web login username duplicate, please reset")
 					return
 				}
 			}
-			if s.GetSession("isAdmin").(bool) {
+			if s.can(permManage) {
 				if !file.GetDb().VerifyVkey(s.getEscapeString("vkey"), c.Id) {
 					s.AjaxErr("Vkey duplicate, please reset")
 					return
@@ -134,40 +206,69 @@ func (s *ClientController) Edit() {
 				c.RateLimit = s.GetIntNoErr("rate_limit")
 				c.MaxConn = s.GetIntNoErr("max_conn")
 				c.MaxTunnelNum = s.GetIntNoErr("max_tunnel")
+				c.GroupId = groupId
+				c.AllowPorts = allowPorts
+				c.GroupOverride = override
 				if s.GetBoolNoErr("flow_reset") {
 					c.Flow.ExportFlow = 0
 					c.Flow.InletFlow = 0
 				}
 			}
 			c.Remark = s.getEscapeString("remark")
+			c.Tags = s.getTags()
 			c.Cnf.U = s.getEscapeString("u")
-			c.Cnf.P = s.getEscapeString("p")
+			// 密码只保存哈希，表单不显示原值，留空不修改，清空用户名时一并清除
+			if p := s.getEscapeString("p"); p != "" || c.Cnf.U == "" {
+				c.Cnf.P = p
+			}
 			c.Cnf.Compress = common.GetBoolByStr(s.getEscapeString("compress"))
 			c.Cnf.Crypt = s.GetBoolNoErr("crypt")
 			b, err := beego.AppConfig.Bool("allow_user_change_username")
-			if s.GetSession("isAdmin").(bool) || (err == nil && b) {
+			if s.can(permManage) || (err == nil && b) {
 				c.WebUserName = s.getEscapeString("web_username")
 			}
-			c.WebPassword = s.getEscapeString("web_password")
-			c.ConfigConnAllow = s.GetBoolNoErr("config_conn_allow")
-			if c.Rate != nil {
-				c.Rate.Stop()
-			}
-			if c.RateLimit > 0 {
-				c.Rate = rate.NewRate(int64(c.RateLimit * 1024))
-				c.Rate.Start()
-			} else {
-				c.Rate = rate.NewRate(int64(2 << 23))
-				c.Rate.Start()
+			if p := s.getEscapeString("web_password"); p != "" || c.WebUserName == "" {
+				c.WebPassword = p
 			}
+			c.ConfigConnAllow = s.GetBoolNoErr("config_conn_allow")
+			c.ResetRate()
 
-			c.BlackIpList = RemoveRepeatedElement(strings.Split(s.getEscapeString("blackiplist"), "\r\n"))
+			c.BlackIpList = blackIpList
+			c.WhiteIpList = whiteIpList
+			c.GeoWhiteList = geoWhiteList
+			c.GeoBlackList = geoBlackList
+			c.HashPasswords()
 			file.GetDb().JsonDb.StoreClientsToJsonFile()
+			s.audit(audit.ActionUpdate, "client", c.Id, before, c)
 		}
 		s.AjaxOk("save success")
 	}
 }
 
+// getGroupPolicy 读取客户端所在的分组、允许的端口范围和不继承分组的限制项
+func (s *ClientController) getGroupPolicy() (int, string, []string, error) {
+	groupId := s.GetIntNoErr("group_id")
+	if groupId != 0 {
+		if _, err := file.GetDb().GetGroup(groupId); err != nil {
+			return 0, "", nil, err
+		}
+	}
+	allowPorts := strings.TrimSpace(s.getEscapeString("allow_ports"))
+	if err := file.CheckPortRanges(allowPorts); err != nil {
+		return 0, "", nil, err
+	}
+	override, err := file.CheckGroupOverride(s.GetStrings("group_override"))
+	if err != nil {
+		return 0, "", nil, err
+	}
+	return groupId, allowPorts, override, nil
+}
+
+// getTags 读取逗号分隔的标签
+func (s *ClientController) getTags() []string {
+	return file.CleanTags(strings.Split(s.getEscapeString("tags"), ","))
+}
+
 func RemoveRepeatedElement(arr []string) (newArr []string) {
 	newArr = make([]string, 0)
 	for i := 0; i < len(arr); i++ {
@@ -189,9 +290,13 @@ func RemoveRepeatedElement(arr []string) (newArr []string) {
 func (s *ClientController) ChangeStatus() {
 	id := s.GetIntNoErr("id")
 	if client, err := file.GetDb().GetClient(id); err == nil {
+		before := audit.Take(client)
 		client.Status = s.GetBoolNoErr("status")
 		if client.Status == false {
 			server.DelClientConnect(client.Id)
+			s.audit(audit.ActionStop, "client", id, before, client)
+		} else {
+			s.audit(audit.ActionStart, "client", id, before, client)
 		}
 		s.AjaxOk("modified success")
 	}
@@ -201,10 +306,56 @@ func (s *ClientController) ChangeStatus() {
 // 删除客户端
 func (s *ClientController) Del() {
 	id := s.GetIntNoErr("id")
+	c, _ := file.GetDb().GetClient(id)
 	if err := file.GetDb().DelClient(id); err != nil {
 		s.AjaxErr("delete error")
 	}
+	s.audit(audit.ActionDelete, "client", id, audit.Take(c), nil)
 	server.DelTunnelAndHostByClientId(id, false)
 	server.DelClientConnect(id)
 	s.AjaxOk("delete success")
 }
+
+// Config 生成客户端的 npc.conf、systemd 和 docker-compose 配置
+func (s *ClientController) Config() {
+	c, err := file.GetDb().GetClient(s.GetIntNoErr("id"))
+	if err != nil || c.NoDisplay {
+		s.error()
+		return
+	}
+	fields := make(map[string]string)
+	o := readNpcConfOptions(&s.Controller, fields)
+	if err := fieldsError(fields); err != nil {
+		o = &npcConfOptions{Kind: "npc", Type: "tcp", Server: common.GetIpByAddr(s.Ctx.Request.Host)}
+		s.Data["error"] = err.Error()
+	}
+	s.Data["menu"] = "client"
+	s.Data["c"] = c
+	s.Data["conn_type"] = o.Type
+	s.Data["server"] = o.Server
+	s.Data["tls_enable"] = bridge.ServerTlsEnable
+	for kind := range npcConfKinds {
+		o.Kind = kind
+		s.Data[kind] = renderNpcConf(c, o)
+	}
+	s.SetInfo("npc config")
+	s.display("client/config")
+}
+
+// ConfigLink 创建一次性下载链接
+func (s *ClientController) ConfigLink() {
+	c, err := file.GetDb().GetClient(s.GetIntNoErr("id"))
+	if err != nil || c.NoDisplay {
+		s.AjaxErr("the client is not exist")
+	}
+	fields := make(map[string]string)
+	o := readNpcConfOptions(&s.Controller, fields)
+	expire := npcConfExpire(s.GetIntNoErr("expire"), fields)
+	if err := fieldsError(fields); err != nil {
+		s.AjaxErr(err.Error())
+	}
+	path, t := newNpcConfLink(c.Id, o, expire)
+	s.Data["json"] = map[string]interface{}{"status": 1, "msg": "create success", "path": path, "expire_time": t.Format("2006-01-02 15:04:05")}
+	s.ServeJSON()
+	s.StopRun()
+}
@@ -0,0 +1,71 @@
+package controllers
+
+import (
+	"net"
+
+	"github.com/beego/beego"
+	"github.com/djylb/nps/lib/common"
+	"github.com/djylb/nps/server/proxy"
+)
+
+// ConnController 正在转发的访问者连接，租户只能查看和断开自己客户端的连接
+type ConnController struct {
+	BaseController
+}
+
+// Index 连接列表，支持按客户端、隧道、域名、访问者 IP 和关键字过滤
+func (s *ConnController) Index() {
+	if s.Ctx.Request.Method == "GET" {
+		s.Data["menu"] = "conn"
+		s.Data["client_id"] = s.GetIntNoErr("client_id")
+		s.Data["tunnel_id"] = s.GetIntNoErr("tunnel_id")
+		s.Data["host_id"] = s.GetIntNoErr("host_id")
+		s.SetInfo("connections")
+		s.display("conn/index")
+		return
+	}
+	start, length := s.GetAjaxParams()
+	list, cnt := pageOwned(&s.BaseController, proxy.ActiveConns(connQuery(&s.Controller)),
+		func(c proxy.ActiveConn) int { return c.ClientId }, start, length)
+	s.AjaxTable(list, cnt, cnt, nil)
+}
+
+// Kill 断开一个连接
+func (s *ConnController) Kill() {
+	id, _ := s.GetInt64("id")
+	c, ok := proxy.GetActiveConn(id)
+	if !ok || !s.ownClient(c.ClientId) {
+		s.AjaxErr("the connection is not exist")
+	}
+	proxy.KillConn(id)
+	s.AjaxOk("disconnect success")
+}
+
+// KillIp 断开访问者 IP 的全部连接，租户只断开自己客户端下的
+func (s *ConnController) KillIp() {
+	q := proxy.ConnQuery{Ip: s.GetString("ip"), ClientId: s.GetIntNoErr("client_id")}
+	if net.ParseIP(q.Ip) == nil {
+		s.AjaxErr("invalid ip")
+	}
+	n := 0
+	if s.isTenant() && q.ClientId == 0 {
+		for _, id := range s.clientIds {
+			q.ClientId = id
+			n += proxy.KillConns(q)
+		}
+	} else {
+		n = proxy.KillConns(q)
+	}
+	s.AjaxOkWithId("disconnect success", n)
+}
+
+// connQuery 从请求参数读取连接的过滤条件，web 和 api 共用
+func connQuery(c *beego.Controller) proxy.ConnQuery {
+	return proxy.ConnQuery{
+		ClientId: common.GetIntNoErrByStr(c.GetString("client_id")),
+		TunnelId: common.GetIntNoErrByStr(c.GetString("tunnel_id")),
+		HostId:   common.GetIntNoErrByStr(c.GetString("host_id")),
+		Ip:       c.GetString("ip"),
+		Search:   c.GetString("search"),
+	}
+}
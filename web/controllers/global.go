@@ -2,7 +2,9 @@ package controllers
 
 import (
 	"strings"
+	"time"
 
+	"github.com/djylb/nps/lib/audit"
 	"github.com/djylb/nps/lib/file"
 )
 
@@ -15,9 +17,6 @@ func (s *GlobalController) Index() {
 	//
 	//	return
 	//}
-	if !s.GetSession("isAdmin").(bool) {
-		return
-	}
 	s.Data["menu"] = "global"
 	s.SetInfo("global")
 	s.display("global/index")
@@ -35,9 +34,6 @@ func (s *GlobalController) Save() {
 	//if err != nil {
 	//	return
 	//}
-	if !s.GetSession("isAdmin").(bool) {
-		return
-	}
 	if s.Ctx.Request.Method == "GET" {
 		s.Data["menu"] = "global"
 		s.SetInfo("save global")
@@ -45,10 +41,59 @@ func (s *GlobalController) Save() {
 	} else {
 
 		t := &file.Glob{BlackIpList: RemoveRepeatedElement(strings.Split(s.getEscapeString("globalBlackIpList"), "\r\n"))}
+		global := file.GetDb().GetGlobal()
+		if global != nil {
+			t.TwoFactor = global.TwoFactor
+		}
 
 		if err := file.GetDb().SaveGlobal(t); err != nil {
 			s.AjaxErr(err.Error())
 		}
+		s.audit(audit.ActionUpdate, "global", 0, audit.Take(global), t)
 		s.AjaxOk("save success")
 	}
 }
+
+// api 令牌列表
+func (s *GlobalController) Tokens() {
+	if s.Ctx.Request.Method == "GET" {
+		s.Data["menu"] = "tokens"
+		s.SetInfo("api tokens")
+		s.display("global/tokens")
+		return
+	}
+	list := file.GetDb().GetApiTokenList()
+	rows := make([]*apiToken, len(list))
+	for i, v := range list {
+		rows[i] = newApiToken(v)
+	}
+	s.AjaxTable(rows, len(rows), len(rows), nil)
+}
+
+// 新建 api 令牌，令牌明文只返回这一次
+func (s *GlobalController) AddToken() {
+	t := &file.ApiToken{
+		Name:     s.getEscapeString("name"),
+		Scope:    s.getEscapeString("scope"),
+		ClientId: s.GetIntNoErr("client_id"),
+	}
+	if days := s.GetIntNoErr("expire_days"); days > 0 {
+		t.ExpireTime = time.Now().Add(time.Duration(days) * 24 * time.Hour).Unix()
+	}
+	token, err := file.GetDb().NewApiToken(t)
+	if err != nil {
+		s.AjaxErr(err.Error())
+		return
+	}
+	s.Data["json"] = map[string]interface{}{"status": 1, "msg": "add success", "token": token}
+	s.ServeJSON()
+}
+
+// 吊销 api 令牌
+func (s *GlobalController) DelToken() {
+	if err := file.GetDb().DelApiToken(s.GetIntNoErr("id")); err != nil {
+		s.AjaxErr(err.Error())
+		return
+	}
+	s.AjaxOk("delete success")
+}
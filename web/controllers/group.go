@@ -0,0 +1,120 @@
+package controllers
+
+import (
+	"strings"
+
+	"github.com/djylb/nps/lib/audit"
+	"github.com/djylb/nps/lib/file"
+	"github.com/djylb/nps/server"
+)
+
+// GroupController 客户端分组，分组的限制对未单独设置的成员生效
+type GroupController struct {
+	BaseController
+}
+
+func (s *GroupController) List() {
+	if s.Ctx.Request.Method == "GET" {
+		s.Data["menu"] = "group"
+		s.SetInfo("groups")
+		s.display("group/list")
+		return
+	}
+	list := file.GetDb().GetGroupList()
+	rows := make([]map[string]interface{}, len(list))
+	for i, g := range list {
+		rows[i] = map[string]interface{}{"group": g, "client_num": len(file.GetDb().GetGroupClients(g.Id))}
+	}
+	s.AjaxTable(rows, len(rows), len(rows), nil)
+}
+
+func (s *GroupController) Add() {
+	g := new(file.Group)
+	if err := s.readGroup(g); err != nil {
+		s.AjaxErr(err.Error())
+	}
+	if err := file.GetDb().NewGroup(g); err != nil {
+		s.AjaxErr(err.Error())
+	}
+	s.audit(audit.ActionCreate, "group", g.Id, nil, g)
+	s.AjaxOkWithId("add success", g.Id)
+}
+
+func (s *GroupController) Edit() {
+	g, err := file.GetDb().GetGroup(s.GetIntNoErr("id"))
+	if err != nil {
+		s.AjaxErr(err.Error())
+	}
+	before := audit.Take(g)
+	v := *g
+	if err := s.readGroup(&v); err != nil {
+		s.AjaxErr(err.Error())
+	}
+	if err := file.GetDb().UpdateGroup(&v); err != nil {
+		s.AjaxErr(err.Error())
+	}
+	s.audit(audit.ActionUpdate, "group", v.Id, before, &v)
+	s.AjaxOk("modified success")
+}
+
+func (s *GroupController) Del() {
+	g, err := file.GetDb().GetGroup(s.GetIntNoErr("id"))
+	if err != nil {
+		s.AjaxErr(err.Error())
+	}
+	before := audit.Take(g)
+	if err := file.GetDb().DelGroup(g.Id); err != nil {
+		s.AjaxErr(err.Error())
+	}
+	s.audit(audit.ActionDelete, "group", g.Id, before, nil)
+	s.AjaxOk("delete success")
+}
+
+// ChangeStatus 启用或停用分组的全部客户端
+func (s *GroupController) ChangeStatus() {
+	if _, err := file.GetDb().GetGroup(s.GetIntNoErr("id")); err != nil {
+		s.AjaxErr(err.Error())
+	}
+	setGroupStatus(s.GetIntNoErr("id"), s.GetBoolNoErr("status"), s.actor())
+	s.AjaxOk("modified success")
+}
+
+// readGroup 读取表单，黑名单每行一个 ip 或网段
+func (s *GroupController) readGroup(g *file.Group) error {
+	blackIpList, err := s.getIpList("blackiplist")
+	if err != nil {
+		return err
+	}
+	g.Name = s.getEscapeString("name")
+	g.Remark = s.getEscapeString("remark")
+	g.RateLimit = s.GetIntNoErr("rate_limit")
+	g.FlowLimit = int64(s.GetIntNoErr("flow_limit"))
+	g.MaxConn = s.GetIntNoErr("max_conn")
+	g.MaxTunnelNum = s.GetIntNoErr("max_tunnel")
+	g.BlackIpList = blackIpList
+	g.AllowPorts = strings.TrimSpace(s.getEscapeString("allow_ports"))
+	return nil
+}
+
+// setGroupStatus 修改分组全部客户端的状态，停用时断开客户端，返回状态有变化的客户端数量
+func setGroupStatus(id int, status bool, actor audit.Actor) int {
+	var n int
+	for _, c := range file.GetDb().GetGroupClients(id) {
+		if c.Status == status {
+			continue
+		}
+		before := audit.Take(c)
+		c.Status = status
+		if status {
+			audit.Record(actor, audit.ActionStart, "client", c.Id, before, c)
+		} else {
+			server.DelClientConnect(c.Id)
+			audit.Record(actor, audit.ActionStop, "client", c.Id, before, c)
+		}
+		n++
+	}
+	if n > 0 {
+		file.GetDb().JsonDb.StoreClientsToJsonFile()
+	}
+	return n
+}
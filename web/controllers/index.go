@@ -1,11 +1,15 @@
 package controllers
 
 import (
+	"errors"
 	"strings"
 
 	"github.com/beego/beego"
+	"github.com/djylb/nps/lib/audit"
 	"github.com/djylb/nps/lib/common"
+	"github.com/djylb/nps/lib/conn"
 	"github.com/djylb/nps/lib/file"
+	"github.com/djylb/nps/lib/logs"
 	"github.com/djylb/nps/server"
 	"github.com/djylb/nps/server/tool"
 )
@@ -43,6 +47,12 @@ func (s *IndexController) Socks5() {
 	s.display("index/list")
 }
 
+func (s *IndexController) Sni() {
+	s.SetInfo("sni")
+	s.SetType("sni")
+	s.display("index/list")
+}
+
 func (s *IndexController) Http() {
 	s.SetInfo("http proxy")
 	s.SetType("httpProxy")
@@ -83,6 +93,11 @@ func (s *IndexController) GetTunnel() {
 	start, length := s.GetAjaxParams()
 	taskType := s.getEscapeString("type")
 	clientId := s.GetIntNoErr("client_id")
+	if s.isTenant() && clientId == 0 {
+		list, _ := server.GetTunnel(0, 0, taskType, 0, s.getEscapeString("search"), s.getEscapeString("sort"), s.getEscapeString("order"))
+		list, cnt := pageOwned(&s.BaseController, list, func(t *file.Tunnel) int { return t.Client.Id }, start, length)
+		s.AjaxTable(list, cnt, cnt, nil)
+	}
 	list, cnt := server.GetTunnel(start, length, taskType, clientId, s.getEscapeString("search"), s.getEscapeString("sort"), s.getEscapeString("order"))
 	s.AjaxTable(list, cnt, cnt, nil)
 }
@@ -94,6 +109,26 @@ func (s *IndexController) Add() {
 		s.SetInfo("add tunnel")
 		s.display()
 	} else {
+		blackIpList, err := s.getIpList("black_ip_list")
+		if err != nil {
+			s.AjaxErr(err.Error())
+			return
+		}
+		whiteIpList, err := s.getIpList("white_ip_list")
+		if err != nil {
+			s.AjaxErr(err.Error())
+			return
+		}
+		geoWhiteList, err := s.getGeoList("geo_white_list")
+		if err != nil {
+			s.AjaxErr(err.Error())
+			return
+		}
+		geoBlackList, err := s.getGeoList("geo_black_list")
+		if err != nil {
+			s.AjaxErr(err.Error())
+			return
+		}
 		id := int(file.GetDb().JsonDb.GetTaskId())
 		clientId := s.GetIntNoErr("client_id")
 		t := &file.Tunnel{
@@ -109,12 +144,26 @@ func (s *IndexController) Add() {
 				Content:    s.getEscapeString("auth"),
 				AccountMap: common.DealMultiUser(s.getEscapeString("auth")),
 			},
-			Id:        id,
-			Status:    true,
-			Remark:    s.getEscapeString("remark"),
-			Password:  s.getEscapeString("password"),
-			LocalPath: s.getEscapeString("local_path"),
-			StripPre:  s.getEscapeString("strip_pre"),
+			Id:                  id,
+			Status:              true,
+			Remark:              s.getEscapeString("remark"),
+			Password:            s.getEscapeString("password"),
+			LocalPath:           s.getEscapeString("local_path"),
+			StripPre:            s.getEscapeString("strip_pre"),
+			ConnLimit:           s.GetIntNoErr("conn_limit"),
+			ConnBurst:           s.GetIntNoErr("conn_burst"),
+			AcceptProxyProtocol: s.GetBoolNoErr("accept_proxy_protocol"),
+			SniHost:             s.getEscapeString("sni_host"),
+			TlsOffload:          s.GetBoolNoErr("tls_offload"),
+			CertFilePath:        s.getEscapeString("cert_file_path"),
+			KeyFilePath:         s.getEscapeString("key_file_path"),
+			AcmeDomain:          strings.TrimSpace(s.getEscapeString("acme_domain")),
+			ClientCaFile:        s.getEscapeString("client_ca_file"),
+			AuthUrl:             strings.TrimSpace(s.getEscapeString("auth_url")),
+			WhiteIpList:         whiteIpList,
+			BlackIpList:         blackIpList,
+			GeoWhiteList:        geoWhiteList,
+			GeoBlackList:        geoBlackList,
 			Flow: &file.Flow{
 				FlowLimit: int64(s.GetIntNoErr("flow_limit")),
 				TimeLimit: common.GetTimeNoErrByStr(s.getEscapeString("time_limit")),
@@ -125,19 +174,39 @@ func (s *IndexController) Add() {
 			t.Port = tool.GenerateServerPort(t.Mode)
 		}
 
-		if !tool.TestServerPort(t.Port, t.Mode) {
+		if err := checkTlsOffload(t); err != nil {
+			s.AjaxErr(err.Error())
+			return
+		}
+		if err := checkProxyProtocol(t); err != nil {
+			s.AjaxErr(err.Error())
+			return
+		}
+		if err := server.CheckSniHost(t); err != nil {
+			s.AjaxErr(err.Error())
+			return
+		}
+		if err := checkAuthUrl(t.AuthUrl); err != nil {
+			s.AjaxErr(err.Error())
+			return
+		}
+
+		if !server.TestTaskPort(t.Port, t.ServerIp, t.Mode) {
 			s.AjaxErr("The port cannot be opened because it may has been occupied or is no longer allowed.")
 		}
-		var err error
 		if t.Client, err = file.GetDb().GetClient(clientId); err != nil {
 			s.AjaxErr(err.Error())
 		}
-		if t.Client.MaxTunnelNum != 0 && t.Client.GetTunnelNum() >= t.Client.MaxTunnelNum {
+		if t.Client.TunnelNumExceeded() {
 			s.AjaxErr("The number of tunnels exceeds the limit")
 		}
+		if !t.Client.AllowPort(t.Port, t.Mode) {
+			s.AjaxErr("The port is not in the allowed port range of the client")
+		}
 		if err := file.GetDb().NewTask(t); err != nil {
 			s.AjaxErr(err.Error())
 		}
+		s.audit(audit.ActionCreate, "tunnel", id, nil, t)
 		if err := server.AddTask(t); err != nil {
 			s.AjaxErr(err.Error())
 		} else {
@@ -164,6 +233,10 @@ func (s *IndexController) Edit() {
 			s.error()
 		} else {
 			s.Data["t"] = t
+			s.Data["white_ip_list"] = strings.Join(t.WhiteIpList, "\r\n")
+			s.Data["black_ip_list"] = strings.Join(t.BlackIpList, "\r\n")
+			s.Data["geo_white_list"] = strings.Join(t.GeoWhiteList, "\r\n")
+			s.Data["geo_black_list"] = strings.Join(t.GeoBlackList, "\r\n")
 			if t.UserAuth == nil {
 				s.Data["auth"] = ""
 			} else {
@@ -173,37 +246,108 @@ func (s *IndexController) Edit() {
 		s.SetInfo("edit tunnel")
 		s.display()
 	} else {
+		blackIpList, err := s.getIpList("black_ip_list")
+		if err != nil {
+			s.AjaxErr(err.Error())
+			return
+		}
+		whiteIpList, err := s.getIpList("white_ip_list")
+		if err != nil {
+			s.AjaxErr(err.Error())
+			return
+		}
+		geoWhiteList, err := s.getGeoList("geo_white_list")
+		if err != nil {
+			s.AjaxErr(err.Error())
+			return
+		}
+		geoBlackList, err := s.getGeoList("geo_black_list")
+		if err != nil {
+			s.AjaxErr(err.Error())
+			return
+		}
 		if t, err := file.GetDb().GetTask(id); err != nil {
 			s.error()
 		} else {
+			before := audit.Take(t)
 			clientId := s.GetIntNoErr("client_id")
-			if client, err := file.GetDb().GetClient(clientId); err != nil {
+			// 先在副本上检查，全部通过后再修改运行中的隧道
+			tmp := &file.Tunnel{
+				Id:                  id,
+				Port:                t.Port,
+				ServerIp:            s.getEscapeString("server_ip"),
+				Mode:                s.getEscapeString("type"),
+				AcceptProxyProtocol: s.GetBoolNoErr("accept_proxy_protocol"),
+				SniHost:             s.getEscapeString("sni_host"),
+				TlsOffload:          s.GetBoolNoErr("tls_offload"),
+				CertFilePath:        s.getEscapeString("cert_file_path"),
+				KeyFilePath:         s.getEscapeString("key_file_path"),
+				AcmeDomain:          strings.TrimSpace(s.getEscapeString("acme_domain")),
+				ClientCaFile:        s.getEscapeString("client_ca_file"),
+				AuthUrl:             strings.TrimSpace(s.getEscapeString("auth_url")),
+			}
+			if tmp.Client, err = file.GetDb().GetClient(clientId); err != nil {
 				s.AjaxErr("modified error,the client is not exist")
 				return
-			} else {
-				t.Client = client
 			}
 			if s.GetIntNoErr("port") != t.Port {
-				t.Port = s.GetIntNoErr("port")
+				tmp.Port = s.GetIntNoErr("port")
 
-				if t.Port <= 0 {
-					t.Port = tool.GenerateServerPort(t.Mode)
+				if tmp.Port <= 0 {
+					tmp.Port = tool.GenerateServerPort(tmp.Mode)
 				}
 
-				if !tool.TestServerPort(s.GetIntNoErr("port"), t.Mode) {
+				if !server.TestTaskPort(tmp.Port, tmp.ServerIp, tmp.Mode) {
 					s.AjaxErr("The port cannot be opened because it may has been occupied or is no longer allowed.")
 					return
 				}
 			}
-			t.ServerIp = s.getEscapeString("server_ip")
-			t.Mode = s.getEscapeString("type")
+			if !tmp.Client.AllowPort(tmp.Port, tmp.Mode) {
+				s.AjaxErr("The port is not in the allowed port range of the client")
+				return
+			}
+			if err := checkTlsOffload(tmp); err != nil {
+				s.AjaxErr(err.Error())
+				return
+			}
+			if err := checkProxyProtocol(tmp); err != nil {
+				s.AjaxErr(err.Error())
+				return
+			}
+			if err := server.CheckSniHost(tmp); err != nil {
+				s.AjaxErr(err.Error())
+				return
+			}
+			if err := checkAuthUrl(tmp.AuthUrl); err != nil {
+				s.AjaxErr(err.Error())
+				return
+			}
+			t.Client = tmp.Client
+			t.Port = tmp.Port
+			t.ServerIp = tmp.ServerIp
+			t.Mode = tmp.Mode
 			t.Target = &file.Target{TargetStr: strings.ReplaceAll(s.getEscapeString("target"), "\r\n", "\n")}
 			t.UserAuth = &file.MultiAccount{Content: s.getEscapeString("auth"), AccountMap: common.DealMultiUser(s.getEscapeString("auth"))}
+			t.UserAuth.HashPasswords()
 			t.Password = s.getEscapeString("password")
 			t.Id = id
 			t.LocalPath = s.getEscapeString("local_path")
 			t.StripPre = s.getEscapeString("strip_pre")
 			t.Remark = s.getEscapeString("remark")
+			t.ConnLimit = s.GetIntNoErr("conn_limit")
+			t.ConnBurst = s.GetIntNoErr("conn_burst")
+			t.AcceptProxyProtocol = tmp.AcceptProxyProtocol
+			t.SniHost = tmp.SniHost
+			t.TlsOffload = tmp.TlsOffload
+			t.CertFilePath = tmp.CertFilePath
+			t.KeyFilePath = tmp.KeyFilePath
+			t.AcmeDomain = tmp.AcmeDomain
+			t.ClientCaFile = tmp.ClientCaFile
+			t.AuthUrl = tmp.AuthUrl
+			t.WhiteIpList = whiteIpList
+			t.BlackIpList = blackIpList
+			t.GeoWhiteList = geoWhiteList
+			t.GeoBlackList = geoBlackList
 			t.Flow.FlowLimit = int64(s.GetIntNoErr("flow_limit"))
 			t.Flow.TimeLimit = common.GetTimeNoErrByStr(s.getEscapeString("time_limit"))
 			if s.GetBoolNoErr("flow_reset") {
@@ -213,6 +357,7 @@ func (s *IndexController) Edit() {
 			t.Target.ProxyProtocol = s.GetIntNoErr("proxy_protocol")
 			t.Target.LocalProxy = (clientId > 0 && s.GetBoolNoErr("local_proxy")) || clientId <= 0
 			file.GetDb().UpdateTask(t)
+			s.audit(audit.ActionUpdate, "tunnel", t.Id, before, t)
 			server.StopServer(t.Id)
 			server.StartTask(t.Id)
 		}
@@ -222,28 +367,36 @@ func (s *IndexController) Edit() {
 
 func (s *IndexController) Stop() {
 	id := s.GetIntNoErr("id")
+	t, _ := file.GetDb().GetTask(id)
+	before := audit.Take(t)
 	if err := server.StopServer(id); err != nil && err.Error() != "task is not running" {
 		s.AjaxErr("stop error")
 	}
+	s.audit(audit.ActionStop, "tunnel", id, before, t)
 	s.AjaxOk("stop success")
 }
 
 func (s *IndexController) Del() {
 	id := s.GetIntNoErr("id")
+	t, _ := file.GetDb().GetTask(id)
 	if err := server.DelTask(id); err != nil {
 		s.AjaxErr("delete error")
 	}
+	s.audit(audit.ActionDelete, "tunnel", id, audit.Take(t), nil)
 	s.AjaxOk("delete success")
 }
 
 func (s *IndexController) Start() {
 	id := s.GetIntNoErr("id")
+	t, _ := file.GetDb().GetTask(id)
+	before := audit.Take(t)
 	if err := server.StartTask(id); err != nil {
 		if err.Error() == "the port open error" {
 			s.AjaxErr("The port cannot be opened because it may has been occupied or is no longer allowed.")
 		}
 		s.AjaxErr("start error")
 	}
+	s.audit(audit.ActionStart, "tunnel", id, before, t)
 	s.AjaxOk("start success")
 }
 
@@ -258,6 +411,11 @@ func (s *IndexController) HostList() {
 		start, length := s.GetAjaxParams()
 		clientId := s.GetIntNoErr("client_id")
 		//list, cnt := file.GetDb().GetHost(start, length, clientId, s.getEscapeString("search"))
+		if s.isTenant() && clientId == 0 {
+			list, _ := server.GetHostList(0, 0, 0, s.getEscapeString("search"), s.getEscapeString("sort"), s.getEscapeString("order"))
+			list, cnt := pageOwned(&s.BaseController, list, func(h *file.Host) int { return h.Client.Id }, start, length)
+			s.AjaxTable(list, cnt, cnt, nil)
+		}
 		list, cnt := server.GetHostList(start, length, clientId, s.getEscapeString("search"), s.getEscapeString("sort"), s.getEscapeString("order"))
 		s.AjaxTable(list, cnt, cnt, nil)
 	}
@@ -279,12 +437,27 @@ func (s *IndexController) GetHost() {
 
 func (s *IndexController) DelHost() {
 	id := s.GetIntNoErr("id")
+	h, _ := file.GetDb().GetHostById(id)
 	if err := file.GetDb().DelHost(id); err != nil {
 		s.AjaxErr("delete error")
 	}
+	s.audit(audit.ActionDelete, "host", id, audit.Take(h), nil)
+	server.PurgeHttpCache(id, "")
 	s.AjaxOk("delete success")
 }
 
+// 清除域名的响应缓存，path 不为空时只清除以其开头的路径
+func (s *IndexController) PurgeCache() {
+	id := s.GetIntNoErr("id")
+	if _, err := file.GetDb().GetHostById(id); err != nil {
+		s.AjaxErr("the host is not exist")
+		return
+	}
+	n := server.PurgeHttpCache(id, s.getEscapeString("path"))
+	logs.Info("purge %d cached responses of host %d", n, id)
+	s.AjaxOk("purge success")
+}
+
 func (s *IndexController) StartHost() {
 	id := s.GetIntNoErr("id")
 	h, err := file.GetDb().GetHostById(id)
@@ -292,8 +465,10 @@ func (s *IndexController) StartHost() {
 		s.error()
 		return
 	}
+	before := audit.Take(h)
 	h.IsClose = false
 	file.GetDb().JsonDb.StoreHostToJsonFile()
+	s.audit(audit.ActionStart, "host", id, before, h)
 	s.AjaxOk("start success")
 }
 
@@ -304,8 +479,10 @@ func (s *IndexController) StopHost() {
 		s.error()
 		return
 	}
+	before := audit.Take(h)
 	h.IsClose = true
 	file.GetDb().JsonDb.StoreHostToJsonFile()
+	s.audit(audit.ActionStop, "host", id, before, h)
 	s.AjaxOk("stop success")
 }
 
@@ -316,6 +493,26 @@ func (s *IndexController) AddHost() {
 		s.SetInfo("add host")
 		s.display("index/hadd")
 	} else {
+		blackIpList, err := s.getIpList("black_ip_list")
+		if err != nil {
+			s.AjaxErr(err.Error())
+			return
+		}
+		whiteIpList, err := s.getIpList("white_ip_list")
+		if err != nil {
+			s.AjaxErr(err.Error())
+			return
+		}
+		geoWhiteList, err := s.getGeoList("geo_white_list")
+		if err != nil {
+			s.AjaxErr(err.Error())
+			return
+		}
+		geoBlackList, err := s.getGeoList("geo_black_list")
+		if err != nil {
+			s.AjaxErr(err.Error())
+			return
+		}
 		id := int(file.GetDb().JsonDb.GetHostId())
 		clientId := s.GetIntNoErr("client_id")
 		h := &file.Host{
@@ -338,25 +535,55 @@ func (s *IndexController) AddHost() {
 				FlowLimit: int64(s.GetIntNoErr("flow_limit")),
 				TimeLimit: common.GetTimeNoErrByStr(s.getEscapeString("time_limit")),
 			},
-			Scheme:         s.getEscapeString("scheme"),
-			HttpsJustProxy: s.GetBoolNoErr("https_just_proxy"),
-			KeyFilePath:    s.getEscapeString("key_file_path"),
-			CertFilePath:   s.getEscapeString("cert_file_path"),
-			AutoHttps:      s.GetBoolNoErr("auto_https"),
-			AutoCORS:       s.GetBoolNoErr("auto_cors"),
-			TargetIsHttps:  s.GetBoolNoErr("target_is_https"),
-		}
-		var err error
+			Scheme:              s.getEscapeString("scheme"),
+			HttpsJustProxy:      s.GetBoolNoErr("https_just_proxy"),
+			KeyFilePath:         s.getEscapeString("key_file_path"),
+			CertFilePath:        s.getEscapeString("cert_file_path"),
+			AutoHttps:           s.GetBoolNoErr("auto_https"),
+			AutoCORS:            s.GetBoolNoErr("auto_cors"),
+			TargetIsHttps:       s.GetBoolNoErr("target_is_https"),
+			BackendProto:        s.getEscapeString("backend_proto"),
+			CacheEnable:         s.GetBoolNoErr("cache_enable"),
+			CacheInclude:        s.getEscapeString("cache_include"),
+			CacheExclude:        s.getEscapeString("cache_exclude"),
+			CompressEnable:      s.GetBoolNoErr("compress_enable"),
+			CompressTypes:       s.getEscapeString("compress_types"),
+			CompressMinSize:     s.GetIntNoErr("compress_min_size"),
+			OidcIssuer:          strings.TrimSpace(s.getEscapeString("oidc_issuer")),
+			OidcClientId:        s.getEscapeString("oidc_client_id"),
+			OidcClientSecret:    s.getEscapeString("oidc_client_secret"),
+			OidcScopes:          s.getEscapeString("oidc_scopes"),
+			OidcAllowDomains:    s.getEscapeString("oidc_allow_domains"),
+			OidcAllowGroups:     s.getEscapeString("oidc_allow_groups"),
+			AuthUrl:             strings.TrimSpace(s.getEscapeString("auth_url")),
+			AuthResponseHeaders: s.getEscapeString("auth_response_headers"),
+			ReqLimit:            s.GetIntNoErr("req_limit"),
+			ReqBurst:            s.GetIntNoErr("req_burst"),
+			ReqLimitKey:         s.getEscapeString("req_limit_key"),
+			WhiteIpList:         whiteIpList,
+			BlackIpList:         blackIpList,
+			GeoWhiteList:        geoWhiteList,
+			GeoBlackList:        geoBlackList,
+		}
+		if err := checkOidc(h); err != nil {
+			s.AjaxErr(err.Error())
+			return
+		}
+		if err := checkAuthUrl(h.AuthUrl); err != nil {
+			s.AjaxErr(err.Error())
+			return
+		}
 		if h.Client, err = file.GetDb().GetClient(s.GetIntNoErr("client_id")); err != nil {
 			s.AjaxErr("add error the client can not be found")
 		}
-		if h.Client.MaxTunnelNum != 0 && h.Client.GetTunnelNum() >= h.Client.MaxTunnelNum {
+		if h.Client.TunnelNumExceeded() {
 			s.AjaxErr("The number of tunnels exceeds the limit")
 		}
 
 		if err := file.GetDb().NewHost(h); err != nil {
 			s.AjaxErr("add fail" + err.Error())
 		}
+		s.audit(audit.ActionCreate, "host", id, nil, h)
 		s.AjaxOkWithId("add success", id)
 	}
 }
@@ -369,6 +596,10 @@ func (s *IndexController) EditHost() {
 			s.error()
 		} else {
 			s.Data["h"] = h
+			s.Data["white_ip_list"] = strings.Join(h.WhiteIpList, "\r\n")
+			s.Data["black_ip_list"] = strings.Join(h.BlackIpList, "\r\n")
+			s.Data["geo_white_list"] = strings.Join(h.GeoWhiteList, "\r\n")
+			s.Data["geo_black_list"] = strings.Join(h.GeoBlackList, "\r\n")
 			if h.UserAuth == nil {
 				s.Data["auth"] = ""
 			} else {
@@ -378,9 +609,45 @@ func (s *IndexController) EditHost() {
 		s.SetInfo("edit")
 		s.display("index/hedit")
 	} else {
+		blackIpList, err := s.getIpList("black_ip_list")
+		if err != nil {
+			s.AjaxErr(err.Error())
+			return
+		}
+		whiteIpList, err := s.getIpList("white_ip_list")
+		if err != nil {
+			s.AjaxErr(err.Error())
+			return
+		}
+		geoWhiteList, err := s.getGeoList("geo_white_list")
+		if err != nil {
+			s.AjaxErr(err.Error())
+			return
+		}
+		geoBlackList, err := s.getGeoList("geo_black_list")
+		if err != nil {
+			s.AjaxErr(err.Error())
+			return
+		}
 		if h, err := file.GetDb().GetHostById(id); err != nil {
 			s.error()
 		} else {
+			before := audit.Take(h)
+			// 先检查登录和认证设置，全部通过后再修改运行中的域名
+			tmp := &file.Host{
+				HttpsJustProxy: s.GetBoolNoErr("https_just_proxy"),
+				OidcIssuer:     strings.TrimSpace(s.getEscapeString("oidc_issuer")),
+				OidcClientId:   s.getEscapeString("oidc_client_id"),
+				AuthUrl:        strings.TrimSpace(s.getEscapeString("auth_url")),
+			}
+			if err := checkOidc(tmp); err != nil {
+				s.AjaxErr(err.Error())
+				return
+			}
+			if err := checkAuthUrl(tmp.AuthUrl); err != nil {
+				s.AjaxErr(err.Error())
+				return
+			}
 			if h.Host != s.getEscapeString("host") {
 				tmpHost := new(file.Host)
 				tmpHost.Host = s.getEscapeString("host")
@@ -400,12 +667,20 @@ func (s *IndexController) EditHost() {
 			h.Host = s.getEscapeString("host")
 			h.Target = &file.Target{TargetStr: strings.ReplaceAll(s.getEscapeString("target"), "\r\n", "\n")}
 			h.UserAuth = &file.MultiAccount{Content: s.getEscapeString("auth"), AccountMap: common.DealMultiUser(s.getEscapeString("auth"))}
+			h.UserAuth.HashPasswords()
 			h.HeaderChange = s.getEscapeString("header")
 			h.HostChange = s.getEscapeString("hostchange")
 			h.Remark = s.getEscapeString("remark")
 			h.Location = s.getEscapeString("location")
+			h.ReqLimit = s.GetIntNoErr("req_limit")
+			h.ReqBurst = s.GetIntNoErr("req_burst")
+			h.ReqLimitKey = s.getEscapeString("req_limit_key")
+			h.WhiteIpList = whiteIpList
+			h.BlackIpList = blackIpList
+			h.GeoWhiteList = geoWhiteList
+			h.GeoBlackList = geoBlackList
 			h.Scheme = s.getEscapeString("scheme")
-			h.HttpsJustProxy = s.GetBoolNoErr("https_just_proxy")
+			h.HttpsJustProxy = tmp.HttpsJustProxy
 			h.KeyFilePath = s.getEscapeString("key_file_path")
 			h.CertFilePath = s.getEscapeString("cert_file_path")
 			h.Target.ProxyProtocol = s.GetIntNoErr("proxy_protocol")
@@ -419,8 +694,118 @@ func (s *IndexController) EditHost() {
 			h.AutoHttps = s.GetBoolNoErr("auto_https")
 			h.AutoCORS = s.GetBoolNoErr("auto_cors")
 			h.TargetIsHttps = s.GetBoolNoErr("target_is_https")
+			h.BackendProto = s.getEscapeString("backend_proto")
+			h.CacheEnable = s.GetBoolNoErr("cache_enable")
+			h.CacheInclude = s.getEscapeString("cache_include")
+			h.CacheExclude = s.getEscapeString("cache_exclude")
+			h.CompressEnable = s.GetBoolNoErr("compress_enable")
+			h.CompressTypes = s.getEscapeString("compress_types")
+			h.CompressMinSize = s.GetIntNoErr("compress_min_size")
+			h.OidcIssuer = tmp.OidcIssuer
+			h.OidcClientId = tmp.OidcClientId
+			if secret := s.getEscapeString("oidc_client_secret"); secret != "" {
+				h.OidcClientSecret = secret
+			}
+			h.OidcScopes = s.getEscapeString("oidc_scopes")
+			h.OidcAllowDomains = s.getEscapeString("oidc_allow_domains")
+			h.OidcAllowGroups = s.getEscapeString("oidc_allow_groups")
+			h.AuthUrl = tmp.AuthUrl
+			h.AuthResponseHeaders = s.getEscapeString("auth_response_headers")
 			file.GetDb().JsonDb.StoreHostToJsonFile()
+			s.audit(audit.ActionUpdate, "host", h.Id, before, h)
+			server.PurgeHttpCache(h.Id, "")
 		}
 		s.AjaxOk("modified success")
 	}
 }
+
+// 隧道访问日志
+func (s *IndexController) TunnelLog() {
+	s.accessLog("tunnel")
+}
+
+// 域名访问日志
+func (s *IndexController) HostLog() {
+	s.Data["menu"] = "host"
+	s.accessLog("host")
+}
+
+func (s *IndexController) accessLog(kind string) {
+	id := s.GetIntNoErr("id")
+	if s.Ctx.Request.Method == "GET" {
+		s.Data["id"] = id
+		s.Data["kind"] = kind
+		s.SetInfo("access log")
+		s.display("index/accesslog")
+		return
+	}
+	n := s.GetIntNoErr("lines", 200)
+	if n <= 0 || n > 2000 {
+		n = 2000
+	}
+	lines, err := logs.ReadAccess(kind, id, n)
+	if err != nil {
+		s.AjaxErr(err.Error())
+	}
+	s.Data["json"] = map[string]interface{}{"status": 1, "rows": lines}
+	s.ServeJSON()
+}
+
+// checkTlsOffload 检查 tcp 隧道 TLS 卸载所需的证书配置
+func checkTlsOffload(t *file.Tunnel) error {
+	if t.Mode != "tcp" || !t.TlsOffload {
+		return nil
+	}
+	if t.AcmeDomain == "" {
+		if _, ok := common.LoadCert(t.CertFilePath, t.KeyFilePath); !ok {
+			return errors.New("invalid tls certificate or key")
+		}
+	}
+	if t.ClientCaFile != "" {
+		if ca, err := common.GetCertContent(t.ClientCaFile, "CERTIFICATE"); err != nil || ca == "" {
+			return errors.New("invalid client ca certificate")
+		}
+	}
+	return nil
+}
+
+// checkOidc 检查域名 OIDC 登录的必填项
+func checkOidc(h *file.Host) error {
+	if h.OidcIssuer == "" {
+		return nil
+	}
+	if !strings.HasPrefix(h.OidcIssuer, "https://") && !strings.HasPrefix(h.OidcIssuer, "http://") {
+		return errors.New("invalid oidc issuer")
+	}
+	if h.OidcClientId == "" {
+		return errors.New("oidc client id is required")
+	}
+	if h.HttpsJustProxy {
+		return errors.New("oidc login does not work with https just proxy")
+	}
+	return nil
+}
+
+// checkProxyProtocol 检查入站 PROXY 协议头的设置，只有 tcp 类的隧道支持，且必须配置受信任的来源
+func checkProxyProtocol(t *file.Tunnel) error {
+	if !t.AcceptProxyProtocol {
+		return nil
+	}
+	switch t.Mode {
+	case "tcp", "file", "socks5", "httpProxy", "tcpTrans":
+	default:
+		return errors.New("the tunnel mode does not support proxy protocol")
+	}
+	if !conn.ProxyProtocolTrustedSet() {
+		return errors.New("proxy_protocol_trusted_ips must be set before accepting proxy protocol")
+	}
+	return nil
+}
+
+// checkAuthUrl 检查转发认证地址
+func checkAuthUrl(u string) error {
+	if u != "" && !strings.HasPrefix(u, "https://") && !strings.HasPrefix(u, "http://") {
+		return errors.New("invalid forward auth url")
+	}
+	return nil
+}
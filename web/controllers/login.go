@@ -10,17 +10,23 @@ import (
 	"github.com/beego/beego/cache"
 	"github.com/beego/beego/utils/captcha"
 	"github.com/djylb/nps/lib/common"
+	"github.com/djylb/nps/lib/crypt"
 	"github.com/djylb/nps/lib/file"
+	"github.com/djylb/nps/lib/webhook"
 	"github.com/djylb/nps/server"
 )
 
 type LoginController struct {
 	beego.Controller
+	totpRequired bool //password is right but the two-factor code is missing or wrong
 }
 
 var ipRecord sync.Map
 var cpt *captcha.Captcha
 
+// loginFailNotify 同一 IP 每连续失败这么多次发送一次 login.failed 通知
+const loginFailNotify = 5
+
 type record struct {
 	hasLoginFailTimes int
 	lastLoginTime     time.Time
@@ -38,7 +44,7 @@ func init() {
 func (self *LoginController) Index() {
 	// Try login implicitly, will succeed if it's configured as no-auth(empty username&password).
 	webBaseUrl := beego.AppConfig.String("web_base_url")
-	if self.doLogin("", "", false) {
+	if self.doLogin("", "", "", false) {
 		self.Redirect(webBaseUrl+"/index/index", 302)
 	}
 	self.Data["web_base_url"] = webBaseUrl
@@ -59,15 +65,17 @@ func (self *LoginController) Verify() {
 			self.ServeJSON()
 		}
 	}
-	if self.doLogin(username, password, true) {
+	if self.doLogin(username, password, self.GetString("code"), true) {
 		self.Data["json"] = map[string]interface{}{"status": 1, "msg": "login success"}
+	} else if self.totpRequired {
+		self.Data["json"] = map[string]interface{}{"status": 0, "msg": "please enter the two-factor verification code", "totp": 1}
 	} else {
 		self.Data["json"] = map[string]interface{}{"status": 0, "msg": "username or password incorrect"}
 	}
 	self.ServeJSON()
 }
 
-func (self *LoginController) doLogin(username, password string, explicit bool) bool {
+func (self *LoginController) doLogin(username, password, code string, explicit bool) bool {
 	clearIprecord()
 	ip, _, _ := net.SplitHostPort(self.Ctx.Request.RemoteAddr)
 	if v, ok := ipRecord.Load(ip); ok {
@@ -80,15 +88,27 @@ func (self *LoginController) doLogin(username, password string, explicit bool) b
 		}
 	}
 	var auth bool
-	if password == beego.AppConfig.String("web_password") && username == beego.AppConfig.String("web_username") {
-		self.SetSession("isAdmin", true)
-		self.DelSession("clientId")
-		self.DelSession("username")
-		auth = true
-		server.Bridge.Register.Store(common.GetIpByAddr(self.Ctx.Input.IP()), time.Now().Add(time.Hour*time.Duration(2)))
+	if username == beego.AppConfig.String("web_username") && crypt.CheckPassword(crypt.MarkLegacyHash(beego.AppConfig.String("web_password")), password) {
+		var tf *file.TwoFactor
+		if global := file.GetDb().GetGlobal(); global != nil {
+			tf = global.TwoFactor
+		}
+		if self.checkTwoFactor(tf, code, file.GetDb().JsonDb.StoreGlobalToJsonFile) {
+			self.setAccount(file.RoleSuperAdmin, nil, "", 0, 0)
+			auth = true
+			server.Bridge.Register.Store(common.GetIpByAddr(self.Ctx.Input.IP()), time.Now().Add(time.Hour*time.Duration(2)))
+		}
+	}
+	if !auth && !self.totpRequired && username != "" {
+		if u, err := file.GetDb().GetUserByName(username); err == nil && u.Status && crypt.CheckPassword(u.Password, password) {
+			if self.checkTwoFactor(u.TwoFactor, code, file.GetDb().JsonDb.StoreUsersToJsonFile) {
+				self.setAccount(u.Role, u.ClientIds, u.Username, u.Id, 0)
+				auth = true
+			}
+		}
 	}
 	b, err := beego.AppConfig.Bool("allow_user_login")
-	if err == nil && b && !auth {
+	if err == nil && b && !auth && !self.totpRequired {
 		file.GetDb().JsonDb.Clients.Range(func(key, value interface{}) bool {
 			v := value.(*file.Client)
 			if !v.Status || v.NoDisplay {
@@ -101,13 +121,15 @@ func (self *LoginController) doLogin(username, password string, explicit bool) b
 					auth = true
 				}
 			}
-			if !auth && v.WebPassword == password && v.WebUserName == username {
+			if !auth && v.WebUserName == username && crypt.CheckPassword(v.WebPassword, password) {
 				auth = true
 			}
+			if auth && !self.checkTwoFactor(v.TwoFactor, code, file.GetDb().JsonDb.StoreClientsToJsonFile) {
+				auth = false
+				return false
+			}
 			if auth {
-				self.SetSession("isAdmin", false)
-				self.SetSession("clientId", v.Id)
-				self.SetSession("username", v.WebUserName)
+				self.setAccount(file.RoleTenant, []int{v.Id}, v.WebUserName, 0, v.Id)
 				return false
 			}
 			return true
@@ -119,14 +141,48 @@ func (self *LoginController) doLogin(username, password string, explicit bool) b
 		return true
 
 	}
+	// 密码正确、尚未输入验证码时不计入失败次数
+	if self.totpRequired && code == "" {
+		return false
+	}
 	if v, load := ipRecord.LoadOrStore(ip, &record{hasLoginFailTimes: 1, lastLoginTime: time.Now()}); load && explicit {
 		vv := v.(*record)
 		vv.lastLoginTime = time.Now()
 		vv.hasLoginFailTimes += 1
 		ipRecord.Store(ip, vv)
+		if vv.hasLoginFailTimes%loginFailNotify == 0 {
+			webhook.Emit(file.EventLoginFail, map[string]interface{}{"ip": ip, "username": username, "times": vv.hasLoginFailTimes})
+		}
 	}
 	return false
 }
+
+// setAccount 保存登录账号的角色和可以访问的客户端；userId 是 web 管理账号，clientId 是使用客户端账号登录
+func (self *LoginController) setAccount(role string, clientIds []int, username string, userId, clientId int) {
+	self.SetSession("role", role)
+	self.SetSession("clientIds", clientIds)
+	self.SetSession("username", username)
+	self.SetSession("userId", userId)
+	self.SetSession("clientId", clientId)
+}
+
+// checkTwoFactor 校验开启了两步验证的账号的验证码或恢复码，未开启时直接通过；
+// 恢复码使用后立即失效，由 save 保存
+func (self *LoginController) checkTwoFactor(tf *file.TwoFactor, code string, save func()) bool {
+	if !tf.Enabled() {
+		return true
+	}
+	ok, recovery := tf.Verify(code)
+	if !ok {
+		self.totpRequired = true
+		return false
+	}
+	if recovery {
+		save()
+	}
+	return true
+}
+
 func (self *LoginController) Register() {
 	if self.Ctx.Request.Method == "GET" {
 		self.Data["web_base_url"] = beego.AppConfig.String("web_base_url")
@@ -0,0 +1,201 @@
+package controllers
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beego/beego"
+	"github.com/djylb/nps/bridge"
+	"github.com/djylb/nps/lib/common"
+	"github.com/djylb/nps/lib/config"
+	"github.com/djylb/nps/lib/crypt"
+	"github.com/djylb/nps/lib/file"
+	"github.com/djylb/nps/server"
+)
+
+// npcConfKinds 可以生成的文件及下载时的文件名
+var npcConfKinds = map[string]string{
+	"npc":     "npc.conf",
+	"systemd": "npc.service",
+	"compose": "docker-compose.yml",
+}
+
+// npcConfOptions 生成配置的参数，Server 为 npc 连接的服务端地址，不含端口
+type npcConfOptions struct {
+	Kind   string
+	Type   string //tcp, kcp or tls
+	Server string
+}
+
+// readNpcConfOptions 读取并检查参数，未指定连接方式时使用 bridge_type，错误写入 fields
+func readNpcConfOptions(c *beego.Controller, fields map[string]string) *npcConfOptions {
+	o := &npcConfOptions{Kind: c.GetString("kind", "npc"), Type: c.GetString("type"), Server: c.GetString("server")}
+	if _, ok := npcConfKinds[o.Kind]; !ok {
+		fields["kind"] = "must be npc, systemd or compose"
+	}
+	bridgeType := beego.AppConfig.String("bridge_type")
+	if o.Type == "" {
+		o.Type = bridgeType
+		if o.Type == "both" {
+			o.Type = "tcp"
+		}
+	}
+	switch {
+	case o.Type == "tls" && bridge.ServerTlsEnable:
+	case (o.Type == "tcp" || o.Type == "kcp") && (bridgeType == o.Type || bridgeType == "both"):
+	default:
+		fields["type"] = "the server does not accept " + o.Type + " connections"
+	}
+	if o.Server == "" {
+		o.Server = common.GetIpByAddr(c.Ctx.Request.Host)
+	}
+	if strings.ContainsAny(o.Server, " \r\n\t/[]{}") {
+		fields["server"] = "invalid server address"
+	}
+	return o
+}
+
+// renderNpcConf 生成客户端的文件，npc.conf 包含客户端在服务端的全部隧道和域名
+func renderNpcConf(c *file.Client, o *npcConfOptions) string {
+	switch o.Kind {
+	case "systemd":
+		return fmt.Sprintf(`[Unit]
+Description=nps client %s
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+Type=simple
+ExecStart=/usr/bin/npc -config=/etc/npc/npc.conf -log=stdout
+Restart=always
+RestartSec=5
+
+[Install]
+WantedBy=multi-user.target
+`, systemdValue(html.UnescapeString(c.Remark)))
+	case "compose":
+		return `services:
+  npc:
+    image: duan2001/npc
+    container_name: npc
+    restart: always
+    network_mode: host
+    volumes:
+      - ./npc.conf:/conf/npc.conf:ro
+    command: -config=/conf/npc.conf -log=stdout
+`
+	}
+	port := server.Bridge.TunnelPort
+	if o.Type == "tls" {
+		port = beego.AppConfig.DefaultInt("tls_bridge_port", 8025)
+	}
+	cnf := &config.Config{CommonConfig: &config.CommonConfig{
+		Server:           common.BuildAddress(o.Server, strconv.Itoa(port)),
+		Tp:               o.Type,
+		VKey:             c.VerifyKey,
+		AutoReconnection: true,
+		Client: &file.Client{
+			Remark:    html.UnescapeString(c.Remark),
+			Cnf:       &file.Config{U: html.UnescapeString(c.Cnf.U), Compress: c.Cnf.Compress, Crypt: c.Cnf.Crypt},
+			RateLimit: c.RateLimit,
+			MaxConn:   c.MaxConn,
+			Flow:      &file.Flow{FlowLimit: c.Flow.FlowLimit},
+		},
+	}}
+	for _, key := range file.GetMapKeys(file.GetDb().JsonDb.Tasks, false, "", "") {
+		if value, ok := file.GetDb().JsonDb.Tasks.Load(key); ok {
+			if t := value.(*file.Tunnel); t.Client != nil && t.Client.Id == c.Id && t.Mode != "httpHostServer" {
+				v := &file.Tunnel{Mode: t.Mode, Port: t.Port, ServerIp: t.ServerIp, Remark: html.UnescapeString(t.Remark),
+					Password: html.UnescapeString(t.Password), LocalPath: html.UnescapeString(t.LocalPath), StripPre: html.UnescapeString(t.StripPre)}
+				if t.Target != nil {
+					v.Target = &file.Target{TargetStr: html.UnescapeString(t.Target.TargetStr)}
+				}
+				cnf.Tasks = append(cnf.Tasks, v)
+			}
+		}
+	}
+	for _, key := range file.GetMapKeys(file.GetDb().JsonDb.Hosts, false, "", "") {
+		if value, ok := file.GetDb().JsonDb.Hosts.Load(key); ok {
+			if h := value.(*file.Host); h.Client != nil && h.Client.Id == c.Id {
+				v := &file.Host{Host: html.UnescapeString(h.Host), Location: html.UnescapeString(h.Location), Scheme: h.Scheme, Remark: html.UnescapeString(h.Remark),
+					HostChange: html.UnescapeString(h.HostChange), HeaderChange: html.UnescapeString(h.HeaderChange)}
+				if h.Target != nil {
+					v.Target = &file.Target{TargetStr: html.UnescapeString(h.Target.TargetStr)}
+				}
+				cnf.Hosts = append(cnf.Hosts, v)
+			}
+		}
+	}
+	return cnf.Render()
+}
+
+// systemdValue 去掉换行等控制字符并转义 systemd 的 % 说明符，行尾的反斜杠会让下一行并入当前行
+func systemdValue(s string) string {
+	s = strings.ReplaceAll(config.SingleLine(s), "%", "%%")
+	return strings.TrimRight(s, "\\")
+}
+
+// npcConfLink 一次性下载链接，下载一次或过期后失效，服务端重启后全部失效
+type npcConfLink struct {
+	ClientId int
+	Options  npcConfOptions
+	Expire   time.Time
+}
+
+var npcConfLinks sync.Map //token -> *npcConfLink
+
+// newNpcConfLink 创建一次性下载链接，返回下载路径
+func newNpcConfLink(clientId int, o *npcConfOptions, expire time.Duration) (string, time.Time) {
+	now := time.Now()
+	npcConfLinks.Range(func(key, value interface{}) bool {
+		if value.(*npcConfLink).Expire.Before(now) {
+			npcConfLinks.Delete(key)
+		}
+		return true
+	})
+	token := crypt.GetRandomString(32)
+	l := &npcConfLink{ClientId: clientId, Options: *o, Expire: now.Add(expire)}
+	npcConfLinks.Store(token, l)
+	return beego.AppConfig.String("web_base_url") + "/npcconf/" + token, l.Expire
+}
+
+// npcConfExpire 链接的有效期，minutes 为 0 时 30 分钟，最长一天
+func npcConfExpire(minutes int, fields map[string]string) time.Duration {
+	if minutes == 0 {
+		minutes = 30
+	}
+	if minutes < 0 || minutes > 1440 {
+		fields["expire"] = "must be between 1 and 1440 minutes"
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// NpcConfController 一次性下载链接，不需要登录
+type NpcConfController struct {
+	beego.Controller
+}
+
+func (s *NpcConfController) Download() {
+	value, ok := npcConfLinks.LoadAndDelete(s.Ctx.Input.Param(":token"))
+	if !ok || value.(*npcConfLink).Expire.Before(time.Now()) {
+		s.Ctx.Output.SetStatus(http.StatusNotFound)
+		s.Ctx.Output.Body([]byte("the link is invalid or expired\n"))
+		return
+	}
+	l := value.(*npcConfLink)
+	c, err := file.GetDb().GetClient(l.ClientId)
+	if err != nil {
+		s.Ctx.Output.SetStatus(http.StatusNotFound)
+		s.Ctx.Output.Body([]byte("the client is not exist\n"))
+		return
+	}
+	s.Ctx.Output.Header("Content-Type", "text/plain; charset=utf-8")
+	s.Ctx.Output.Header("Content-Disposition", "attachment; filename="+npcConfKinds[l.Options.Kind])
+	s.Ctx.Output.Header("Cache-Control", "no-store")
+	s.Ctx.Output.Body([]byte(renderNpcConf(c, &l.Options)))
+}
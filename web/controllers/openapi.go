@@ -0,0 +1,238 @@
+package controllers
+
+import (
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/beego/beego"
+	"github.com/djylb/nps/server"
+)
+
+// ApiDocController 提供 /api/v1 的 OpenAPI 文档和在线调试页面，不需要认证
+type ApiDocController struct {
+	beego.Controller
+}
+
+// OpenApi 返回由 ApiRoutes 生成的 OpenAPI 3 文档
+func (s *ApiDocController) OpenApi() {
+	s.Data["json"] = openApiDocument(beego.AppConfig.String("web_base_url") + "/api/v1")
+	s.ServeJSON()
+}
+
+// Explorer 在线调试页面
+func (s *ApiDocController) Explorer() {
+	s.Data["web_base_url"] = beego.AppConfig.String("web_base_url")
+	s.TplName = "api/explorer.html"
+}
+
+var apiPathParam = regexp.MustCompile(`:(\w+)(\([^)]*\))?`)
+
+var apiScopeDesc = map[string]string{
+	"any":    "any token",
+	"read":   "read or admin token",
+	"client": "client or admin token, client tokens only see their own client",
+	"admin":  "admin token",
+}
+
+// openApiDocument 根据路由表和资源结构体生成 OpenAPI 文档
+func openApiDocument(serverUrl string) map[string]interface{} {
+	schemas := make(map[string]interface{})
+	paths := make(map[string]interface{})
+	for _, route := range ApiRoutes {
+		path := apiPathParam.ReplaceAllString(route.Path, "{$1}")
+		item := make(map[string]interface{})
+		for _, op := range route.Operations {
+			o := map[string]interface{}{
+				"operationId": lowerFirst(op.Handler),
+				"summary":     op.Summary,
+				"description": "Requires " + apiScopeDesc[op.Scope] + ".",
+				"tags":        []string{strings.Split(strings.Trim(path, "/"), "/")[0]},
+				"responses":   apiResponses(op, schemas),
+			}
+			o["x-nps-scope"] = op.Scope
+			params := make([]interface{}, 0)
+			for _, m := range apiPathParam.FindAllStringSubmatch(route.Path, -1) {
+				params = append(params, map[string]interface{}{
+					"name": m[1], "in": "path", "required": true, "schema": map[string]interface{}{"type": "integer"},
+				})
+			}
+			for _, p := range op.Query {
+				params = append(params, map[string]interface{}{
+					"name": p.Name, "in": "query", "description": p.Desc, "schema": map[string]interface{}{"type": p.Type},
+				})
+			}
+			if len(params) > 0 {
+				o["parameters"] = params
+			}
+			if op.Body != nil {
+				desc := "JSON body, read-only fields are ignored"
+				if op.Method == http.MethodPatch {
+					desc = "fields to change, omitted fields keep their values"
+				} else if op.Method == http.MethodPut {
+					desc = "the whole resource, omitted fields are reset to defaults"
+				}
+				o["requestBody"] = map[string]interface{}{
+					"required":    true,
+					"description": desc,
+					"content":     apiContent(apiSchemaRef(op.Body, schemas)),
+				}
+			}
+			item[strings.ToLower(op.Method)] = o
+		}
+		paths[path] = item
+	}
+	schemas["Error"] = map[string]interface{}{
+		"type":       "object",
+		"properties": map[string]interface{}{"error": map[string]interface{}{"type": "string"}},
+	}
+	schemas["ValidationError"] = map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"error":  map[string]interface{}{"type": "string"},
+			"fields": map[string]interface{}{"type": "object", "additionalProperties": map[string]interface{}{"type": "string"}, "description": "error of each field"},
+		},
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "nps management API",
+			"version":     server.GetVersion(),
+			"description": "Resource-oriented JSON API of the nps web management. Create tokens in the web management or with POST /tokens.",
+		},
+		"servers":  []interface{}{map[string]interface{}{"url": serverUrl}},
+		"security": []interface{}{map[string]interface{}{"bearer": []string{}}},
+		"paths":    paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearer": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+func apiResponses(op apiOperation, schemas map[string]interface{}) map[string]interface{} {
+	res := make(map[string]interface{})
+	status := op.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if op.Result == nil {
+		res[strconv.Itoa(http.StatusNoContent)] = map[string]interface{}{"description": "success"}
+	} else {
+		res[strconv.Itoa(status)] = map[string]interface{}{
+			"description": "success",
+			"content":     apiContent(apiSchemaRef(op.Result, schemas)),
+		}
+	}
+	errs := map[int]string{
+		http.StatusUnauthorized: "missing, invalid or expired token",
+		http.StatusForbidden:    "the token has no permission",
+	}
+	if strings.Contains(op.Handler, "Get") || strings.Contains(op.Handler, "Put") || strings.Contains(op.Handler, "Patch") || strings.Contains(op.Handler, "Del") {
+		errs[http.StatusNotFound] = "the resource is not exist"
+	}
+	if op.Body != nil {
+		errs[http.StatusBadRequest] = "invalid json body or unknown field"
+		errs[http.StatusConflict] = "port occupied, host exists or other conflicts"
+		res[strconv.Itoa(http.StatusUnprocessableEntity)] = map[string]interface{}{
+			"description": "validation failed",
+			"content":     apiContent(map[string]interface{}{"$ref": "#/components/schemas/ValidationError"}),
+		}
+	}
+	for code, desc := range errs {
+		res[strconv.Itoa(code)] = map[string]interface{}{
+			"description": desc,
+			"content":     apiContent(map[string]interface{}{"$ref": "#/components/schemas/Error"}),
+		}
+	}
+	return res
+}
+
+func apiContent(schema interface{}) map[string]interface{} {
+	return map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}}
+}
+
+// apiSchemaRef 返回 v 的 schema，结构体登记到 components 中并返回引用
+func apiSchemaRef(v interface{}, schemas map[string]interface{}) interface{} {
+	if page, ok := v.(apiPage); ok {
+		return map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"total": map[string]interface{}{"type": "integer"},
+				"items": map[string]interface{}{"type": "array", "items": apiSchemaRef(page.item, schemas)},
+			},
+		}
+	}
+	t := reflect.TypeOf(v)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return apiSchema(t)
+	}
+	name := strings.TrimPrefix(t.Name(), "api")
+	if _, ok := schemas[name]; !ok {
+		schemas[name] = apiSchema(t)
+	}
+	return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+}
+
+func apiSchema(t reflect.Type) map[string]interface{} {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int32:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Int64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": apiSchema(t.Elem())}
+	case reflect.Struct:
+		props := make(map[string]interface{})
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.Anonymous && f.Type.Kind() == reflect.Struct {
+				for k, v := range apiSchema(f.Type)["properties"].(map[string]interface{}) {
+					props[k] = v
+				}
+				continue
+			}
+			name := strings.Split(f.Tag.Get("json"), ",")[0]
+			if name == "" || name == "-" {
+				continue
+			}
+			p := apiSchema(f.Type)
+			switch f.Tag.Get("api") {
+			case "readonly":
+				p["readOnly"] = true
+			case "writeonly":
+				p["writeOnly"] = true
+			}
+			if desc := f.Tag.Get("desc"); desc != "" {
+				p["description"] = desc
+			}
+			if enum, ok := apiEnums[name]; ok {
+				p["enum"] = enum
+			}
+			props[name] = p
+		}
+		return map[string]interface{}{"type": "object", "properties": props}
+	}
+	return map[string]interface{}{"type": "object", "additionalProperties": true}
+}
+
+func lowerFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToLower(s[:1]) + s[1:]
+}
@@ -0,0 +1,192 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/djylb/nps/lib/file"
+)
+
+// permission web 管理的权限等级，高等级包含低等级
+type permission int
+
+const (
+	permRead   permission = iota //view clients, tunnels and hosts
+	permWrite                    //change tunnels, hosts and the clients themselves
+	permManage                   //add, delete and enable clients
+	permAdmin                    //global settings, api tokens and web users
+)
+
+// rolePermissions 每个角色拥有的最高权限
+var rolePermissions = map[string]permission{
+	file.RoleSuperAdmin: permAdmin,
+	file.RoleOperator:   permManage,
+	file.RoleTenant:     permWrite,
+	file.RoleAuditor:    permRead,
+}
+
+// webPermissions 每个页面需要的权限，第一个用于 GET 请求，第二个用于其他请求；
+// 不在表中的 action 只有超级管理员可以访问
+var webPermissions = map[string][2]permission{
+	"index.index":         {permRead, permRead},
+	"index.help":          {permRead, permRead},
+	"index.tcp":           {permRead, permRead},
+	"index.udp":           {permRead, permRead},
+	"index.socks5":        {permRead, permRead},
+	"index.sni":           {permRead, permRead},
+	"index.http":          {permRead, permRead},
+	"index.file":          {permRead, permRead},
+	"index.secret":        {permRead, permRead},
+	"index.p2p":           {permRead, permRead},
+	"index.host":          {permRead, permRead},
+	"index.all":           {permRead, permRead},
+	"index.gettunnel":     {permRead, permRead},
+	"index.getonetunnel":  {permRead, permRead},
+	"index.hostlist":      {permRead, permRead},
+	"index.gethost":       {permRead, permRead},
+	"index.tunnellog":     {permRead, permRead},
+	"index.hostlog":       {permRead, permRead},
+	"index.add":           {permWrite, permWrite},
+	"index.edit":          {permRead, permWrite},
+	"index.stop":          {permWrite, permWrite},
+	"index.start":         {permWrite, permWrite},
+	"index.del":           {permWrite, permWrite},
+	"index.addhost":       {permWrite, permWrite},
+	"index.edithost":      {permRead, permWrite},
+	"index.starthost":     {permWrite, permWrite},
+	"index.stophost":      {permWrite, permWrite},
+	"index.delhost":       {permWrite, permWrite},
+	"index.purgecache":    {permWrite, permWrite},
+	"client.list":         {permRead, permRead},
+	"client.getclient":    {permRead, permRead},
+	"client.edit":         {permRead, permWrite},
+	"client.add":          {permManage, permManage},
+	"client.changestatus": {permManage, permManage},
+	"client.del":          {permManage, permManage},
+	"client.config":       {permRead, permRead},
+	"client.configlink":   {permRead, permRead},
+	"group.list":          {permManage, permManage},
+	"group.add":           {permManage, permManage},
+	"group.edit":          {permManage, permManage},
+	"group.del":           {permManage, permManage},
+	"group.changestatus":  {permManage, permManage},
+	"twofactor.index":     {permRead, permRead},
+	"twofactor.setup":     {permRead, permRead},
+	"twofactor.enable":    {permRead, permRead},
+	"twofactor.recovery":  {permRead, permRead},
+	"twofactor.disable":   {permRead, permRead},
+	"twofactor.reset":     {permManage, permManage},
+	"conn.index":          {permRead, permRead},
+	"conn.kill":           {permWrite, permWrite},
+	"conn.killip":         {permWrite, permWrite},
+	"audit.index":         {permRead, permRead},
+	"audit.export":        {permRead, permRead},
+}
+
+// tenantDenied 租户不能访问的页面，审计日志包含其他客户端的修改
+var tenantDenied = map[string]bool{
+	"audit": true,
+}
+
+// hostActions 参数 id 是域名 id 的 action，其余 index 下的 id 是隧道 id
+var hostActions = map[string]bool{
+	"gethost": true, "edithost": true, "starthost": true, "stophost": true, "delhost": true, "purgecache": true, "hostlog": true,
+}
+
+// can 当前账号是否拥有权限 p
+func (s *BaseController) can(p permission) bool {
+	max, ok := rolePermissions[s.role]
+	return ok && p <= max
+}
+
+// isTenant 当前账号是否只能访问部分客户端
+func (s *BaseController) isTenant() bool {
+	return s.role == file.RoleTenant
+}
+
+// ownClient 当前账号是否可以访问客户端 id
+func (s *BaseController) ownClient(id int) bool {
+	if !s.isTenant() {
+		return true
+	}
+	for _, v := range s.clientIds {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize 按 webPermissions 检查当前请求，租户只能访问自己客户端下的资源
+func (s *BaseController) authorize() {
+	need := permAdmin
+	if p, ok := webPermissions[s.controllerName+"."+s.actionName]; ok {
+		need = p[1]
+		if s.Ctx.Request.Method == http.MethodGet {
+			need = p[0]
+		}
+	}
+	if !s.can(need) {
+		s.forbidden()
+	}
+	if !s.isTenant() {
+		return
+	}
+	if tenantDenied[s.controllerName] {
+		s.forbidden()
+	}
+	if clientId := s.GetIntNoErr("client_id"); clientId != 0 {
+		if !s.ownClient(clientId) {
+			s.forbidden()
+		}
+	} else if len(s.clientIds) == 1 {
+		s.Ctx.Input.SetParam("client_id", strconv.Itoa(s.clientIds[0]))
+	}
+	id := s.GetIntNoErr("id")
+	if id == 0 {
+		return
+	}
+	switch {
+	case s.controllerName == "client":
+		if !s.ownClient(id) {
+			s.forbidden()
+		}
+	case s.controllerName == "index" && hostActions[s.actionName]:
+		if h, err := file.GetDb().GetHostById(id); err != nil || !s.ownClient(h.Client.Id) {
+			s.forbidden()
+		}
+	case s.controllerName == "index":
+		if t, err := file.GetDb().GetTask(id); err != nil || !s.ownClient(t.Client.Id) {
+			s.forbidden()
+		}
+	}
+}
+
+// forbidden 拒绝当前请求，页面返回 403，ajax 请求返回错误信息
+func (s *BaseController) forbidden() {
+	if s.Ctx.Request.Method == http.MethodGet {
+		s.Ctx.Output.SetStatus(http.StatusForbidden)
+		s.Ctx.Output.Body([]byte("permission denied"))
+		s.StopRun()
+	}
+	s.AjaxErr("permission denied")
+}
+
+// pageOwned 租户查看多个客户端时，从全部结果中过滤出可访问的部分并分页
+func pageOwned[T any](s *BaseController, list []T, clientOf func(T) int, start, length int) ([]T, int) {
+	owned := make([]T, 0)
+	for _, v := range list {
+		if s.ownClient(clientOf(v)) {
+			owned = append(owned, v)
+		}
+	}
+	cnt := len(owned)
+	if start > cnt {
+		start = cnt
+	}
+	owned = owned[start:]
+	if length > 0 && length < len(owned) {
+		owned = owned[:length]
+	}
+	return owned, cnt
+}
@@ -0,0 +1,647 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beego/beego"
+	"github.com/djylb/nps/lib/audit"
+	"github.com/djylb/nps/lib/common"
+	"github.com/djylb/nps/lib/file"
+	"github.com/djylb/nps/server"
+	"github.com/djylb/nps/server/tool"
+	"gopkg.in/yaml.v2"
+)
+
+// TransferController 客户端、隧道和域名的批量导入导出，只有超级管理员可以访问
+type TransferController struct {
+	BaseController
+}
+
+func (s *TransferController) Index() {
+	s.Data["menu"] = "transfer"
+	list, _ := file.GetDb().GetClientList(0, 0, "", "", "", 0, 0, "")
+	s.Data["clients"] = list
+	s.SetInfo("transfer")
+	s.display("transfer/index")
+}
+
+// Export 下载所选客户端的导出文档，format 为 yaml 或 json
+func (s *TransferController) Export() {
+	format := s.GetString("format")
+	b, err := encodeTransfer(exportClients(transferIds(s.GetStrings("client_ids"))), format)
+	if err != nil {
+		s.AjaxErr(err.Error())
+	}
+	name := "nps-" + time.Now().Format("20060102150405")
+	if format == "yaml" {
+		s.Ctx.Output.Header("Content-Type", "application/yaml; charset=utf-8")
+		name += ".yaml"
+	} else {
+		s.Ctx.Output.Header("Content-Type", "application/json; charset=utf-8")
+		name += ".json"
+	}
+	s.Ctx.Output.Header("Content-Disposition", "attachment; filename="+name)
+	s.Ctx.Output.Body(b)
+	s.StopRun()
+}
+
+// Import 导入文档并返回每个对象的结果，dry_run 时只校验
+func (s *TransferController) Import() {
+	doc, err := decodeTransfer([]byte(s.GetString("data")))
+	if err != nil {
+		s.AjaxErr(err.Error())
+	}
+	dryRun, _ := s.GetBool("dry_run")
+	im, err := newImporter(s.GetString("mode"), dryRun, s.actor())
+	if err != nil {
+		s.AjaxErr(err.Error())
+	}
+	runImport(im, doc)
+	s.AjaxTable(im.Results, len(im.Results), len(im.Results), map[string]interface{}{"status": 1, "count": im.Count(), "dry_run": dryRun})
+}
+
+// transferIds 读取客户端 id 列表，支持多个参数或逗号分隔
+func transferIds(values []string) []int {
+	ids := make([]int, 0)
+	for _, v := range values {
+		for _, id := range strings.Split(v, ",") {
+			if id := common.GetIntNoErrByStr(strings.TrimSpace(id)); id > 0 {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+// importLock 同一时间只运行一个导入，避免两次导入占用相同的端口和域名
+var importLock sync.Mutex
+
+func runImport(im *importer, doc *transferDoc) {
+	importLock.Lock()
+	defer importLock.Unlock()
+	im.Run(doc)
+}
+
+// transferVersion 导入导出文档的格式版本，导入时拒绝更高的版本
+const transferVersion = 1
+
+// 导入模式，create 跳过已经存在的对象，upsert 更新已经存在的对象
+const (
+	importCreate = "create"
+	importUpsert = "upsert"
+)
+
+// transferDoc 客户端及其隧道、域名的导出文档，字段与 /api/v1 的资源一致，
+// 密码为服务端保存的哈希，导入后可以直接使用
+type transferDoc struct {
+	Version    int               `json:"version"`
+	ExportTime string            `json:"export_time" api:"readonly"`
+	Clients    []*transferClient `json:"clients"`
+}
+
+type transferClient struct {
+	apiClient
+	Tunnels []*apiTunnel `json:"tunnels"`
+	Hosts   []*apiHost   `json:"hosts"`
+}
+
+// transferReport 导入的结果
+type transferReport struct {
+	DryRun  bool           `json:"dry_run"`
+	Count   map[string]int `json:"count" desc:"number of results per action"`
+	Results []importResult `json:"results"`
+}
+
+// importResult 导入一个对象的结果
+type importResult struct {
+	Object string `json:"object"` //client, tunnel or host
+	Name   string `json:"name"`
+	Id     int    `json:"id"`
+	Action string `json:"action"` //create, update, skip or error
+	Error  string `json:"error,omitempty"`
+}
+
+// exportClients 导出 ids 中的客户端，ids 为空时导出全部，npc 配置文件模式创建的隧道和域名不导出
+func exportClients(ids []int) *transferDoc {
+	doc := &transferDoc{Version: transferVersion, ExportTime: time.Now().Format("2006-01-02 15:04:05"), Clients: make([]*transferClient, 0)}
+	for _, key := range file.GetMapKeys(file.GetDb().JsonDb.Clients, false, "", "") {
+		value, ok := file.GetDb().JsonDb.Clients.Load(key)
+		if !ok {
+			continue
+		}
+		c := value.(*file.Client)
+		if c.NoDisplay || c.NoStore || (len(ids) > 0 && !common.InIntArr(ids, c.Id)) {
+			continue
+		}
+		v := &transferClient{apiClient: *newApiClient(c), Tunnels: make([]*apiTunnel, 0), Hosts: make([]*apiHost, 0)}
+		v.WebPassword = c.WebPassword
+		if c.Cnf != nil {
+			v.BasicPassword = c.Cnf.P
+		}
+		for _, key := range file.GetMapKeys(file.GetDb().JsonDb.Tasks, false, "", "") {
+			if value, ok := file.GetDb().JsonDb.Tasks.Load(key); ok {
+				if t := value.(*file.Tunnel); t.Client != nil && t.Client.Id == c.Id && !t.NoStore && t.Mode != "httpHostServer" {
+					v.Tunnels = append(v.Tunnels, newApiTunnel(t))
+				}
+			}
+		}
+		for _, key := range file.GetMapKeys(file.GetDb().JsonDb.Hosts, false, "", "") {
+			if value, ok := file.GetDb().JsonDb.Hosts.Load(key); ok {
+				if h := value.(*file.Host); h.Client != nil && h.Client.Id == c.Id && !h.NoStore {
+					a := newApiHost(h)
+					a.OidcClientSecret = h.OidcClientSecret
+					v.Hosts = append(v.Hosts, a)
+				}
+			}
+		}
+		doc.Clients = append(doc.Clients, v)
+	}
+	return doc
+}
+
+// encodeTransfer 把文档编码为 json 或 yaml，yaml 保持与 json 相同的字段顺序
+func encodeTransfer(doc *transferDoc, format string) ([]byte, error) {
+	b, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil || format != "yaml" {
+		return b, err
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	v, err := jsonOrdered(d)
+	if err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(v)
+}
+
+// jsonOrdered 读取下一个 json 值，对象转为 yaml.MapSlice 以保留字段顺序
+func jsonOrdered(d *json.Decoder) (interface{}, error) {
+	tok, err := d.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case json.Delim('{'):
+		m := yaml.MapSlice{}
+		for d.More() {
+			key, err := d.Token()
+			if err != nil {
+				return nil, err
+			}
+			v, err := jsonOrdered(d)
+			if err != nil {
+				return nil, err
+			}
+			m = append(m, yaml.MapItem{Key: key, Value: v})
+		}
+		_, err = d.Token()
+		return m, err
+	case json.Delim('['):
+		list := make([]interface{}, 0)
+		for d.More() {
+			v, err := jsonOrdered(d)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		_, err = d.Token()
+		return list, err
+	}
+	if n, ok := tok.(json.Number); ok {
+		if i, err := n.Int64(); err == nil {
+			return i, nil
+		}
+		return n.String(), nil
+	}
+	return tok, nil
+}
+
+// decodeTransfer 读取 json 或 yaml 格式的文档，未知字段视为错误
+func decodeTransfer(body []byte) (*transferDoc, error) {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return nil, errors.New("empty document")
+	}
+	if body[0] != '{' {
+		var v interface{}
+		if err := yaml.Unmarshal(body, &v); err != nil {
+			return nil, err
+		}
+		b, err := json.Marshal(yamlToJson(v))
+		if err != nil {
+			return nil, err
+		}
+		body = b
+	}
+	doc := new(transferDoc)
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.DisallowUnknownFields()
+	if err := d.Decode(doc); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if doc.Version <= 0 || doc.Version > transferVersion {
+		return nil, fmt.Errorf("unsupported document version %d", doc.Version)
+	}
+	return doc, nil
+}
+
+// yamlToJson 把 yaml 解析出的 map[interface{}]interface{} 转为 json 可以编码的 map[string]interface{}
+func yamlToJson(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = yamlToJson(e)
+		}
+		return m
+	case []interface{}:
+		for i, e := range v {
+			v[i] = yamlToJson(e)
+		}
+	}
+	return v
+}
+
+// importer 按顺序导入文档中的客户端、隧道和域名；dryRun 时只校验不保存，
+// 文档内部的端口、域名和密钥冲突同样会被检查
+type importer struct {
+	mode    string
+	dryRun  bool
+	actor   audit.Actor
+	ports   map[string]bool //ports used by earlier tunnels of the document
+	vkeys   map[string]bool
+	hosts   []*file.Host
+	Results []importResult
+}
+
+func newImporter(mode string, dryRun bool, actor audit.Actor) (*importer, error) {
+	if mode == "" {
+		mode = importCreate
+	}
+	if mode != importCreate && mode != importUpsert {
+		return nil, errors.New("mode must be create or upsert")
+	}
+	return &importer{mode: mode, dryRun: dryRun, actor: actor, ports: make(map[string]bool), vkeys: make(map[string]bool)}, nil
+}
+
+// Run 导入文档，单个对象失败不影响其他对象，客户端失败时跳过它的隧道和域名
+func (im *importer) Run(doc *transferDoc) {
+	for _, v := range doc.Clients {
+		c, ok := im.client(v)
+		for _, t := range v.Tunnels {
+			if ok {
+				im.tunnel(t, c)
+			} else {
+				im.add("tunnel", t.Remark, 0, "skip", errors.New("the client is not imported"))
+			}
+		}
+		for _, h := range v.Hosts {
+			if ok {
+				im.host(h, c)
+			} else {
+				im.add("host", h.Host, 0, "skip", errors.New("the client is not imported"))
+			}
+		}
+	}
+}
+
+// Count 每种结果的数量
+func (im *importer) Count() map[string]int {
+	m := map[string]int{"create": 0, "update": 0, "skip": 0, "error": 0}
+	for _, r := range im.Results {
+		m[r.Action]++
+	}
+	return m
+}
+
+func (im *importer) add(object, name string, id int, action string, err error) {
+	r := importResult{Object: object, Name: html.UnescapeString(name), Id: id, Action: action}
+	if err != nil {
+		r.Error = err.Error()
+		if action == "" {
+			r.Action = "error"
+		}
+	}
+	im.Results = append(im.Results, r)
+}
+
+// fieldsError 把字段错误合并为一个错误
+func fieldsError(fields map[string]string) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	list := make([]string, 0, len(fields))
+	for k, v := range fields {
+		list = append(list, k+": "+v)
+	}
+	sort.Strings(list)
+	return errors.New(strings.Join(list, "; "))
+}
+
+// client 导入客户端，按 verify_key 匹配已有客户端；dryRun 时新客户端返回未保存的对象
+func (im *importer) client(v *transferClient) (*file.Client, bool) {
+	a := &v.apiClient
+	name := a.Remark
+	if name == "" {
+		name = a.VerifyKey
+	}
+	fields := make(map[string]string)
+	a.validate(fields)
+	var old *file.Client
+	if a.VerifyKey != "" {
+		if im.vkeys[a.VerifyKey] {
+			fields["verify_key"] = "verify key duplicate in the document"
+		}
+		im.vkeys[a.VerifyKey] = true
+		file.GetDb().JsonDb.Clients.Range(func(key, value interface{}) bool {
+			if c := value.(*file.Client); c.VerifyKey == a.VerifyKey {
+				old = c
+				return false
+			}
+			return true
+		})
+	}
+	id := 0
+	if old != nil {
+		id = old.Id
+	}
+	if a.WebUsername != "" && (a.WebUsername == beego.AppConfig.String("web_username") || !file.GetDb().VerifyUserName(a.WebUsername, id)) {
+		fields["web_username"] = "web login username duplicate"
+	}
+	if err := fieldsError(fields); err != nil {
+		im.add("client", name, id, "", err)
+		return nil, false
+	}
+	htmlStrings(a, html.EscapeString)
+	if old != nil {
+		if im.mode != importUpsert {
+			im.add("client", name, old.Id, "skip", errors.New("the client already exists"))
+			return old, true
+		}
+		if !im.dryRun {
+			before := audit.Take(old)
+			a.apply(old, true, true)
+			old.HashPasswords()
+			old.ResetRate()
+			if !old.Status {
+				server.DelClientConnect(old.Id)
+			}
+			file.GetDb().JsonDb.StoreClientsToJsonFile()
+			audit.Record(im.actor, audit.ActionUpdate, "client", old.Id, before, old)
+		}
+		im.add("client", name, old.Id, "update", nil)
+		return old, true
+	}
+	c := &file.Client{CreateTime: time.Now().Format("2006-01-02 15:04:05")}
+	a.apply(c, true, true)
+	if im.dryRun {
+		c.Cnf, c.Flow = &file.Config{}, &file.Flow{}
+		im.add("client", name, 0, "create", nil)
+		return c, true
+	}
+	if err := file.GetDb().NewClient(c); err != nil {
+		im.add("client", name, 0, "", err)
+		return nil, false
+	}
+	audit.Record(im.actor, audit.ActionCreate, "client", c.Id, nil, c)
+	im.add("client", name, c.Id, "create", nil)
+	return c, true
+}
+
+// tunnel 导入隧道，按客户端、模式和端口（secret、p2p 为密钥）匹配客户端已有的隧道
+func (im *importer) tunnel(v *apiTunnel, c *file.Client) {
+	name := v.Remark
+	if name == "" {
+		name = v.Mode + ":" + strconv.Itoa(v.Port)
+	}
+	v.ClientId = c.Id
+	fields := make(map[string]string)
+	v.validate(fields)
+	if err := fieldsError(fields); err != nil {
+		im.add("tunnel", name, 0, "", err)
+		return
+	}
+	htmlStrings(v, html.EscapeString)
+	tmp := &file.Tunnel{Client: c}
+	v.apply(tmp)
+	if err := checkTlsOffload(tmp); err != nil {
+		fields["tls_offload"] = err.Error()
+	}
+	if err := checkProxyProtocol(tmp); err != nil {
+		fields["accept_proxy_protocol"] = err.Error()
+	}
+	if err := checkAuthUrl(tmp.AuthUrl); err != nil {
+		fields["auth_url"] = err.Error()
+	}
+	if err := fieldsError(fields); err != nil {
+		im.add("tunnel", name, 0, "", err)
+		return
+	}
+	keyed := v.Mode == "secret" || v.Mode == "p2p"
+	var old, other *file.Tunnel
+	file.GetDb().JsonDb.Tasks.Range(func(key, value interface{}) bool {
+		t := value.(*file.Tunnel)
+		if t.Client == nil || t.Mode == "httpHostServer" {
+			return true
+		}
+		same := (keyed && (t.Mode == "secret" || t.Mode == "p2p") && t.Password == v.Password) ||
+			(!keyed && v.Port > 0 && t.Port == v.Port && t.ServerIp == v.ServerIp && (t.Mode == "udp") == (v.Mode == "udp"))
+		if same && t.Client.Id == c.Id && t.Mode == v.Mode && old == nil {
+			old = t
+		} else if same && other == nil {
+			other = t
+		}
+		return true
+	})
+	if old != nil {
+		tmp.Id = old.Id
+	}
+	if err := server.CheckSniHost(tmp); err != nil {
+		im.add("tunnel", name, 0, "", err)
+		return
+	}
+	portKey := v.ServerIp + ":" + strconv.Itoa(v.Port)
+	if v.Mode == "udp" {
+		portKey += "/udp"
+	}
+	if keyed {
+		portKey = "key:" + v.Password
+	}
+	switch {
+	case other != nil && old == nil:
+		if keyed {
+			im.add("tunnel", name, 0, "", errors.New("secret mode keys must be unique"))
+		} else {
+			im.add("tunnel", name, 0, "", fmt.Errorf("the port %d is used by tunnel %d", v.Port, other.Id))
+		}
+		return
+	case (keyed || v.Port > 0) && im.ports[portKey]:
+		im.add("tunnel", name, 0, "", errors.New("duplicate port or key in the document"))
+		return
+	}
+	if keyed || v.Port > 0 {
+		im.ports[portKey] = true
+	}
+	if old != nil {
+		if im.mode != importUpsert {
+			im.add("tunnel", name, old.Id, "skip", errors.New("the tunnel already exists"))
+			return
+		}
+		if !im.dryRun {
+			before := audit.Take(old)
+			server.StopServer(old.Id)
+			v.apply(old)
+			old.UserAuth.HashPasswords()
+			file.GetDb().UpdateTask(old)
+			audit.Record(im.actor, audit.ActionUpdate, "tunnel", old.Id, before, old)
+			if v.Status {
+				if err := server.StartTask(old.Id); err != nil {
+					im.add("tunnel", name, old.Id, "update", err)
+					return
+				}
+			}
+		}
+		im.add("tunnel", name, old.Id, "update", nil)
+		return
+	}
+	if c.Id != 0 && c.TunnelNumExceeded() {
+		im.add("tunnel", name, 0, "", errors.New("The number of tunnels exceeds the limit"))
+		return
+	}
+	if v.Port <= 0 && !keyed {
+		v.Port = tool.GenerateServerPort(v.Mode)
+	}
+	if !server.TestTaskPort(v.Port, v.ServerIp, v.Mode) {
+		im.add("tunnel", name, 0, "", errors.New("The port cannot be opened because it may has been occupied or is no longer allowed."))
+		return
+	}
+	if !c.AllowPort(v.Port, v.Mode) {
+		im.add("tunnel", name, 0, "", errors.New("The port is not in the allowed port range of the client"))
+		return
+	}
+	if im.dryRun {
+		im.add("tunnel", name, 0, "create", nil)
+		return
+	}
+	t := &file.Tunnel{Id: int(file.GetDb().JsonDb.GetTaskId()), Client: c}
+	v.apply(t)
+	flow := t.Flow
+	if err := file.GetDb().NewTask(t); err != nil {
+		im.add("tunnel", name, 0, "", err)
+		return
+	}
+	t.Flow.FlowLimit, t.Flow.TimeLimit = flow.FlowLimit, flow.TimeLimit
+	audit.Record(im.actor, audit.ActionCreate, "tunnel", t.Id, nil, t)
+	var err error
+	if v.Status {
+		t.Status = true
+		if err = server.AddTask(t); err != nil {
+			t.Status = false
+		}
+	}
+	file.GetDb().UpdateTask(t)
+	im.add("tunnel", name, t.Id, "create", err)
+}
+
+// host 导入域名，按域名、路径和协议匹配，已经属于其他客户端时报告冲突
+func (im *importer) host(v *apiHost, c *file.Client) {
+	v.ClientId = c.Id
+	if v.Location == "" {
+		v.Location = "/"
+	}
+	if v.Scheme == "" {
+		v.Scheme = "all"
+	}
+	fields := make(map[string]string)
+	v.validate(fields)
+	if err := fieldsError(fields); err != nil {
+		im.add("host", v.Host, 0, "", err)
+		return
+	}
+	name := v.Host + v.Location
+	htmlStrings(v, html.EscapeString)
+	tmp := &file.Host{Client: c}
+	v.apply(tmp)
+	if err := checkOidc(tmp); err != nil {
+		fields["oidc_issuer"] = err.Error()
+	}
+	if err := checkAuthUrl(tmp.AuthUrl); err != nil {
+		fields["auth_url"] = err.Error()
+	}
+	if err := fieldsError(fields); err != nil {
+		im.add("host", name, 0, "", err)
+		return
+	}
+	var old *file.Host
+	file.GetDb().JsonDb.Hosts.Range(func(key, value interface{}) bool {
+		h := value.(*file.Host)
+		if h.Client != nil && h.Client.Id == c.Id && h.Host == tmp.Host && h.Location == tmp.Location && h.Scheme == tmp.Scheme {
+			old = h
+			return false
+		}
+		return true
+	})
+	if old != nil {
+		tmp.Id = old.Id
+	}
+	for _, h := range im.hosts {
+		if h.Host == tmp.Host && h.Location == tmp.Location && (h.Scheme == "all" || tmp.Scheme == "all" || h.Scheme == tmp.Scheme) {
+			im.add("host", name, tmp.Id, "", errors.New("duplicate host in the document"))
+			return
+		}
+	}
+	if file.GetDb().IsHostExist(tmp) {
+		im.add("host", name, tmp.Id, "", errors.New("host has exist"))
+		return
+	}
+	im.hosts = append(im.hosts, tmp)
+	if old != nil {
+		if im.mode != importUpsert {
+			im.add("host", name, old.Id, "skip", errors.New("the host already exists"))
+			return
+		}
+		if !im.dryRun {
+			before := audit.Take(old)
+			secret := old.OidcClientSecret
+			v.apply(old)
+			if old.OidcClientSecret == "" {
+				old.OidcClientSecret = secret
+			}
+			old.UserAuth.HashPasswords()
+			file.GetDb().JsonDb.StoreHostToJsonFile()
+			audit.Record(im.actor, audit.ActionUpdate, "host", old.Id, before, old)
+			server.PurgeHttpCache(old.Id, "")
+		}
+		im.add("host", name, old.Id, "update", nil)
+		return
+	}
+	if c.Id != 0 && c.TunnelNumExceeded() {
+		im.add("host", name, 0, "", errors.New("The number of tunnels exceeds the limit"))
+		return
+	}
+	if im.dryRun {
+		im.add("host", name, 0, "create", nil)
+		return
+	}
+	tmp.Id = int(file.GetDb().JsonDb.GetHostId())
+	flow := tmp.Flow
+	if err := file.GetDb().NewHost(tmp); err != nil {
+		im.add("host", name, 0, "", err)
+		return
+	}
+	tmp.Flow.FlowLimit, tmp.Flow.TimeLimit = flow.FlowLimit, flow.TimeLimit
+	file.GetDb().JsonDb.StoreHostToJsonFile()
+	audit.Record(im.actor, audit.ActionCreate, "host", tmp.Id, nil, tmp)
+	im.add("host", name, tmp.Id, "create", nil)
+}
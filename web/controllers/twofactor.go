@@ -0,0 +1,190 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"strings"
+
+	"github.com/beego/beego"
+	"github.com/djylb/nps/lib/crypt"
+	"github.com/djylb/nps/lib/file"
+	"github.com/skip2/go-qrcode"
+)
+
+type TwoFactorController struct {
+	BaseController
+}
+
+// 两步验证设置页，管理员和客户端用户设置自己的账号
+func (s *TwoFactorController) Index() {
+	s.Data["menu"] = "twofactor"
+	tf := s.twoFactor()
+	s.Data["enabled"] = tf.Enabled()
+	if tf.Enabled() {
+		s.Data["recoveryNum"] = len(tf.RecoveryCodes)
+	}
+	s.SetInfo("two-factor authentication")
+	s.display("twofactor/index")
+}
+
+// 生成待确认的密钥和二维码
+func (s *TwoFactorController) Setup() {
+	if s.twoFactor().Enabled() {
+		s.AjaxErr("two-factor authentication is already enabled")
+		return
+	}
+	secret := crypt.NewTotpSecret()
+	uri := crypt.TotpURI(beego.AppConfig.DefaultString("appname", "nps"), s.accountName(), secret)
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		s.AjaxErr(err.Error())
+		return
+	}
+	s.SetSession("totpPending", secret)
+	s.Data["json"] = map[string]interface{}{
+		"status": 1,
+		"secret": secret,
+		"uri":    uri,
+		"qrcode": "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+	}
+	s.ServeJSON()
+}
+
+// 输入验证码确认后开启，返回只显示一次的恢复码
+func (s *TwoFactorController) Enable() {
+	secret, _ := s.GetSession("totpPending").(string)
+	if secret == "" {
+		s.AjaxErr("please scan the qr code first")
+		return
+	}
+	tf := &file.TwoFactor{Secret: secret}
+	if ok, _ := tf.Verify(s.GetString("code")); !ok {
+		s.AjaxErr("verification code is wrong")
+		return
+	}
+	codes := tf.NewRecoveryCodes()
+	s.DelSession("totpPending")
+	s.saveTwoFactor(tf)
+	s.Data["json"] = map[string]interface{}{"status": 1, "msg": "two-factor authentication enabled", "codes": codes}
+	s.ServeJSON()
+}
+
+// 重新生成恢复码，需要当前验证码
+func (s *TwoFactorController) Recovery() {
+	tf := s.twoFactor()
+	if !s.checkCode(tf) {
+		return
+	}
+	codes := tf.NewRecoveryCodes()
+	s.saveTwoFactor(tf)
+	s.Data["json"] = map[string]interface{}{"status": 1, "msg": "recovery codes regenerated", "codes": codes}
+	s.ServeJSON()
+}
+
+// 关闭自己的两步验证，需要当前验证码或恢复码
+func (s *TwoFactorController) Disable() {
+	if !s.checkCode(s.twoFactor()) {
+		return
+	}
+	s.saveTwoFactor(nil)
+	s.AjaxOk("two-factor authentication disabled")
+}
+
+// 管理员重置客户端用户的两步验证，type 为 user 时重置 web 管理账号的，只有超级管理员可以重置
+func (s *TwoFactorController) Reset() {
+	if s.GetString("type") == "user" {
+		if !s.can(permAdmin) {
+			s.AjaxErr("permission denied")
+			return
+		}
+		u, err := file.GetDb().GetUser(s.GetIntNoErr("id"))
+		if err != nil {
+			s.AjaxErr(err.Error())
+			return
+		}
+		u.TwoFactor = nil
+		file.GetDb().JsonDb.StoreUsersToJsonFile()
+		s.AjaxOk("two-factor authentication reset")
+		return
+	}
+	c, err := file.GetDb().GetClient(s.GetIntNoErr("id"))
+	if err != nil {
+		s.AjaxErr("the client is not exist")
+		return
+	}
+	c.TwoFactor = nil
+	file.GetDb().JsonDb.StoreClientsToJsonFile()
+	s.AjaxOk("two-factor authentication reset")
+}
+
+func (s *TwoFactorController) checkCode(tf *file.TwoFactor) bool {
+	if !tf.Enabled() {
+		s.AjaxErr("two-factor authentication is not enabled")
+		return false
+	}
+	ok, recovery := tf.Verify(s.GetString("code"))
+	if !ok {
+		s.AjaxErr("verification code is wrong")
+		return false
+	}
+	if recovery {
+		s.saveTwoFactor(tf)
+	}
+	return true
+}
+
+// twoFactor 返回当前登录账号的两步验证设置，账号可以是 nps.conf 中的管理员、web 管理账号或客户端
+func (s *TwoFactorController) twoFactor() *file.TwoFactor {
+	userId, _ := s.GetSession("userId").(int)
+	clientId, _ := s.GetSession("clientId").(int)
+	switch {
+	case userId != 0:
+		if u, err := file.GetDb().GetUser(userId); err == nil {
+			return u.TwoFactor
+		}
+	case clientId != 0:
+		if c, err := file.GetDb().GetClient(clientId); err == nil {
+			return c.TwoFactor
+		}
+	default:
+		if global := file.GetDb().GetGlobal(); global != nil {
+			return global.TwoFactor
+		}
+	}
+	return nil
+}
+
+func (s *TwoFactorController) saveTwoFactor(tf *file.TwoFactor) {
+	userId, _ := s.GetSession("userId").(int)
+	clientId, _ := s.GetSession("clientId").(int)
+	switch {
+	case userId != 0:
+		if u, err := file.GetDb().GetUser(userId); err == nil {
+			u.TwoFactor = tf
+			file.GetDb().JsonDb.StoreUsersToJsonFile()
+		}
+	case clientId != 0:
+		if c, err := file.GetDb().GetClient(clientId); err == nil {
+			c.TwoFactor = tf
+			file.GetDb().JsonDb.StoreClientsToJsonFile()
+		}
+	default:
+		global := file.GetDb().GetGlobal()
+		if global == nil {
+			global = &file.Glob{BlackIpList: make([]string, 0)}
+		}
+		global.TwoFactor = tf
+		file.GetDb().SaveGlobal(global)
+	}
+}
+
+func (s *TwoFactorController) accountName() string {
+	userId, _ := s.GetSession("userId").(int)
+	clientId, _ := s.GetSession("clientId").(int)
+	if userId == 0 && clientId == 0 {
+		return beego.AppConfig.DefaultString("web_username", "admin")
+	}
+	if name, _ := s.GetSession("username").(string); strings.TrimSpace(name) != "" {
+		return name
+	}
+	return "user"
+}
@@ -0,0 +1,105 @@
+package controllers
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/djylb/nps/lib/file"
+)
+
+// UserController web 管理账号，只有超级管理员可以访问
+type UserController struct {
+	BaseController
+}
+
+// userRow 账号列表的一行，不返回密码哈希和两步验证密钥
+type userRow struct {
+	Id         int
+	Username   string
+	Role       string
+	ClientIds  []int
+	Status     bool
+	Remark     string
+	TwoFactor  bool
+	CreateTime string
+}
+
+func (s *UserController) List() {
+	if s.Ctx.Request.Method == "GET" {
+		s.Data["menu"] = "user"
+		s.SetInfo("users")
+		s.display("user/list")
+		return
+	}
+	list := file.GetDb().GetUserList()
+	rows := make([]*userRow, len(list))
+	for i, v := range list {
+		rows[i] = &userRow{
+			Id:         v.Id,
+			Username:   v.Username,
+			Role:       v.Role,
+			ClientIds:  v.ClientIds,
+			Status:     v.Status,
+			Remark:     v.Remark,
+			TwoFactor:  v.TwoFactor.Enabled(),
+			CreateTime: v.CreateTime,
+		}
+	}
+	s.AjaxTable(rows, len(rows), len(rows), nil)
+}
+
+// 添加账号
+func (s *UserController) Add() {
+	u := new(file.User)
+	if err := s.readUser(u); err != nil {
+		s.AjaxErr(err.Error())
+	}
+	u.Password = s.GetString("password")
+	if err := file.GetDb().NewUser(u); err != nil {
+		s.AjaxErr(err.Error())
+	}
+	s.AjaxOkWithId("add success", u.Id)
+}
+
+// 修改账号，密码留空时保持不变
+func (s *UserController) Edit() {
+	u, err := file.GetDb().GetUser(s.GetIntNoErr("id"))
+	if err != nil {
+		s.AjaxErr(err.Error())
+	}
+	v := *u
+	if err := s.readUser(&v); err != nil {
+		s.AjaxErr(err.Error())
+	}
+	if err := file.GetDb().UpdateUser(&v, s.GetString("password")); err != nil {
+		s.AjaxErr(err.Error())
+	}
+	s.AjaxOk("modified success")
+}
+
+func (s *UserController) Del() {
+	if err := file.GetDb().DelUser(s.GetIntNoErr("id")); err != nil {
+		s.AjaxErr(err.Error())
+	}
+	s.AjaxOk("delete success")
+}
+
+// readUser 读取表单中的账号信息，client_ids 为逗号分隔的客户端 id
+func (s *UserController) readUser(u *file.User) error {
+	u.Username = s.getEscapeString("username")
+	u.Role = s.getEscapeString("role")
+	u.Remark = s.getEscapeString("remark")
+	u.Status = s.GetBoolNoErr("status", true)
+	u.ClientIds = nil
+	for _, v := range strings.FieldsFunc(s.GetString("client_ids"), func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\n'
+	}) {
+		id, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return errors.New("please check your input")
+		}
+		u.ClientIds = append(u.ClientIds, id)
+	}
+	return nil
+}
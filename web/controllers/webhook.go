@@ -0,0 +1,80 @@
+package controllers
+
+import (
+	"github.com/djylb/nps/lib/file"
+	"github.com/djylb/nps/lib/webhook"
+)
+
+// WebhookController 事件通知地址和发送记录，只有超级管理员可以访问
+type WebhookController struct {
+	BaseController
+}
+
+func (s *WebhookController) List() {
+	if s.Ctx.Request.Method == "GET" {
+		s.Data["menu"] = "webhook"
+		s.Data["events"] = file.WebhookEvents
+		s.SetInfo("webhooks")
+		s.display("webhook/list")
+		return
+	}
+	list := file.GetDb().GetWebhookList()
+	s.AjaxTable(list, len(list), len(list), nil)
+}
+
+// 添加通知地址，未填写密钥时随机生成
+func (s *WebhookController) Add() {
+	h := new(file.Webhook)
+	s.readWebhook(h)
+	if err := file.GetDb().NewWebhook(h); err != nil {
+		s.AjaxErr(err.Error())
+	}
+	s.AjaxOkWithId("add success", h.Id)
+}
+
+func (s *WebhookController) Edit() {
+	h, err := file.GetDb().GetWebhook(s.GetIntNoErr("id"))
+	if err != nil {
+		s.AjaxErr(err.Error())
+	}
+	v := *h
+	s.readWebhook(&v)
+	if err := file.GetDb().UpdateWebhook(&v); err != nil {
+		s.AjaxErr(err.Error())
+	}
+	s.AjaxOk("modified success")
+}
+
+func (s *WebhookController) Del() {
+	if err := file.GetDb().DelWebhook(s.GetIntNoErr("id")); err != nil {
+		s.AjaxErr(err.Error())
+	}
+	s.AjaxOk("delete success")
+}
+
+// Test 立即发送一次 ping 事件并返回结果
+func (s *WebhookController) Test() {
+	h, err := file.GetDb().GetWebhook(s.GetIntNoErr("id"))
+	if err != nil {
+		s.AjaxErr(err.Error())
+	}
+	if d := webhook.Test(h); !d.Success {
+		s.AjaxErr(d.Error)
+	}
+	s.AjaxOk("test success")
+}
+
+// Deliveries 最近的发送记录，id 不为 0 时只返回该地址的记录
+func (s *WebhookController) Deliveries() {
+	list := webhook.Deliveries(s.GetIntNoErr("id"))
+	s.AjaxTable(list, len(list), len(list), nil)
+}
+
+// readWebhook 读取表单，events 为多选的事件，不选表示全部事件
+func (s *WebhookController) readWebhook(h *file.Webhook) {
+	h.Name = s.getEscapeString("name")
+	h.Url = s.GetString("url")
+	h.Secret = s.GetString("secret")
+	h.Status = s.GetBoolNoErr("status", true)
+	h.Events = s.GetStrings("events")
+}
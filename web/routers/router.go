@@ -4,6 +4,8 @@ import (
 	"net/http"
 
 	"github.com/beego/beego"
+	"github.com/djylb/nps/lib/logs"
+	"github.com/djylb/nps/lib/metrics"
 	"github.com/djylb/nps/web/controllers"
 )
 
@@ -21,8 +23,17 @@ func Init() {
 			beego.NSAutoRouter(&controllers.IndexController{}),
 			beego.NSAutoRouter(&controllers.LoginController{}),
 			beego.NSAutoRouter(&controllers.ClientController{}),
+			beego.NSAutoRouter(&controllers.GroupController{}),
 			beego.NSAutoRouter(&controllers.AuthController{}),
 			beego.NSAutoRouter(&controllers.GlobalController{}),
+			beego.NSAutoRouter(&controllers.TwoFactorController{}),
+			beego.NSAutoRouter(&controllers.UserController{}),
+			beego.NSAutoRouter(&controllers.AuditController{}),
+			beego.NSAutoRouter(&controllers.WebhookController{}),
+			beego.NSAutoRouter(&controllers.ConnController{}),
+			beego.NSAutoRouter(&controllers.TransferController{}),
+			beego.NSRouter("/npcconf/:token([0-9a-z]+)", &controllers.NpcConfController{}, "get:Download"),
+			beego.NSNamespace("/api/v1", apiRouters()...),
 		)
 		beego.AddNamespace(ns)
 	} else {
@@ -30,8 +41,39 @@ func Init() {
 		beego.AutoRouter(&controllers.IndexController{})
 		beego.AutoRouter(&controllers.LoginController{})
 		beego.AutoRouter(&controllers.ClientController{})
+		beego.AutoRouter(&controllers.GroupController{})
 		beego.AutoRouter(&controllers.AuthController{})
 		beego.AutoRouter(&controllers.GlobalController{})
+		beego.AutoRouter(&controllers.TwoFactorController{})
+		beego.AutoRouter(&controllers.UserController{})
+		beego.AutoRouter(&controllers.AuditController{})
+		beego.AutoRouter(&controllers.WebhookController{})
+		beego.AutoRouter(&controllers.ConnController{})
+		beego.AutoRouter(&controllers.TransferController{})
+		beego.Router("/npcconf/:token([0-9a-z]+)", &controllers.NpcConfController{}, "get:Download")
+		beego.AddNamespace(beego.NewNamespace("/api/v1", apiRouters()...))
 
 	}
+	// 未配置单独端口时在 web 端口提供 Prometheus 指标，web 端口通常对外开放，必须设置令牌
+	if metrics.Enabled() && beego.AppConfig.String("metrics_port") == "" {
+		if token := beego.AppConfig.String("metrics_token"); token != "" {
+			beego.Handler(web_base_url+"/metrics", metrics.Handler(token))
+		} else {
+			logs.Warn("metrics are not served on the web port because metrics_token is empty")
+		}
+	}
+}
+
+// apiRouters /api/v1 的 REST 路由，由 controllers.ApiRoutes 生成
+func apiRouters() []beego.LinkNamespace {
+	api := &controllers.ApiController{}
+	doc := &controllers.ApiDocController{}
+	list := []beego.LinkNamespace{
+		beego.NSRouter("/openapi.json", doc, "get:OpenApi"),
+		beego.NSRouter("/docs", doc, "get:Explorer"),
+	}
+	for _, r := range controllers.ApiRoutes {
+		list = append(list, beego.NSRouter(r.Path, api, r.Mapping()))
+	}
+	return list
 }
@@ -162,11 +162,13 @@ function submitform(action, url, postdata) {
     });
     switch (action) {
         case 'delete':
+        case 'resettotp':
             var langobj = languages['content']['confirm'][action];
             action = (langobj[languages['current']] || langobj[languages['default']] || 'Are you sure you want to ' + action + ' it?');
             if (!confirm(action)) return;
         case 'start':
         case 'stop':
+        case 'purge':
             postsubmit = true;
         case 'add':
         case 'edit':